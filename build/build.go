@@ -0,0 +1,126 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultTimeout = 10 * time.Minute
+
+// RunStep runs a repository's pre-archive build command inside its checkout.
+// The command is executed by the shell exactly as written in the config, so
+// it can do anything the user running the service can. Unless the step sets
+// InheritEnv it only gets PATH and HOME from our own environment, plus its
+// own Env, so secrets such as the api key don't leak in.
+//
+// The combined stdout and stderr is returned whether or not the command
+// succeeds, a non-zero exit or running past the timeout is an error. Secrets
+// referenced by the step's Env are redacted from it.
+func RunStep(step *config.BuildStep, dir string) (string, error) {
+	return run("build", step, dir, nil)
+}
+
+// RunVerification runs a staging verify command the same way as RunStep,
+// with the package that was uploaded to staging described in the
+// CLOUDSMITH_OWNER, CLOUDSMITH_REPOSITORY, PACKAGE_NAME and PACKAGE_VERSION
+// environment variables.
+func RunVerification(step *config.BuildStep, dir, owner, repository, name, version string) (string, error) {
+	return run("verify", step, dir, []string{
+		"CLOUDSMITH_OWNER=" + owner,
+		"CLOUDSMITH_REPOSITORY=" + repository,
+		"PACKAGE_NAME=" + name,
+		"PACKAGE_VERSION=" + version,
+	})
+}
+
+func run(kind string, step *config.BuildStep, dir string, env []string) (string, error) {
+	timeout := step.Timeout
+
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	stepEnv, secrets, err := resolveEnv(step.Env)
+
+	if err != nil {
+		return "", errors.New(kind + " command not run: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", step.Command)
+	cmd.Dir = dir
+
+	if step.InheritEnv {
+		cmd.Env = os.Environ()
+	} else {
+		cmd.Env = []string{
+			"PATH=" + os.Getenv("PATH"),
+			"HOME=" + os.Getenv("HOME"),
+		}
+	}
+
+	cmd.Env = append(append(cmd.Env, stepEnv...), env...)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	// Whatever the command changes, composer.json included, means the
+	// checkout is no longer just its commit
+	composer.Modified(dir)
+
+	err = cmd.Run()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return redact(output.String(), secrets), fmt.Errorf("%s command timed out after %v", kind, timeout)
+	}
+
+	if err != nil {
+		return redact(output.String(), secrets), errors.New(kind + " command failed: " + err.Error())
+	}
+
+	return redact(output.String(), secrets), nil
+}
+
+// resolveEnv turns a step's Env into NAME=value pairs, resolving secret
+// references, and returns the secret values so they can be redacted.
+func resolveEnv(env map[string]string) ([]string, []string, error) {
+	var pairs []string
+	var secrets []string
+
+	for name, value := range env {
+		resolved, err := config.ResolveSecret(value)
+
+		if err != nil {
+			return nil, nil, errors.New(name + ": " + err.Error())
+		}
+
+		if resolved != value {
+			secrets = append(secrets, resolved)
+		}
+
+		pairs = append(pairs, name+"="+resolved)
+	}
+
+	return pairs, secrets, nil
+}
+
+// redact hides any secret the command echoed, it can't catch secrets the
+// command has transformed (encoded, split up) before printing them
+func redact(output string, secrets []string) string {
+	for _, secret := range secrets {
+		output = strings.Replace(output, secret, "[redacted]", -1)
+	}
+
+	return output
+}
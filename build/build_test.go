@@ -0,0 +1,54 @@
+package build_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/build"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunStepEnv(t *testing.T) {
+	os.Setenv("CLOUDSMITH_SYNC_TEST_TOKEN", "s3cr3t-token")
+	defer os.Unsetenv("CLOUDSMITH_SYNC_TEST_TOKEN")
+
+	step := &config.BuildStep{
+		Command: `echo "$BUILD_FLAGS $NPM_TOKEN $CLOUDSMITH_SYNC_TEST_TOKEN"`,
+		Env: map[string]string{
+			"BUILD_FLAGS": "--production",
+			"NPM_TOKEN":   "env:CLOUDSMITH_SYNC_TEST_TOKEN",
+		},
+	}
+
+	output, err := build.RunStep(step, os.TempDir())
+
+	if err != nil {
+		t.Fatalf("[!] RunStep() = %v", err)
+	}
+
+	// Our own environment isn't passed on, only the step's
+	expected := "--production [redacted]"
+
+	if strings.TrimSpace(output) != expected {
+		t.Errorf("[!] RunStep() output %q; want %q", output, expected)
+	}
+
+	step.InheritEnv = true
+	output, _ = build.RunStep(step, os.TempDir())
+	expected = "--production [redacted] [redacted]"
+
+	if strings.TrimSpace(output) != expected {
+		t.Errorf("[!] RunStep(InheritEnv) output %q; want %q", output, expected)
+	}
+}
+
+func TestRunStepUnresolvableSecret(t *testing.T) {
+	step := &config.BuildStep{
+		Command: "true",
+		Env:     map[string]string{"NPM_TOKEN": "env:CLOUDSMITH_SYNC_TEST_MISSING"},
+	}
+
+	if _, err := build.RunStep(step, os.TempDir()); err == nil {
+		t.Errorf("[!] RunStep() = nil; want an error for the missing secret")
+	}
+}
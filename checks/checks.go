@@ -0,0 +1,182 @@
+package checks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultBaseUrl = "https://api.github.com"
+
+const (
+	StatePassed  = "passed"
+	StatePending = "pending"
+	StateFailed  = "failed"
+)
+
+// Client reads the check runs and commit statuses GitHub has for a commit
+type Client struct {
+	BaseUrl string
+	Token   string
+	http    *http.Client
+}
+
+func NewClient(baseUrl, token string) *Client {
+	if baseUrl == "" {
+		baseUrl = DefaultBaseUrl
+	}
+
+	return &Client{
+		BaseUrl: strings.TrimSuffix(baseUrl, "/"),
+		Token:   token,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Result is how a commit's required checks stand. It has only passed once
+// every one of them has, a failed check fails it even with others pending.
+type Result struct {
+	State   string
+	Pending []string
+	Failed  []string
+}
+
+type checkRuns struct {
+	CheckRuns []struct {
+		Name       string `json:"name"`
+		Status     string `json:"status"`
+		Conclusion string `json:"conclusion"`
+	} `json:"check_runs"`
+}
+
+type combinedStatus struct {
+	Statuses []struct {
+		Context string `json:"context"`
+		State   string `json:"state"`
+	} `json:"statuses"`
+}
+
+// Check looks up the required checks for ref, a commit sha or a name like
+// tags/v1.2.0, of the owner/repo repository. Both check runs (GitHub
+// Actions and apps) and commit statuses (older CI integrations) count, a
+// check that hasn't reported anything yet is pending.
+func (c *Client) Check(ctx context.Context, fullName, ref string, required []string) (Result, error) {
+	var runs checkRuns
+
+	if err := c.get(ctx, "/repos/"+fullName+"/commits/"+ref+"/check-runs?per_page=100", &runs); err != nil {
+		return Result{}, err
+	}
+
+	var statuses combinedStatus
+
+	if err := c.get(ctx, "/repos/"+fullName+"/commits/"+ref+"/status", &statuses); err != nil {
+		return Result{}, err
+	}
+
+	// A check that was re-run, or is reported both ways, counts as its best
+	// outcome. One that succeeded is good enough and one still running might
+	// yet succeed
+	states := map[string]string{}
+	rank := map[string]int{StateFailed: 1, StatePending: 2, StatePassed: 3}
+
+	record := func(name, state string) {
+		if rank[state] > rank[states[name]] {
+			states[name] = state
+		}
+	}
+
+	for _, status := range statuses.Statuses {
+		switch status.State {
+		case "success":
+			record(status.Context, StatePassed)
+		case "pending":
+			record(status.Context, StatePending)
+		default:
+			record(status.Context, StateFailed)
+		}
+	}
+
+	for _, run := range runs.CheckRuns {
+		switch {
+		case run.Status != "completed":
+			record(run.Name, StatePending)
+		case run.Conclusion == "success" || run.Conclusion == "neutral" || run.Conclusion == "skipped":
+			record(run.Name, StatePassed)
+		default:
+			record(run.Name, StateFailed)
+		}
+	}
+
+	result := Result{State: StatePassed}
+
+	for _, name := range required {
+		switch states[name] {
+		case StatePassed:
+		case StateFailed:
+			result.Failed = append(result.Failed, name)
+		default:
+			result.Pending = append(result.Pending, name)
+		}
+	}
+
+	if len(result.Failed) > 0 {
+		result.State = StateFailed
+	} else if len(result.Pending) > 0 {
+		result.State = StatePending
+	}
+
+	return result, nil
+}
+
+// Wait checks every interval until the required checks have passed or
+// failed, giving up with them still pending once timeout has passed. A zero
+// timeout checks once.
+func (c *Client) Wait(ctx context.Context, fullName, ref string, required []string, interval, timeout time.Duration) (Result, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		result, err := c.Check(ctx, fullName, ref, required)
+
+		if err != nil || result.State != StatePending || time.Now().Add(interval).After(deadline) {
+			return result, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (c *Client) get(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequest("GET", c.BaseUrl+path, nil)
+
+	if err != nil {
+		return err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	res, err := c.http.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GitHub responded to %s with %s", path, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,94 @@
+package checks_test
+
+import (
+	"context"
+	"github.com/Lavoaster/cloudsmith-sync/checks"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const checkRunsResponse = `{"check_runs": [
+	{"name": "tests", "status": "completed", "conclusion": "failure"},
+	{"name": "tests", "status": "completed", "conclusion": "success"},
+	{"name": "lint", "status": "completed", "conclusion": "failure"},
+	{"name": "build", "status": "in_progress", "conclusion": null}
+]}`
+
+const statusResponse = `{"statuses": [
+	{"context": "ci/jenkins", "state": "success"},
+	{"context": "ci/legacy", "state": "pending"}
+]}`
+
+func newTestServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("[!] Authorization = %q; want Bearer token", auth)
+		}
+
+		switch r.URL.Path {
+		case "/repos/acme/widgets/commits/abc123/check-runs":
+			w.Write([]byte(checkRunsResponse))
+		case "/repos/acme/widgets/commits/abc123/status":
+			w.Write([]byte(statusResponse))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+// [][]interface{}{required, expected result}
+var checkTests = [][]interface{}{
+	{[]string{"tests", "ci/jenkins"}, checks.Result{State: checks.StatePassed}},
+	{[]string{"tests", "build"}, checks.Result{State: checks.StatePending, Pending: []string{"build"}}},
+	{[]string{"tests", "deploy-preview"}, checks.Result{State: checks.StatePending, Pending: []string{"deploy-preview"}}},
+	{[]string{"lint", "ci/legacy"}, checks.Result{State: checks.StateFailed, Pending: []string{"ci/legacy"}, Failed: []string{"lint"}}},
+}
+
+func TestCheck(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	client := checks.NewClient(server.URL, "token")
+
+	for _, test := range checkTests {
+		result, err := client.Check(context.Background(), "acme/widgets", "abc123", test[0].([]string))
+
+		if err != nil || !reflect.DeepEqual(result, test[1]) {
+			t.Errorf("[!] Check(%v) = %+v, %v; want %+v", test[0], result, err, test[1])
+		}
+	}
+
+	if _, err := client.Check(context.Background(), "acme/missing", "abc123", []string{"tests"}); err == nil {
+		t.Errorf("[!] Check(acme/missing) = nil; want an error for a repository GitHub doesn't know")
+	}
+}
+
+func TestCheckAgainstGithubEnterprise(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	// GitHub Enterprise serves its api under /api/v3 of its own host
+	server.Config.Handler = http.StripPrefix("/api/v3", server.Config.Handler)
+	client := checks.NewClient(server.URL+"/api/v3/", "token")
+
+	result, err := client.Check(context.Background(), "acme/widgets", "abc123", []string{"tests"})
+
+	if err != nil || result.State != checks.StatePassed {
+		t.Errorf("[!] Check(tests) = %+v, %v; want it passed", result, err)
+	}
+}
+
+func TestWaitGivesUpWhilePending(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	client := checks.NewClient(server.URL, "token")
+	result, err := client.Wait(context.Background(), "acme/widgets", "abc123", []string{"build"}, 10*time.Millisecond, 50*time.Millisecond)
+
+	if err != nil || result.State != checks.StatePending {
+		t.Errorf("[!] Wait(build) = %+v, %v; want it still pending", result, err)
+	}
+}
@@ -0,0 +1,71 @@
+package cloudsmith
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DeleteReasonReplace is a package deleted so it can be uploaded again
+	DeleteReasonReplace = "pre-upload-replace"
+	// DeleteReasonRefDeleted is a package deleted because its branch or tag
+	// was deleted
+	DeleteReasonRefDeleted = "ref-deletion"
+	// DeleteReasonRenamed is a package deleted because it was published
+	// again under a new name
+	DeleteReasonRenamed = "package-rename"
+	// DeleteReasonSelfTest is the throwaway package uploaded by the startup
+	// self-test
+	DeleteReasonSelfTest = "self-test"
+	// DeleteReasonRollback is a package deleted because another package of
+	// the same transactional push failed to upload
+	DeleteReasonRollback = "transaction-rollback"
+
+	// ActorManual is used for deletes made from the command line
+	ActorManual = "manual"
+	// ActorSelfTest is used for the startup self-test's delete
+	ActorSelfTest = "self-test"
+)
+
+// AuditEntry is a single line in the audit log
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	Owner      string    `json:"owner"`
+	Repository string    `json:"repository"`
+	Package    string    `json:"package"`
+	Version    string    `json:"version"`
+	Reason     string    `json:"reason"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// AuditLog appends a json object per line to a file for every package that
+// gets deleted, so there's a record to go to when a package goes missing.
+type AuditLog struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path}
+}
+
+func (a *AuditLog) Record(entry AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(entry)
+}
@@ -2,34 +2,141 @@ package cloudsmith
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/limit"
 	"github.com/cloudsmith-io/cloudsmith-api/bindings/go/src"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type Error struct {
 	Detail string `json:"detail"`
 }
 
+var ErrPackageNotFound = errors.New("package not found")
+
+// ErrSyncTimeout is returned when an uploaded package is still being
+// processed by Cloudsmith after waiting for it
+var ErrSyncTimeout = errors.New("timed out waiting for the package to finish synchronising")
+
+// Package is the metadata for a single version of a package on Cloudsmith
+type Package struct {
+	Identifier  string
+	Name        string
+	Version     string
+	Filename    string
+	Status      string
+	Checksum    string
+	ChecksumMd5 string
+	Size        int64
+	DownloadUrl string
+	// Cloudsmith processes uploads in the background, the package can't be
+	// installed until it has synchronised
+	SyncCompleted bool
+	SyncFailed    bool
+}
+
 type Client struct {
 	Files         cloudsmith_api.FilesApi
 	Packages      cloudsmith_api.PackagesApi
+	Repos         cloudsmith_api.ReposApi
 	KnownVersions []string
+	// Records every delete when set
+	AuditLog *AuditLog
+	// Caps concurrent uploads when set
+	Uploads *limit.Limit
+	// When SyncTimeout is set composer uploads only return once the package
+	// has synchronised, checking every SyncInterval
+	SyncInterval time.Duration
+	SyncTimeout  time.Duration
+	// How often WaitForPackageDeletion checks whether a package has gone
+	DeletionInterval time.Duration
+	// Replaces the scheme and host of download urls when set, for consumers
+	// that go through a proxy instead of dl.cloudsmith.io
+	DownloadBaseUrl string
+	// Paces listing, deleting and resyncing packages when set, for bulk
+	// operations that would otherwise run into the rate limit
+	Pacer *Pacer
+}
+
+// UploadOptions are the optional extras attached to a package when it is
+// created on Cloudsmith.
+type UploadOptions struct {
+	Tags []string
+	// Raw packages aren't described by the file, so need a name and version
+	Name    string
+	Version string
+	// Replace an existing package with the same name and version
+	Republish bool
+	// Rendered on the package's page, only raw uploads take one as Cloudsmith
+	// reads composer packages' from their composer.json
+	Description string
+}
+
+// MaxDescriptionLength is the most of a description sent to Cloudsmith,
+// longer ones are cut short with a note saying so
+const MaxDescriptionLength = 64 * 1024
+
+const truncatedNote = "\n\n*Truncated, see the repository for the rest.*"
+
+// TruncateDescription cuts description down to MaxDescriptionLength bytes,
+// without splitting a character, noting that it was cut short.
+func TruncateDescription(description string) string {
+	if len(description) <= MaxDescriptionLength {
+		return description
+	}
+
+	end := MaxDescriptionLength - len(truncatedNote)
+
+	for end > 0 && !utf8.RuneStart(description[end]) {
+		end--
+	}
+
+	return description[:end] + truncatedNote
+}
+
+const (
+	FormatComposer = "composer"
+	FormatRaw      = "raw"
+)
+
+// ErrReservedHeader is returned when adding a header the client sets itself
+var ErrReservedHeader = errors.New("header is set by the client and can't be replaced")
+
+// UserAgent identifies cloudsmith-sync at the given version to Cloudsmith
+func UserAgent(version string) string {
+	return "cloudsmith-sync/" + version + " (+https://github.com/Lavoaster/cloudsmith-sync)"
+}
+
+// IsReservedHeader is whether the client sets the header itself, replacing
+// X-Api-Key would break authentication
+func IsReservedHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "X-Api-Key", "Authorization", "User-Agent":
+		return true
+	}
+
+	return false
 }
 
 func NewClient(apiKey string) *Client {
 	configuration := cloudsmith_api.NewConfiguration()
 	configuration.AddDefaultHeader("X-Api-Key", apiKey)
+	configuration.UserAgent = UserAgent("dev")
 
 	return &Client{
 		Files: cloudsmith_api.FilesApi{
@@ -38,10 +145,50 @@ func NewClient(apiKey string) *Client {
 		Packages: cloudsmith_api.PackagesApi{
 			Configuration: configuration,
 		},
+		Repos: cloudsmith_api.ReposApi{
+			Configuration: configuration,
+		},
+		DeletionInterval: 2 * time.Second,
 	}
 }
 
-func (c *Client) UploadComposerPackage(owner, repo, artifactPath string) (csPkg *cloudsmith_api.ModelPackage, error error) {
+// UploadLimit is the limit on concurrent uploads, nil when there isn't one
+func (c *Client) UploadLimit() *limit.Limit {
+	return c.Uploads
+}
+
+// SetUserAgent changes the User-Agent sent with every request to Cloudsmith
+func (c *Client) SetUserAgent(userAgent string) {
+	c.Packages.Configuration.UserAgent = userAgent
+}
+
+// AddHeader sends an extra header with every request to Cloudsmith, for
+// proxies and firewalls in front of it. Headers the client sets itself are
+// refused.
+func (c *Client) AddHeader(name, value string) error {
+	if IsReservedHeader(name) {
+		return ErrReservedHeader
+	}
+
+	c.Packages.Configuration.AddDefaultHeader(name, value)
+
+	return nil
+}
+
+func (c *Client) UploadComposerPackage(owner, repo, artifactPath string, options UploadOptions) (*cloudsmith_api.ModelPackage, error) {
+	return c.UploadPackage(owner, repo, FormatComposer, artifactPath, options)
+}
+
+// UploadPackage uploads the artifact and creates a package of the given
+// format, one of the Format* constants, from it.
+func (c *Client) UploadPackage(owner, repo, format, artifactPath string, options UploadOptions) (csPkg *cloudsmith_api.ModelPackage, error error) {
+	if format != FormatComposer && format != FormatRaw {
+		return csPkg, errors.New("unsupported package format " + format)
+	}
+
+	c.Uploads.Acquire()
+	defer c.Uploads.Release()
+
 	fileName := filepath.Base(artifactPath)
 
 	// Get upload details from Cloudsmith (which is a pre-signed s3 upload)
@@ -77,23 +224,72 @@ func (c *Client) UploadComposerPackage(owner, repo, artifactPath string) (csPkg
 
 	// Alright, the file uploaded, now to create a package on Cloudsmith and
 	// link it to the file
-	pkg, rawPkg, err := c.Packages.PackagesUploadComposer(owner, repo, cloudsmith_api.PackagesUploadComposer{
-		PackageFile: upload.Identifier,
-	})
+	var pkg *cloudsmith_api.ModelPackage
+	var rawPkg *cloudsmith_api.APIResponse
+
+	if format == FormatRaw {
+		pkg, rawPkg, err = c.Packages.PackagesUploadRaw(owner, repo, cloudsmith_api.PackagesUploadRaw{
+			PackageFile: upload.Identifier,
+			Name:        options.Name,
+			Version:     options.Version,
+			Description: TruncateDescription(options.Description),
+			Republish:   options.Republish,
+			Tags:        strings.Join(options.Tags, ","),
+		})
+	} else {
+		pkg, rawPkg, err = c.Packages.PackagesUploadComposer(owner, repo, cloudsmith_api.PackagesUploadComposer{
+			PackageFile: upload.Identifier,
+			Republish:   options.Republish,
+			Tags:        strings.Join(options.Tags, ","),
+		})
+	}
 
 	if err := checkForCloudsmithRequestError(rawPkg, err); err != nil {
 		return csPkg, err
 	}
 
+	if format == FormatComposer && c.SyncTimeout > 0 && pkg != nil {
+		if err := c.WaitForPackageSync(owner, repo, pkg.Name, pkg.Version, c.SyncInterval, c.SyncTimeout); err != nil {
+			return pkg, err
+		}
+	}
+
 	return pkg, nil
 }
 
 func (c *Client) LoadPackages(owner, repo string) error {
+	pkgs, err := c.ListPackageVersions(owner, repo)
+
+	if err != nil {
+		return err
+	}
+
+	for _, pkg := range pkgs {
+		c.KnownVersions = append(c.KnownVersions, repo+":"+pkg.Name+":"+pkg.Version)
+	}
+
+	return nil
+}
+
+// ListPackageVersions returns every completed composer package in the
+// repository.
+func (c *Client) ListPackageVersions(owner, repo string) ([]Package, error) {
+	var packages []Package
+
 	pageSize := 100
 	page := 1
 
 	for {
-		pkgs, rawList, err := c.Packages.PackagesList(owner, repo, int32(page), int32(pageSize), "status:completed format:composer")
+		var pkgs []cloudsmith_api.ModelPackage
+
+		rawList, err := c.withRequestRetry(func() (*cloudsmith_api.APIResponse, error) {
+			var rawList *cloudsmith_api.APIResponse
+			var err error
+
+			pkgs, rawList, err = c.Packages.PackagesList(owner, repo, int32(page), int32(pageSize), "status:completed format:composer")
+
+			return rawList, err
+		})
 
 		if err := checkForCloudsmithRequestError(rawList, err); err != nil {
 			// If the error is because of a 404, we've reached the end of the list!
@@ -101,11 +297,11 @@ func (c *Client) LoadPackages(owner, repo string) error {
 				break
 			}
 
-			return err
+			return nil, err
 		}
 
 		for _, pkg := range pkgs {
-			c.KnownVersions = append(c.KnownVersions, pkg.Name+":"+pkg.Version)
+			packages = append(packages, c.newPackage(pkg))
 		}
 
 		if len(pkgs) < pageSize {
@@ -115,7 +311,7 @@ func (c *Client) LoadPackages(owner, repo string) error {
 		page++
 	}
 
-	return nil
+	return packages, nil
 }
 
 func (c *Client) RemoteCheckPackageExists(owner, repo, name, version string) (bool, error) {
@@ -135,32 +331,352 @@ func (c *Client) RemoteCheckPackageExists(owner, repo, name, version string) (bo
 	return len(pkgs) != 0, nil
 }
 
-func (c *Client) DeletePackageIfExists(owner, repo, name, version string) error {
-	searchTerm := fmt.Sprintf("name:%s version:%s status:completed format:composer", name, version)
+// GetPackage looks up a single version of a package. Cloudsmith can only
+// search for packages so the results are filtered down to an exact match,
+// ErrPackageNotFound is returned when there isn't one.
+func (c *Client) GetPackage(owner, repo, name, version string) (*Package, error) {
+	pkgs, err := c.findPackages(owner, repo, FormatComposer, name, version)
 
-	pkgs, rawList, err := c.Packages.PackagesList(owner, repo, 1, 1, searchTerm)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pkgs) == 0 {
+		return nil, ErrPackageNotFound
+	}
+
+	pkg := c.newPackage(pkgs[0])
+
+	return &pkg, nil
+}
+
+func (c *Client) newPackage(pkg cloudsmith_api.ModelPackage) Package {
+	return Package{
+		Identifier:  strconv.Itoa(int(pkg.Identifier)),
+		Name:        pkg.Name,
+		Version:     pkg.Version,
+		Filename:    pkg.Filename,
+		Status:      pkg.StatusStr,
+		Checksum:    pkg.ChecksumSha256,
+		ChecksumMd5: pkg.ChecksumMd5,
+		Size:        int64(pkg.Size),
+		DownloadUrl: c.rewriteDownloadUrl(pkg.CdnUrl),
+
+		SyncCompleted: pkg.IsSyncCompleted,
+		SyncFailed:    pkg.IsSyncFailed,
+	}
+}
+
+// DownloadPackage saves the package's file to path, authenticating the same
+// way as requests to the API.
+func (c *Client) DownloadPackage(pkg Package, path string) error {
+	if pkg.DownloadUrl == "" {
+		return fmt.Errorf("%s@%s has no download url", pkg.Name, pkg.Version)
+	}
+
+	req, err := http.NewRequest("GET", pkg.DownloadUrl, nil)
+
+	if err != nil {
+		return err
+	}
+
+	for name, value := range c.Packages.Configuration.DefaultHeader {
+		req.Header.Set(name, value)
+	}
+
+	req.Header.Set("User-Agent", c.Packages.Configuration.UserAgent)
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("downloading %s@%s failed with status %d", pkg.Name, pkg.Version, resp.StatusCode)
+	}
+
+	file, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(file, resp.Body)
+
+	return err
+}
+
+// rewriteDownloadUrl swaps the scheme and host of a Cloudsmith download url
+// for DownloadBaseUrl, keeping the path.
+func (c *Client) rewriteDownloadUrl(downloadUrl string) string {
+	if c.DownloadBaseUrl == "" || downloadUrl == "" {
+		return downloadUrl
+	}
+
+	parsed, err := url.Parse(downloadUrl)
+
+	if err != nil {
+		return downloadUrl
+	}
+
+	rewritten := strings.TrimSuffix(c.DownloadBaseUrl, "/") + parsed.EscapedPath()
+
+	if parsed.RawQuery != "" {
+		rewritten += "?" + parsed.RawQuery
+	}
+
+	return rewritten
+}
+
+// DeletePackageIfExists deletes every copy of the package version in format,
+// one of the Format* constants. The reason and actor (a webhook delivery id or
+// ActorManual) go to the audit log. Copies that are already gone or already
+// being deleted count as deleted and transient errors are retried, so once
+// this returns nil the version is gone.
+func (c *Client) DeletePackageIfExists(owner, repo, format, name, version, reason, actor string) error {
+	pkgs, err := c.findPackages(owner, repo, format, name, version)
+
+	if err != nil {
+		return err
+	}
+
+	for _, pkg := range pkgs {
+		identifier := strconv.Itoa(int(pkg.Identifier))
+
+		rawDelete, err := c.withRequestRetry(func() (*cloudsmith_api.APIResponse, error) {
+			return c.Packages.PackagesDelete(owner, repo, identifier)
+		})
+
+		if isAlreadyDeleted(rawDelete, err) {
+			continue
+		}
+
+		err = checkForCloudsmithRequestError(rawDelete, err)
+
+		entry := AuditEntry{
+			Time:       time.Now().UTC(),
+			Actor:      actor,
+			Owner:      owner,
+			Repository: repo,
+			Package:    name,
+			Version:    version,
+			Reason:     reason,
+		}
+
+		if err != nil {
+			entry.Error = err.Error()
+		}
+
+		if auditErr := c.AuditLog.Record(entry); auditErr != nil {
+			log.Printf("Unable to write to the audit log: %v", auditErr)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const (
+	TagActionAdd    = "add"
+	TagActionRemove = "remove"
+)
+
+// TagPackage adds tags to, or removes them from, every copy of the package
+// version depending on action, one of the TagAction* actions.
+func (c *Client) TagPackage(owner, repo, name, version, action string, tags []string) error {
+	pkgs, err := c.findPackages(owner, repo, FormatComposer, name, version)
+
+	if err != nil {
+		return err
+	}
+
+	if len(pkgs) == 0 {
+		return ErrPackageNotFound
+	}
+
+	for _, pkg := range pkgs {
+		identifier := strconv.Itoa(int(pkg.Identifier))
+
+		_, rawTag, err := c.Packages.PackagesTag(owner, repo, identifier, cloudsmith_api.PackagesTag{
+			Action: action,
+			Tags:   tags,
+		})
+
+		if err := checkForCloudsmithRequestError(rawTag, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findPackages returns every copy of the exact package version in format,
+// one of the Format* constants, whatever its status.
+func (c *Client) findPackages(owner, repo, format, name, version string) ([]cloudsmith_api.ModelPackage, error) {
+	searchTerm := fmt.Sprintf("name:%s version:%s format:%s", name, version, format)
+
+	var pkgs []cloudsmith_api.ModelPackage
+
+	rawList, err := c.withRequestRetry(func() (*cloudsmith_api.APIResponse, error) {
+		var rawList *cloudsmith_api.APIResponse
+		var err error
+
+		pkgs, rawList, err = c.Packages.PackagesList(owner, repo, 1, 30, searchTerm)
+
+		return rawList, err
+	})
 
 	if err := checkForCloudsmithRequestError(rawList, err); err != nil {
-		// If the error is because of a 404, we've reached the end of the list! or there is nothing to deal with
-		if rawList.StatusCode == 404 {
-			return nil
+		// A 404 is Cloudsmith's way of saying there are no results
+		if rawList != nil && rawList.StatusCode == 404 {
+			return nil, nil
 		}
 
+		return nil, err
+	}
+
+	var matches []cloudsmith_api.ModelPackage
+
+	for _, pkg := range pkgs {
+		if pkg.Name == name && pkg.Version == version {
+			matches = append(matches, pkg)
+		}
+	}
+
+	return matches, nil
+}
+
+// MovePackage moves every copy of the package version from one repository
+// to another within the same owner.
+func (c *Client) MovePackage(owner, fromRepo, toRepo, name, version string) error {
+	pkgs, err := c.findPackages(owner, fromRepo, FormatComposer, name, version)
+
+	if err != nil {
 		return err
 	}
 
 	if len(pkgs) == 0 {
-		return nil
+		return ErrPackageNotFound
 	}
 
-	// Delete the first matching version
-	pkg := pkgs[0]
+	for _, pkg := range pkgs {
+		_, rawMove, err := c.Packages.PackagesMove(owner, fromRepo, strconv.Itoa(int(pkg.Identifier)), cloudsmith_api.PackagesMove{
+			Destination: toRepo,
+		})
 
-	c.Packages.PackagesDelete(owner, repo, strconv.Itoa(int(pkg.Identifier)))
+		if err := checkForCloudsmithRequestError(rawMove, err); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// CopyPackage copies the package version to another repository within the
+// same owner, leaving the original where it is.
+func (c *Client) CopyPackage(owner, fromRepo, toRepo, name, version string) error {
+	pkg, err := c.GetPackage(owner, fromRepo, name, version)
+
+	if err != nil {
+		return err
+	}
+
+	_, rawCopy, err := c.Packages.PackagesCopy(owner, fromRepo, pkg.Identifier, cloudsmith_api.PackagesCopy{
+		Destination: toRepo,
+	})
+
+	return checkForCloudsmithRequestError(rawCopy, err)
+}
+
+// PromotePackage moves a package version out of staging, replacing the
+// version in the target repository if there is one.
+func (c *Client) PromotePackage(ctx context.Context, owner, stagingRepo, targetRepo, name, version, actor string, timeout time.Duration) error {
+	if err := c.DeletePackageIfExists(owner, targetRepo, FormatComposer, name, version, DeleteReasonReplace, actor); err != nil {
+		return err
+	}
+
+	if err := c.WaitForPackageDeletion(ctx, owner, targetRepo, name, version, timeout); err != nil {
+		return err
+	}
+
+	return c.MovePackage(owner, stagingRepo, targetRepo, name, version)
+}
+
+// WaitForPackageDeletion polls Cloudsmith every DeletionInterval until the
+// package version no longer exists, or returns an error once timeout has
+// passed or ctx is done.
+func (c *Client) WaitForPackageDeletion(ctx context.Context, owner, repo, name, version string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		_, err := c.GetPackage(owner, repo, name, version)
+
+		if err == ErrPackageNotFound {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s@%s still exists after waiting %v for it to be deleted", name, version, timeout)
+		}
+
+		timer := time.NewTimer(c.DeletionInterval)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// WaitForPackageSync waits for Cloudsmith to finish processing an uploaded
+// package so it can be installed, returning ErrSyncTimeout if it hasn't
+// within timeout.
+func (c *Client) WaitForPackageSync(owner, repo, name, version string, interval, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		pkg, err := c.GetPackage(owner, repo, name, version)
+
+		// Search results can lag behind the upload, so not found yet is
+		// waited out like any other unfinished sync
+		if err != nil && err != ErrPackageNotFound {
+			return err
+		}
+
+		if err == nil && pkg.SyncFailed {
+			return fmt.Errorf("%s@%s failed to synchronise", name, version)
+		}
+
+		if err == nil && pkg.SyncCompleted {
+			return nil
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			return ErrSyncTimeout
+		}
+
+		time.Sleep(interval)
+	}
+}
+
 func (c *Client) RetryFailed(owner, repo string) error {
 	pkgs, rawList, err := c.Packages.PackagesList(owner, repo, 1, 100, "status:failed format:composer")
 
@@ -176,15 +692,53 @@ func (c *Client) RetryFailed(owner, repo string) error {
 	}
 
 	for _, pkg := range pkgs {
-		c.Packages.PackagesResync(owner, repo, strconv.Itoa(int(pkg.Identifier)))
+		identifier := strconv.Itoa(int(pkg.Identifier))
+
+		c.withRequestRetry(func() (*cloudsmith_api.APIResponse, error) {
+			_, rawResync, err := c.Packages.PackagesResync(owner, repo, identifier)
+
+			return rawResync, err
+		})
+	}
+
+	return nil
+}
+
+// CheckRepositoryExists makes sure the repository can be seen by the api key
+func (c *Client) CheckRepositoryExists(owner, repo string) error {
+	_, rawRepo, err := c.Repos.ReposRead(owner, repo)
+
+	if err := checkForCloudsmithRequestError(rawRepo, err); err != nil {
+		if rawRepo != nil && rawRepo.StatusCode == 404 {
+			return fmt.Errorf("repository %s/%s not found", owner, repo)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// CheckCanUpload asks for an upload slot in the repository, which is only
+// handed out to api keys with write access. Nothing is uploaded to it and
+// Cloudsmith expires unused slots on its own.
+func (c *Client) CheckCanUpload(owner, repo string) error {
+	_, rawUpload, err := c.Files.FilesCreate(owner, repo, cloudsmith_api.FilesCreate{
+		Filename: "cloudsmith-sync-check.zip",
+		// md5 of an empty file
+		Md5Checksum: "d41d8cd98f00b204e9800998ecf8427e",
+	})
+
+	if err := checkForCloudsmithRequestError(rawUpload, err); err != nil {
+		return fmt.Errorf("unable to upload to %s/%s: %v", owner, repo, err)
 	}
 
 	return nil
 }
 
-func (c *Client) IsAwareOfPackage(name string, version string) bool {
+func (c *Client) IsAwareOfPackage(repo, name, version string) bool {
 	for _, knownVersion := range c.KnownVersions {
-		if knownVersion == name+":"+version {
+		if knownVersion == repo+":"+name+":"+version {
 			return true
 		}
 	}
@@ -203,7 +757,7 @@ func checkForCloudsmithRequestError(response *cloudsmith_api.APIResponse, err er
 	if response.StatusCode >= 400 {
 		var cmError Error
 
-		json.Unmarshal(response.Payload, cmError)
+		json.Unmarshal(response.Payload, &cmError)
 
 		return errors.New(cmError.Detail)
 	}
@@ -0,0 +1,381 @@
+package cloudsmith_test
+
+import (
+	"context"
+	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// Cloudsmith searches are fuzzy, so acme/widgets also finds acme/widgets-extra
+const packagesListResponse = `[
+	{"identifier": 11, "name": "acme/widgets-extra", "version": "1.0.0", "status_str": "Completed"},
+	{"identifier": 12, "name": "acme/widgets", "version": "1.0.0", "filename": "acme-widgets-abc123.zip",
+	 "status_str": "Completed", "checksum_sha256": "5e88", "checksum_md5": "d41d", "size": 2048,
+	 "cdn_url": "https://dl.cloudsmith.io/acme/widgets.zip"}
+]`
+
+func newTestClient(handler http.HandlerFunc) (*cloudsmith.Client, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	client := cloudsmith.NewClient("api-key")
+	client.Packages.Configuration.BasePath = server.URL
+
+	return client, server
+}
+
+func TestGetPackage(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if query := r.URL.Query().Get("query"); query != "name:acme/widgets version:1.0.0 format:composer" {
+			t.Errorf("[!] GetPackage searched for %s", query)
+		}
+
+		w.Write([]byte(packagesListResponse))
+	})
+	defer server.Close()
+
+	pkg, err := client.GetPackage("acme", "packages", "acme/widgets", "1.0.0")
+
+	if err != nil {
+		t.Fatalf("[!] GetPackage(acme/widgets, 1.0.0) = %v; want a package", err)
+	}
+
+	expected := cloudsmith.Package{
+		Identifier:  "12",
+		Name:        "acme/widgets",
+		Version:     "1.0.0",
+		Filename:    "acme-widgets-abc123.zip",
+		Status:      "Completed",
+		Checksum:    "5e88",
+		ChecksumMd5: "d41d",
+		Size:        2048,
+		DownloadUrl: "https://dl.cloudsmith.io/acme/widgets.zip",
+	}
+
+	if *pkg != expected {
+		t.Errorf("[!] GetPackage(acme/widgets, 1.0.0) = %+v; want %+v", *pkg, expected)
+	}
+}
+
+func TestGetPackageNotFound(t *testing.T) {
+	responses := map[string]func(w http.ResponseWriter){
+		"no results": func(w http.ResponseWriter) {
+			w.Write([]byte(`[]`))
+		},
+		"only fuzzy matches": func(w http.ResponseWriter) {
+			w.Write([]byte(`[{"identifier": 11, "name": "acme/widgets-extra", "version": "1.0.0"}]`))
+		},
+		"404": func(w http.ResponseWriter) {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"detail": "Not found."}`))
+		},
+	}
+
+	for name, respond := range responses {
+		client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+			respond(w)
+		})
+
+		_, err := client.GetPackage("acme", "packages", "acme/widgets", "1.0.0")
+		server.Close()
+
+		if err != cloudsmith.ErrPackageNotFound {
+			t.Errorf("[!] GetPackage(%s) = %v; want %v", name, err, cloudsmith.ErrPackageNotFound)
+		}
+	}
+}
+
+func TestDeletePackageIfExistsIsIdempotent(t *testing.T) {
+	responses := map[string][]int{
+		"deleted":              {204},
+		"already deleted":      {404},
+		"deletion in progress": {409},
+		"transient failure":    {503, 204},
+	}
+
+	for name, statuses := range responses {
+		deletes := 0
+
+		client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				w.Write([]byte(packagesListResponse))
+				return
+			}
+
+			if r.URL.Path != "/packages/acme/packages/12/" {
+				t.Errorf("[!] DeletePackageIfExists(%s) deleted %s", name, r.URL.Path)
+			}
+
+			w.WriteHeader(statuses[deletes])
+
+			if statuses[deletes] == 409 {
+				w.Write([]byte(`{"detail": "Package is already being deleted."}`))
+			}
+
+			deletes++
+		})
+
+		err := client.DeletePackageIfExists("acme", "packages", cloudsmith.FormatComposer, "acme/widgets", "1.0.0", cloudsmith.DeleteReasonReplace, cloudsmith.ActorManual)
+		server.Close()
+
+		if err != nil {
+			t.Errorf("[!] DeletePackageIfExists(%s) = %v; want nil", name, err)
+		}
+
+		if deletes != len(statuses) {
+			t.Errorf("[!] DeletePackageIfExists(%s) sent %d deletes; want %d", name, deletes, len(statuses))
+		}
+	}
+}
+
+func TestDeletePackageIfExistsFails(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte(packagesListResponse))
+			return
+		}
+
+		w.WriteHeader(403)
+		w.Write([]byte(`{"detail": "You do not have permission to perform this action."}`))
+	})
+	defer server.Close()
+
+	err := client.DeletePackageIfExists("acme", "packages", cloudsmith.FormatComposer, "acme/widgets", "1.0.0", cloudsmith.DeleteReasonReplace, cloudsmith.ActorManual)
+
+	if err == nil {
+		t.Errorf("[!] DeletePackageIfExists() = nil; want the permission error")
+	}
+}
+
+func TestPacerWaitsOutTheRateLimit(t *testing.T) {
+	var sent []time.Time
+
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		sent = append(sent, time.Now())
+
+		switch len(sent) {
+		case 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(429)
+		case 2:
+			// The last request the limit allows, it resets a second later
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Second).Unix()+1, 10))
+			w.Write([]byte(packagesListResponse))
+		default:
+			w.WriteHeader(204)
+		}
+	})
+	defer server.Close()
+
+	client.Pacer = cloudsmith.NewPacer(0)
+
+	err := client.DeletePackageIfExists("acme", "packages", cloudsmith.FormatComposer, "acme/widgets", "1.0.0", cloudsmith.DeleteReasonReplace, cloudsmith.ActorManual)
+
+	if err != nil || len(sent) != 3 {
+		t.Fatalf("[!] DeletePackageIfExists() = %v after %d requests; want nil after 3", err, len(sent))
+	}
+
+	if waited := sent[1].Sub(sent[0]); waited < time.Second {
+		t.Errorf("[!] retried %v after a Retry-After of 1s", waited)
+	}
+
+	if waited := sent[2].Sub(sent[1]); waited < time.Second {
+		t.Errorf("[!] sent the next request %v after the limit was used up; want it to wait for the reset", waited)
+	}
+
+	if stats := client.Pacer.Stats(); stats.Requests != 3 || stats.Throttled != 2 {
+		t.Errorf("[!] Pacer.Stats() = %+v; want 3 requests throttled twice", stats)
+	}
+}
+
+func TestPacerSpacesOutRequests(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	defer server.Close()
+
+	client.Pacer = cloudsmith.NewPacer(10)
+	started := time.Now()
+
+	for i := 0; i < 4; i++ {
+		client.ListPackageVersions("acme", "packages")
+	}
+
+	// The first request goes straight away
+	if took := time.Since(started); took < 300*time.Millisecond {
+		t.Errorf("[!] 4 requests at 10 a second took %v; want at least 300ms", took)
+	}
+}
+
+func TestMovePackage(t *testing.T) {
+	moved := ""
+
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte(packagesListResponse))
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		moved = r.URL.Path + " " + string(body)
+
+		w.Write([]byte(`{"repository": "production"}`))
+	})
+	defer server.Close()
+
+	err := client.MovePackage("acme", "staging", "production", "acme/widgets", "1.0.0")
+
+	if err != nil {
+		t.Fatalf("[!] MovePackage() = %v; want nil", err)
+	}
+
+	if expected := `/packages/acme/staging/12/move/ {"destination":"production"}`; moved != expected {
+		t.Errorf("[!] MovePackage() sent %s; want %s", moved, expected)
+	}
+}
+
+func TestWaitForPackageSync(t *testing.T) {
+	requests := 0
+
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		switch requests {
+		case 1:
+			w.Write([]byte(`[]`))
+		case 2:
+			w.Write([]byte(`[{"identifier": 12, "name": "acme/widgets", "version": "1.0.0", "is_sync_in_progress": true}]`))
+		default:
+			w.Write([]byte(`[{"identifier": 12, "name": "acme/widgets", "version": "1.0.0", "is_sync_completed": true}]`))
+		}
+	})
+	defer server.Close()
+
+	err := client.WaitForPackageSync("acme", "packages", "acme/widgets", "1.0.0", time.Millisecond, time.Second)
+
+	if err != nil || requests != 3 {
+		t.Errorf("[!] WaitForPackageSync() = %v after %d requests; want nil after 3", err, requests)
+	}
+}
+
+func TestWaitForPackageSyncTimesOut(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"identifier": 12, "name": "acme/widgets", "version": "1.0.0", "is_sync_in_progress": true}]`))
+	})
+	defer server.Close()
+
+	err := client.WaitForPackageSync("acme", "packages", "acme/widgets", "1.0.0", time.Millisecond, 20*time.Millisecond)
+
+	if err != cloudsmith.ErrSyncTimeout {
+		t.Errorf("[!] WaitForPackageSync() = %v; want ErrSyncTimeout", err)
+	}
+}
+
+func TestWaitForPackageSyncFailed(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"identifier": 12, "name": "acme/widgets", "version": "1.0.0", "is_sync_failed": true}]`))
+	})
+	defer server.Close()
+
+	err := client.WaitForPackageSync("acme", "packages", "acme/widgets", "1.0.0", time.Millisecond, time.Second)
+
+	if err == nil || err == cloudsmith.ErrSyncTimeout {
+		t.Errorf("[!] WaitForPackageSync() = %v; want a sync failure", err)
+	}
+}
+
+func TestWaitForPackageDeletionStopsWhenCancelled(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"identifier": 12, "name": "acme/widgets", "version": "1.0.0"}]`))
+	})
+	defer server.Close()
+
+	// Only the cancel can end the wait before the timeout
+	client.DeletionInterval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	started := time.Now()
+	err := client.WaitForPackageDeletion(ctx, "acme", "packages", "acme/widgets", "1.0.0", time.Minute)
+
+	if err != context.Canceled || time.Since(started) > 5*time.Second {
+		t.Errorf("[!] WaitForPackageDeletion() = %v after %v; want context.Canceled straight away", err, time.Since(started))
+	}
+}
+
+func TestRequestsCarryUserAgentAndHeaders(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if userAgent := r.Header.Get("User-Agent"); userAgent != cloudsmith.UserAgent("1.2.3") {
+			t.Errorf("[!] User-Agent = %q; want %q", userAgent, cloudsmith.UserAgent("1.2.3"))
+		}
+
+		if token := r.Header.Get("X-Waf-Token"); token != "let-me-in" {
+			t.Errorf("[!] X-Waf-Token = %q; want let-me-in", token)
+		}
+
+		if apiKey := r.Header.Get("X-Api-Key"); apiKey != "api-key" {
+			t.Errorf("[!] X-Api-Key = %q; want api-key", apiKey)
+		}
+
+		w.Write([]byte(packagesListResponse))
+	})
+	defer server.Close()
+
+	client.SetUserAgent(cloudsmith.UserAgent("1.2.3"))
+
+	if err := client.AddHeader("X-Waf-Token", "let-me-in"); err != nil {
+		t.Fatalf("[!] AddHeader(X-Waf-Token) = %v; want nil", err)
+	}
+
+	for _, name := range []string{"x-api-key", "Authorization", "User-Agent"} {
+		if err := client.AddHeader(name, "nope"); err != cloudsmith.ErrReservedHeader {
+			t.Errorf("[!] AddHeader(%s) = %v; want ErrReservedHeader", name, err)
+		}
+	}
+
+	if _, err := client.GetPackage("acme", "packages", "acme/widgets", "1.0.0"); err != nil {
+		t.Fatalf("[!] GetPackage(acme/widgets, 1.0.0) = %v; want a package", err)
+	}
+}
+
+func TestTruncateDescription(t *testing.T) {
+	if short := cloudsmith.TruncateDescription("# Widgets"); short != "# Widgets" {
+		t.Errorf("[!] TruncateDescription(# Widgets) = %q; want it unchanged", short)
+	}
+
+	long := strings.Repeat("é", cloudsmith.MaxDescriptionLength)
+	truncated := cloudsmith.TruncateDescription(long)
+
+	if len(truncated) > cloudsmith.MaxDescriptionLength {
+		t.Errorf("[!] TruncateDescription() is %d bytes; want at most %d", len(truncated), cloudsmith.MaxDescriptionLength)
+	}
+
+	if !utf8.ValidString(truncated) || !strings.HasSuffix(truncated, "see the repository for the rest.*") {
+		t.Errorf("[!] TruncateDescription() = ...%q; want valid utf-8 ending with a note", truncated[len(truncated)-60:])
+	}
+}
+
+func TestGetPackageRewritesDownloadUrl(t *testing.T) {
+	client, server := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(packagesListResponse))
+	})
+	defer server.Close()
+
+	client.DownloadBaseUrl = "https://packages.internal.acme.com/"
+
+	pkg, err := client.GetPackage("acme", "packages", "acme/widgets", "1.0.0")
+
+	if err != nil {
+		t.Fatalf("[!] GetPackage(acme/widgets, 1.0.0) = %v; want a package", err)
+	}
+
+	if expected := "https://packages.internal.acme.com/acme/widgets.zip"; pkg.DownloadUrl != expected {
+		t.Errorf("[!] DownloadUrl = %s; want %s", pkg.DownloadUrl, expected)
+	}
+}
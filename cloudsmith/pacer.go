@@ -0,0 +1,131 @@
+package cloudsmith
+
+import (
+	"github.com/cloudsmith-io/cloudsmith-api/bindings/go/src"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The longest a single rate limit response is waited out for, a bad header
+// shouldn't stall a command for hours
+const maxRateLimitWait = 5 * time.Minute
+
+// Pacer keeps bulk operations, like renaming every version of a package,
+// under Cloudsmith's rate limit. Requests are spaced out to a target rate
+// and when Cloudsmith says the limit has been used up, with a 429's
+// Retry-After or an X-RateLimit-Remaining of 0, every request waits until
+// it resets. A nil Pacer doesn't wait at all.
+type Pacer struct {
+	interval time.Duration
+	mutex    sync.Mutex
+	// The earliest the next request can be sent
+	next  time.Time
+	stats PacerStats
+}
+
+// PacerStats is how a bulk operation got on with the rate limit
+type PacerStats struct {
+	Requests int
+	// How many times Cloudsmith said the rate limit was used up
+	Throttled int
+	// How long requests were held back for, pacing included
+	Waited time.Duration
+}
+
+// NewPacer paces requests to rate a second, 0 only waits when Cloudsmith
+// asks to
+func NewPacer(rate float64) *Pacer {
+	pacer := &Pacer{}
+
+	if rate > 0 {
+		pacer.interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	return pacer
+}
+
+// Wait blocks until the next request can be sent
+func (p *Pacer) Wait() {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+
+	now := time.Now()
+	wait := p.next.Sub(now)
+
+	if wait < 0 {
+		wait = 0
+	}
+
+	p.next = now.Add(wait + p.interval)
+	p.stats.Requests++
+	p.stats.Waited += wait
+
+	p.mutex.Unlock()
+
+	time.Sleep(wait)
+}
+
+// Observe holds back the requests after a response that says the rate limit
+// has been used up until it resets
+func (p *Pacer) Observe(response *cloudsmith_api.APIResponse) {
+	if p == nil || response == nil || response.Response == nil {
+		return
+	}
+
+	wait := rateLimitWait(response.StatusCode, response.Header, time.Now())
+
+	if wait <= 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.stats.Throttled++
+
+	if until := time.Now().Add(wait); until.After(p.next) {
+		p.next = until
+	}
+}
+
+// Stats is how the requests so far got on with the rate limit
+func (p *Pacer) Stats() PacerStats {
+	if p == nil {
+		return PacerStats{}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.stats
+}
+
+// rateLimitWait is how long to wait before the next request given the
+// headers of a response, 0 when the rate limit hasn't been reached.
+// Retry-After is seconds or a date, X-RateLimit-Reset is a unix timestamp
+func rateLimitWait(status int, header http.Header, now time.Time) time.Duration {
+	var wait time.Duration
+
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" && status == http.StatusTooManyRequests {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(retryAfter); err == nil {
+			wait = date.Sub(now)
+		}
+	} else if header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseFloat(header.Get("X-RateLimit-Reset"), 64); err == nil {
+			wait = time.Unix(0, int64(reset*float64(time.Second))).Sub(now)
+		}
+	}
+
+	if wait > maxRateLimitWait {
+		wait = maxRateLimitWait
+	}
+
+	return wait
+}
@@ -0,0 +1,73 @@
+package cloudsmith
+
+import (
+	"github.com/cloudsmith-io/cloudsmith-api/bindings/go/src"
+	"log"
+	"strings"
+	"time"
+)
+
+// How many times a request that failed for a transient reason is attempted
+const requestAttempts = 3
+
+// How long to wait before the first retry, doubled after each attempt
+const requestRetryBackoff = 500 * time.Millisecond
+
+// isTransientRequestError says whether a request failed in a way that might
+// succeed if it is sent again, i.e. the request never got an answer or
+// Cloudsmith was overloaded or broken.
+func isTransientRequestError(response *cloudsmith_api.APIResponse, err error) bool {
+	if response == nil || response.Response == nil {
+		return err != nil
+	}
+
+	return response.StatusCode == 429 || response.StatusCode >= 500
+}
+
+// withRequestRetry sends a request until it gets an answer that isn't a
+// transient failure or runs out of attempts, each attempt paced by the
+// client's Pacer.
+func (c *Client) withRequestRetry(request func() (*cloudsmith_api.APIResponse, error)) (*cloudsmith_api.APIResponse, error) {
+	backoff := requestRetryBackoff
+
+	var response *cloudsmith_api.APIResponse
+	var err error
+
+	for attempt := 1; attempt <= requestAttempts; attempt++ {
+		c.Pacer.Wait()
+		response, err = request()
+		c.Pacer.Observe(response)
+
+		if !isTransientRequestError(response, err) {
+			return response, err
+		}
+
+		if attempt < requestAttempts {
+			log.Printf("Cloudsmith request failed (attempt %d of %d), retrying in %v", attempt, requestAttempts, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	return response, err
+}
+
+// isAlreadyDeleted says whether a delete failed only because the package had
+// already gone, or another delete of it was already under way.
+func isAlreadyDeleted(response *cloudsmith_api.APIResponse, err error) bool {
+	if err != nil || response == nil || response.Response == nil {
+		return false
+	}
+
+	if response.StatusCode == 404 {
+		return true
+	}
+
+	if response.StatusCode != 400 && response.StatusCode != 409 && response.StatusCode != 422 {
+		return false
+	}
+
+	detail := strings.ToLower(checkForCloudsmithRequestError(response, nil).Error())
+
+	return strings.Contains(detail, "already deleted") || strings.Contains(detail, "being deleted") || strings.Contains(detail, "deletion in progress")
+}
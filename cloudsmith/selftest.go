@@ -0,0 +1,76 @@
+package cloudsmith
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SelfTestPackage is the name the self-test's throwaway package is uploaded as
+const SelfTestPackage = "cloudsmith-sync/self-test"
+
+// SelfTest uploads a throwaway composer package to repo and deletes it again,
+// going through the same credentials, network and API calls as a publish.
+// repo should be a scratch repository nothing installs from, the archive is
+// written to dir while it's uploaded.
+func (c *Client) SelfTest(ctx context.Context, owner, repo, dir string) error {
+	// Every run gets its own version so a package left behind by an earlier
+	// run that failed to delete doesn't get in the way
+	version := fmt.Sprintf("0.0.%d", time.Now().Unix())
+	artifactPath := filepath.Join(dir, "cloudsmith-sync-self-test-"+version+".zip")
+
+	if err := writeSelfTestArchive(artifactPath, version); err != nil {
+		return err
+	}
+
+	defer os.Remove(artifactPath)
+
+	if _, err := c.UploadComposerPackage(owner, repo, artifactPath, UploadOptions{}); err != nil {
+		return fmt.Errorf("uploading %s@%s: %v", SelfTestPackage, version, err)
+	}
+
+	// The delete only finds the package once Cloudsmith has processed it
+	if err := c.WaitForPackageSync(owner, repo, SelfTestPackage, version, 2*time.Second, 2*time.Minute); err != nil {
+		return fmt.Errorf("waiting for %s@%s: %v", SelfTestPackage, version, err)
+	}
+
+	if err := c.DeletePackageIfExists(owner, repo, FormatComposer, SelfTestPackage, version, DeleteReasonSelfTest, ActorSelfTest); err != nil {
+		return fmt.Errorf("deleting %s@%s: %v", SelfTestPackage, version, err)
+	}
+
+	return c.WaitForPackageDeletion(ctx, owner, repo, SelfTestPackage, version, 2*time.Minute)
+}
+
+func writeSelfTestArchive(path, version string) error {
+	file, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	writer, err := archive.Create("composer.json")
+
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(writer).Encode(map[string]string{
+		"name":        SelfTestPackage,
+		"description": "Uploaded and deleted again by cloudsmith-sync's startup self-test",
+		"type":        "library",
+		"version":     version,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	config2 "github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"github.com/spf13/cobra"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var auditJson bool
+
+func init() {
+	auditCmd.Flags().BoolVar(&auditJson, "json", false, "print the report as json")
+	rootCmd.AddCommand(auditCmd)
+}
+
+// auditReport compares the versions a repository's refs should produce with
+// what is published for its packages, as name@version.
+type auditReport struct {
+	Repository string   `json:"repository"`
+	Target     string   `json:"target"`
+	Missing    []string `json:"missing"`
+	Orphaned   []string `json:"orphaned"`
+	Both       []string `json:"both"`
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Compares the versions in git with what is published to Cloudsmith, without changing anything",
+	Run: func(cmd *cobra.Command, args []string) {
+		started := time.Now()
+		client := newBulkClient()
+		git.Config = config
+		ctx := context.Background()
+
+		var reports []auditReport
+
+		for _, repoCfg := range config.Repositories {
+			report, err := auditRepository(ctx, client, &repoCfg)
+			exitOnError(err)
+
+			reports = append(reports, report)
+		}
+
+		if auditJson {
+			output, err := json.MarshalIndent(reports, "", "  ")
+			exitOnError(err)
+
+			fmt.Println(string(output))
+			printPacing(os.Stderr, client, started)
+			return
+		}
+
+		for _, report := range reports {
+			fmt.Println(report.Repository + " -> " + report.Target)
+			printAuditSet("missing in Cloudsmith", report.Missing)
+			printAuditSet("orphaned in Cloudsmith", report.Orphaned)
+			printAuditSet("in both", report.Both)
+			fmt.Println()
+		}
+
+		printPacing(os.Stdout, client, started)
+	},
+}
+
+func auditRepository(ctx context.Context, client *cloudsmith.Client, repoCfg *config2.Repository) (auditReport, error) {
+	report := auditReport{
+		Repository: repoCfg.Url,
+		Target:     config.GetTargetRepository(repoCfg),
+		Missing:    []string{},
+		Orphaned:   []string{},
+		Both:       []string{},
+	}
+
+	repoPath, err := git.GetRepoPath(repoCfg.Url)
+
+	if err != nil {
+		return report, err
+	}
+
+	unlock := git.LockClone(repoPath)
+	defer unlock()
+
+	// Fetching only updates our own clone, the refs are read straight from
+	// the object store so nothing is checked out
+	repo, err := git.CloneOrOpenAndUpdate(ctx, repoCfg.Url, repoPath)
+
+	if err != nil {
+		return report, err
+	}
+
+	refs, err := git.ListRemote(ctx, repoCfg.Url)
+
+	if err != nil {
+		return report, err
+	}
+
+	defaultBranch := git.GetDefaultBranch(refs)
+	expected := map[string]bool{}
+	names := map[string]bool{}
+
+	for _, ref := range refs {
+		isBranch := strings.HasPrefix(ref.Name().String(), "refs/heads/")
+		isTag := strings.HasPrefix(ref.Name().String(), "refs/tags/")
+
+		if !isBranch && !isTag {
+			continue
+		}
+
+		if isBranch && !repoCfg.ShouldPublishBranch(ref.Name().Short(), defaultBranch) {
+			continue
+		}
+
+		packages, versionRef, err := repoCfg.GetPackagesForRef(ref.Name().Short(), isBranch)
+
+		if err != nil {
+			continue
+		}
+
+		for _, pkg := range packages {
+			manifest := repoCfg.Manifest
+
+			if manifest == "" {
+				manifest = composer.DefaultManifest
+			}
+
+			rawComposerFile, err := git.ReadFile(repo, ref, path.Join(pkg.Path, manifest))
+
+			if err != nil {
+				continue
+			}
+
+			composerData, err := composer.ParseManifest(rawComposerFile)
+
+			if err != nil {
+				continue
+			}
+
+			name, err := composer.ResolvePackageName(composerData, config.DefaultVendor)
+
+			if err != nil {
+				continue
+			}
+
+			version, _, err := repoCfg.DeriveVersion(versionRef, isBranch, composerData)
+
+			if err != nil {
+				continue
+			}
+
+			names[name] = true
+			expected[name+"@"+version] = true
+		}
+	}
+
+	published, err := client.ListPackageVersions(config.Owner, report.Target)
+
+	if err != nil {
+		return report, err
+	}
+
+	// Targets can be shared, only versions of this repository's packages
+	// can be orphans of it
+	publishedVersions := map[string]bool{}
+
+	for _, pkg := range published {
+		if names[pkg.Name] {
+			publishedVersions[pkg.Name+"@"+pkg.Version] = true
+		}
+	}
+
+	for version := range expected {
+		if publishedVersions[version] {
+			report.Both = append(report.Both, version)
+		} else {
+			report.Missing = append(report.Missing, version)
+		}
+	}
+
+	for version := range publishedVersions {
+		if !expected[version] {
+			report.Orphaned = append(report.Orphaned, version)
+		}
+	}
+
+	sort.Strings(report.Missing)
+	sort.Strings(report.Orphaned)
+	sort.Strings(report.Both)
+
+	return report, nil
+}
+
+func printAuditSet(title string, versions []string) {
+	fmt.Printf("  %s (%d)\n", title, len(versions))
+
+	for _, version := range versions {
+		fmt.Println("    " + version)
+	}
+}
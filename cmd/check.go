@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"github.com/spf13/cobra"
+	"os"
+	"text/tabwriter"
+)
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+}
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Checks every repository can be fetched from git and published to Cloudsmith",
+	Run: func(cmd *cobra.Command, args []string) {
+		client := newClient()
+		git.Config = config
+		ctx := context.Background()
+
+		// Cloudsmith targets are shared between repositories so only check
+		// each one once
+		targetResults := map[string]error{}
+		failed := false
+
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "REPOSITORY\tGIT\tCLOUDSMITH")
+
+		for _, repoCfg := range config.Repositories {
+			target := config.GetTargetRepository(&repoCfg)
+
+			_, gitErr := git.ListRemote(ctx, repoCfg.Url)
+
+			targetErr, checked := targetResults[target]
+
+			if !checked {
+				targetErr = client.CheckRepositoryExists(config.Owner, target)
+
+				if targetErr == nil {
+					targetErr = client.CheckCanUpload(config.Owner, target)
+				}
+
+				targetResults[target] = targetErr
+			}
+
+			if gitErr != nil || targetErr != nil {
+				failed = true
+			}
+
+			fmt.Fprintf(table, "%s\t%s\t%s\n", repoCfg.Url, checkResult(gitErr), checkResult(targetErr))
+		}
+
+		table.Flush()
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func checkResult(err error) string {
+	if err != nil {
+		return "fail (" + err.Error() + ")"
+	}
+
+	return "pass"
+}
@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	config2 "github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"github.com/spf13/cobra"
+	git2 "gopkg.in/src-d/go-git.v4"
+	"os"
+	"path/filepath"
+)
+
+var lintRef string
+var lintBranch bool
+var lintRepository string
+
+func init() {
+	lintCmd.Flags().StringVar(&lintRef, "ref", "", "branch or tag to publish as, defaults to the one checked out")
+	lintCmd.Flags().BoolVar(&lintBranch, "branch", false, "--ref is a branch rather than a tag")
+	lintCmd.Flags().StringVar(&lintRepository, "repository", "", "git url of the configured repository, defaults to the checkout's origin")
+	rootCmd.AddCommand(lintCmd)
+}
+
+// lintCmd runs a package through the same checks and mutation a publish
+// would, without touching git remotes or Cloudsmith, so it can be used as a
+// pre-commit or CI check in package repositories.
+var lintCmd = &cobra.Command{
+	Use:   "lint <path-to-repo-or-composer.json>",
+	Short: "Checks a composer.json would publish cleanly, without any network access",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := args[0]
+
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			path = filepath.Dir(path)
+		}
+
+		repo, _ := git2.PlainOpenWithOptions(path, &git2.PlainOpenOptions{DetectDotGit: true})
+
+		ref, isBranch, commitRef, err := lintDetectRef(repo)
+		exitOnError(err)
+
+		repoCfg := lintRepositoryConfig(repo)
+
+		packages, versionRef, err := repoCfg.GetPackagesForRef(ref, isBranch)
+		exitOnError(err)
+
+		failed := false
+
+		for _, pkg := range packages {
+			problems := lintPackage(&repoCfg, filepath.Join(path, pkg.Path), versionRef, isBranch, commitRef)
+
+			if len(problems) > 0 {
+				failed = true
+			}
+
+			for _, problem := range problems {
+				fmt.Println("  error: " + problem)
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// lintDetectRef is the ref given with --ref, or the branch or tag the
+// checkout is on
+func lintDetectRef(repo *git2.Repository) (string, bool, string, error) {
+	var commitRef string
+
+	if repo != nil {
+		if head, err := repo.Head(); err == nil {
+			commitRef = head.Hash().String()
+		}
+	}
+
+	if lintRef != "" {
+		return lintRef, lintBranch, commitRef, nil
+	}
+
+	if repo == nil {
+		return "", false, "", errors.New("not a git checkout, use --ref to say which branch or tag to publish as")
+	}
+
+	ref, err := git.HeadRef(repo)
+
+	if err != nil {
+		return "", false, "", errors.New("can't detect the ref, use --ref to say which branch or tag to publish as: " + err.Error())
+	}
+
+	return ref.Name().Short(), ref.Name().IsBranch(), commitRef, nil
+}
+
+// lintRepositoryConfig finds the configured repository by --repository or
+// the checkout's origin, one that isn't configured is linted with defaults
+func lintRepositoryConfig(repo *git2.Repository) config2.Repository {
+	url := lintRepository
+
+	if url == "" && repo != nil {
+		if remote, err := repo.Remote("origin"); err == nil && len(remote.Config().URLs) > 0 {
+			url = remote.Config().URLs[0]
+		}
+	}
+
+	repoCfg, err := config.GetRepository("", url)
+
+	if err != nil {
+		fmt.Printf("%s isn't configured, the webhook would reject it. Linting with the defaults\n", url)
+		return config2.Repository{Url: url}
+	}
+
+	return repoCfg
+}
+
+// lintPackage is processPackage up to the point it would archive and upload,
+// returning whatever would stop the package from being published
+func lintPackage(repoCfg *config2.Repository, packagePath, versionRef string, isBranch bool, commitRef string) []string {
+	composerData, err := composer.LoadManifest(packagePath, repoCfg.Manifest)
+
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	packageName, err := composer.ResolvePackageName(composerData, config.DefaultVendor)
+
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var problems []string
+
+	if !config.IsPackageAllowed(packageName) {
+		problems = append(problems, packageName+" is not allowed to be published")
+	}
+
+	warnings, violations := config.CheckRequiredFields(repoCfg, composerData)
+
+	for _, violation := range violations {
+		problems = append(problems, "below policy: "+violation)
+	}
+
+	version, normalisedVersion, err := repoCfg.DeriveVersion(versionRef, isBranch, composerData)
+
+	if err != nil {
+		fmt.Printf("%s from %s\n", packageName, versionRef)
+
+		return append(problems, err.Error())
+	}
+
+	fmt.Printf("%s@%s (%s) from %s\n", packageName, version, normalisedVersion, versionRef)
+
+	for _, warning := range warnings {
+		fmt.Println("  warning: below policy: " + warning)
+	}
+
+	var source *composer.Source
+
+	if repoCfg.ShouldPublishSource(isBranch) {
+		source = &composer.Source{
+			Url:       repoCfg.Url,
+			Type:      "git",
+			Reference: commitRef,
+		}
+	}
+
+	mutation := composer.Mutation{
+		Name:              packageName,
+		Version:           version,
+		NormalizedVersion: normalisedVersion,
+		Source:            source,
+		Manifest:          repoCfg.Manifest,
+		Replace:           repoCfg.Replace,
+		RequireRewrites:   config.GetRequireRewrites(repoCfg),
+		Provenance:        config.NewProvenance(commitRef, Version, ""),
+		Transforms:        repoCfg.Transforms,
+	}
+
+	// Applied to the copy in memory, the composer.json is left alone
+	if err := mutation.Apply(composerData); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("  ok: would publish cleanly")
+	}
+
+	return problems
+}
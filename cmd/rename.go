@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+var renameRepository string
+var renameConfirmDeletes int
+
+func init() {
+	renameCmd.Flags().StringVar(&renameRepository, "repository", "", "Cloudsmith repository the package is in, defaults to targetRepository")
+	renameCmd.Flags().IntVar(&renameConfirmDeletes, "yes-delete", 0, "confirm deleting this many versions, when it's more than maxBulkDeletes")
+	rootCmd.AddCommand(renameCmd)
+}
+
+// renameCmd moves every version of a package to a new name. Each version is
+// downloaded, uploaded again with composer.json renamed and only then deleted
+// under the old name. Versions already under the new name aren't uploaded
+// again, so an interrupted rename is finished by running it again.
+var renameCmd = &cobra.Command{
+	Use:   "rename <old-name> <new-name>",
+	Short: "Moves every version of a package on Cloudsmith to a new name",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		oldName, newName := args[0], args[1]
+
+		if !composer.IsValidPackageName(newName) {
+			exitOnError(errors.New(newName + " isn't a valid package name"))
+		}
+
+		if !config.IsPackageAllowed(newName) {
+			exitOnError(errors.New(newName + " is not allowed to be published"))
+		}
+
+		repository := renameRepository
+
+		if repository == "" {
+			repository = config.TargetRepository
+		}
+
+		started := time.Now()
+		client := newBulkClient()
+
+		packages, err := client.ListPackageVersions(config.Owner, repository)
+		exitOnError(err)
+
+		renamed := map[string]bool{}
+		var versions []cloudsmith.Package
+
+		for _, pkg := range packages {
+			switch pkg.Name {
+			case newName:
+				renamed[pkg.Version] = true
+			case oldName:
+				versions = append(versions, pkg)
+			}
+		}
+
+		if len(versions) == 0 {
+			fmt.Printf("%s has no versions in %s\n", oldName, repository)
+			return
+		}
+
+		// A dry run only lists them anyway
+		if err := config.CheckBulkDelete(len(versions), renameConfirmDeletes); err != nil && !dryRun {
+			for _, pkg := range versions {
+				fmt.Printf("Would delete %s@%s\n", oldName, pkg.Version)
+			}
+
+			exitOnError(err)
+		}
+
+		for _, pkg := range versions {
+			if renamed[pkg.Version] {
+				fmt.Printf("%s@%s is already published as %s, deleting the old version...\n", oldName, pkg.Version, newName)
+			} else {
+				fmt.Printf("Renaming %s@%s to %s...\n", oldName, pkg.Version, newName)
+			}
+
+			if dryRun {
+				continue
+			}
+
+			if !renamed[pkg.Version] {
+				exitOnError(renameVersion(client, repository, pkg, newName))
+			}
+
+			err := client.DeletePackageIfExists(config.Owner, repository, cloudsmith.FormatComposer, oldName, pkg.Version, cloudsmith.DeleteReasonRenamed, cloudsmith.ActorManual)
+			exitOnError(err)
+		}
+
+		fmt.Println("Done")
+		printPacing(os.Stdout, client, started)
+	},
+}
+
+// renameVersion uploads the version again under the new name and waits for
+// it to be there, the old version isn't deleted until it is.
+func renameVersion(client *cloudsmith.Client, repository string, pkg cloudsmith.Package, newName string) error {
+	artifactName := fmt.Sprintf("rename-%s-%s", strings.Replace(pkg.Name, "/", "-", 1), config.SanitizeVersion(pkg.Version))
+	downloadPath := config.GetArtifactPath(artifactName + "-old.zip")
+	renamedPath := config.GetArtifactPath(artifactName + ".zip")
+
+	defer os.Remove(downloadPath)
+	defer os.Remove(renamedPath)
+
+	if err := client.DownloadPackage(pkg, downloadPath); err != nil {
+		return err
+	}
+
+	if err := composer.RenameArchive(downloadPath, renamedPath, newName); err != nil {
+		return err
+	}
+
+	if _, err := client.UploadComposerPackage(config.Owner, repository, renamedPath, cloudsmith.UploadOptions{}); err != nil {
+		return err
+	}
+
+	return client.WaitForPackageSync(config.Owner, repository, newName, pkg.Version, 2*time.Second, 5*time.Minute)
+}
@@ -1,8 +1,9 @@
 package cmd
 
 import (
-	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
 	"github.com/spf13/cobra"
+	"os"
+	"time"
 )
 
 func init() {
@@ -13,8 +14,13 @@ var retryCmd = &cobra.Command{
 	Use:   "retry",
 	Short: "Retry's packages that failed to sync",
 	Run: func(cmd *cobra.Command, args []string) {
+		started := time.Now()
+		client := newBulkClient()
 
-		client := cloudsmith.NewClient(config.ApiKey)
-		client.RetryFailed(config.Owner, config.TargetRepository)
+		for _, target := range config.GetTargetRepositories() {
+			client.RetryFailed(config.Owner, target)
+		}
+
+		printPacing(os.Stdout, client, started)
 	},
 }
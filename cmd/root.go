@@ -2,10 +2,15 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
 	config2 "github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/limit"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"io"
 	"os"
+	"time"
 )
 
 var cfgFile string
@@ -13,6 +18,10 @@ var dryRun bool
 var config *config2.Config
 var workingDirectory string
 
+// Version is reported to Cloudsmith in the User-Agent, set when building with
+// -ldflags "-X github.com/Lavoaster/cloudsmith-sync/cmd.Version=1.2.3"
+var Version = "dev"
+
 func init() {
 	wd, err := os.Getwd()
 	workingDirectory = wd
@@ -35,8 +44,20 @@ func initConfig() {
 		os.Exit(1)
 	}
 
-	config = config2.NewConfigFromViper(workingDirectory)
+	cfg, err := config2.NewConfigFromViper(workingDirectory)
+
+	if err == nil {
+		err = cfg.Validate()
+	}
+
+	if err != nil {
+		fmt.Println("Invalid config:", err)
+		os.Exit(1)
+	}
+
+	config = cfg
 	config.EnsureDirsExist()
+	composer.SetCacheSize(config.ComposerCacheSize)
 }
 
 var rootCmd = &cobra.Command{
@@ -52,6 +73,54 @@ func Execute() {
 	}
 }
 
+func newClient() *cloudsmith.Client {
+	client := cloudsmith.NewClient(config.ApiKey)
+	client.Uploads = limit.New(config.UploadConcurrency)
+	client.SyncInterval = config.SyncInterval
+	client.SyncTimeout = config.SyncTimeout
+	client.DeletionInterval = config.DeletionInterval
+	client.DownloadBaseUrl = config.DownloadBaseUrl
+	client.SetUserAgent(cloudsmith.UserAgent(Version))
+
+	if config.CloudsmithUserAgent != "" {
+		client.SetUserAgent(config.CloudsmithUserAgent)
+	}
+
+	for name, value := range config.CloudsmithHeaders {
+		// Reserved headers were refused when the config was validated
+		exitOnError(client.AddHeader(name, value))
+	}
+
+	if config.AuditLog != "" {
+		client.AuditLog = cloudsmith.NewAuditLog(config.AuditLog)
+	}
+
+	return client
+}
+
+// newBulkClient is a client for commands that list or delete a lot of
+// packages, paced to stay under Cloudsmith's rate limit
+func newBulkClient() *cloudsmith.Client {
+	client := newClient()
+	client.Pacer = cloudsmith.NewPacer(config.CloudsmithRequestRate)
+
+	return client
+}
+
+// printPacing reports how long a bulk command took and whether Cloudsmith
+// throttled it
+func printPacing(w io.Writer, client *cloudsmith.Client, started time.Time) {
+	stats := client.Pacer.Stats()
+	took := time.Since(started).Round(time.Second)
+
+	if stats.Throttled == 0 {
+		fmt.Fprintf(w, "Took %v, %d requests to Cloudsmith\n", took, stats.Requests)
+		return
+	}
+
+	fmt.Fprintf(w, "Took %v, %d requests to Cloudsmith, throttled %d times and held back for %v in all\n", took, stats.Requests, stats.Throttled, stats.Waited.Round(time.Second))
+}
+
 func exitOnError(err error) {
 	if err != nil {
 		fmt.Println(err)
@@ -3,10 +3,13 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
+	"github.com/Lavoaster/cloudsmith-sync/checks"
+	config2 "github.com/Lavoaster/cloudsmith-sync/config"
 	"github.com/Lavoaster/cloudsmith-sync/git"
+	"github.com/Lavoaster/cloudsmith-sync/limit"
+	"github.com/Lavoaster/cloudsmith-sync/state"
+	"github.com/Lavoaster/cloudsmith-sync/tracing"
 	"github.com/Lavoaster/cloudsmith-sync/webhooks"
-	"github.com/gorilla/mux"
 	"github.com/spf13/cobra"
 	"gopkg.in/go-playground/webhooks.v5/github"
 	"net/http"
@@ -23,20 +26,73 @@ var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Runs a server that listens for GitHub webhooks",
 	Run: func(cmd *cobra.Command, args []string) {
-		router := mux.NewRouter()
+		var options []github.Option
+
+		if config.UsesWebhookSignature() {
+			options = append(options, github.Options.Secret(config.WebhookSecret))
+		} else {
+			fmt.Println("**********************************************************************")
+			fmt.Println("WARNING: webhook signatures are NOT being verified, anyone who can")
+			fmt.Println("reach this server with the " + config.WebhookAuthHeader + " token can trigger a publish.")
+			fmt.Println("Only use header authentication behind a trusted, authenticating proxy.")
+			fmt.Println("**********************************************************************")
+		}
 
-		hook, err := github.New(github.Options.Secret(config.WebhookSecret))
+		hook, err := github.New(options...)
 		exitOnError(err)
 
 		webhooks.Hook = hook
 
-		router.HandleFunc("/webhooks/github", webhooks.HandleGithubWebhook).Methods("POST")
+		if config.UsesWebhookSignature() && config.WebhookSecondarySecret != "" {
+			fmt.Println("Also accepting webhooks signed with the secondary secret, remove it once rotation is done")
+
+			webhooks.SecondaryHook, err = github.New(github.Options.Secret(config.WebhookSecondarySecret))
+			exitOnError(err)
+		}
+
+		router := webhooks.NewRouter(config)
 
-		webhooks.Client = cloudsmith.NewClient(config.ApiKey)
+		client := newClient()
+		webhooks.Client = client
 		webhooks.Config = config
+		webhooks.Version = Version
+		webhooks.Checks = checks.NewClient(config.GithubApiUrl, config.GithubToken)
+		webhooks.SourceLimits = limit.NewKeyed(config.SourceConcurrency)
+		webhooks.SetMaintenance(config.Maintenance)
+
+		// Nothing needs these to publish, so run without one that can't be
+		// read rather than not at all
+		if webhooks.PackageNames, err = state.LoadPackageNames(config.GetStatePath("package-names.json")); err != nil {
+			webhooks.StateStoreUnavailable(webhooks.StorePackageNames, err)
+		}
+
+		if config.SkipUnchangedBranches {
+			if webhooks.PublishedDigests, err = state.LoadPublishedDigests(config.GetStatePath("published-digests.json")); err != nil {
+				webhooks.StateStoreUnavailable(webhooks.StorePublishedDigests, err)
+			}
+		}
+
+		if config.UsesImmutableTags() {
+			if webhooks.PublishedCommits, err = state.LoadPublishedCommits(config.GetStatePath("published-commits.json")); err != nil {
+				webhooks.StateStoreUnavailable(webhooks.StorePublishedCommits, err)
+			}
+		}
 
 		git.Config = config
 
+		if config.SelfTestRepository != "" {
+			fmt.Println("Self-testing against " + config.Owner + "/" + config.SelfTestRepository)
+
+			if err := client.SelfTest(context.Background(), config.Owner, config.SelfTestRepository, config.GetArtifactPath("")); err != nil {
+				exitOnError(fmt.Errorf("self-test failed: %v", err))
+			}
+
+			webhooks.SelfTestPassed()
+		}
+
+		shutdownTracing, err := tracing.Setup(context.Background(), config.TracingEndpoint, config.TracingInsecure, Version)
+		exitOnError(err)
+
 		srv := &http.Server{
 			Addr: config.Server,
 
@@ -47,8 +103,16 @@ var serveCmd = &cobra.Command{
 			Handler:      router, // Pass our instance of gorilla/mux in.
 		}
 
+		if config.PackageNamesRetention > 0 || config.PublishedDigestsRetention > 0 || config.StatusRetention > 0 {
+			go webhooks.CompactStates(config.StateCompactionInterval)
+		}
+
+		if config.StatusSnapshotInterval > 0 {
+			go webhooks.WriteStatusSnapshots(config.StatusSnapshotPath, config.StatusSnapshotInterval)
+		}
+
 		go func() {
-			fmt.Println("Server listening on " + srv.Addr)
+			fmt.Println("Server listening on " + srv.Addr + ", GitHub webhooks at " + config.ProviderRoute(config2.ProviderGithub))
 
 			if err := srv.ListenAndServe(); err != nil {
 				exitOnError(err)
@@ -71,6 +135,14 @@ var serveCmd = &cobra.Command{
 		// until the timeout deadline.
 
 		srv.Shutdown(ctx)
+		shutdownTracing(ctx)
+
+		// So the snapshot doesn't go stale while the server is down
+		if config.StatusSnapshotPath != "" {
+			if err := webhooks.WriteStatusSnapshot(config.StatusSnapshotPath); err != nil {
+				fmt.Printf("Unable to write the status snapshot to %s: %v\n", config.StatusSnapshotPath, err)
+			}
+		}
 
 		// Optionally, you could run srv.Shutdown in a goroutine and block on
 		// <-ctx.Done() if your application should wait for other services
@@ -1,23 +1,42 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/build"
 	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
 	"github.com/Lavoaster/cloudsmith-sync/composer"
 	config2 "github.com/Lavoaster/cloudsmith-sync/config"
 	"github.com/Lavoaster/cloudsmith-sync/git"
+	"github.com/Lavoaster/cloudsmith-sync/limit"
+	"github.com/Lavoaster/cloudsmith-sync/state"
 	"github.com/briandowns/spinner"
 	"github.com/spf13/cobra"
 	git2 "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var Target string
+var resume bool
+var restart bool
+var concurrency int
+
+// The versions finished so far, so an interrupted run can be resumed
+var checkpoint *state.Checkpoint
 
 func init() {
 	runCmd.Flags().StringVarP(&Target, "target", "t", "both", "Target [tags, branches, both]")
+	runCmd.Flags().BoolVar(&resume, "resume", false, "skip the versions an interrupted run already finished")
+	runCmd.Flags().BoolVar(&restart, "restart", false, "ignore the checkpoint of an interrupted run and start again")
+	runCmd.Flags().IntVar(&concurrency, "concurrency", 1, "how many branches and tags of a repository are published at once, each from an export of its own")
 	rootCmd.AddCommand(runCmd)
 }
 
@@ -32,8 +51,34 @@ var runCmd = &cobra.Command{
 		totalRepositories := strconv.Itoa(len(config.Repositories))
 		fmt.Println("Syncing " + totalRepositories + " repositories")
 
-		client := cloudsmith.NewClient(config.ApiKey)
+		if resume && restart {
+			exitOnError(errors.New("only one of --resume and --restart can be used"))
+		}
+
+		if concurrency < 1 {
+			exitOnError(errors.New("--concurrency must be at least one"))
+		}
+
+		client := newClient()
 		git.Config = config
+		ctx := context.Background()
+
+		checkpointPath := config.GetStatePath("run-checkpoint.json")
+
+		if resume {
+			var err error
+			checkpoint, err = state.LoadCheckpoint(checkpointPath)
+			exitOnError(err)
+		} else {
+			// Left alone, a plain run would overwrite it and the interrupted
+			// run couldn't be resumed
+			if _, err := os.Stat(checkpointPath); err == nil && !restart {
+				exitOnError(errors.New("an interrupted run left a checkpoint, use --resume to continue it or --restart to start again"))
+			}
+
+			checkpoint = state.NewCheckpoint(checkpointPath)
+			exitOnError(checkpoint.Remove())
+		}
 
 		fmt.Print("Loading existing packages...")
 
@@ -42,17 +87,20 @@ var runCmd = &cobra.Command{
 		s.FinalMSG = "Done\n\n"
 		s.Start()
 
-		err := client.LoadPackages(config.Owner, config.TargetRepository)
-		exitOnError(err)
+		for _, target := range config.GetTargetRepositories() {
+			err := client.LoadPackages(config.Owner, target)
+			exitOnError(err)
+		}
 
 		s.Stop()
 
 		for _, repoCfg := range config.Repositories {
 			// Repo Config
-			repoDir, err := git.GitUrlToDirectory(repoCfg.Url)
-			repoPath := config.GetRepoPath(repoDir)
+			repoPath, err := git.GetRepoPath(repoCfg.Url)
 			exitOnError(err)
 
+			unlock := git.LockClone(repoPath)
+
 			processLine := "Processing repository: " + repoCfg.Url
 			outer := strings.Repeat("=", len(processLine))
 
@@ -62,7 +110,14 @@ var runCmd = &cobra.Command{
 			fmt.Println()
 
 			// Clone Repo
-			repo, err := git.CloneOrOpenAndUpdate(repoCfg.Url, repoPath)
+			repo, err := git.CloneOrOpenAndUpdate(ctx, repoCfg.Url, repoPath)
+
+			if git.IsEmptyRepository(err) {
+				fmt.Printf("Skipping %s, it doesn't have any commits yet\n\n", repoCfg.Url)
+				unlock()
+				continue
+			}
+
 			exitOnError(err)
 
 			// Get Remote
@@ -75,8 +130,9 @@ var runCmd = &cobra.Command{
 			refList, err := remote.List(&git2.ListOptions{Auth: auth})
 			exitOnError(err)
 
-			worktree, err := repo.Worktree()
-			exitOnError(err)
+			defaultBranch := git.GetDefaultBranch(refList)
+
+			var refs []*plumbing.Reference
 
 			for _, ref := range refList {
 				isBranch := strings.HasPrefix(ref.Name().String(), "refs/heads/")
@@ -86,90 +142,351 @@ var runCmd = &cobra.Command{
 					continue
 				}
 
-				// Tags
-				if isTag {
-					_, err := git.CheckoutTag(repo, worktree, ref)
-
-					if err != nil {
-						fmt.Printf("Skipping tag %v - %v\n", ref, err.Error())
-						continue
-					}
+				if isBranch && !repoCfg.ShouldPublishBranch(ref.Name().Short(), defaultBranch) {
+					continue
 				}
 
-				// Branch
-				if isBranch {
-					_, err := git.CheckoutBranch(repo, worktree, ref)
+				refs = append(refs, ref)
+			}
 
-					if err != nil {
-						fmt.Printf("Skipping branch %v - %v\n", ref, err.Error())
-						continue
-					}
-				}
+			progress := &runProgress{total: len(refs)}
 
-				processPackage(client, &repoCfg, repoPath, ref.Name().Short(), isBranch, ref.Hash().String())
+			// Submodules are only checked out into the clone's own worktree
+			if concurrency > 1 && !repoCfg.IncludeSubmodules {
+				publishExported(ctx, client, &repoCfg, repo, refs, progress)
+			} else {
+				worktree, err := repo.Worktree()
+				exitOnError(err)
 
-				worktree.Reset(&git2.ResetOptions{
-					Mode: git2.HardReset,
-				})
+				for _, ref := range refs {
+					progress.done(ref, publishCheckedOut(ctx, client, &repoCfg, repo, worktree, repoPath, ref))
+				}
 			}
 
+			unlock()
 			fmt.Println()
 		}
+
+		summary.print()
+
+		// Finished, so there's nothing left to resume
+		exitOnError(checkpoint.Remove())
 	},
 }
 
+// How publishing a package went, counted for the summary at the end of a run
+const (
+	outcomePublished = "published"
+	outcomeSkipped   = "skipped"
+	outcomeFailed    = "failed"
+)
+
+// runSummary counts the outcomes of every package published in a run
+type runSummary struct {
+	mutex    sync.Mutex
+	outcomes map[string]int
+}
+
+var summary = &runSummary{outcomes: map[string]int{}}
+
+func (s *runSummary) add(outcomes ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, outcome := range outcomes {
+		s.outcomes[outcome]++
+	}
+}
+
+func (s *runSummary) print() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fmt.Printf("Published %d, skipped %d and failed %d packages\n", s.outcomes[outcomePublished], s.outcomes[outcomeSkipped], s.outcomes[outcomeFailed])
+}
+
+// runProgress is how far through a repository's branches and tags a run is
+type runProgress struct {
+	mutex    sync.Mutex
+	total    int
+	finished int
+}
+
+// done counts the ref as finished, along with the outcomes of its packages
+func (p *runProgress) done(ref *plumbing.Reference, outcomes []string) {
+	summary.add(outcomes...)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.finished++
+	fmt.Printf("[%d of %d] %s done\n", p.finished, p.total, ref.Name().Short())
+}
+
+// publishCheckedOut checks the ref out in the clone's worktree and publishes
+// its packages, one ref at a time
+func publishCheckedOut(ctx context.Context, client *cloudsmith.Client, repoCfg *config2.Repository, repo *git2.Repository, worktree *git2.Worktree, repoPath string, ref *plumbing.Reference) []string {
+	isBranch := strings.HasPrefix(ref.Name().String(), "refs/heads/")
+
+	var description string
+
+	// Tags
+	if !isBranch {
+		commit, err := git.CheckoutTag(ctx, repo, worktree, ref)
+
+		if err != nil {
+			fmt.Printf("Skipping tag %v - %v\n", ref, err.Error())
+			return []string{outcomeFailed}
+		}
+
+		composer.CheckedOut(worktree.Filesystem.Root(), commit)
+
+		description = git.GetTagMessage(repo, ref)
+	}
+
+	// Branch
+	if isBranch {
+		commit, err := git.CheckoutBranch(ctx, repo, worktree, ref)
+
+		if err != nil {
+			fmt.Printf("Skipping branch %v - %v\n", ref, err.Error())
+			return []string{outcomeFailed}
+		}
+
+		composer.CheckedOut(worktree.Filesystem.Root(), commit)
+	}
+
+	defer git.ResetWorktree(worktree)
+
+	if repoCfg.IncludeSubmodules {
+		if err := git.UpdateSubmodules(ctx, worktree); err != nil {
+			fmt.Printf("Skipping %v - %v\n", ref, err.Error())
+			return []string{outcomeFailed}
+		}
+	}
+
+	return publishRefPackages(ctx, client, repoCfg, repoPath, ref, isBranch, description)
+}
+
+// publishExported publishes up to --concurrency refs at once, each exported to
+// a directory of its own rather than checked out in the shared clone
+func publishExported(ctx context.Context, client *cloudsmith.Client, repoCfg *config2.Repository, repo *git2.Repository, refs []*plumbing.Reference, progress *runProgress) {
+	// Read before any exports start, they can't share the clone
+	descriptions := map[string]string{}
+
+	for _, ref := range refs {
+		descriptions[ref.Name().String()] = git.GetTagMessage(repo, ref)
+	}
+
+	queue := make(chan *plumbing.Reference)
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for ref := range queue {
+				progress.done(ref, publishExport(ctx, client, repoCfg, repo, ref, descriptions[ref.Name().String()]))
+			}
+		}()
+	}
+
+	for _, ref := range refs {
+		queue <- ref
+	}
+
+	close(queue)
+	wg.Wait()
+}
+
+func publishExport(ctx context.Context, client *cloudsmith.Client, repoCfg *config2.Repository, repo *git2.Repository, ref *plumbing.Reference, description string) []string {
+	isBranch := strings.HasPrefix(ref.Name().String(), "refs/heads/")
+
+	dir, err := ioutil.TempDir("", "cloudsmith-sync-export")
+
+	if err != nil {
+		fmt.Printf("Skipping %v - %v\n", ref, err.Error())
+		return []string{outcomeFailed}
+	}
+
+	defer os.RemoveAll(dir)
+
+	if _, err := git.ExportRef(ctx, repo, ref, dir); err != nil {
+		fmt.Printf("Skipping %v - %v\n", ref, err.Error())
+		return []string{outcomeFailed}
+	}
+
+	if isBranch {
+		description = ""
+	}
+
+	return publishRefPackages(ctx, client, repoCfg, dir, ref, isBranch, description)
+}
+
+// publishRefPackages publishes the packages of a branch or tag whose files are
+// at checkoutPath
+func publishRefPackages(ctx context.Context, client *cloudsmith.Client, repoCfg *config2.Repository, checkoutPath string, ref *plumbing.Reference, isBranch bool, description string) []string {
+	packages, versionRef, err := repoCfg.GetPackagesForRef(ref.Name().Short(), isBranch)
+
+	if err != nil {
+		fmt.Printf("Skipping tag %v - %v\n", ref, err.Error())
+		return []string{outcomeSkipped}
+	}
+
+	var outcomes []string
+
+	for _, pkg := range packages {
+		outcomes = append(outcomes, processPackage(ctx, client, repoCfg, filepath.Join(checkoutPath, pkg.Path), versionRef, isBranch, ref.Hash().String(), description))
+	}
+
+	return outcomes
+}
+
+// packageStatus shows how publishing a package is going. Packages published
+// one at a time get a spinner, ones published side by side a line each once
+// they're finished so they don't talk over each other
+type packageStatus struct {
+	label   string
+	spinner *spinner.Spinner
+}
+
+func startPackageStatus(label string) *packageStatus {
+	status := &packageStatus{label: label}
+
+	if concurrency > 1 {
+		return status
+	}
+
+	fmt.Printf("Processing %s...", label)
+
+	status.spinner = spinner.New(spinner.CharSets[9], 100*time.Millisecond)
+	status.spinner.Prefix = " "
+	status.spinner.Start()
+
+	return status
+}
+
+// Step shows what's being done now, it's only shown by the spinner
+func (s *packageStatus) Step(step string) {
+	if s.spinner != nil {
+		s.spinner.Suffix = step
+	}
+}
+
+// Finish stops the status with how it went
+func (s *packageStatus) Finish(message string) {
+	if s.spinner == nil {
+		fmt.Printf("%s %s\n", s.label, message)
+		return
+	}
+
+	s.spinner.FinalMSG = message + "\n"
+	s.spinner.Stop()
+}
+
 func processPackage(
+	ctx context.Context,
 	client *cloudsmith.Client,
 	repoCfg *config2.Repository,
 	repoPath, branchOrTagName string,
 	isBranch bool,
-	commitRef string,
-) {
-	composerData, err := composer.LoadFile(repoPath)
+	commitRef, description string,
+) string {
+	// Fail fast rather than after the build step with a confusing archive
+	// error, nothing else can be published either
+	exitOnError(config.CheckArtifactsDir(repoCfg))
+
+	composerData, err := composer.LoadManifest(repoPath, repoCfg.Manifest)
 	exitOnError(err)
 
-	packageName := composerData["name"].(string)
+	packageName, err := composer.ResolvePackageName(composerData, config.DefaultVendor)
 
-	version, normalisedVersion, err := composer.DeriveVersion(branchOrTagName, isBranch)
+	if err != nil {
+		fmt.Printf("Skipping %s@%s due to %s...\n", repoPath, branchOrTagName, err)
+		return outcomeSkipped
+	}
+
+	if !config.IsPackageAllowed(packageName) {
+		fmt.Printf("Refusing to publish %s from %s, the package name isn't allowed\n", packageName, repoCfg.Url)
+		return outcomeSkipped
+	}
+
+	warnings, violations := config.CheckRequiredFields(repoCfg, composerData)
+
+	if len(warnings) > 0 {
+		fmt.Printf("%s from %s is below policy: %s\n", packageName, repoCfg.Url, strings.Join(warnings, ", "))
+	}
+
+	if len(violations) > 0 {
+		fmt.Printf("Refusing to publish %s@%s, it's below policy: %s\n", packageName, branchOrTagName, strings.Join(violations, ", "))
+		return outcomeSkipped
+	}
+
+	version, normalisedVersion, err := repoCfg.DeriveVersion(branchOrTagName, isBranch, composerData)
 
 	if err != nil {
 		fmt.Printf("Skipping %s@%s due to %s...\n", packageName, branchOrTagName, err)
-		return
+		return outcomeSkipped
 	}
 
-	fmt.Printf("Processing %s@%s...", packageName, version)
+	if checkpoint.IsDone(packageName, version) {
+		fmt.Printf("Skipping %s@%s, already done before the run was interrupted\n", packageName, version)
+		return outcomeSkipped
+	}
 
-	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
-	s.Prefix = " "
-	s.Start()
+	s := startPackageStatus(packageName + "@" + version)
 
-	if client.IsAwareOfPackage(packageName, version) {
-		if isBranch {
-			client.DeletePackageIfExists(config.Owner, config.TargetRepository, packageName, version)
+	targetRepository := config.GetTargetRepository(repoCfg)
+	uploadRepository := config.GetUploadRepository(repoCfg)
 
-			s.Suffix = " Waiting for package to be deleted"
+	if !isBranch && client.IsAwareOfPackage(targetRepository, packageName, version) {
+		s.Finish("already exists")
 
-			for {
-				exists, err := client.RemoteCheckPackageExists(config.Owner, config.TargetRepository, packageName, version)
-				exitOnError(err)
+		if !dryRun {
+			exitOnError(checkpoint.Record(packageName, version))
+		}
 
-				if !exists {
-					s.Suffix = ""
-					break
-				}
+		return outcomeSkipped
+	}
 
-				time.Sleep(2 * time.Second)
-			}
-		} else {
-			s.FinalMSG = "already exists\n"
-			s.Stop()
-			return
+	// Branches are replaced, as are packages left in staging by a failed
+	// verification. Republishing replaces them as part of the upload
+	if !config.RepublishesInPlace() && client.IsAwareOfPackage(uploadRepository, packageName, version) {
+		err := client.DeletePackageIfExists(config.Owner, uploadRepository, cloudsmith.FormatComposer, packageName, version, cloudsmith.DeleteReasonReplace, cloudsmith.ActorManual)
+
+		if err != nil {
+			s.Finish("failed")
+			fmt.Printf("Skipping %s@%s, unable to delete the old version: %s\n", packageName, version, err)
+			return outcomeFailed
+		}
+
+		s.Step(" Waiting for package to be deleted")
+
+		err = client.WaitForPackageDeletion(ctx, config.Owner, uploadRepository, packageName, version, 2*time.Minute)
+		exitOnError(err)
+
+		s.Step("")
+	}
+
+	if repoCfg.BuildStep != nil {
+		s.Step(" Running build step")
+
+		output, err := build.RunStep(repoCfg.BuildStep, repoPath)
+
+		if err != nil {
+			s.Finish("failed")
+			fmt.Printf("Skipping %s@%s due to %s...\n%s\n", packageName, version, err, output)
+			return outcomeFailed
 		}
+
+		s.Step("")
 	}
 
 	var source *composer.Source
 
-	if repoCfg.PublishSource {
+	if repoCfg.ShouldPublishSource(isBranch) {
 		source = &composer.Source{
 			Url:       repoCfg.Url,
 			Type:      "git",
@@ -178,27 +495,194 @@ func processPackage(
 	}
 
 	// Mutate composer.json file
-	err = composer.MutateComposerFile(repoPath, version, normalisedVersion, source)
+	err = composer.MutateComposerFile(repoPath, composer.Mutation{
+		Name:              packageName,
+		Version:           version,
+		NormalizedVersion: normalisedVersion,
+		Source:            source,
+		Description:       description,
+		Manifest:          repoCfg.Manifest,
+		Replace:           repoCfg.Replace,
+		RequireRewrites:   config.GetRequireRewrites(repoCfg),
+		Provenance:        config.NewProvenance(commitRef, Version, ""),
+		Transforms:        repoCfg.Transforms,
+	})
+	exitOnError(err)
+
+	mutatedComposerData, err := composer.LoadFile(repoPath)
 	exitOnError(err)
 
-	// Extract Info from the composer file
-	packageNameParts := strings.Split(packageName, "/")
-	namespace := packageNameParts[0]
-	name := packageNameParts[1]
+	packageDescription, err := repoCfg.ReadDescription(repoPath, mutatedComposerData)
+	exitOnError(err)
+
+	targets := config.GetPublishTargets(repoCfg)
+	sizes := make([]int64, len(targets))
+	errs := make([]error, len(targets))
+
+	// The checkout is only read from here on, so the targets can share it
+	limit.Each(len(targets), config.GetTargetConcurrency(repoCfg), func(i int) {
+		sizes[i], errs[i] = publishTarget(client, repoCfg, targets[i], i, repoPath, branchOrTagName, isBranch, packageName, version, commitRef, packageDescription, mutatedComposerData)
+	})
+
+	var size int64
+	var failures []string
+
+	for i, err := range errs {
+		size += sizes[i]
+
+		if err == nil {
+			continue
+		}
+
+		// A failed target doesn't stop the others but the main composer
+		// upload has to succeed before it can be promoted
+		if i == 0 {
+			exitOnError(err)
+		}
+
+		failures = append(failures, targets[i].Format+" to "+targets[i].Repository+": "+err.Error())
+	}
+
+	if !dryRun && repoCfg.Staging != nil {
+		if repoCfg.Staging.Verify != nil {
+			s.Step(" Verifying staged package")
+
+			output, err := build.RunVerification(repoCfg.Staging.Verify, repoPath, config.Owner, uploadRepository, packageName, version)
+
+			if err != nil {
+				s.Finish("failed verification, left in " + uploadRepository)
+				fmt.Printf("%s\n%s\n", err, output)
+				return outcomeFailed
+			}
+		}
+
+		s.Step(" Promoting to " + targetRepository)
+
+		err = client.PromotePackage(ctx, config.Owner, uploadRepository, targetRepository, packageName, version, cloudsmith.ActorManual, 2*time.Minute)
+		exitOnError(err)
+
+		s.Step("")
+	}
+
+	if len(failures) > 0 {
+		s.Finish(fmt.Sprintf("done (%d KiB), failed %s", size/1024, strings.Join(failures, ", ")))
+		return outcomeFailed
+	}
+
+	finished := fmt.Sprintf("done (%d KiB)", size/1024)
+
+	if !dryRun && repoCfg.Metadata.Publishes(isBranch) {
+		s.Step(" Uploading metadata")
+
+		// It only points at the package, which is published either way
+		if err := publishMetadata(client, repoCfg, branchOrTagName, packageName, version, commitRef); err != nil {
+			finished += ", metadata failed: " + err.Error()
+		}
+	}
+
+	if !dryRun {
+		exitOnError(checkpoint.Record(packageName, version))
+	}
+
+	s.Finish(finished)
+
+	return outcomePublished
+}
+
+// publishTarget archives the package for one of its publish targets and,
+// unless it's a dry run, uploads it, returning the archive's size. Only a
+// failed upload is returned, anything else stops the sync.
+func publishTarget(
+	client *cloudsmith.Client,
+	repoCfg *config2.Repository,
+	target config2.PublishTarget,
+	index int,
+	repoPath, branchOrTagName string,
+	isBranch bool,
+	packageName, version, commitRef, packageDescription string,
+	composerData composer.ComposerFile,
+) (int64, error) {
+	namespace, name := composer.SplitPackageName(packageName)
+
+	maxFiles, maxFileSize := config.GetArchiveLimits(repoCfg)
+
+	archiveOptions := git.ArchiveOptions{
+		Compression: config.GetTargetCompression(repoCfg, target),
+		StripVendor: repoCfg.ShouldStripVendor(composerData),
+		Symlinks:    config.ArchiveSymlinks,
+		FileModes:   config.ArchiveFileModes,
+		MaxFiles:    maxFiles,
+		MaxFileSize: maxFileSize,
+	}
+
+	options := cloudsmith.UploadOptions{
+		Tags:        repoCfg.GetPackageTags(branchOrTagName, isBranch),
+		Republish:   index > 0 || config.RepublishesInPlace(),
+		Description: packageDescription,
+	}
 
 	artifactName := fmt.Sprintf("%v-%v-%v.zip", namespace, name, commitRef)
-	artifactPath := config.GetArtifactPath(artifactName)
+
+	if target.Format == config2.PublishFormatRaw {
+		artifactName = fmt.Sprintf("%v-%v-%v.tar.gz", namespace, name, commitRef)
+
+		options.Name = namespace + "-" + name
+		options.Version = version
+	}
+
+	artifactPath, release, err := git.ReserveArtifact(config.GetRepositoryArtifactPath(repoCfg, artifactName))
+	exitOnError(err)
+
+	defer release()
+
+	var size int64
 
 	// Create archive file
-	err = git.CreateArtifactFromRepository(repoPath, artifactPath)
+	if target.Format == config2.PublishFormatRaw {
+		size, err = git.CreateTarballFromRepository(repoPath, artifactPath, archiveOptions)
+	} else {
+		size, err = git.CreateArtifactFromRepository(repoPath, artifactPath, archiveOptions)
+	}
 	exitOnError(err)
 
-	if !dryRun {
-		// Upload archive to cloudsmith
-		_, err = client.UploadComposerPackage(config.Owner, config.TargetRepository, artifactPath)
-		exitOnError(err)
+	if target.Format == config2.PublishFormatComposer {
+		exitOnError(config.CheckArchiveAutoload(artifactPath))
 	}
 
-	s.FinalMSG = "done\n"
-	s.Stop()
+	if dryRun {
+		return size, nil
+	}
+
+	// Upload archive to cloudsmith
+	_, err = client.UploadPackage(config.Owner, target.Repository, target.Format, artifactPath, options)
+
+	return size, err
+}
+
+// publishMetadata uploads the metadata of a newly published version as a raw
+// package, replacing what was there
+func publishMetadata(client *cloudsmith.Client, repoCfg *config2.Repository, branchOrTagName, packageName, version, commitRef string) error {
+	metadataVersion := config.GetMetadataVersion(repoCfg, branchOrTagName)
+	namespace, name := composer.SplitPackageName(packageName)
+	artifactName := fmt.Sprintf("%v-%v-metadata-%v.json", namespace, name, metadataVersion)
+
+	artifactPath, release, err := git.ReserveArtifact(config.GetRepositoryArtifactPath(repoCfg, artifactName))
+
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	if err := composer.WriteMetadata(artifactPath, config.NewMetadata(repoCfg, packageName, version, branchOrTagName, commitRef, Version, "")); err != nil {
+		return err
+	}
+
+	_, err = client.UploadPackage(config.Owner, config.GetMetadataRepository(repoCfg), config2.PublishFormatRaw, artifactPath, cloudsmith.UploadOptions{
+		Name:      namespace + "-" + name + "-metadata",
+		Version:   metadataVersion,
+		Republish: true,
+	})
+
+	return err
 }
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/spf13/cobra"
+)
+
+var uploadPackage string
+var uploadVersion string
+var uploadRepository string
+var uploadTags []string
+
+func init() {
+	uploadCmd.Flags().StringVar(&uploadPackage, "package", "", "package name the artifact must contain")
+	uploadCmd.Flags().StringVar(&uploadVersion, "version", "", "version the artifact must contain")
+	uploadCmd.Flags().StringVar(&uploadRepository, "repository", "", "Cloudsmith repository to upload to, defaults to targetRepository")
+	uploadCmd.Flags().StringSliceVar(&uploadTags, "tags", nil, "tags to attach to the package")
+	rootCmd.AddCommand(uploadCmd)
+}
+
+var uploadCmd = &cobra.Command{
+	Use:   "upload <artifact-path>",
+	Short: "Uploads an artifact that has already been built, without touching git",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		artifactPath := args[0]
+
+		// Artifacts have their version injected into composer.json, which is
+		// what Cloudsmith reads, so it's the source of truth for what this is
+		composerData, err := composer.LoadFileFromArchive(artifactPath)
+		exitOnError(err)
+
+		name, _ := composerData["name"].(string)
+		version, _ := composerData["version"].(string)
+
+		if uploadPackage != "" && uploadPackage != name {
+			exitOnError(errors.New(artifactPath + " is " + name + ", not " + uploadPackage))
+		}
+
+		if !config.IsPackageAllowed(name) {
+			exitOnError(errors.New(name + " is not allowed to be published"))
+		}
+
+		if uploadVersion != "" && uploadVersion != version {
+			exitOnError(errors.New(artifactPath + " is version " + version + ", not " + uploadVersion))
+		}
+
+		repository := uploadRepository
+
+		if repository == "" {
+			repository = config.TargetRepository
+		}
+
+		fmt.Printf("Uploading %s@%s to %s...\n", name, version, repository)
+
+		if dryRun {
+			return
+		}
+
+		client := newClient()
+
+		_, err = client.UploadComposerPackage(config.Owner, repository, artifactPath, cloudsmith.UploadOptions{
+			Tags: uploadTags,
+		})
+		exitOnError(err)
+
+		fmt.Println("Done")
+	},
+}
@@ -0,0 +1,69 @@
+package composer_test
+
+import (
+	"archive/zip"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenameArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	archivePath := filepath.Join(dir, "widgets.zip")
+	file, err := os.Create(archivePath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := zip.NewWriter(file)
+
+	for name, contents := range map[string]string{
+		"composer.json":  `{"name": "acme/widgets", "version": "1.0.0"}`,
+		"src/Widget.php": "<?php\n",
+	} {
+		entry, err := archive.Create(name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entry.Write([]byte(contents))
+	}
+
+	archive.Close()
+	file.Close()
+
+	renamedPath := filepath.Join(dir, "gizmos.zip")
+
+	if err := composer.RenameArchive(archivePath, renamedPath, "acme/gizmos"); err != nil {
+		t.Fatalf("[!] RenameArchive() = %v; want nil", err)
+	}
+
+	data, err := composer.LoadFileFromArchive(renamedPath)
+
+	if err != nil || data["name"] != "acme/gizmos" || data["version"] != "1.0.0" {
+		t.Errorf("[!] renamed composer.json = %v, %v; want acme/gizmos at 1.0.0", data, err)
+	}
+
+	renamed, err := zip.OpenReader(renamedPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer renamed.Close()
+
+	if len(renamed.File) != 2 {
+		t.Errorf("[!] renamed archive has %d files; want 2", len(renamed.File))
+	}
+}
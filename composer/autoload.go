@@ -0,0 +1,127 @@
+package composer
+
+import (
+	"archive/zip"
+	"path"
+	"sort"
+	"strings"
+)
+
+// CheckArchiveAutoload compares the autoload section of the composer.json in
+// a package archive with the files the archive has, returning an entry for
+// each psr-4, psr-0, classmap or files path that's missing. Packages like
+// that install fine and then fatal when the class is first loaded.
+func CheckArchiveAutoload(archivePath string) ([]string, error) {
+	data, err := LoadFileFromArchive(archivePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := zip.OpenReader(archivePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer archive.Close()
+
+	var entries []string
+
+	for _, file := range archive.File {
+		entries = append(entries, file.Name)
+	}
+
+	return MissingAutoloadPaths(data, entries), nil
+}
+
+// MissingAutoloadPaths is CheckArchiveAutoload for a composer.json and the
+// paths of the files that are published with it.
+func MissingAutoloadPaths(data ComposerFile, entries []string) []string {
+	autoload, ok := data["autoload"].(map[string]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	var missing []string
+
+	for _, kind := range []string{"psr-4", "psr-0"} {
+		namespaces, _ := autoload[kind].(map[string]interface{})
+		var prefixes []string
+
+		for prefix := range namespaces {
+			prefixes = append(prefixes, prefix)
+		}
+
+		sort.Strings(prefixes)
+
+		for _, prefix := range prefixes {
+			for _, dir := range autoloadPaths(namespaces[prefix]) {
+				if !hasArchivePath(entries, dir) {
+					missing = append(missing, kind+" "+prefix+" => "+dir)
+				}
+			}
+		}
+	}
+
+	for _, kind := range []string{"classmap", "files"} {
+		for _, file := range autoloadPaths(autoload[kind]) {
+			if !hasArchivePath(entries, file) {
+				missing = append(missing, kind+" "+file)
+			}
+		}
+	}
+
+	return missing
+}
+
+// autoloadPaths reads an autoload value, which is either a path or a list of
+// them
+func autoloadPaths(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var paths []string
+
+		for _, item := range value {
+			if item, ok := item.(string); ok {
+				paths = append(paths, item)
+			}
+		}
+
+		return paths
+	}
+
+	return nil
+}
+
+// hasArchivePath is whether the archive has the file, or a file inside the
+// directory, at target. Classmap paths can have wildcards in them.
+func hasArchivePath(entries []string, target string) bool {
+	target = strings.TrimSuffix(strings.TrimPrefix(path.Clean("/"+target), "/"), "/")
+
+	// The package root is always there
+	if target == "" {
+		return true
+	}
+
+	wildcard := strings.ContainsAny(target, "*?[")
+
+	for _, entry := range entries {
+		entry = strings.TrimSuffix(entry, "/")
+
+		for candidate := entry; candidate != "." && candidate != "/" && candidate != ""; candidate = path.Dir(candidate) {
+			if candidate == target {
+				return true
+			}
+
+			if matched, _ := path.Match(target, candidate); wildcard && matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,45 @@
+package composer_test
+
+import (
+	"encoding/json"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"reflect"
+	"testing"
+)
+
+func TestMissingAutoloadPaths(t *testing.T) {
+	entries := []string{
+		"composer.json",
+		"src/Widget.php",
+		"lib/Acme/Legacy.php",
+		"resources/classes/Thing.php",
+		"helpers.php",
+	}
+
+	cases := []struct {
+		autoload string
+		expected []string
+	}{
+		{`{}`, nil},
+		{`{"psr-4": {"Acme\\": "src/"}, "files": ["helpers.php"]}`, nil},
+		{`{"psr-4": {"Acme\\": ["src", "./lib/"], "Acme\\Tests\\": "tests/"}}`, []string{`psr-4 Acme\Tests\ => tests/`}},
+		{`{"psr-4": {"": ""}, "psr-0": {"Acme_": "lib/"}}`, nil},
+		{`{"psr-0": {"Acme_": "legacy/"}}`, []string{"psr-0 Acme_ => legacy/"}},
+		{`{"classmap": ["resources/*/", "build/"]}`, []string{"classmap build/"}},
+		{`{"files": ["helpers.php", "src/functions.php"]}`, []string{"files src/functions.php"}},
+	}
+
+	for _, c := range cases {
+		var autoload map[string]interface{}
+
+		if err := json.Unmarshal([]byte(c.autoload), &autoload); err != nil {
+			t.Fatal(err)
+		}
+
+		data := composer.ComposerFile{"name": "acme/widgets", "autoload": autoload}
+
+		if missing := composer.MissingAutoloadPaths(data, entries); !reflect.DeepEqual(missing, c.expected) {
+			t.Errorf("[!] MissingAutoloadPaths(%s) = %q; want %q", c.autoload, missing, c.expected)
+		}
+	}
+}
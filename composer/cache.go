@@ -0,0 +1,150 @@
+package composer
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fileCache holds parsed composer.json files by commit and path, so packages
+// in a monorepo and the same commit processed again aren't read and parsed
+// over and over. Files are only cached while their checkout is known to be
+// at a commit, anything written to it (a mutation or build step) stops that
+// until it's checked out again.
+type fileCache struct {
+	mutex sync.Mutex
+	size  int
+	// Checkout directory to the commit it's at
+	checkouts map[string]string
+	files     map[string]ComposerFile
+	// Keys oldest first, the oldest is evicted once there are size files
+	order []string
+}
+
+var cache = &fileCache{
+	size:      256,
+	checkouts: map[string]string{},
+	files:     map[string]ComposerFile{},
+}
+
+// SetCacheSize is how many parsed composer.json files are kept, zero turns
+// the cache off.
+func SetCacheSize(size int) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.size = size
+	cache.files = map[string]ComposerFile{}
+	cache.order = nil
+}
+
+// CheckedOut records that the checkout in dir is now exactly commit, so its
+// composer.json files can be cached.
+func CheckedOut(dir, commit string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.checkouts[filepath.Clean(dir)] = commit
+}
+
+// Modified stops caching the checkout containing dir, or any inside it, as
+// its files may no longer be the same as its commit.
+func Modified(dir string) {
+	dir = filepath.Clean(dir)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for checkout := range cache.checkouts {
+		if isWithin(dir, checkout) || isWithin(checkout, dir) {
+			delete(cache.checkouts, checkout)
+		}
+	}
+}
+
+// key is what the composer.json in path is cached under, empty when it can't
+// be cached
+func (c *fileCache) key(path string) string {
+	path = filepath.Clean(path)
+
+	for checkout, commit := range c.checkouts {
+		if isWithin(path, checkout) {
+			return commit + ":" + strings.TrimPrefix(path, checkout)
+		}
+	}
+
+	return ""
+}
+
+func (c *fileCache) get(path string) (ComposerFile, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := c.key(path)
+
+	if key == "" {
+		return nil, false
+	}
+
+	data, ok := c.files[key]
+
+	if !ok {
+		return nil, false
+	}
+
+	// Callers are free to change what they're given
+	return copyValue(data).(ComposerFile), true
+}
+
+func (c *fileCache) put(path string, data ComposerFile) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := c.key(path)
+
+	if key == "" || c.size <= 0 {
+		return
+	}
+
+	if _, ok := c.files[key]; !ok {
+		c.order = append(c.order, key)
+	}
+
+	c.files[key] = copyValue(data).(ComposerFile)
+
+	for len(c.order) > c.size {
+		delete(c.files, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// isWithin is whether path is dir or somewhere inside it
+func isWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// copyValue deep copies decoded json
+func copyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case ComposerFile:
+		return ComposerFile(copyValue(map[string]interface{}(value)).(map[string]interface{}))
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(value))
+
+		for key, item := range value {
+			copied[key] = copyValue(item)
+		}
+
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+
+		for i, item := range value {
+			copied[i] = copyValue(item)
+		}
+
+		return copied
+	}
+
+	return value
+}
@@ -0,0 +1,78 @@
+package composer_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeComposerJson(t *testing.T, dir, contents string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, "composer.json"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadFileCachesByCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	writeComposerJson(t, dir, `{"name": "acme/widgets"}`)
+	composer.CheckedOut(dir, "abc123")
+
+	first, err := composer.LoadFile(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes to what's returned mustn't leak into the cache
+	first["name"] = "acme/changed"
+
+	// Written behind the cache's back, the same commit is still served
+	writeComposerJson(t, dir, `{"name": "acme/gadgets"}`)
+
+	if data, _ := composer.LoadFile(dir); data["name"] != "acme/widgets" {
+		t.Errorf("[!] LoadFile() at the same commit = %v; want the cached acme/widgets", data["name"])
+	}
+
+	composer.Modified(dir)
+
+	if data, _ := composer.LoadFile(dir); data["name"] != "acme/gadgets" {
+		t.Errorf("[!] LoadFile() once modified = %v; want acme/gadgets from disk", data["name"])
+	}
+
+	writeComposerJson(t, dir, `{"name": "acme/sprockets"}`)
+	composer.CheckedOut(dir, "def456")
+
+	if data, _ := composer.LoadFile(dir); data["name"] != "acme/sprockets" {
+		t.Errorf("[!] LoadFile() at a new commit = %v; want acme/sprockets", data["name"])
+	}
+}
+
+func TestMutateComposerFileInvalidatesCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	writeComposerJson(t, dir, `{"name": "acme/widgets"}`)
+	composer.CheckedOut(dir, "abc123")
+
+	if err := composer.MutateComposerFile(dir, composer.Mutation{Version: "1.0.0", NormalizedVersion: "1.0.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := composer.LoadFile(dir); data["version"] != "1.0.0" {
+		t.Errorf("[!] LoadFile() after a mutation = %v; want version 1.0.0", data["version"])
+	}
+}
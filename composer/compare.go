@@ -0,0 +1,203 @@
+package composer
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PHP's version_compare order for the words in a version, Composer compares
+// normalised versions with it. A number ranks as # and words that aren't
+// here rank below all of them
+var specialForms = []struct {
+	form  string
+	order int
+}{
+	{"dev", 0},
+	{"alpha", 1},
+	{"a", 1},
+	{"beta", 2},
+	{"b", 2},
+	{"RC", 3},
+	{"rc", 3},
+	{"#", 4},
+	{"pl", 5},
+	{"p", 5},
+}
+
+var stabilityModifier = regexp.MustCompile(`(?i)` + ModifierRegex + `(?:\+.*)?$`)
+
+// An alpha, beta or RC modifier at the end of a normalised version
+var prereleaseModifier = regexp.MustCompile(`-(?:alpha|beta|RC)(?:[.-]?\d+)*$`)
+
+// CompareVersions compares two versions the way Composer orders them,
+// returning -1, 0 or 1 as a is lower than, equal to or higher than b. Both
+// are normalised first so v1.2 and 1.2.0.0 are equal, and dev < alpha < beta
+// < RC < stable < patch for the same number. Branches like dev-feature only
+// equal themselves, Composer has no order between them and anything else.
+func CompareVersions(a, b string) (int, error) {
+	normalisedA, err := NormaliseVersion(a, "")
+
+	if err != nil {
+		return 0, err
+	}
+
+	normalisedB, err := NormaliseVersion(b, "")
+
+	if err != nil {
+		return 0, err
+	}
+
+	if strings.HasPrefix(normalisedA, "dev-") || strings.HasPrefix(normalisedB, "dev-") {
+		if normalisedA == normalisedB {
+			return 0, nil
+		}
+
+		return 0, errors.New("can't order " + a + " against " + b + ", branches only equal themselves")
+	}
+
+	return compareParts(versionParts(normalisedA), versionParts(normalisedB)), nil
+}
+
+// IsStable is whether Composer sees a version as stable, so not a dev branch
+// or an alpha, beta or RC release. Patch releases are stable.
+func IsStable(version string) bool {
+	version = strings.SplitN(version, "#", 2)[0]
+
+	if strings.HasPrefix(strings.ToLower(version), "dev-") || strings.HasSuffix(strings.ToLower(version), "-dev") {
+		return false
+	}
+
+	match := stabilityModifier.FindStringSubmatch(version)
+
+	if match == nil {
+		return true
+	}
+
+	if match[3] != "" {
+		return false
+	}
+
+	switch strings.ToLower(match[1]) {
+	case "beta", "b", "alpha", "a", "rc":
+		return false
+	}
+
+	return true
+}
+
+// StripPrerelease drops the alpha, beta or RC modifier from a normalised
+// version, so Composer sees 2.0.0.0-beta1 as the stable 2.0.0.0. Composer
+// takes a package's stability from its normalised version, not the label.
+// Dev versions and patch releases are returned as they are.
+func StripPrerelease(normalised string) string {
+	if strings.HasPrefix(normalised, "dev-") {
+		return normalised
+	}
+
+	return prereleaseModifier.ReplaceAllString(normalised, "")
+}
+
+// versionParts splits a version the way version_compare does, on ., -, _ and
+// + and wherever numbers and words meet, so 1.0.0.0-RC15 is 1 0 0 0 RC 15
+func versionParts(version string) []string {
+	var parts []string
+	var part []rune
+
+	flush := func() {
+		if len(part) > 0 {
+			parts = append(parts, string(part))
+			part = nil
+		}
+	}
+
+	for _, r := range version {
+		switch {
+		case r == '.' || r == '-' || r == '_' || r == '+':
+			flush()
+		case len(part) > 0 && isDigit(part[len(part)-1]) != isDigit(r):
+			flush()
+			part = append(part, r)
+		default:
+			part = append(part, r)
+		}
+	}
+
+	flush()
+
+	return parts
+}
+
+func compareParts(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := comparePart(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+
+	// Whatever is left over decides, a number makes it higher and a word is
+	// ranked against a number so 1.0-dev < 1.0 < 1.0-patch1
+	switch {
+	case len(a) > len(b):
+		return compareRemainder(a[len(b)])
+	case len(b) > len(a):
+		return -compareRemainder(b[len(a)])
+	}
+
+	return 0
+}
+
+func compareRemainder(part string) int {
+	if isDigit(rune(part[0])) {
+		return 1
+	}
+
+	return comparePart(part, "#")
+}
+
+func comparePart(a, b string) int {
+	aNumber, bNumber := isDigit(rune(a[0])), isDigit(rune(b[0]))
+
+	switch {
+	case aNumber && bNumber:
+		aInt, _ := strconv.ParseInt(a, 10, 64)
+		bInt, _ := strconv.ParseInt(b, 10, 64)
+
+		return compareInts(aInt, bInt)
+	case aNumber:
+		a = "#"
+	case bNumber:
+		b = "#"
+	}
+
+	return compareInts(specialFormOrder(a), specialFormOrder(b))
+}
+
+// specialFormOrder matches on prefixes like version_compare does, so patch
+// is p
+func specialFormOrder(part string) int64 {
+	for _, special := range specialForms {
+		if strings.HasPrefix(part, special.form) {
+			return int64(special.order)
+		}
+	}
+
+	return -1
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func compareInts(a, b int64) int {
+	if a < b {
+		return -1
+	}
+
+	if a > b {
+		return 1
+	}
+
+	return 0
+}
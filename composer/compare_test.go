@@ -0,0 +1,116 @@
+package composer_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	// Lowest first, as Composer orders them
+	ordered := []string{
+		"1.0.0-dev",
+		"1.0.0-alpha1",
+		"1.0.0-alpha2.1",
+		"1.0.0-beta1",
+		"1.0.0-beta2-dev",
+		"1.0.0-beta2",
+		"1.0.0-beta10",
+		"1.0.0-RC1-dev",
+		"1.0.0-rc1",
+		"1.0.0-RC2",
+		"1.0.0",
+		"1.0.0-patch1",
+		"1.0.0-pl2",
+		"1.0.1",
+		"1.2",
+		"1.10.0",
+		"1.x-dev",
+		"2.0.0",
+		"2010.01.02",
+		"dev-master",
+	}
+
+	for i := range ordered {
+		for j := range ordered {
+			expected := 0
+
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+
+			if actual, err := composer.CompareVersions(ordered[i], ordered[j]); actual != expected || err != nil {
+				t.Errorf("[!] CompareVersions(%s, %s) = %d, %v; want %d", ordered[i], ordered[j], actual, err, expected)
+			}
+		}
+	}
+
+	// [][]interface{}{a, b, expected}
+	equal := [][]interface{}{
+		{"v1.2", "1.2.0.0", 0},
+		{"1.0.0-b1", "1.0.0-beta1", 0},
+		{"1.0.0+build5", "1.0.0", 0},
+		{"dev-feature", "dev-feature", 0},
+	}
+
+	for _, test := range equal {
+		if actual, err := composer.CompareVersions(test[0].(string), test[1].(string)); actual != test[2] || err != nil {
+			t.Errorf("[!] CompareVersions(%s, %s) = %d, %v; want %d", test[0], test[1], actual, err, test[2])
+		}
+	}
+
+	for _, pair := range [][]string{{"dev-feature", "1.0.0"}, {"2.0.0", "dev-feature"}, {"dev-a", "dev-b"}, {"not a version", "1.0.0"}} {
+		if _, err := composer.CompareVersions(pair[0], pair[1]); err == nil {
+			t.Errorf("[!] CompareVersions(%s, %s) = nil error; want an error", pair[0], pair[1])
+		}
+	}
+}
+
+func TestStripPrerelease(t *testing.T) {
+	versions := map[string]string{
+		"2.0.0.0-beta1":                 "2.0.0.0",
+		"2.0.0.0-RC2":                   "2.0.0.0",
+		"2.0.0.0-alpha1.2":              "2.0.0.0",
+		"2.0.0.0":                       "2.0.0.0",
+		"2.0.0.0-patch1":                "2.0.0.0-patch1",
+		"2.0.0.0-beta1-dev":             "2.0.0.0-beta1-dev",
+		"dev-beta":                      "dev-beta",
+		"2.9999999.9999999.9999999-dev": "2.9999999.9999999.9999999-dev",
+	}
+
+	for version, stripped := range versions {
+		if composer.StripPrerelease(version) != stripped {
+			t.Errorf("[!] StripPrerelease(%s) = %s; want %s", version, composer.StripPrerelease(version), stripped)
+		}
+	}
+}
+
+func TestIsStable(t *testing.T) {
+	versions := map[string]bool{
+		"1.2.0":          true,
+		"v1.2":           true,
+		"1.2.0.0":        true,
+		"1.2.0-patch1":   true,
+		"1.2.0-pl1":      true,
+		"1.2.0+build5":   true,
+		"1.2.0-RC1":      false,
+		"1.2.0-rc1":      false,
+		"1.2.0-beta1":    false,
+		"1.2.0b2":        false,
+		"1.2.0-alpha.1":  false,
+		"1.2.0-dev":      false,
+		"1.2.0-RC1-dev":  false,
+		"1.x-dev":        false,
+		"9999999-dev":    false,
+		"dev-master":     false,
+		"dev-feature":    false,
+		"dev-master#abc": false,
+	}
+
+	for version, stable := range versions {
+		if composer.IsStable(version) != stable {
+			t.Errorf("[!] IsStable(%s) = %v; want %v", version, !stable, stable)
+		}
+	}
+}
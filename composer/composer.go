@@ -1,9 +1,15 @@
 package composer
 
 import (
+	"archive/zip"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
@@ -17,6 +23,28 @@ type Source struct {
 	Reference string `json:"reference"`
 }
 
+// Mutation holds the changes made to a composer.json before it is archived
+type Mutation struct {
+	// Replaces the package name when set, for names given a default vendor
+	Name              string
+	Version           string
+	NormalizedVersion string
+	Source            *Source
+	// Cloudsmith takes the package description from composer.json, so this
+	// replaces it when set and leaves the original alone otherwise.
+	Description string
+	// Packages this one replaces, merged into any replace it already has
+	Replace map[string]string
+	// The file the manifest is read from, composer.json when empty
+	Manifest string
+	// Requires pointed at other packages or constraints
+	RequireRewrites []RequireRewrite
+	// Written to extra when set, for tracing the package back to its build
+	Provenance *Provenance
+	// Applied in order after everything else has been set
+	Transforms []Transform
+}
+
 func DeriveVersion(tagOrBranchName string, isBranch bool) (version string, normalizedVersion string, error error) {
 	version = tagOrBranchName
 
@@ -53,42 +81,378 @@ func DeriveVersion(tagOrBranchName string, isBranch bool) (version string, norma
 	return
 }
 
-func LoadFile(path string) (file ComposerFile, error error) {
-	rawComposerFile, err := ioutil.ReadFile(path + "/composer.json")
+// VersionFromComposer returns the version committed to a composer.json
+// verbatim, for repositories that bump it rather than tagging, along with its
+// normalised form. It's an error when there isn't one or it can't be
+// normalised.
+func VersionFromComposer(data ComposerFile) (version string, normalizedVersion string, error error) {
+	version, _ = data["version"].(string)
+
+	if version == "" {
+		return "", "", errors.New("composer.json has no version")
+	}
+
+	normalizedVersion, err := NormaliseVersion(version, "")
+
+	if err != nil {
+		return "", "", err
+	}
+
+	return version, normalizedVersion, nil
+}
+
+// DefaultManifest is the file a package's manifest is read from, unless its
+// repository names another
+const DefaultManifest = "composer.json"
+
+// LoadFile reads the composer.json in path. Files in a checkout registered
+// with CheckedOut are only parsed once per commit.
+func LoadFile(path string) (ComposerFile, error) {
+	return LoadManifest(path, DefaultManifest)
+}
+
+// LoadManifest reads the package manifest in path from the file manifest,
+// for packages whose composer.json is generated from a committed template or
+// kept under another name. It's read like a composer.json and has to be
+// shaped like one, the mutated copy is always written to composer.json.
+func LoadManifest(path, manifest string) (ComposerFile, error) {
+	if manifest == "" {
+		manifest = DefaultManifest
+	}
+
+	manifestPath := filepath.Join(path, manifest)
+
+	if cached, ok := cache.get(manifestPath); ok {
+		return cached, nil
+	}
+
+	rawComposerFile, err := ioutil.ReadFile(manifestPath)
+
+	if os.IsNotExist(err) {
+		return nil, missingManifestError{manifest}
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	error = json.Unmarshal(rawComposerFile, &file)
+	file, err := ParseManifest(rawComposerFile)
 
-	return
+	if err != nil {
+		return nil, errors.New(manifest + " " + err.Error())
+	}
+
+	cache.put(manifestPath, file)
+
+	return file, nil
+}
+
+var (
+	utf8ByteOrderMark     = []byte{0xef, 0xbb, 0xbf}
+	utf16BigEndianMark    = []byte{0xfe, 0xff}
+	utf16LittleEndianMark = []byte{0xff, 0xfe}
+)
+
+// ParseManifest parses the contents of a package manifest. Editors on Windows
+// like to start files with a byte order mark, which isn't valid json and is
+// dropped, CRLF line endings are fine as they are. Errors say where in the
+// file it stops being json.
+func ParseManifest(contents []byte) (ComposerFile, error) {
+	if bytes.HasPrefix(contents, utf16BigEndianMark) || bytes.HasPrefix(contents, utf16LittleEndianMark) {
+		return nil, errors.New("is UTF-16 encoded, it has to be saved as UTF-8")
+	}
+
+	contents = bytes.TrimPrefix(contents, utf8ByteOrderMark)
+
+	var file ComposerFile
+
+	if err := json.Unmarshal(contents, &file); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			// The offset is just past the character it choked on
+			line, column := position(contents, syntaxErr.Offset-1)
+
+			return nil, fmt.Errorf("isn't valid json, line %d column %d: %v", line, column, err)
+		}
+
+		return nil, errors.New("isn't valid json: " + err.Error())
+	}
+
+	if err := validateManifest(file); err != nil {
+		return nil, errors.New("isn't a composer manifest: " + err.Error())
+	}
+
+	return file, nil
+}
+
+// position is the line and column, counting from one, of the byte at offset
+func position(contents []byte, offset int64) (int, int) {
+	if offset > int64(len(contents)) {
+		offset = int64(len(contents))
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	before := contents[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+
+	return line, column
+}
+
+// missingManifestError is returned by LoadManifest when the checkout doesn't
+// have the manifest, which checking out again won't fix
+type missingManifestError struct {
+	manifest string
+}
+
+func (err missingManifestError) Error() string {
+	return err.manifest + " doesn't exist in the checkout"
+}
+
+// IsMissingManifest is whether err is from loading a manifest that doesn't
+// exist
+func IsMissingManifest(err error) bool {
+	_, ok := err.(missingManifestError)
+
+	return ok
+}
+
+// validateManifest checks the fields everything else relies on the shape of,
+// an empty object is often written as []
+func validateManifest(data ComposerFile) error {
+	if name, ok := data["name"]; ok {
+		if _, ok := name.(string); !ok {
+			return errors.New("name must be a string")
+		}
+	}
+
+	for _, field := range []string{"require", "require-dev", "replace", "autoload", "extra"} {
+		switch value := data[field].(type) {
+		case nil, map[string]interface{}:
+		case []interface{}:
+			if len(value) > 0 {
+				return errors.New(field + " must be an object")
+			}
+		default:
+			return errors.New(field + " must be an object")
+		}
+	}
+
+	return nil
+}
+
+// IsFieldEmpty is whether the top level field is missing from data, or set
+// to null, an empty string, list or object.
+func IsFieldEmpty(data ComposerFile, field string) bool {
+	switch value := data[field].(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(value) == ""
+	case []interface{}:
+		return len(value) == 0
+	case map[string]interface{}:
+		return len(value) == 0
+	}
+
+	return false
+}
+
+// LoadFileFromArchive reads the composer.json at the root of a package
+// archive, as built by git.CreateArtifactFromRepository.
+func LoadFileFromArchive(archivePath string) (ComposerFile, error) {
+	archive, err := zip.OpenReader(archivePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		if file.Name != "composer.json" {
+			continue
+		}
+
+		reader, err := file.Open()
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer reader.Close()
+
+		var data ComposerFile
+
+		err = json.NewDecoder(reader).Decode(&data)
+
+		return data, err
+	}
+
+	return nil, errors.New(archivePath + " doesn't have a composer.json")
 }
 
-func MutateComposerFile(path, version, normalizedVersion string, source *Source) error {
-	data, err := LoadFile(path)
+// RenameArchive copies the package archive at archivePath to target with the
+// package in its composer.json renamed, everything else is left as it is.
+func RenameArchive(archivePath, target, name string) error {
+	archive, err := zip.OpenReader(archivePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer archive.Close()
+
+	out, err := os.Create(target)
 
 	if err != nil {
 		return err
 	}
 
-	data["version"] = version
-	data["version_normalized"] = normalizedVersion
+	defer out.Close()
+
+	writer := zip.NewWriter(out)
+	renamed := false
+
+	for _, file := range archive.File {
+		header := &zip.FileHeader{Name: file.Name, Method: file.Method}
+		header.SetModTime(file.ModTime())
+		header.SetMode(file.Mode())
+
+		entry, err := writer.CreateHeader(header)
+
+		if err != nil {
+			return err
+		}
+
+		reader, err := file.Open()
+
+		if err != nil {
+			return err
+		}
+
+		if file.Name == "composer.json" {
+			err = renameComposerJson(reader, entry, name)
+			renamed = true
+		} else {
+			_, err = io.Copy(entry, reader)
+		}
+
+		reader.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if !renamed {
+		return errors.New(archivePath + " doesn't have a composer.json")
+	}
+
+	return writer.Close()
+}
+
+func renameComposerJson(in io.Reader, out io.Writer, name string) error {
+	var data ComposerFile
+
+	if err := json.NewDecoder(in).Decode(&data); err != nil {
+		return err
+	}
+
+	data["name"] = name
 
-	if source != nil {
-		data["source"] = source
+	return encode(out, data)
+}
+
+// MutateComposerFile applies the mutation to the package manifest in path,
+// writing the result to its composer.json
+func MutateComposerFile(path string, mutation Mutation) error {
+	data, err := LoadManifest(path, mutation.Manifest)
+
+	if err != nil {
+		return err
 	}
 
-	// Truncate on open, and in write mode only
-	file, err := os.OpenFile(path+"/composer.json", os.O_TRUNC|os.O_WRONLY, 0644)
+	if err := mutation.Apply(data); err != nil {
+		return err
+	}
+
+	Modified(path)
+
+	// Truncate on open, and in write mode only. It won't exist yet when the
+	// manifest is a template
+	file, err := os.OpenFile(path+"/composer.json", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	return encode(file, data)
+}
+
+// Apply makes the mutation's changes to data in place.
+func (mutation Mutation) Apply(data ComposerFile) error {
+	if mutation.Name != "" {
+		data["name"] = mutation.Name
+	}
+
+	data["version"] = mutation.Version
+	data["version_normalized"] = mutation.NormalizedVersion
+
+	if mutation.Source != nil {
+		data["source"] = mutation.Source
+	}
+
+	if mutation.Description != "" {
+		data["description"] = mutation.Description
+	}
+
+	ApplyReplace(data, mutation.Replace)
+
+	if err := ApplyRequireRewrites(data, mutation.RequireRewrites); err != nil {
+		return err
+	}
+
+	ApplyProvenance(data, mutation.Provenance)
+
+	return ApplyTransforms(data, mutation.Transforms)
+}
+
+// DiffMutation returns a unified diff of what MutateComposerFile would do to
+// the composer.json in path, without changing it. Both sides are written out
+// the same way so the diff only shows real changes, not formatting.
+func DiffMutation(path string, mutation Mutation) (string, error) {
+	data, err := LoadManifest(path, mutation.Manifest)
+
+	if err != nil {
+		return "", err
+	}
+
+	var original bytes.Buffer
+
+	if err := encode(&original, data); err != nil {
+		return "", err
+	}
+
+	if err := mutation.Apply(data); err != nil {
+		return "", err
+	}
+
+	var mutated bytes.Buffer
+
+	if err := encode(&mutated, data); err != nil {
+		return "", err
+	}
+
+	return UnifiedDiff(path+"/composer.json", original.String(), mutated.String()), nil
+}
+
+func encode(out io.Writer, data ComposerFile) error {
 	// Required to prevent goland from escaping "<", ">", and "&".
-	enc := json.NewEncoder(file)
+	enc := json.NewEncoder(out)
 	enc.SetEscapeHTML(false)
 	enc.SetIndent("", "    ")
 
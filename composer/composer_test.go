@@ -2,6 +2,10 @@ package composer_test
 
 import (
 	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -40,3 +44,87 @@ func TestDeriveVersion(t *testing.T) {
 		}
 	}
 }
+
+// Webhooks derived versions from the full ref until they were given the
+// short name like the sync command.
+// [][]string{ref, short name, version from the ref, version from the name}
+var refVersionChanges = [][]string{
+	{"refs/heads/master", "master", "dev-refs/heads/master", "dev-master"},
+	{"refs/heads/1.x", "1.x", "dev-refs/heads/1.x", "1.x-dev"},
+	{"refs/heads/feature/foo", "feature/foo", "dev-refs/heads/feature/foo", "dev-feature/foo"},
+	{"refs/tags/v1.2.0", "v1.2.0", "", "v1.2.0"},
+	{"refs/tags/release-2.0.0", "release-2.0.0", "", "2.0.0"},
+}
+
+func TestDeriveVersionFromShortRefName(t *testing.T) {
+	for _, test := range refVersionChanges {
+		isBranch := strings.HasPrefix(test[0], "refs/heads/")
+
+		// Full refs aren't valid tag versions, tag pushes were skipped
+		if version, _, _ := composer.DeriveVersion(test[0], isBranch); version != test[2] {
+			t.Errorf("[!] DeriveVersion(%s, %v) = %v; want %v", test[0], isBranch, version, test[2])
+		}
+
+		if version, _, err := composer.DeriveVersion(test[1], isBranch); version != test[3] || err != nil {
+			t.Errorf("[!] DeriveVersion(%s, %v) = %v, %v; want %v", test[1], isBranch, version, err, test[3])
+		}
+	}
+}
+
+func TestLoadManifestFromAnotherFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	template := filepath.Join(dir, "composer.template.json")
+
+	if err := ioutil.WriteFile(template, []byte(`{"name": "acme/widgets", "require": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := composer.LoadFile(dir); !composer.IsMissingManifest(err) {
+		t.Errorf("[!] LoadFile() without a composer.json = %v; want a missing manifest", err)
+	}
+
+	mutation := composer.Mutation{Version: "1.0.0", NormalizedVersion: "1.0.0.0", Manifest: "composer.template.json"}
+
+	if err := composer.MutateComposerFile(dir, mutation); err != nil {
+		t.Fatalf("[!] MutateComposerFile(composer.template.json) = %v", err)
+	}
+
+	if data, err := composer.LoadFile(dir); err != nil || data["name"] != "acme/widgets" || data["version"] != "1.0.0" {
+		t.Errorf("[!] LoadFile() once mutated = %v, %v; want acme/widgets at 1.0.0 from the template", data, err)
+	}
+
+	if err := ioutil.WriteFile(template, []byte(`{"name": "acme/widgets", "require": "acme/gadgets"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := composer.LoadManifest(dir, "composer.template.json"); err == nil {
+		t.Errorf("[!] LoadManifest() with a string require = nil; want it refused as not a composer manifest")
+	}
+}
+
+func TestLoadFileWithByteOrderMark(t *testing.T) {
+	data, err := composer.LoadFile(filepath.Join("testdata", "bom"))
+
+	if err != nil || data["name"] != "acme/widgets" || data["description"] != "Written on Windows" {
+		t.Errorf("[!] LoadFile(bom) = %v, %v; want acme/widgets", data, err)
+	}
+
+	// [][]interface{}{contents, expected error}
+	invalid := [][]interface{}{
+		{"{\r\n  \"name\": \"acme/widgets\",\r\n}", "isn't valid json, line 3 column 1: invalid character '}' looking for beginning of object key string"},
+		{"\xff\xfe{\x00}\x00", "is UTF-16 encoded, it has to be saved as UTF-8"},
+	}
+
+	for _, test := range invalid {
+		if _, err := composer.ParseManifest([]byte(test[0].(string))); err == nil || err.Error() != test[1] {
+			t.Errorf("[!] ParseManifest(%q) = %v; want %s", test[0], err, test[1])
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package composer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How many unchanged lines are shown either side of a change
+const diffContext = 3
+
+// UnifiedDiff compares two texts line by line and returns the differences in
+// unified diff format, or an empty string when they're the same.
+func UnifiedDiff(name, a, b string) string {
+	if a == b {
+		return ""
+	}
+
+	aLines := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	bLines := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+
+	// Longest common subsequence lengths of every pair of suffixes
+	lcs := make([][]int, len(aLines)+1)
+
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			if aLines[i] == bLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type edit struct {
+		op   byte
+		line string
+		a, b int
+	}
+
+	var edits []edit
+
+	i, j := 0, 0
+
+	for i < len(aLines) || j < len(bLines) {
+		switch {
+		case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+			edits = append(edits, edit{' ', aLines[i], i, j})
+			i++
+			j++
+		case i < len(aLines) && (j == len(bLines) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', aLines[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', bLines[j], i, j})
+			j++
+		}
+	}
+
+	var out strings.Builder
+
+	fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", name, name)
+
+	for start := 0; start < len(edits); {
+		if edits[start].op == ' ' {
+			start++
+			continue
+		}
+
+		// Grow the hunk until there's more unchanged context than can be
+		// shown between two changes
+		first := start - diffContext
+
+		if first < 0 {
+			first = 0
+		}
+
+		last := start
+
+		for k := start; k < len(edits) && k-last <= 2*diffContext; k++ {
+			if edits[k].op != ' ' {
+				last = k
+			}
+		}
+
+		end := last + diffContext + 1
+
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		aCount, bCount := 0, 0
+
+		for _, e := range edits[first:end] {
+			if e.op != '+' {
+				aCount++
+			}
+
+			if e.op != '-' {
+				bCount++
+			}
+		}
+
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", edits[first].a+1, aCount, edits[first].b+1, bCount)
+
+		for _, e := range edits[first:end] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			out.WriteByte('\n')
+		}
+
+		start = end
+	}
+
+	return out.String()
+}
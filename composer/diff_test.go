@@ -0,0 +1,28 @@
+package composer_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "{\n    \"name\": \"acme/widgets\",\n    \"type\": \"library\"\n}\n"
+	b := "{\n    \"name\": \"acme/widgets\",\n    \"type\": \"library\",\n    \"version\": \"1.2.0\"\n}\n"
+
+	expected := "--- a/composer.json\n+++ b/composer.json\n" +
+		"@@ -1,4 +1,5 @@\n" +
+		" {\n" +
+		"     \"name\": \"acme/widgets\",\n" +
+		"-    \"type\": \"library\"\n" +
+		"+    \"type\": \"library\",\n" +
+		"+    \"version\": \"1.2.0\"\n" +
+		" }\n"
+
+	if actual := composer.UnifiedDiff("composer.json", a, b); actual != expected {
+		t.Errorf("[!] UnifiedDiff() =\n%s\nwant\n%s", actual, expected)
+	}
+
+	if actual := composer.UnifiedDiff("composer.json", a, a); actual != "" {
+		t.Errorf("[!] UnifiedDiff() of identical text = %q; want nothing", actual)
+	}
+}
@@ -0,0 +1,42 @@
+package composer
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrNoVendor is returned for package names without a vendor when there's no
+// default vendor to add
+var ErrNoVendor = errors.New("package name must be vendor/name")
+
+// ResolvePackageName returns the package name from a composer.json. Composer
+// once allowed names without a vendor, those get defaultVendor added when
+// it's set and are refused otherwise.
+func ResolvePackageName(data ComposerFile, defaultVendor string) (string, error) {
+	name, _ := data["name"].(string)
+
+	if name == "" {
+		return "", errors.New("composer.json has no package name")
+	}
+
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+
+	if defaultVendor == "" {
+		return "", ErrNoVendor
+	}
+
+	return defaultVendor + "/" + name, nil
+}
+
+// SplitPackageName splits a resolved vendor/name package name into its parts
+func SplitPackageName(name string) (vendor, project string) {
+	parts := strings.SplitN(name, "/", 2)
+
+	if len(parts) < 2 {
+		return "", name
+	}
+
+	return parts[0], parts[1]
+}
@@ -0,0 +1,47 @@
+package composer_test
+
+import (
+	. "github.com/Lavoaster/cloudsmith-sync/composer"
+	"testing"
+)
+
+// [][]interface{}{composer.json name, default vendor, expected name, expected error}
+var packageNameTests = [][]interface{}{
+	{"acme/widgets", "", "acme/widgets", false},
+	{"acme/widgets", "internal", "acme/widgets", false},
+	{"widgets", "internal", "internal/widgets", false},
+	{"widgets", "", "", true},
+	{"", "internal", "", true},
+	{nil, "internal", "", true},
+}
+
+func TestResolvePackageName(t *testing.T) {
+	for _, test := range packageNameTests {
+		data := ComposerFile{}
+
+		if test[0] != nil {
+			data["name"] = test[0]
+		}
+
+		actual, err := ResolvePackageName(data, test[1].(string))
+
+		if actual != test[2] || (err != nil) != test[3] {
+			t.Errorf("[!] ResolvePackageName(%v, %q) = %q, %v; want %q, error %v", test[0], test[1], actual, err, test[2], test[3])
+		}
+	}
+}
+
+func TestSplitPackageName(t *testing.T) {
+	vendor, project := SplitPackageName("acme/widgets")
+
+	if vendor != "acme" || project != "widgets" {
+		t.Errorf("[!] SplitPackageName(acme/widgets) = %s, %s; want acme, widgets", vendor, project)
+	}
+
+	// Shouldn't panic on names that weren't resolved first
+	vendor, project = SplitPackageName("widgets")
+
+	if vendor != "" || project != "widgets" {
+		t.Errorf("[!] SplitPackageName(widgets) = %s, %s; want \"\", widgets", vendor, project)
+	}
+}
@@ -0,0 +1,74 @@
+package composer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// Provenance records how a package was built, so an installed package can be
+// traced back to the commit and the delivery that published it.
+type Provenance struct {
+	// The key within extra it's written under, nothing is written when empty
+	Key        string
+	Commit     string
+	BuiltAt    time.Time
+	Tool       string
+	DeliveryID string
+}
+
+// ApplyProvenance writes provenance to extra under its key, replacing
+// whatever the package had there. The rest of extra is left alone.
+func ApplyProvenance(data ComposerFile, provenance *Provenance) {
+	if provenance == nil || provenance.Key == "" {
+		return
+	}
+
+	// An empty extra is often written as [] rather than {}
+	extra, ok := data["extra"].(map[string]interface{})
+
+	if !ok {
+		extra = map[string]interface{}{}
+	}
+
+	block := map[string]interface{}{
+		"commit":  provenance.Commit,
+		"builtAt": provenance.BuiltAt.UTC().Format(time.RFC3339),
+		"tool":    provenance.Tool,
+	}
+
+	// Publishes from the command line don't have a delivery
+	if provenance.DeliveryID != "" {
+		block["deliveryId"] = provenance.DeliveryID
+	}
+
+	extra[provenance.Key] = block
+	data["extra"] = extra
+}
+
+// Metadata is a small json document about a newly published version, so
+// tooling can find the latest build without going through Cloudsmith's
+// package API. It carries the same details as the provenance.
+type Metadata struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	// The branch or tag it was published from
+	Ref    string `json:"ref"`
+	Commit string `json:"commit"`
+	// Owner/repository on Cloudsmith the package is in
+	Repository  string    `json:"repository"`
+	PublishedAt time.Time `json:"publishedAt"`
+	Tool        string    `json:"tool"`
+	DeliveryID  string    `json:"deliveryId,omitempty"`
+}
+
+// WriteMetadata writes metadata to path as indented json
+func WriteMetadata(path string, metadata Metadata) error {
+	contents, err := json.MarshalIndent(metadata, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(contents, '\n'), 0644)
+}
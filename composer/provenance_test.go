@@ -0,0 +1,44 @@
+package composer_test
+
+import (
+	"encoding/json"
+	. "github.com/Lavoaster/cloudsmith-sync/composer"
+	"testing"
+	"time"
+)
+
+// [][]interface{}{name, manifest, expected extra json}
+var provenanceTests = [][]interface{}{
+	{"no extra", `{"name": "acme/widgets"}`, `{"cloudsmith-sync":{"builtAt":"2020-01-02T03:04:05Z","commit":"abc123","deliveryId":"d-1","tool":"cloudsmith-sync/1.2.0"}}`},
+	{"empty list", `{"name": "acme/widgets", "extra": []}`, `{"cloudsmith-sync":{"builtAt":"2020-01-02T03:04:05Z","commit":"abc123","deliveryId":"d-1","tool":"cloudsmith-sync/1.2.0"}}`},
+	{"merged", `{"name": "acme/widgets", "extra": {"branch-alias": {"dev-master": "1.x-dev"}}}`, `{"branch-alias":{"dev-master":"1.x-dev"},"cloudsmith-sync":{"builtAt":"2020-01-02T03:04:05Z","commit":"abc123","deliveryId":"d-1","tool":"cloudsmith-sync/1.2.0"}}`},
+}
+
+func TestApplyProvenance(t *testing.T) {
+	provenance := &Provenance{
+		Key:        "cloudsmith-sync",
+		Commit:     "abc123",
+		BuiltAt:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Tool:       "cloudsmith-sync/1.2.0",
+		DeliveryID: "d-1",
+	}
+
+	for _, test := range provenanceTests {
+		var data ComposerFile
+		json.Unmarshal([]byte(test[1].(string)), &data)
+
+		ApplyProvenance(data, provenance)
+		actual, _ := json.Marshal(data["extra"])
+
+		if string(actual) != test[2] {
+			t.Errorf("[!] ApplyProvenance(%s) = %s; want %s", test[0], actual, test[2])
+		}
+	}
+
+	data := ComposerFile{"name": "acme/widgets"}
+	ApplyProvenance(data, &Provenance{Commit: "abc123"})
+
+	if _, ok := data["extra"]; ok {
+		t.Errorf("[!] ApplyProvenance() without a key = %v; want extra left alone", data["extra"])
+	}
+}
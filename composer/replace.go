@@ -0,0 +1,35 @@
+package composer
+
+import "regexp"
+
+// The package name format Composer itself accepts
+var packageNamePattern = regexp.MustCompile(`^[a-z0-9]([_.-]?[a-z0-9]+)*/[a-z0-9](([_.]?|-{0,2})[a-z0-9]+)*$`)
+
+// IsValidPackageName is whether name is a vendor/package name Composer would
+// accept.
+func IsValidPackageName(name string) bool {
+	return packageNamePattern.MatchString(name)
+}
+
+// ApplyReplace adds replace to the composer.json's own replace entries, so a
+// fork can stand in for the upstream package. Entries in replace win over
+// existing ones for the same package.
+func ApplyReplace(data ComposerFile, replace map[string]string) {
+	if len(replace) == 0 {
+		return
+	}
+
+	// An empty replace is often written as [] rather than {}
+	existing, _ := data["replace"].(map[string]interface{})
+	merged := map[string]interface{}{}
+
+	for name, constraint := range existing {
+		merged[name] = constraint
+	}
+
+	for name, constraint := range replace {
+		merged[name] = constraint
+	}
+
+	data["replace"] = merged
+}
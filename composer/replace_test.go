@@ -0,0 +1,49 @@
+package composer_test
+
+import (
+	"encoding/json"
+	. "github.com/Lavoaster/cloudsmith-sync/composer"
+	"testing"
+)
+
+// [][]interface{}{name, manifest, expected replace json}
+var replaceTests = [][]interface{}{
+	{"no replace", `{"name": "acme/guzzle"}`, `{"guzzlehttp/guzzle":"self.version"}`},
+	{"empty list", `{"name": "acme/guzzle", "replace": []}`, `{"guzzlehttp/guzzle":"self.version"}`},
+	{"merged", `{"name": "acme/guzzle", "replace": {"acme/http": "*"}}`, `{"acme/http":"*","guzzlehttp/guzzle":"self.version"}`},
+	{"overridden", `{"name": "acme/guzzle", "replace": {"guzzlehttp/guzzle": "^6.0"}}`, `{"guzzlehttp/guzzle":"self.version"}`},
+}
+
+func TestApplyReplace(t *testing.T) {
+	for _, test := range replaceTests {
+		var data ComposerFile
+		json.Unmarshal([]byte(test[1].(string)), &data)
+
+		ApplyReplace(data, map[string]string{"guzzlehttp/guzzle": "self.version"})
+		actual, _ := json.Marshal(data["replace"])
+
+		if string(actual) != test[2] {
+			t.Errorf("[!] ApplyReplace(%s) = %s; want %s", test[0], actual, test[2])
+		}
+	}
+}
+
+var packageNames = map[string]bool{
+	"guzzlehttp/guzzle":    true,
+	"acme/widget-tools":    true,
+	"acme/widget--tools":   true,
+	"acme.co/widget_tools": true,
+	"Acme/Widgets":         false,
+	"guzzle":               false,
+	"acme/widgets/extra":   false,
+	"acme/-widgets":        false,
+	"":                     false,
+}
+
+func TestIsValidPackageName(t *testing.T) {
+	for name, expected := range packageNames {
+		if actual := IsValidPackageName(name); actual != expected {
+			t.Errorf("[!] IsValidPackageName(%q) = %v; want %v", name, actual, expected)
+		}
+	}
+}
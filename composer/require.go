@@ -0,0 +1,138 @@
+package composer
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// RequireRewrite points a package's require on Package at another package,
+// like an internal fork, and/or another constraint. Either can be left empty
+// to keep what the package asked for.
+type RequireRewrite struct {
+	Package    string `json:"package"`
+	Name       string `json:"name,omitempty"`
+	Constraint string `json:"constraint,omitempty"`
+}
+
+var (
+	constraintOr        = regexp.MustCompile(`\s*\|\|?\s*`)
+	constraintAnd       = regexp.MustCompile(`\s*,\s*|\s+`)
+	constraintHyphen    = regexp.MustCompile(`^(\S+)\s+-\s+(\S+)$`)
+	constraintOperator  = regexp.MustCompile(`^(?:\^|~|>=?|<=?|!=|==?)\s*`)
+	constraintWildcard  = regexp.MustCompile(`^v?\d+(?:\.\d+){0,2}\.[*xX]$`)
+	constraintStability = regexp.MustCompile(`(?i)@(?:dev|alpha|beta|RC|stable)$`)
+	// Composer allows spaces between an operator and its version
+	constraintSpacedOperator = regexp.MustCompile(`([<>=!~^])\s+`)
+)
+
+// ApplyRequireRewrites rewrites the require entries with a rewrite, others
+// are left alone. The constraint each rewritten entry ends up with has to be
+// one Composer can parse.
+func ApplyRequireRewrites(data ComposerFile, rewrites []RequireRewrite) error {
+	if len(rewrites) == 0 {
+		return nil
+	}
+
+	// An empty require is often written as [] rather than {}
+	require, ok := data["require"].(map[string]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	for _, rewrite := range rewrites {
+		value, exists := require[rewrite.Package]
+
+		if !exists {
+			continue
+		}
+
+		constraint, _ := value.(string)
+
+		if rewrite.Constraint != "" {
+			constraint = rewrite.Constraint
+		}
+
+		if err := ValidateConstraint(constraint); err != nil {
+			return errors.New("require " + rewrite.Package + ": " + err.Error())
+		}
+
+		name := rewrite.Package
+
+		if rewrite.Name != "" {
+			name = rewrite.Name
+			delete(require, rewrite.Package)
+		}
+
+		require[name] = constraint
+	}
+
+	return nil
+}
+
+// ValidateConstraint checks a version constraint, like ^1.2 || ~2.0@beta,
+// is one Composer would be able to parse.
+func ValidateConstraint(constraint string) error {
+	if strings.TrimSpace(constraint) == "" {
+		return errors.New("empty constraint")
+	}
+
+	constraint = constraintSpacedOperator.ReplaceAllString(strings.TrimSpace(constraint), "$1")
+
+	for _, alternative := range constraintOr.Split(constraint, -1) {
+		if r := constraintHyphen.FindStringSubmatch(alternative); r != nil {
+			if err := validateConstraintVersion(r[1]); err != nil {
+				return err
+			}
+
+			if err := validateConstraintVersion(r[2]); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		for _, part := range constraintAnd.Split(alternative, -1) {
+			if err := validateConstraintPart(part); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateConstraintPart(part string) error {
+	if part == "" {
+		return errors.New("invalid constraint, an empty part")
+	}
+
+	// A reference pinned to a branch, like dev-master#abc123
+	if i := strings.Index(part, "#"); i > 0 {
+		part = part[:i]
+	}
+
+	part = constraintStability.ReplaceAllString(part, "")
+
+	if part == "" || part == "*" || part == "self.version" {
+		return nil
+	}
+
+	operator := constraintOperator.FindString(part)
+	version := strings.TrimPrefix(part, operator)
+
+	if operator == "" && constraintWildcard.MatchString(version) {
+		return nil
+	}
+
+	return validateConstraintVersion(version)
+}
+
+func validateConstraintVersion(version string) error {
+	if _, err := NormaliseVersion(version, ""); err != nil {
+		return errors.New("invalid constraint version \"" + version + "\"")
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package composer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/Lavoaster/cloudsmith-sync/composer"
+	"strings"
+	"testing"
+)
+
+var requireRewrites = []RequireRewrite{
+	{Package: "monolog/monolog", Name: "acme/monolog", Constraint: "^2.0"},
+	{Package: "guzzlehttp/guzzle", Name: "acme/guzzle"},
+	{Package: "symfony/console", Constraint: "~4.4 || ^5.0"},
+}
+
+// [][]interface{}{name, manifest, expected require json}
+var requireRewriteTests = [][]interface{}{
+	{"renamed", `{"require": {"monolog/monolog": "^1.0"}}`, `{"acme/monolog":"^2.0"}`},
+	{"renamed keeping constraint", `{"require": {"guzzlehttp/guzzle": "^6.3"}}`, `{"acme/guzzle":"^6.3"}`},
+	{"constraint only", `{"require": {"symfony/console": "^3.4"}}`, `{"symfony/console":"~4.4 || ^5.0"}`},
+	{"untouched", `{"require": {"php": ">=7.1", "psr/log": "^1.0"}}`, `{"php":">=7.1","psr/log":"^1.0"}`},
+	{"empty list", `{"require": []}`, `[]`},
+}
+
+func TestApplyRequireRewrites(t *testing.T) {
+	for _, test := range requireRewriteTests {
+		var data ComposerFile
+		json.Unmarshal([]byte(test[1].(string)), &data)
+
+		if err := ApplyRequireRewrites(data, requireRewrites); err != nil {
+			t.Errorf("[!] ApplyRequireRewrites(%s) = %v; want no error", test[0], err)
+			continue
+		}
+
+		// Encoded the way composer.json is written, without escaping ">"
+		var actual bytes.Buffer
+		enc := json.NewEncoder(&actual)
+		enc.SetEscapeHTML(false)
+		enc.Encode(data["require"])
+
+		if got := strings.TrimSpace(actual.String()); got != test[2] {
+			t.Errorf("[!] ApplyRequireRewrites(%s) = %s; want %s", test[0], got, test[2])
+		}
+	}
+}
+
+func TestApplyRequireRewritesRefusesInvalidConstraint(t *testing.T) {
+	var data ComposerFile
+	json.Unmarshal([]byte(`{"require": {"guzzlehttp/guzzle": "not a version"}}`), &data)
+
+	if err := ApplyRequireRewrites(data, requireRewrites); err == nil {
+		t.Errorf("[!] ApplyRequireRewrites() = nil; want the kept constraint to be refused")
+	}
+}
+
+var constraints = map[string]bool{
+	"^1.2":              true,
+	"~1.2.3":            true,
+	">=1.0 <2.0":        true,
+	">= 1.0, < 2.0":     true,
+	"1.0.*":             true,
+	"1.0 - 2.0":         true,
+	"^1.0 || ^2.0":      true,
+	"^1.0|^2.0":         true,
+	"dev-master":        true,
+	"dev-master#abc123": true,
+	"2.0.x-dev":         true,
+	"^2.0@beta":         true,
+	"@dev":              true,
+	"*":                 true,
+	"self.version":      true,
+	"":                  false,
+	"latest":            false,
+	"^one":              false,
+	"^1.0 || ":          false,
+	">=1.0 <banana":     false,
+}
+
+func TestValidateConstraint(t *testing.T) {
+	for constraint, valid := range constraints {
+		if err := ValidateConstraint(constraint); (err == nil) != valid {
+			t.Errorf("[!] ValidateConstraint(%q) = %v; want valid %v", constraint, err, valid)
+		}
+	}
+}
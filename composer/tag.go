@@ -0,0 +1,52 @@
+package composer
+
+import (
+	"regexp"
+	"strings"
+)
+
+// TagRule describes how to get from a repository's tag naming convention to
+// something that can be parsed as a version.
+type TagRule struct {
+	Prefixes []string
+	Suffixes []string
+	// Regex with a capture group around the version, e.g. ^release-(.+)$.
+	// The prefixes and suffixes are ignored when this is set
+	Pattern string
+}
+
+// Strip returns tag with the rule applied. Tags the rule doesn't match are
+// returned as is and are left for version normalisation to reject.
+func (rule TagRule) Strip(tag string) string {
+	if rule.Pattern != "" {
+		exp, err := regexp.Compile(rule.Pattern)
+
+		if err != nil {
+			return tag
+		}
+
+		matches := exp.FindStringSubmatch(tag)
+
+		if len(matches) < 2 {
+			return tag
+		}
+
+		return matches[1]
+	}
+
+	for _, prefix := range rule.Prefixes {
+		if strings.HasPrefix(tag, prefix) {
+			tag = strings.TrimPrefix(tag, prefix)
+			break
+		}
+	}
+
+	for _, suffix := range rule.Suffixes {
+		if strings.HasSuffix(tag, suffix) {
+			tag = strings.TrimSuffix(tag, suffix)
+			break
+		}
+	}
+
+	return tag
+}
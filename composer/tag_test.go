@@ -0,0 +1,48 @@
+package composer_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"testing"
+)
+
+var tagRuleTests = []struct {
+	rule     composer.TagRule
+	tag      string
+	expected string
+}{
+	{composer.TagRule{Prefixes: []string{"release-"}}, "release-1.2.0", "1.2.0"},
+	{composer.TagRule{Prefixes: []string{"release-"}}, "1.2.0", "1.2.0"},
+	{composer.TagRule{Prefixes: []string{"rel-", "release-"}}, "release-1.2.0", "1.2.0"},
+	{composer.TagRule{Suffixes: []string{"-acme"}}, "v1.2.0-acme", "v1.2.0"},
+	{composer.TagRule{Suffixes: []string{"-acme"}}, "v1.2.0-beta", "v1.2.0-beta"},
+	{composer.TagRule{Prefixes: []string{"release-"}, Suffixes: []string{"-acme"}}, "release-1.2.0-acme", "1.2.0"},
+	{composer.TagRule{Prefixes: []string{"release-"}, Suffixes: []string{"-acme"}}, "release-1.2.0", "1.2.0"},
+	{composer.TagRule{Pattern: `^build-(\d+\.\d+\.\d+)-.*$`}, "build-1.2.0-linux", "1.2.0"},
+	{composer.TagRule{Pattern: `^build-(\d+\.\d+\.\d+)-.*$`}, "1.2.0", "1.2.0"},
+	{composer.TagRule{Pattern: `^build-(\d+\.\d+\.\d+)$`, Prefixes: []string{"build-"}}, "build-1.2", "build-1.2"},
+}
+
+func TestTagRuleStrip(t *testing.T) {
+	for _, test := range tagRuleTests {
+		actual := test.rule.Strip(test.tag)
+
+		if actual != test.expected {
+			t.Errorf("[!] %+v.Strip(%s) = %v; want %v", test.rule, test.tag, actual, test.expected)
+		}
+	}
+}
+
+func TestTagRuleStripThenDeriveVersion(t *testing.T) {
+	rule := composer.TagRule{Prefixes: []string{"release-"}, Suffixes: []string{"-acme"}}
+
+	version, normalizedVersion, err := composer.DeriveVersion(rule.Strip("release-1.2.0-acme"), false)
+
+	if err != nil || version != "1.2.0" || normalizedVersion != "1.2.0.0" {
+		t.Errorf("[!] DeriveVersion(release-1.2.0-acme, false) = %v, %v, %v; want 1.2.0, 1.2.0.0, nil", version, normalizedVersion, err)
+	}
+
+	// Tags that are still not versions after stripping keep being skipped
+	if _, _, err := composer.DeriveVersion(rule.Strip("nightly-acme"), false); err == nil {
+		t.Errorf("[!] DeriveVersion(nightly, false) returned no error")
+	}
+}
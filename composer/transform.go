@@ -0,0 +1,126 @@
+package composer
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// TransformRemove deletes the key at Path
+	TransformRemove = "remove"
+	// TransformSet sets the key at Path to Value, creating any missing parents
+	TransformSet = "set"
+	// TransformReplaceRequire swaps the constraint for Package in require
+	TransformReplaceRequire = "replace-require"
+)
+
+// Transform is a change made to composer.json after the version and source
+// have been injected, for tidying up manifests before they are published.
+type Transform struct {
+	Action string `json:"action"`
+	// Dot separated path to a key, e.g. extra.branch-alias
+	Path    string      `json:"path,omitempty"`
+	Package string      `json:"package,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+}
+
+func ApplyTransforms(data ComposerFile, transforms []Transform) error {
+	for _, transform := range transforms {
+		var err error
+
+		switch transform.Action {
+		case TransformRemove:
+			err = removeKey(data, transform.Path)
+		case TransformSet:
+			err = setKey(data, transform.Path, transform.Value)
+		case TransformReplaceRequire:
+			err = replaceRequire(data, transform.Package, transform.Value)
+		default:
+			err = errors.New("unknown action")
+		}
+
+		if err != nil {
+			return errors.New("transform " + transform.Action + " " + transform.Path + transform.Package + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// walkToParent follows path to the map holding its last key. When create is
+// set missing maps along the way are added rather than being an error.
+func walkToParent(data map[string]interface{}, path string, create bool) (map[string]interface{}, string, error) {
+	keys := strings.Split(path, ".")
+	current := data
+
+	for _, key := range keys[:len(keys)-1] {
+		next, exists := current[key]
+
+		if !exists && create {
+			next = map[string]interface{}{}
+			current[key] = next
+		} else if !exists {
+			return nil, "", errors.New("\"" + key + "\" doesn't exist")
+		}
+
+		nextMap, ok := next.(map[string]interface{})
+
+		if !ok {
+			return nil, "", errors.New("\"" + key + "\" isn't an object")
+		}
+
+		current = nextMap
+	}
+
+	return current, keys[len(keys)-1], nil
+}
+
+func removeKey(data ComposerFile, path string) error {
+	parent, key, err := walkToParent(data, path, false)
+
+	if err != nil {
+		return err
+	}
+
+	if _, exists := parent[key]; !exists {
+		return errors.New("\"" + key + "\" doesn't exist")
+	}
+
+	delete(parent, key)
+
+	return nil
+}
+
+func setKey(data ComposerFile, path string, value interface{}) error {
+	parent, key, err := walkToParent(data, path, true)
+
+	if err != nil {
+		return err
+	}
+
+	parent[key] = value
+
+	return nil
+}
+
+func replaceRequire(data ComposerFile, pkg string, constraint interface{}) error {
+	require, ok := data["require"].(map[string]interface{})
+
+	if !ok {
+		return errors.New("there are no requirements")
+	}
+
+	if _, exists := require[pkg]; !exists {
+		return errors.New("\"" + pkg + "\" isn't required")
+	}
+
+	value, ok := constraint.(string)
+
+	if !ok || value == "" {
+		return errors.New("the constraint must be a string")
+	}
+
+	require[pkg] = value
+
+	return nil
+}
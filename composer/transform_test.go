@@ -0,0 +1,55 @@
+package composer_test
+
+import (
+	"encoding/json"
+	. "github.com/Lavoaster/cloudsmith-sync/composer"
+	"testing"
+)
+
+const transformManifest = `{
+	"name": "acme/widgets",
+	"require": {"php": "^7.1", "monolog/monolog": "^1.0"},
+	"repositories": [{"type": "vcs", "url": "https://dev.example.com/mirror"}],
+	"scripts": {"test": "phpunit"},
+	"extra": {"branch-alias": {"dev-master": "1.x-dev"}}
+}`
+
+// [][]interface{}{name, transform, expected json}
+var successfulTransforms = [][]interface{}{
+	{"remove key", Transform{Action: "remove", Path: "repositories"}, `{"extra":{"branch-alias":{"dev-master":"1.x-dev"}},"name":"acme/widgets","require":{"monolog/monolog":"^1.0","php":"^7.1"},"scripts":{"test":"phpunit"}}`},
+	{"remove nested key", Transform{Action: "remove", Path: "extra.branch-alias"}, `{"extra":{},"name":"acme/widgets","repositories":[{"type":"vcs","url":"https://dev.example.com/mirror"}],"require":{"monolog/monolog":"^1.0","php":"^7.1"},"scripts":{"test":"phpunit"}}`},
+	{"set key", Transform{Action: "set", Path: "scripts", Value: map[string]interface{}{}}, `{"extra":{"branch-alias":{"dev-master":"1.x-dev"}},"name":"acme/widgets","repositories":[{"type":"vcs","url":"https://dev.example.com/mirror"}],"require":{"monolog/monolog":"^1.0","php":"^7.1"},"scripts":{}}`},
+	{"set creates parents", Transform{Action: "set", Path: "config.sort-packages", Value: true}, `{"config":{"sort-packages":true},"extra":{"branch-alias":{"dev-master":"1.x-dev"}},"name":"acme/widgets","repositories":[{"type":"vcs","url":"https://dev.example.com/mirror"}],"require":{"monolog/monolog":"^1.0","php":"^7.1"},"scripts":{"test":"phpunit"}}`},
+	{"replace require", Transform{Action: "replace-require", Package: "monolog/monolog", Value: "^2.0"}, `{"extra":{"branch-alias":{"dev-master":"1.x-dev"}},"name":"acme/widgets","repositories":[{"type":"vcs","url":"https://dev.example.com/mirror"}],"require":{"monolog/monolog":"^2.0","php":"^7.1"},"scripts":{"test":"phpunit"}}`},
+}
+
+var failingTransforms = [][]interface{}{
+	{"remove missing key", Transform{Action: "remove", Path: "autoload"}},
+	{"remove missing parent", Transform{Action: "remove", Path: "autoload.psr-4"}},
+	{"set through a non object", Transform{Action: "set", Path: "name.vendor", Value: "acme"}},
+	{"replace missing require", Transform{Action: "replace-require", Package: "psr/log", Value: "^1.0"}},
+	{"unknown action", Transform{Action: "rename", Path: "name"}},
+}
+
+func TestApplyTransforms(t *testing.T) {
+	for _, test := range successfulTransforms {
+		var data ComposerFile
+		json.Unmarshal([]byte(transformManifest), &data)
+
+		err := ApplyTransforms(data, []Transform{test[1].(Transform)})
+		actual, _ := json.Marshal(data)
+
+		if err != nil || string(actual) != test[2] {
+			t.Errorf("[!] ApplyTransforms(%s) = %s, %v; want %s", test[0], actual, err, test[2])
+		}
+	}
+
+	for _, test := range failingTransforms {
+		var data ComposerFile
+		json.Unmarshal([]byte(transformManifest), &data)
+
+		if err := ApplyTransforms(data, []Transform{test[1].(Transform)}); err == nil {
+			t.Errorf("[!] ApplyTransforms(%s) = nil; want an error to occur", test[0])
+		}
+	}
+}
@@ -2,14 +2,424 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
 	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
+)
+
+const (
+	PublishSourceAlways       = "always"
+	PublishSourceTagsOnly     = "tags-only"
+	PublishSourceBranchesOnly = "branches-only"
+	PublishSourceNever        = "never"
+)
+
+const (
+	// PackageRenameWarn only logs when a repository's package changes name
+	PackageRenameWarn = "warn"
+	// PackageRenameDeleteOld also deletes the ref's version under the old
+	// name so it isn't left behind as an orphan
+	PackageRenameDeleteOld = "delete-old"
+)
+
+const (
+	// RepoLayoutFlat is the original naming, host and path squashed together,
+	// which can give two different repositories the same directory.
+	RepoLayoutFlat = "flat"
+	// RepoLayoutUnique keeps the whole host and path and adds a hash of the
+	// url so no two urls can share a directory.
+	RepoLayoutUnique = "unique"
 )
 
 type Repository struct {
-	Url           string
-	PublishSource bool
+	Url string
+	// GitHub's owner/name for the repository, matched before the url. When
+	// there's no url it is cloned from github.com over ssh
+	Name string
+	// One of the PublishSource* modes, true and false in the config file are
+	// read as always and never.
+	PublishSource string
+	// Cloudsmith only supports privacy at the repository level, so packages
+	// that need a different visibility to the rest are published to another
+	// repository. Empty uses the global TargetRepository.
+	TargetRepository string
+	// Static tags added to every package published from the repository
+	Tags []string
+	// Refs that don't produce a version are rejected rather than skipped
+	StrictVersioning bool
+	// Optional command run in the checkout before it is archived
+	BuildStep *BuildStep
+	// Packages living in sub directories of a monorepo, when empty the
+	// repository itself is the package.
+	Packages []Package
+	// What happens to tags without a package prefix in a monorepo, either
+	// UnprefixedTagsAll or UnprefixedTagsReject
+	UnprefixedTags string
+	// Overrides the global Compression for this repository's archives
+	Compression string
+	// Overrides the global TargetConcurrency for this repository's packages
+	TargetConcurrency int
+	// Override the global ArchiveMaxFiles and ArchiveMaxFileSize, for
+	// repositories that really do have that many or that large files
+	ArchiveMaxFiles    int
+	ArchiveMaxFileSize int64
+	// Changes made to composer.json before it's published
+	Transforms []composer.Transform
+	// Overrides the global RequireRewrites for the same packages
+	RequireRewrites []composer.RequireRewrite
+	// Added to composer.json's replace so a fork stands in for its upstream,
+	// package name to constraint (usually self.version)
+	Replace map[string]string
+	// Only publish the default branch, tags are still all published
+	DefaultBranchOnly bool
+	// Overrides the default branch reported by GitHub
+	DefaultBranch string
+	// Check out submodules so their files end up in the archive
+	IncludeSubmodules bool
+	// Keep a committed vendor directory in library archives
+	KeepVendor bool
+	// Turns tags into versions for repos with their own tag convention
+	TagRule composer.TagRule
+	// Upload to a staging repository first and only promote on success
+	Staging *Staging
+	// Extra places the package is published to, on top of TargetRepository
+	PublishTargets []PublishTarget
+	// Where versions come from, one of the VersionSource* sources
+	VersionSource string
+	// Fixed versions pushes are published as instead of deriving them
+	StaticVersion *StaticVersion
+	// How prerelease tags are published, one of the PrereleaseStability*
+	// treatments
+	PrereleaseStability string
+	// Refuse to republish a tag that has been moved to another commit since
+	// it was published, instead of replacing its package
+	ImmutableTags bool
+	// Rules adding release channel tags depending on the ref, the first
+	// matching rule wins
+	Channels []ChannelRule
+	// Replace the global RequiredFields rules for the same fields
+	RequiredFields []FieldRule
+	// Keep a Cloudsmith tag on the highest tagged version
+	StableAlias *StableAlias
+	// Upload a json pointer to each newly published version
+	Metadata *Metadata
+	// GitHub checks that have to pass before a push is published
+	RequiredChecks *RequiredChecks
+	// Overrides of where the repository is cloned to and its artifacts are
+	// written, for repositories that need a volume of their own. They have
+	// to exist already
+	ReposDir     string
+	ArtifactsDir string
+	// File in the package, like README.md, used as its description on
+	// Cloudsmith. composer.json's description is used when it's missing
+	DescriptionFile string
+	// File in the package its manifest is read from instead of
+	// composer.json, like a template that composer.json is generated from
+	Manifest string
+	// Directory, like src, the repository's only package lives in. Just it
+	// is archived, with its files at the root of the archive
+	PackageRoot string
+	// Publish every package of a monorepo push or none of them, packages
+	// already uploaded are deleted again when another fails
+	Transactional bool
+	// Which pushes are published depending on who made them
+	AuthorFilter *AuthorFilter
+}
+
+const (
+	// WebhookAuthHmac verifies GitHub's signature, it's the default
+	WebhookAuthHmac = "hmac"
+	// WebhookAuthHeader only checks for a shared token in a header, with no
+	// cryptographic verification of the payload at all
+	WebhookAuthHeader = "header"
+	// WebhookAuthBoth requires both the signature and the header token
+	WebhookAuthBoth = "both"
+)
+
+const (
+	CompressionDefault = "default"
+	CompressionStore   = "store"
+	CompressionFast    = "fast"
+	CompressionBest    = "best"
+)
+
+const (
+	// ReplaceDeleteThenUpload deletes the existing version and waits for it
+	// to go before uploading, leaving a gap where the package is missing
+	ReplaceDeleteThenUpload = "delete-then-upload"
+	// ReplaceRepublish uploads over the existing version with Cloudsmith's
+	// republish, so there's no gap
+	ReplaceRepublish = "republish-in-place"
+)
+
+const (
+	// ArtifactCollisionUnique writes the artifact into its own temporary
+	// directory, keeping the file name, when the name is already in use
+	ArtifactCollisionUnique = "unique"
+	// ArtifactCollisionWait waits until the artifact of the same name has
+	// been uploaded
+	ArtifactCollisionWait = "wait"
+)
+
+const (
+	// VersionSourceRef derives versions from the tag or branch, the default
+	VersionSourceRef = "ref"
+	// VersionSourceComposer uses the version committed to composer.json for
+	// every ref
+	VersionSourceComposer = "composer-json"
+	// VersionSourceRefThenComposer uses the tag for tags and composer.json for
+	// branches
+	VersionSourceRefThenComposer = "ref-then-composer"
+)
+
+const (
+	// PrereleaseStabilityKeep publishes a tag like v2.0.0-beta1 as a beta,
+	// the default
+	PrereleaseStabilityKeep = "keep"
+	// PrereleaseStabilityStable keeps the v2.0.0-beta1 label but advertises it
+	// as stable, for channels that install betas with minimum-stability
+	// stable. Two prereleases of the same version can't be told apart by
+	// Composer then, nor from the release itself
+	PrereleaseStabilityStable = "stable"
+)
+
+const (
+	// PublishFormatComposer uploads the zip archive as a Composer package
+	PublishFormatComposer = "composer"
+	// PublishFormatRaw uploads a tar.gz of the checkout as a raw package
+	PublishFormatRaw = "raw"
+)
+
+const (
+	UnprefixedTagsAll    = "all"
+	UnprefixedTagsReject = "reject"
+)
+
+// Package is one package in a monorepo. Tags starting with TagPrefix, for
+// example foo/v1.2.0 with a prefix of foo/, only publish this package and
+// have the prefix removed before their version is worked out.
+type Package struct {
+	Path      string
+	TagPrefix string
+}
+
+// BuildStep is a shell command run against a checkout before it's archived,
+// for packages that need generated files. This executes whatever is in the
+// config file on the host so it's only available when configured.
+type BuildStep struct {
+	Command string
+	Timeout time.Duration
+	// Extra environment variables, values can be file: or env: secret
+	// references which are resolved when the step runs
+	Env map[string]string
+	// Pass on our whole environment instead of just PATH and HOME
+	InheritEnv bool
+}
+
+// Staging is where packages are uploaded before they are promoted to the
+// target repository. Verify optionally runs in the checkout once the package
+// is in staging, a non-zero exit leaves it there and the target untouched.
+type Staging struct {
+	Repository string
+	Verify     *BuildStep
+}
+
+// StableAlias is a Cloudsmith tag, like latest-stable, that's moved to each
+// newly published tag that's the highest version of the package, so it can
+// be tracked without pinning. Deleting the version with the tag doesn't move
+// it back.
+type StableAlias struct {
+	Tag string
+	// Let alpha, beta and RC versions have the tag too
+	IncludePrereleases bool
+}
+
+// StaticVersion publishes every push of a branch, or tag, as the same version
+// whatever the ref is called, for repositories with one rolling version like
+// 1.0.x-dev. Refs without one are derived as usual.
+type StaticVersion struct {
+	Branches string
+	Tags     string
+}
+
+// For is the static version of a branch or tag, empty when it's derived
+func (static *StaticVersion) For(isBranch bool) string {
+	if static == nil {
+		return ""
+	}
+
+	if isBranch {
+		return static.Branches
+	}
+
+	return static.Tags
+}
+
+// Metadata is a json document about the latest published version, its
+// commit and when it was built, uploaded as a raw package after each publish
+// so tooling can find the latest build without Cloudsmith's package API. The
+// same version is overwritten every time.
+type Metadata struct {
+	// Repository it's uploaded to, the target repository when empty
+	Repository string
+	// Version it's uploaded as, {ref} is replaced with the branch or tag so
+	// each can have its own. latest when empty
+	Version string
+	// Only publishing a tag updates it, so a branch push doesn't take over
+	// latest
+	TagsOnly bool
+}
+
+// Publishes is whether publishing a branch, or tag, updates the metadata
+func (metadata *Metadata) Publishes(isBranch bool) bool {
+	return metadata != nil && (!isBranch || !metadata.TagsOnly)
+}
+
+// RequiredChecks holds back publishing a push until the named GitHub check
+// runs or commit statuses, like "tests" or "ci/jenkins", have passed for its
+// commit. They're checked every Interval for up to Timeout, a push whose
+// checks are still pending after that is deferred rather than published.
+type RequiredChecks struct {
+	Checks   []string
+	Timeout  time.Duration
+	Interval time.Duration
+}
+
+// AuthorFilter skips pushes made by, or only publishes pushes made by,
+// particular people or bots. Patterns are globs like dependabot* or
+// *@example.com, matched case insensitively against the logins and emails of
+// a push's pusher, sender and head commit author.
+type AuthorFilter struct {
+	// When set only pushes with an identity matching one of these publish
+	Allow []string
+	// Pushes with an identity matching one of these never publish
+	Deny []string
+}
+
+// Allows is whether a push made by identities, its logins and emails, is
+// published. Deny wins over allow, empty identities are ignored.
+func (filter *AuthorFilter) Allows(identities []string) bool {
+	if filter == nil {
+		return true
+	}
+
+	if matchesAuthor(filter.Deny, identities) {
+		return false
+	}
+
+	return len(filter.Allow) == 0 || matchesAuthor(filter.Allow, identities)
+}
+
+func matchesAuthor(patterns, identities []string) bool {
+	for _, identity := range identities {
+		if identity == "" {
+			continue
+		}
+
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(identity)); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+const (
+	// SymlinksFollow archives what a symlink points at as if it were a file
+	// or directory of its own
+	SymlinksFollow = "follow"
+	// SymlinksKeep archives symlinks as symlinks
+	SymlinksKeep = "keep"
+	// SymlinksSkip leaves symlinks out of archives
+	SymlinksSkip = "skip"
+)
+
+const (
+	// FileModesNormalize archives files as 0644, or 0755 when executable
+	FileModesNormalize = "normalize"
+	// FileModesPreserve archives files with the mode they have in the
+	// checkout
+	FileModesPreserve = "preserve"
+)
+
+const (
+	// AutoloadCheckIgnore doesn't look at the autoload section, the default
+	AutoloadCheckIgnore = "ignore"
+	// AutoloadCheckWarn logs autoload paths missing from an archive
+	AutoloadCheckWarn = "warn"
+	// AutoloadCheckFail refuses to upload an archive with autoload paths
+	// missing from it
+	AutoloadCheckFail = "fail"
+)
+
+const (
+	// PolicyWarn only logs a missing required field
+	PolicyWarn = "warn"
+	// PolicyBlock refuses to publish a package missing the field
+	PolicyBlock = "block"
+	// PolicyOff turns off a global rule for a repository
+	PolicyOff = "off"
+)
+
+// FieldRule requires a composer.json field, like license or authors, to be
+// set and not empty.
+type FieldRule struct {
+	Field string
+	// One of the Policy* severities
+	Severity string
+}
+
+const (
+	ChannelRefTag    = "tag"
+	ChannelRefBranch = "branch"
+)
+
+// ChannelRule tags packages built from matching refs with a release channel,
+// like stable or nightly, so consumers can pin to one.
+type ChannelRule struct {
+	// Either ChannelRefTag or ChannelRefBranch, both when empty
+	RefType string
+	// Glob the branch or tag name has to match, like release/*. Any name when
+	// empty
+	Pattern string
+	Tags    []string
+}
+
+// Matches is whether the rule applies to the given branch or tag
+func (rule ChannelRule) Matches(branchOrTagName string, isBranch bool) bool {
+	if (rule.RefType == ChannelRefTag && isBranch) || (rule.RefType == ChannelRefBranch && !isBranch) {
+		return false
+	}
+
+	if rule.Pattern == "" {
+		return true
+	}
+
+	matched, _ := path.Match(rule.Pattern, branchOrTagName)
+
+	return matched
+}
+
+// PublishTarget is an extra repository a package is published to, in its own
+// format. Packages are republished over the same version, so nothing is
+// deleted from these repositories when a ref is replaced or deleted.
+type PublishTarget struct {
+	// One of the PublishFormat* formats
+	Format     string
+	Repository string
+	// Overrides the repository's compression for this target's archive
+	Compression string
 }
 
 type Config struct {
@@ -22,6 +432,327 @@ type Config struct {
 	Repositories     []Repository
 	Server           string
 	WebhookSecret    string
+	GitRetryAttempts int
+	GitRetryBackoff  time.Duration
+	RepoLayout       string
+	// Response code for GitHub's ping event
+	PingStatusCode int
+	// Mention in the ping response whether the repository is configured
+	PingCheckRepository bool
+	// How hard to compress archives, one of the Compression* levels
+	Compression string
+	// How many of a package's publish targets are archived and uploaded at
+	// once, the uploads still count against UploadConcurrency
+	TargetConcurrency int
+	// How archives handle symlinks, one of the Symlinks* modes, and file
+	// modes, one of the FileModes* modes
+	ArchiveSymlinks  string
+	ArchiveFileModes string
+	// What happens when an archive is missing paths its composer.json
+	// autoloads, one of the AutoloadCheck* modes
+	ArchiveAutoloadCheck string
+	// The most files an archive can have and the largest any of them can be
+	// in bytes, past either a package isn't published. 0 is no limit
+	ArchiveMaxFiles    int
+	ArchiveMaxFileSize int64
+	// One of the WebhookAuth* modes
+	WebhookAuthMode   string
+	WebhookAuthHeader string
+	WebhookAuthToken  string
+	// Also accepted while rotating webhookSecret, deliveries signed with
+	// either are verified. Remove it once GitHub has the new secret
+	WebhookSecondarySecret string
+	// Token GitHub's API is read with, for repositories with requiredChecks.
+	// GitHub Enterprise has its api at GithubApiUrl, GitHub's own when empty
+	GithubToken  string
+	GithubApiUrl string
+	// File every package delete is recorded to, disabled when empty
+	AuditLog string
+	// How long to wait before deleting the package of a deleted branch
+	BranchDeleteGracePeriod time.Duration
+	// Respond to webhooks with json rather than plain text
+	JsonResponses bool
+	// Largest webhook body read before giving up, in bytes
+	MaxPayloadSize int64
+	// How many clones/fetches and Cloudsmith uploads can run at once, zero
+	// for no limit
+	GitConcurrency    int
+	UploadConcurrency int
+	// How many pushes from the same GitHub owner are published at once, on
+	// top of the limits above, zero for no limit
+	SourceConcurrency int
+	// Deadline for the git work done for a webhook, zero for none
+	WebhookTimeout time.Duration
+	// What happens when a push's composer.json name is different to the
+	// last one published from the repository, one of the PackageRename*
+	// modes
+	OnPackageRename string
+	// Most clones kept on disk, the least recently used are deleted (and
+	// cloned again when next needed) past this. Zero keeps them all
+	MaxClones int
+	// Serve endpoints for debugging what a push would publish
+	DebugEndpoints bool
+	// Serve POST /sync for publishing a ref or commit on request, and POST
+	// /reconcile for publishing every ref missing from Cloudsmith
+	ManualSync bool
+	// Start with publishing paused, POST /maintenance turns it off
+	Maintenance bool
+	// Path every endpoint is served under, for sharing an ingress. Webhook
+	// providers are served at their ProviderRoutes path, or the default,
+	// and /sync, /plan and /maintenance under AdminRoutePrefix
+	RoutePrefix      string
+	ProviderRoutes   map[string]string
+	AdminRoutePrefix string
+	// Most versions a single command deletes without being confirmed, zero
+	// for no limit
+	MaxBulkDeletes int
+	// OTLP/HTTP collector, host:port, spans are sent to. No tracing when
+	// empty
+	TracingEndpoint string
+	// Send spans over plain http rather than https
+	TracingInsecure bool
+	// How many times a push that failed with an error is published from
+	// scratch, and the wait before the first retry
+	PublishRetryAttempts int
+	PublishRetryBackoff  time.Duration
+	// What to do when an artifact is already being written or uploaded
+	// under the same name, one of the ArtifactCollision* modes
+	ArtifactCollision string
+	// Patterns like acme/* of the package names that may be published, any
+	// name when empty. Denied names are refused even if they're allowed
+	AllowedPackages []string
+	DeniedPackages  []string
+	// How an already published version is replaced, one of the Replace*
+	// strategies
+	ReplaceStrategy string
+	// How many times a write to a state file in the data directory is
+	// tried, and the wait before the first retry. Publishing carries on when
+	// it still fails
+	StateRetryAttempts int
+	StateRetryBackoff  time.Duration
+	// How long an entry in each state store is kept after it was last
+	// recorded, zero keeps them until they're deleted. Status is the
+	// repositories reported by GET /status. Expired entries are pruned every
+	// StateCompactionInterval
+	PackageNamesRetention     time.Duration
+	PublishedDigestsRetention time.Duration
+	StatusRetention           time.Duration
+	StateCompactionInterval   time.Duration
+	// File serve writes what GET /status reports to every
+	// StatusSnapshotInterval, for setups without a metrics stack. Zero only
+	// writes it when asked to
+	StatusSnapshotPath     string
+	StatusSnapshotInterval time.Duration
+	// Branch pushes that would publish exactly what the branch was last
+	// published with are skipped, instead of deleting and uploading it again
+	SkipUnchangedBranches bool
+	// Vendor added to package names without one, those are refused when
+	// it's empty
+	DefaultVendor string
+	// Wait up to SyncTimeout for composer uploads to finish synchronising on
+	// Cloudsmith, checking every SyncInterval. Zero doesn't wait
+	SyncInterval time.Duration
+	SyncTimeout  time.Duration
+	// How often a delete is checked on while waiting for Cloudsmith to
+	// finish it, before replacing or promoting the version
+	DeletionInterval time.Duration
+	// Replaces the default User-Agent sent to Cloudsmith when set
+	CloudsmithUserAgent string
+	// Extra headers sent with every request to Cloudsmith
+	CloudsmithHeaders map[string]string
+	// Requests a second bulk commands like rename send to Cloudsmith, zero
+	// only slows down when Cloudsmith's rate limit is reached
+	CloudsmithRequestRate float64
+	// Scratch repository serve uploads a throwaway package to, and deletes
+	// it from, before accepting webhooks. No self-test when empty
+	SelfTestRepository string
+	// How many parsed composer.json files are cached by commit, zero for no
+	// cache
+	ComposerCacheSize int
+	// composer.json fields every package has to have, repositories can
+	// override them
+	RequiredFields []FieldRule
+	// Requires of published packages pointed at other packages, like
+	// internal forks, or constraints. Repositories can override them
+	RequireRewrites []composer.RequireRewrite
+	// Key within composer.json's extra that a package's provenance, the
+	// commit and build it was published from, is written under. Nothing is
+	// written when empty
+	ProvenanceKey string
+	// Base url, like https://packages.internal.acme.com, replacing
+	// Cloudsmith's download host. No rewrite when empty
+	DownloadBaseUrl string
+	// Characters of a version replaced, with VersionPathReplacement, when it
+	// is used in a file name. The defaults are used when empty
+	VersionPathPattern     string
+	VersionPathReplacement string
+}
+
+const (
+	// DefaultVersionPathPattern matches anything that isn't safe in a file
+	// name, path separators included
+	DefaultVersionPathPattern     = `[^A-Za-z0-9._+-]`
+	DefaultVersionPathReplacement = "-"
+)
+
+func (repo *Repository) ShouldPublishSource(isBranch bool) bool {
+	switch repo.PublishSource {
+	case PublishSourceAlways:
+		return true
+	case PublishSourceTagsOnly:
+		return !isBranch
+	case PublishSourceBranchesOnly:
+		return isBranch
+	}
+
+	return false
+}
+
+// DeriveVersion works out the version a branch or tag publishes the package
+// with the given composer.json as, and its normalised form. A static version
+// is used as it is, whatever the ref and versionSource. Tags treated as stable
+// lose their prerelease modifier from the normalised form only.
+func (repo *Repository) DeriveVersion(branchOrTagName string, isBranch bool, data composer.ComposerFile) (string, string, error) {
+	version, normalizedVersion, err := repo.deriveVersion(branchOrTagName, isBranch, data)
+
+	if err == nil && !isBranch && repo.PrereleaseStability == PrereleaseStabilityStable {
+		normalizedVersion = composer.StripPrerelease(normalizedVersion)
+	}
+
+	return version, normalizedVersion, err
+}
+
+func (repo *Repository) deriveVersion(branchOrTagName string, isBranch bool, data composer.ComposerFile) (string, string, error) {
+	if static := repo.StaticVersion.For(isBranch); static != "" {
+		normalizedVersion, err := composer.NormaliseVersion(static, "")
+
+		if err != nil {
+			return "", "", err
+		}
+
+		return static, normalizedVersion, nil
+	}
+
+	if repo.VersionSource == VersionSourceComposer || (repo.VersionSource == VersionSourceRefThenComposer && isBranch) {
+		return composer.VersionFromComposer(data)
+	}
+
+	if !isBranch {
+		branchOrTagName = repo.TagRule.Strip(branchOrTagName)
+	}
+
+	return composer.DeriveVersion(branchOrTagName, isBranch)
+}
+
+// ReadDescription reads the package's description file from the checkout at
+// packagePath, falling back to the description in its composer.json when
+// there isn't one.
+func (repo *Repository) ReadDescription(packagePath string, data composer.ComposerFile) (string, error) {
+	if repo.DescriptionFile != "" {
+		contents, err := ioutil.ReadFile(filepath.Join(packagePath, repo.DescriptionFile))
+
+		if err == nil {
+			return string(contents), nil
+		}
+
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	description, _ := data["description"].(string)
+
+	return description, nil
+}
+
+// GetPackagesForRef works out which packages a branch or tag publishes, and
+// the name that their version should be derived from. Branches publish every
+// package, as do tags without a package prefix unless they're rejected.
+func (repo *Repository) GetPackagesForRef(branchOrTagName string, isBranch bool) ([]Package, string, error) {
+	if len(repo.Packages) == 0 {
+		return []Package{{Path: repo.PackageRoot}}, branchOrTagName, nil
+	}
+
+	if isBranch {
+		return repo.Packages, branchOrTagName, nil
+	}
+
+	// The longest prefix wins so foo/ and foo/bar/ can live side by side
+	var match *Package
+
+	for i, pkg := range repo.Packages {
+		if pkg.TagPrefix == "" || !strings.HasPrefix(branchOrTagName, pkg.TagPrefix) {
+			continue
+		}
+
+		if match == nil || len(pkg.TagPrefix) > len(match.TagPrefix) {
+			match = &repo.Packages[i]
+		}
+	}
+
+	if match != nil {
+		return []Package{*match}, strings.TrimPrefix(branchOrTagName, match.TagPrefix), nil
+	}
+
+	if repo.UnprefixedTags == UnprefixedTagsReject {
+		return nil, "", errors.New("tag " + branchOrTagName + " doesn't start with a package prefix")
+	}
+
+	return repo.Packages, branchOrTagName, nil
+}
+
+// PackageKey identifies one of the repository's packages, independent of
+// what it's called.
+func (repo *Repository) PackageKey(pkg Package) string {
+	return repo.Url + "#" + pkg.Path
+}
+
+// ShouldStripVendor decides whether a top level vendor directory is left out
+// of the archive. Only libraries have it stripped, projects are more likely
+// to vendor their dependencies on purpose.
+func (repo *Repository) ShouldStripVendor(composerData composer.ComposerFile) bool {
+	if repo.KeepVendor {
+		return false
+	}
+
+	packageType, _ := composerData["type"].(string)
+
+	return packageType == "" || packageType == "library"
+}
+
+// ShouldPublishBranch decides whether a branch gets published given the
+// default branch the remote reports.
+func (repo *Repository) ShouldPublishBranch(branch, defaultBranch string) bool {
+	if !repo.DefaultBranchOnly {
+		return true
+	}
+
+	if repo.DefaultBranch != "" {
+		defaultBranch = repo.DefaultBranch
+	}
+
+	return branch == defaultBranch
+}
+
+// GetPackageTags returns the Cloudsmith tags for a package built from the
+// given branch or tag, the configured tags plus one naming the ref and those
+// of the first channel rule it matches.
+func (repo *Repository) GetPackageTags(branchOrTagName string, isBranch bool) []string {
+	refTag := "tag:" + branchOrTagName
+
+	if isBranch {
+		refTag = "branch:" + branchOrTagName
+	}
+
+	tags := append(append([]string{}, repo.Tags...), refTag)
+
+	for _, rule := range repo.Channels {
+		if rule.Matches(branchOrTagName, isBranch) {
+			return append(tags, rule.Tags...)
+		}
+	}
+
+	return tags
 }
 
 func (config *Config) EnsureDirsExist() {
@@ -38,9 +769,24 @@ func (config *Config) EnsureDirsExist() {
 	}
 }
 
-func (config *Config) GetRepository(ssh string) (Repository, error) {
+// GetRepository finds the configuration for the repository a webhook came
+// from. A match on owner/name is more specific than one on url so it always
+// wins, and when several entries match the same way (Validate refuses
+// duplicates, but config built elsewhere may not be validated) the first
+// declared is used.
+func (config *Config) GetRepository(fullName, gitUrl string) (Repository, error) {
+	if fullName != "" {
+		for _, repo := range config.Repositories {
+			if repo.Name != "" && strings.EqualFold(repo.Name, fullName) {
+				return repo, nil
+			}
+		}
+	}
+
+	canonical := CanonicalUrl(gitUrl)
+
 	for _, repo := range config.Repositories {
-		if repo.Url == ssh {
+		if CanonicalUrl(repo.Url) == canonical {
 			return repo, nil
 		}
 	}
@@ -48,49 +794,1503 @@ func (config *Config) GetRepository(ssh string) (Repository, error) {
 	return Repository{}, errors.New("repository not found")
 }
 
-func (config *Config) GetRepoPath(dir string) string {
-	return config.DataDir + "/repos/" + dir
+func (config *Config) GetTargetRepository(repo *Repository) string {
+	if repo.TargetRepository != "" {
+		return repo.TargetRepository
+	}
+
+	return config.TargetRepository
 }
 
-func (config *Config) GetArtifactPath(artifact string) string {
-	return config.DataDir + "/artifacts/" + artifact
+// GetMetadataRepository returns the Cloudsmith repository the repository's
+// metadata is uploaded to
+func (config *Config) GetMetadataRepository(repo *Repository) string {
+	if repo.Metadata != nil && repo.Metadata.Repository != "" {
+		return repo.Metadata.Repository
+	}
+
+	return config.GetTargetRepository(repo)
 }
 
-func NewConfigFromViper(workingDirectory string) *Config {
-	var repositories []Repository
+// GetMetadataVersion is the version the metadata of a ref is uploaded as. It
+// is sanitised like any version in a file name, raw versions can't have
+// slashes in them either and it names the metadata's artifact too.
+func (config *Config) GetMetadataVersion(repo *Repository, ref string) string {
+	version := repo.Metadata.Version
 
-	dataDir := viper.GetString("dataDir")
-	dataDir = strings.Replace(dataDir, "${cwd}", workingDirectory, 1)
+	if version == "" {
+		version = "latest"
+	}
 
-	for _, repo := range viper.Get("repositories").([]interface{}) {
-		cfg := repo.(map[interface{}]interface{})
+	return config.SanitizeVersion(strings.Replace(version, "{ref}", ref, -1))
+}
 
-		var url string
-		var publishSource bool
+// NewMetadata is the metadata uploaded for a package published from commit
+// of ref
+func (config *Config) NewMetadata(repo *Repository, packageName, version, ref, commit, toolVersion, deliveryID string) composer.Metadata {
+	return composer.Metadata{
+		Package:     packageName,
+		Version:     version,
+		Ref:         ref,
+		Commit:      commit,
+		Repository:  config.Owner + "/" + config.GetTargetRepository(repo),
+		PublishedAt: time.Now().UTC(),
+		Tool:        "cloudsmith-sync/" + toolVersion,
+		DeliveryID:  deliveryID,
+	}
+}
 
-		if cfg["publishSource"] != nil {
-			publishSource = cfg["publishSource"].(bool)
-		}
+// GetUploadRepository returns the Cloudsmith repository packages from the
+// repository are uploaded to, which is staging when it's enabled.
+func (config *Config) GetUploadRepository(repo *Repository) string {
+	if repo.Staging != nil {
+		return repo.Staging.Repository
+	}
+
+	return config.GetTargetRepository(repo)
+}
+
+// GetTargetRepositories returns every Cloudsmith repository that packages
+// can be published to, staging included, without duplicates.
+func (config *Config) GetTargetRepositories() []string {
+	targets := []string{config.TargetRepository}
+
+	for _, repo := range config.Repositories {
+		candidates := []string{config.GetTargetRepository(&repo), config.GetUploadRepository(&repo)}
+
+		for _, target := range candidates {
+			known := false
 
-		if cfg["url"] != nil {
-			url = cfg["url"].(string)
+			for _, existing := range targets {
+				if existing == target {
+					known = true
+					break
+				}
+			}
+
+			if !known {
+				targets = append(targets, target)
+			}
 		}
+	}
+
+	return targets
+}
+
+// GetPublishTargets is everywhere a package from the repository is uploaded,
+// the composer upload repository first and then any extra PublishTargets.
+func (config *Config) GetPublishTargets(repo *Repository) []PublishTarget {
+	targets := []PublishTarget{{
+		Format:     PublishFormatComposer,
+		Repository: config.GetUploadRepository(repo),
+	}}
+
+	return append(targets, repo.PublishTargets...)
+}
 
-		repositories = append(repositories, Repository{
-			Url:           url,
-			PublishSource: publishSource,
-		})
+// CheckArchiveAutoload looks for autoload paths missing from a package
+// archive, only returning an error when ArchiveAutoloadCheck says they should
+// stop it being published.
+func (config *Config) CheckArchiveAutoload(archivePath string) error {
+	if config.ArchiveAutoloadCheck == AutoloadCheckIgnore || config.ArchiveAutoloadCheck == "" {
+		return nil
 	}
 
-	return &Config{
-		ApiKey:           viper.GetString("apiKey"),
-		DataDir:          dataDir,
-		Owner:            viper.GetString("owner"),
-		TargetRepository: viper.GetString("targetRepository"),
-		SshKey:           viper.GetString("sshKey"),
-		SshKeyPassphrase: viper.GetString("sshKeyPassphrase"),
-		Repositories:     repositories,
-		Server:           viper.GetString("server"),
-		WebhookSecret:    viper.GetString("webhookSecret"),
+	missing, err := composer.CheckArchiveAutoload(archivePath)
+
+	if err != nil {
+		return err
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	message := "autoload paths missing from " + filepath.Base(archivePath) + ": " + strings.Join(missing, ", ")
+
+	if config.ArchiveAutoloadCheck == AutoloadCheckWarn {
+		fmt.Println("WARNING: " + message)
+		return nil
 	}
+
+	return errors.New(message)
+}
+
+// GetTargetCompression is the compression for a publish target's archive
+func (config *Config) GetTargetCompression(repo *Repository, target PublishTarget) string {
+	if target.Compression != "" {
+		return target.Compression
+	}
+
+	return config.GetCompression(repo)
+}
+
+// GetTargetConcurrency is how many of the repository's publish targets a
+// package is uploaded to at once
+func (config *Config) GetTargetConcurrency(repo *Repository) int {
+	if repo.TargetConcurrency > 0 {
+		return repo.TargetConcurrency
+	}
+
+	return config.TargetConcurrency
+}
+
+// GetArchiveLimits is the most files the repository's archives can have and
+// the largest any of them can be
+func (config *Config) GetArchiveLimits(repo *Repository) (int, int64) {
+	maxFiles, maxFileSize := config.ArchiveMaxFiles, config.ArchiveMaxFileSize
+
+	if repo.ArchiveMaxFiles > 0 {
+		maxFiles = repo.ArchiveMaxFiles
+	}
+
+	if repo.ArchiveMaxFileSize > 0 {
+		maxFileSize = repo.ArchiveMaxFileSize
+	}
+
+	return maxFiles, maxFileSize
+}
+
+func (config *Config) GetCompression(repo *Repository) string {
+	if repo.Compression != "" {
+		return repo.Compression
+	}
+
+	return config.Compression
+}
+
+func (config *Config) GetRepoPath(dir string) string {
+	return config.GetReposDir(nil) + "/" + dir
+}
+
+// GetReposDir is the directory the repository is cloned into, the global
+// one when repo is nil or doesn't have its own
+func (config *Config) GetReposDir(repo *Repository) string {
+	if repo != nil && repo.ReposDir != "" {
+		return repo.ReposDir
+	}
+
+	return config.DataDir + "/repos"
+}
+
+// GetArtifactsDir is the directory the repository's artifacts are written
+// to, the global one when repo is nil or doesn't have its own
+func (config *Config) GetArtifactsDir(repo *Repository) string {
+	if repo != nil && repo.ArtifactsDir != "" {
+		return repo.ArtifactsDir
+	}
+
+	return config.DataDir + "/artifacts"
+}
+
+// GetRepositoryArtifactPath is where an artifact built from the repository
+// is written
+func (config *Config) GetRepositoryArtifactPath(repo *Repository, artifact string) string {
+	return config.GetArtifactsDir(repo) + "/" + artifact
+}
+
+// SanitizeVersion makes a version, like dev-feature/JIRA-123, safe to use in
+// a file name. It is only for naming files, composer.json and Cloudsmith
+// always get the real version.
+func (config *Config) SanitizeVersion(version string) string {
+	pattern := config.VersionPathPattern
+	replacement := config.VersionPathReplacement
+
+	if pattern == "" {
+		pattern = DefaultVersionPathPattern
+	}
+
+	if replacement == "" {
+		replacement = DefaultVersionPathReplacement
+	}
+
+	exp, err := regexp.Compile(pattern)
+
+	if err != nil {
+		exp = regexp.MustCompile(DefaultVersionPathPattern)
+	}
+
+	sanitized := exp.ReplaceAllLiteralString(version, replacement)
+
+	// Whatever the pattern, the result can't leave or name a directory
+	sanitized = strings.NewReplacer("/", replacement, "\\", replacement).Replace(sanitized)
+
+	if strings.Trim(sanitized, ".") == "" {
+		sanitized = strings.Replace(sanitized, ".", replacement, -1)
+	}
+
+	return sanitized
+}
+
+// CheckArtifactsDir checks the repository's artifacts directory can still be
+// written to, it can fill up or have its permissions changed after startup
+func (config *Config) CheckArtifactsDir(repo *Repository) error {
+	if err := checkWritableDir(config.GetArtifactsDir(repo)); err != nil {
+		return errors.New("artifact directory not writable: " + err.Error())
+	}
+
+	return nil
+}
+
+// CheckArtifactsDirs checks every artifacts directory, the global one and
+// those of repositories with their own, can still be written to
+func (config *Config) CheckArtifactsDirs() error {
+	if err := config.CheckArtifactsDir(nil); err != nil {
+		return err
+	}
+
+	for i := range config.Repositories {
+		if config.Repositories[i].ArtifactsDir == "" {
+			continue
+		}
+
+		if err := config.CheckArtifactsDir(&config.Repositories[i]); err != nil {
+			return errors.New(config.Repositories[i].Url + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// GetStatePath is where the state file with the given name is kept
+func (config *Config) GetStatePath(name string) string {
+	return config.DataDir + "/" + name
+}
+
+func (config *Config) GetArtifactPath(artifact string) string {
+	return config.GetRepositoryArtifactPath(nil, artifact)
+}
+
+// RepublishesInPlace is whether existing versions are uploaded over rather
+// than deleted first
+func (config *Config) RepublishesInPlace() bool {
+	return config.ReplaceStrategy == ReplaceRepublish
+}
+
+// CheckBulkDelete guards against deleting far more than intended. Deleting
+// more than MaxBulkDeletes versions at once is refused unless confirmed, by
+// giving the number that will be deleted.
+func (config *Config) CheckBulkDelete(count, confirmed int) error {
+	if config.MaxBulkDeletes == 0 || count <= config.MaxBulkDeletes || confirmed == count {
+		return nil
+	}
+
+	return fmt.Errorf("refusing to delete %d versions, more than maxBulkDeletes (%d). Check they're the ones expected and run again with --yes-delete=%d", count, config.MaxBulkDeletes, count)
+}
+
+// NewProvenance is the provenance written to a package published from
+// commit, nil when provenance is turned off
+func (config *Config) NewProvenance(commit, toolVersion, deliveryID string) *composer.Provenance {
+	if config.ProvenanceKey == "" {
+		return nil
+	}
+
+	return &composer.Provenance{
+		Key:        config.ProvenanceKey,
+		Commit:     commit,
+		BuiltAt:    time.Now(),
+		Tool:       "cloudsmith-sync/" + toolVersion,
+		DeliveryID: deliveryID,
+	}
+}
+
+// IsPackageAllowed is whether a package with this name may be published
+func (config *Config) IsPackageAllowed(name string) bool {
+	for _, pattern := range config.DeniedPackages {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+
+	if len(config.AllowedPackages) == 0 {
+		return true
+	}
+
+	for _, pattern := range config.AllowedPackages {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetRequiredFields is the required field rules for the repository, the
+// global ones with the repository's overrides applied.
+func (config *Config) GetRequiredFields(repo *Repository) []FieldRule {
+	var rules []FieldRule
+
+	for _, rule := range append(append([]FieldRule{}, config.RequiredFields...), repo.RequiredFields...) {
+		replaced := false
+
+		for i := range rules {
+			if rules[i].Field == rule.Field {
+				rules[i] = rule
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// GetRequireRewrites is the global require rewrites with the repository's
+// own replacing those for the same package.
+func (config *Config) GetRequireRewrites(repo *Repository) []composer.RequireRewrite {
+	var rewrites []composer.RequireRewrite
+
+	for _, rewrite := range append(append([]composer.RequireRewrite{}, config.RequireRewrites...), repo.RequireRewrites...) {
+		replaced := false
+
+		for i := range rewrites {
+			if rewrites[i].Package == rewrite.Package {
+				rewrites[i] = rewrite
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			rewrites = append(rewrites, rewrite)
+		}
+	}
+
+	return rewrites
+}
+
+// CheckRequiredFields returns the repository's required fields missing from
+// a package's composer.json, those that only warn and those that block it
+// from being published.
+func (config *Config) CheckRequiredFields(repo *Repository, data composer.ComposerFile) (warnings []string, violations []string) {
+	for _, rule := range config.GetRequiredFields(repo) {
+		if rule.Severity == PolicyOff || !composer.IsFieldEmpty(data, rule.Field) {
+			continue
+		}
+
+		if rule.Severity == PolicyWarn {
+			warnings = append(warnings, rule.Field+" is missing")
+		} else {
+			violations = append(violations, rule.Field+" is missing")
+		}
+	}
+
+	return warnings, violations
+}
+
+// Validate checks for settings that would otherwise only fail part way
+// through a sync.
+func (config *Config) Validate() error {
+	if config.MaxPayloadSize <= 0 {
+		return errors.New("maxPayloadSize must be greater than zero")
+	}
+
+	if config.StateRetryAttempts < 1 {
+		return errors.New("stateStore.retryAttempts must be at least one")
+	}
+
+	if config.PackageNamesRetention < 0 || config.PublishedDigestsRetention < 0 || config.StatusRetention < 0 {
+		return errors.New("stateStore.retention can't be negative")
+	}
+
+	if config.StateCompactionInterval <= 0 {
+		return errors.New("stateStore.compactionInterval must be greater than zero")
+	}
+
+	if config.StatusSnapshotInterval < 0 {
+		return errors.New("statusSnapshot.interval can't be negative")
+	}
+
+	if config.StatusSnapshotInterval > 0 && config.StatusSnapshotPath == "" {
+		return errors.New("statusSnapshot.interval needs statusSnapshot.path")
+	}
+
+	if config.MaxBulkDeletes < 0 {
+		return errors.New("maxBulkDeletes can't be negative")
+	}
+
+	if config.ArtifactCollision != ArtifactCollisionUnique && config.ArtifactCollision != ArtifactCollisionWait {
+		return errors.New("artifactCollision must be unique or wait")
+	}
+
+	for _, pattern := range append(append([]string{}, config.AllowedPackages...), config.DeniedPackages...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("invalid package name pattern " + pattern)
+		}
+	}
+
+	if config.ArchiveSymlinks != SymlinksFollow && config.ArchiveSymlinks != SymlinksKeep && config.ArchiveSymlinks != SymlinksSkip {
+		return errors.New("archive.symlinks must be follow, keep or skip")
+	}
+
+	if config.ArchiveFileModes != FileModesNormalize && config.ArchiveFileModes != FileModesPreserve {
+		return errors.New("archive.fileModes must be normalize or preserve")
+	}
+
+	if config.ArchiveAutoloadCheck != AutoloadCheckIgnore && config.ArchiveAutoloadCheck != AutoloadCheckWarn && config.ArchiveAutoloadCheck != AutoloadCheckFail {
+		return errors.New("archive.autoloadCheck must be ignore, warn or fail")
+	}
+
+	if config.ArchiveMaxFiles < 0 || config.ArchiveMaxFileSize < 0 {
+		return errors.New("archive.maxFiles and archive.maxFileSize can't be negative")
+	}
+
+	if config.ReplaceStrategy != ReplaceDeleteThenUpload && config.ReplaceStrategy != ReplaceRepublish {
+		return errors.New("replaceStrategy must be delete-then-upload or republish-in-place")
+	}
+
+	if config.DefaultVendor != "" && !composer.IsValidPackageName(config.DefaultVendor+"/package") {
+		return errors.New("defaultVendor " + config.DefaultVendor + " isn't a valid vendor name")
+	}
+
+	if config.SyncTimeout > 0 && config.SyncInterval <= 0 {
+		return errors.New("waitForSync.interval must be greater than zero")
+	}
+
+	if config.OnPackageRename != PackageRenameWarn && config.OnPackageRename != PackageRenameDeleteOld {
+		return errors.New("onPackageRename must be warn or delete-old")
+	}
+
+	if config.PingStatusCode < 200 || config.PingStatusCode > 299 {
+		return errors.New("pingStatusCode must be a 2xx status code")
+	}
+
+	if config.RepoLayout != "" && config.RepoLayout != RepoLayoutFlat && config.RepoLayout != RepoLayoutUnique {
+		return errors.New("repoLayout must be flat or unique")
+	}
+
+	if config.DownloadBaseUrl != "" {
+		if parsed, err := url.Parse(config.DownloadBaseUrl); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return errors.New("downloadBaseUrl must be an absolute url like https://packages.example.com")
+		}
+	}
+
+	if config.VersionPathPattern != "" {
+		if _, err := regexp.Compile(config.VersionPathPattern); err != nil {
+			return errors.New("invalid versionPaths pattern: " + err.Error())
+		}
+	}
+
+	if strings.ContainsAny(config.VersionPathReplacement, "/\\.") {
+		return errors.New("versionPaths replacement can't contain path separators or dots")
+	}
+
+	if err := validateRoutes(config); err != nil {
+		return err
+	}
+
+	if err := validateFieldRules(config.RequiredFields); err != nil {
+		return errors.New("requiredFields: " + err.Error())
+	}
+
+	if err := validateRequireRewrites(config.RequireRewrites); err != nil {
+		return errors.New("requireRewrites: " + err.Error())
+	}
+
+	if config.SelfTestRepository != "" {
+		for _, target := range config.GetTargetRepositories() {
+			if target == config.SelfTestRepository {
+				return errors.New("selfTest.repository must be a scratch repository, " + target + " is published to")
+			}
+		}
+
+		for _, repo := range config.Repositories {
+			for _, target := range repo.PublishTargets {
+				if target.Repository == config.SelfTestRepository {
+					return errors.New("selfTest.repository must be a scratch repository, " + target.Repository + " is published to")
+				}
+			}
+		}
+	}
+
+	for name := range config.CloudsmithHeaders {
+		if cloudsmith.IsReservedHeader(name) {
+			return errors.New("cloudsmith.headers can't set " + name + ", it's set by the client")
+		}
+	}
+
+	if config.CloudsmithRequestRate < 0 {
+		return errors.New("cloudsmith.requestRate can't be negative")
+	}
+
+	if config.TargetConcurrency < 1 {
+		return errors.New("targetConcurrency must be at least one")
+	}
+
+	switch config.WebhookAuthMode {
+	case WebhookAuthHmac, WebhookAuthHeader, WebhookAuthBoth:
+	default:
+		return errors.New("webhookAuth.mode must be hmac, header or both")
+	}
+
+	if config.UsesWebhookAuthHeader() && (config.WebhookAuthHeader == "" || config.WebhookAuthToken == "") {
+		return errors.New("webhookAuth needs a header and token when using header authentication")
+	}
+
+	if config.WebhookSecondarySecret != "" && config.WebhookSecondarySecret == config.WebhookSecret {
+		return errors.New("webhookSecondarySecret is the same as webhookSecret, remove it once rotation is done")
+	}
+
+	if !isCompression(config.Compression) {
+		return errors.New("compression must be default, store, fast or best")
+	}
+
+	urls := map[string]string{}
+	names := map[string]string{}
+
+	for _, repo := range config.Repositories {
+		if repo.Url == "" {
+			return errors.New("every repository needs a url or name")
+		}
+
+		// Both ssh and https forms of a url match the same webhooks, so
+		// only the first of them would ever be used
+		canonical := CanonicalUrl(repo.Url)
+
+		if existing, ok := urls[canonical]; ok {
+			return errors.New(repo.Url + ": same repository as " + existing + ", it can only be configured once")
+		}
+
+		urls[canonical] = repo.Url
+
+		if repo.Name != "" {
+			name := strings.ToLower(repo.Name)
+
+			if existing, ok := names[name]; ok {
+				return errors.New(repo.Url + ": name " + repo.Name + " is already used by " + existing)
+			}
+
+			names[name] = repo.Url
+		}
+
+		if !isCompression(repo.Compression) {
+			return errors.New(repo.Url + ": compression must be default, store, fast or best")
+		}
+
+		if repo.TargetConcurrency < 0 {
+			return errors.New(repo.Url + ": targetConcurrency can't be negative")
+		}
+
+		if repo.ArchiveMaxFiles < 0 || repo.ArchiveMaxFileSize < 0 {
+			return errors.New(repo.Url + ": archiveMaxFiles and archiveMaxFileSize can't be negative")
+		}
+
+		if repo.UnprefixedTags != "" && repo.UnprefixedTags != UnprefixedTagsAll && repo.UnprefixedTags != UnprefixedTagsReject {
+			return errors.New(repo.Url + ": unprefixedTags must be all or reject")
+		}
+
+		if repo.TagRule.Pattern != "" {
+			exp, err := regexp.Compile(repo.TagRule.Pattern)
+
+			if err != nil {
+				return errors.New(repo.Url + ": invalid tagRule pattern: " + err.Error())
+			}
+
+			if exp.NumSubexp() < 1 {
+				return errors.New(repo.Url + ": tagRule pattern needs a capture group around the version")
+			}
+		}
+
+		for name, constraint := range repo.Replace {
+			if !composer.IsValidPackageName(name) {
+				return errors.New(repo.Url + ": replace has an invalid package name " + name)
+			}
+
+			if constraint == "" {
+				return errors.New(repo.Url + ": replace " + name + " needs a version constraint")
+			}
+		}
+
+		for _, transform := range repo.Transforms {
+			switch transform.Action {
+			case composer.TransformRemove, composer.TransformSet:
+				if transform.Path == "" {
+					return errors.New(repo.Url + ": " + transform.Action + " transforms need a path")
+				}
+			case composer.TransformReplaceRequire:
+				if transform.Package == "" {
+					return errors.New(repo.Url + ": replace-require transforms need a package")
+				}
+			default:
+				return errors.New(repo.Url + ": unknown transform " + transform.Action)
+			}
+		}
+
+		if repo.PackageRoot != "" {
+			if len(repo.Packages) > 0 {
+				return errors.New(repo.Url + ": packageRoot is for a single package, give each package a path instead")
+			}
+
+			if filepath.IsAbs(repo.PackageRoot) || strings.HasPrefix(filepath.Clean(repo.PackageRoot), "..") {
+				return errors.New(repo.Url + ": packageRoot " + repo.PackageRoot + " must be inside the repository")
+			}
+		}
+
+		for _, pkg := range repo.Packages {
+			if pkg.Path == "" {
+				return errors.New(repo.Url + ": every package needs a path")
+			}
+
+			if filepath.IsAbs(pkg.Path) || strings.HasPrefix(filepath.Clean(pkg.Path), "..") {
+				return errors.New(repo.Url + ": package path " + pkg.Path + " must be inside the repository")
+			}
+		}
+
+		if repo.BuildStep != nil && repo.BuildStep.Command == "" {
+			return errors.New(repo.Url + ": buildStep needs a command")
+		}
+
+		if repo.Staging != nil {
+			if repo.Staging.Repository == "" {
+				return errors.New(repo.Url + ": staging needs a repository")
+			}
+
+			if repo.Staging.Repository == config.GetTargetRepository(&repo) {
+				return errors.New(repo.Url + ": staging repository must be different to the target repository")
+			}
+
+			if repo.Staging.Verify != nil && repo.Staging.Verify.Command == "" {
+				return errors.New(repo.Url + ": staging verify needs a command")
+			}
+
+			if repo.Transactional {
+				return errors.New(repo.Url + ": transactional can't be used with staging")
+			}
+		}
+
+		for _, target := range repo.PublishTargets {
+			if target.Format != PublishFormatComposer && target.Format != PublishFormatRaw {
+				return errors.New(repo.Url + ": publishTargets format must be composer or raw")
+			}
+
+			if target.Repository == "" {
+				return errors.New(repo.Url + ": every publish target needs a repository")
+			}
+
+			if target.Format == PublishFormatComposer && target.Repository == config.GetUploadRepository(&repo) {
+				return errors.New(repo.Url + ": composer publish target " + target.Repository + " is already published to")
+			}
+
+			if !isCompression(target.Compression) {
+				return errors.New(repo.Url + ": publish target compression must be default, store, fast or best")
+			}
+		}
+
+		if repo.Manifest != "" && (filepath.IsAbs(repo.Manifest) || strings.HasPrefix(filepath.Clean(repo.Manifest), "..")) {
+			return errors.New(repo.Url + ": manifest must be a path inside the package")
+		}
+
+		for _, dir := range []string{repo.ReposDir, repo.ArtifactsDir} {
+			if dir == "" {
+				continue
+			}
+
+			if err := checkWritableDir(dir); err != nil {
+				return errors.New(repo.Url + ": " + err.Error())
+			}
+		}
+
+		if err := validateFieldRules(repo.RequiredFields); err != nil {
+			return errors.New(repo.Url + ": requiredFields: " + err.Error())
+		}
+
+		if err := validateRequireRewrites(repo.RequireRewrites); err != nil {
+			return errors.New(repo.Url + ": requireRewrites: " + err.Error())
+		}
+
+		if repo.StableAlias != nil && repo.StableAlias.Tag == "" {
+			return errors.New(repo.Url + ": stableAlias needs a tag")
+		}
+
+		if repo.Metadata != nil && strings.Contains(repo.Metadata.Version, "/") {
+			return errors.New(repo.Url + ": metadata.version can't have a slash")
+		}
+
+		if repo.RequiredChecks != nil {
+			if len(repo.RequiredChecks.Checks) == 0 {
+				return errors.New(repo.Url + ": requiredChecks needs at least one check")
+			}
+
+			if config.GithubToken == "" {
+				return errors.New(repo.Url + ": requiredChecks needs github.token to read them with")
+			}
+		}
+
+		if repo.AuthorFilter != nil {
+			for _, pattern := range append(repo.AuthorFilter.Allow, repo.AuthorFilter.Deny...) {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return errors.New(repo.Url + ": invalid authorFilter pattern " + pattern)
+				}
+			}
+		}
+
+		for _, rule := range repo.Channels {
+			if rule.RefType != "" && rule.RefType != ChannelRefTag && rule.RefType != ChannelRefBranch {
+				return errors.New(repo.Url + ": channel refType must be tag or branch")
+			}
+
+			if _, err := path.Match(rule.Pattern, ""); err != nil {
+				return errors.New(repo.Url + ": invalid channel pattern " + rule.Pattern)
+			}
+
+			if len(rule.Tags) == 0 {
+				return errors.New(repo.Url + ": every channel needs tags")
+			}
+		}
+
+		switch repo.VersionSource {
+		case "", VersionSourceRef, VersionSourceComposer, VersionSourceRefThenComposer:
+		default:
+			return errors.New(repo.Url + ": versionSource must be ref, composer-json or ref-then-composer")
+		}
+
+		switch repo.PrereleaseStability {
+		case "", PrereleaseStabilityKeep, PrereleaseStabilityStable:
+		default:
+			return errors.New(repo.Url + ": prereleaseStability must be keep or stable")
+		}
+
+		for _, static := range []string{repo.StaticVersion.For(true), repo.StaticVersion.For(false)} {
+			if _, err := composer.NormaliseVersion(static, ""); static != "" && err != nil {
+				return errors.New(repo.Url + ": staticVersion " + static + " isn't a valid version")
+			}
+		}
+
+		switch repo.PublishSource {
+		case PublishSourceAlways, PublishSourceTagsOnly, PublishSourceBranchesOnly, PublishSourceNever:
+		default:
+			return errors.New(repo.Url + ": publishSource must be always, tags-only, branches-only or never")
+		}
+	}
+
+	return nil
+}
+
+// checkWritableDir makes sure dir is an existing directory files can be
+// written to
+func checkWritableDir(dir string) error {
+	info, err := os.Stat(dir)
+
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return errors.New(dir + " isn't a directory")
+	}
+
+	file, err := ioutil.TempFile(dir, ".cloudsmith-sync-")
+
+	if err != nil {
+		return errors.New(dir + " isn't writable: " + err.Error())
+	}
+
+	file.Close()
+
+	return os.Remove(file.Name())
+}
+
+func validateRequireRewrites(rewrites []composer.RequireRewrite) error {
+	for _, rewrite := range rewrites {
+		if !composer.IsValidPackageName(rewrite.Package) {
+			return errors.New("invalid package name " + rewrite.Package)
+		}
+
+		if rewrite.Name == "" && rewrite.Constraint == "" {
+			return errors.New(rewrite.Package + " needs a name or a constraint")
+		}
+
+		if rewrite.Name != "" && !composer.IsValidPackageName(rewrite.Name) {
+			return errors.New(rewrite.Package + ": invalid package name " + rewrite.Name)
+		}
+
+		if rewrite.Constraint != "" {
+			if err := composer.ValidateConstraint(rewrite.Constraint); err != nil {
+				return errors.New(rewrite.Package + ": " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateFieldRules(rules []FieldRule) error {
+	for _, rule := range rules {
+		if rule.Field == "" {
+			return errors.New("every rule needs a field")
+		}
+
+		switch rule.Severity {
+		case PolicyWarn, PolicyBlock, PolicyOff:
+		default:
+			return errors.New(rule.Field + " severity must be warn, block or off")
+		}
+	}
+
+	return nil
+}
+
+// UsesImmutableTags is whether any repository has immutable tags, which need
+// the commit each tag was published from to be kept
+func (config *Config) UsesImmutableTags() bool {
+	for _, repo := range config.Repositories {
+		if repo.ImmutableTags {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UsesWebhookSignature is whether GitHub's HMAC signature is verified
+func (config *Config) UsesWebhookSignature() bool {
+	return config.WebhookAuthMode != WebhookAuthHeader
+}
+
+// UsesWebhookAuthHeader is whether webhooks need the shared header token
+func (config *Config) UsesWebhookAuthHeader() bool {
+	return config.WebhookAuthMode == WebhookAuthHeader || config.WebhookAuthMode == WebhookAuthBoth
+}
+
+func isCompression(compression string) bool {
+	switch compression {
+	case "", CompressionDefault, CompressionStore, CompressionFast, CompressionBest:
+		return true
+	}
+
+	return false
+}
+
+func NewConfigFromViper(workingDirectory string) (*Config, error) {
+	var repositories []Repository
+
+	dataDir := viper.GetString("dataDir")
+	dataDir = strings.Replace(dataDir, "${cwd}", workingDirectory, 1)
+
+	for _, repo := range viper.Get("repositories").([]interface{}) {
+		repositories = append(repositories, newRepositoryFromConfig(repo.(map[interface{}]interface{})))
+	}
+
+	apiKey, err := ResolveSecret(viper.GetString("apiKey"))
+
+	if err != nil {
+		return nil, errors.New("apiKey: " + err.Error())
+	}
+
+	webhookSecret, err := ResolveSecret(viper.GetString("webhookSecret"))
+
+	if err != nil {
+		return nil, errors.New("webhookSecret: " + err.Error())
+	}
+
+	webhookSecondarySecret, err := ResolveSecret(viper.GetString("webhookSecondarySecret"))
+
+	if err != nil {
+		return nil, errors.New("webhookSecondarySecret: " + err.Error())
+	}
+
+	githubToken, err := ResolveSecret(viper.GetString("github.token"))
+
+	if err != nil {
+		return nil, errors.New("github.token: " + err.Error())
+	}
+
+	gitRetryAttempts := 3
+
+	if viper.IsSet("gitRetryAttempts") {
+		gitRetryAttempts = viper.GetInt("gitRetryAttempts")
+	}
+
+	webhookAuthToken, err := ResolveSecret(viper.GetString("webhookAuth.token"))
+
+	if err != nil {
+		return nil, errors.New("webhookAuth.token: " + err.Error())
+	}
+
+	webhookAuthMode := WebhookAuthHmac
+
+	if viper.IsSet("webhookAuth.mode") {
+		webhookAuthMode = viper.GetString("webhookAuth.mode")
+	}
+
+	pingStatusCode := 201
+
+	if viper.IsSet("pingStatusCode") {
+		pingStatusCode = viper.GetInt("pingStatusCode")
+	}
+
+	// GitHub caps payloads at 25MB but pushes are typically a few KB
+	maxPayloadSize := int64(5 * 1024 * 1024)
+
+	if viper.IsSet("maxPayloadSize") {
+		maxPayloadSize = viper.GetInt64("maxPayloadSize")
+	}
+
+	publishRetryBackoff := 5 * time.Second
+
+	if viper.IsSet("publishRetryBackoff") {
+		publishRetryBackoff = viper.GetDuration("publishRetryBackoff")
+	}
+
+	artifactCollision := ArtifactCollisionUnique
+
+	if viper.IsSet("artifactCollision") {
+		artifactCollision = viper.GetString("artifactCollision")
+	}
+
+	archiveSymlinks := SymlinksFollow
+
+	if viper.IsSet("archive.symlinks") {
+		archiveSymlinks = viper.GetString("archive.symlinks")
+	}
+
+	archiveFileModes := FileModesNormalize
+
+	if viper.IsSet("archive.fileModes") {
+		archiveFileModes = viper.GetString("archive.fileModes")
+	}
+
+	archiveAutoloadCheck := AutoloadCheckIgnore
+
+	if viper.IsSet("archive.autoloadCheck") {
+		archiveAutoloadCheck = viper.GetString("archive.autoloadCheck")
+	}
+
+	archiveMaxFiles := 50000
+
+	if viper.IsSet("archive.maxFiles") {
+		archiveMaxFiles = viper.GetInt("archive.maxFiles")
+	}
+
+	archiveMaxFileSize := int64(100 * 1024 * 1024)
+
+	if viper.IsSet("archive.maxFileSize") {
+		archiveMaxFileSize = viper.GetInt64("archive.maxFileSize")
+	}
+
+	replaceStrategy := ReplaceDeleteThenUpload
+
+	if viper.IsSet("replaceStrategy") {
+		replaceStrategy = viper.GetString("replaceStrategy")
+	}
+
+	syncInterval := 2 * time.Second
+
+	if viper.IsSet("waitForSync.interval") {
+		syncInterval = viper.GetDuration("waitForSync.interval")
+	}
+
+	deletionInterval := 2 * time.Second
+
+	if viper.IsSet("waitForDeletion.interval") {
+		deletionInterval = viper.GetDuration("waitForDeletion.interval")
+
+		if deletionInterval <= 0 {
+			return nil, errors.New("waitForDeletion.interval must be greater than zero")
+		}
+	}
+
+	cloudsmithHeaders := map[string]string{}
+
+	for name, value := range viper.GetStringMapString("cloudsmith.headers") {
+		resolved, err := ResolveSecret(value)
+
+		if err != nil {
+			return nil, errors.New("cloudsmith.headers." + name + ": " + err.Error())
+		}
+
+		cloudsmithHeaders[name] = resolved
+	}
+
+	composerCacheSize := 256
+
+	if viper.IsSet("composerCacheSize") {
+		composerCacheSize = viper.GetInt("composerCacheSize")
+	}
+
+	targetConcurrency := 1
+
+	if viper.IsSet("targetConcurrency") {
+		targetConcurrency = viper.GetInt("targetConcurrency")
+	}
+
+	stateRetryAttempts := 3
+
+	if viper.IsSet("stateStore.retryAttempts") {
+		stateRetryAttempts = viper.GetInt("stateStore.retryAttempts")
+	}
+
+	stateRetryBackoff := 100 * time.Millisecond
+
+	if viper.IsSet("stateStore.retryBackoff") {
+		stateRetryBackoff = viper.GetDuration("stateStore.retryBackoff")
+	}
+
+	stateCompactionInterval := time.Hour
+
+	if viper.IsSet("stateStore.compactionInterval") {
+		stateCompactionInterval = viper.GetDuration("stateStore.compactionInterval")
+	}
+
+	maxBulkDeletes := 20
+
+	if viper.IsSet("maxBulkDeletes") {
+		maxBulkDeletes = viper.GetInt("maxBulkDeletes")
+	}
+
+	onPackageRename := PackageRenameWarn
+
+	if viper.IsSet("onPackageRename") {
+		onPackageRename = viper.GetString("onPackageRename")
+	}
+
+	return &Config{
+		ApiKey:                    apiKey,
+		DataDir:                   dataDir,
+		Owner:                     viper.GetString("owner"),
+		TargetRepository:          viper.GetString("targetRepository"),
+		SshKey:                    viper.GetString("sshKey"),
+		SshKeyPassphrase:          viper.GetString("sshKeyPassphrase"),
+		Repositories:              repositories,
+		Server:                    viper.GetString("server"),
+		WebhookSecret:             webhookSecret,
+		WebhookSecondarySecret:    webhookSecondarySecret,
+		GithubToken:               githubToken,
+		GithubApiUrl:              viper.GetString("github.apiUrl"),
+		GitRetryAttempts:          gitRetryAttempts,
+		GitRetryBackoff:           viper.GetDuration("gitRetryBackoff"),
+		RepoLayout:                viper.GetString("repoLayout"),
+		PingStatusCode:            pingStatusCode,
+		PingCheckRepository:       viper.GetBool("pingCheckRepository"),
+		Compression:               viper.GetString("compression"),
+		TargetConcurrency:         targetConcurrency,
+		ArchiveSymlinks:           archiveSymlinks,
+		ArchiveFileModes:          archiveFileModes,
+		ArchiveAutoloadCheck:      archiveAutoloadCheck,
+		ArchiveMaxFiles:           archiveMaxFiles,
+		ArchiveMaxFileSize:        archiveMaxFileSize,
+		WebhookAuthMode:           webhookAuthMode,
+		WebhookAuthHeader:         viper.GetString("webhookAuth.header"),
+		WebhookAuthToken:          webhookAuthToken,
+		AuditLog:                  strings.Replace(viper.GetString("auditLog"), "${cwd}", workingDirectory, 1),
+		BranchDeleteGracePeriod:   viper.GetDuration("branchDeleteGracePeriod"),
+		JsonResponses:             viper.GetBool("jsonResponses"),
+		MaxPayloadSize:            maxPayloadSize,
+		GitConcurrency:            viper.GetInt("gitConcurrency"),
+		SourceConcurrency:         viper.GetInt("sourceConcurrency"),
+		UploadConcurrency:         viper.GetInt("uploadConcurrency"),
+		WebhookTimeout:            viper.GetDuration("webhookTimeout"),
+		OnPackageRename:           onPackageRename,
+		MaxClones:                 viper.GetInt("maxClones"),
+		DebugEndpoints:            viper.GetBool("debugEndpoints"),
+		ManualSync:                viper.GetBool("manualSync"),
+		Maintenance:               viper.GetBool("maintenance"),
+		RoutePrefix:               viper.GetString("routes.prefix"),
+		ProviderRoutes:            viper.GetStringMapString("routes.providers"),
+		AdminRoutePrefix:          viper.GetString("routes.admin"),
+		SkipUnchangedBranches:     viper.GetBool("skipUnchangedBranches"),
+		StateRetryAttempts:        stateRetryAttempts,
+		StateRetryBackoff:         stateRetryBackoff,
+		PackageNamesRetention:     viper.GetDuration("stateStore.retention.packageNames"),
+		PublishedDigestsRetention: viper.GetDuration("stateStore.retention.publishedDigests"),
+		StatusRetention:           viper.GetDuration("stateStore.retention.status"),
+		StateCompactionInterval:   stateCompactionInterval,
+		StatusSnapshotPath:        viper.GetString("statusSnapshot.path"),
+		StatusSnapshotInterval:    viper.GetDuration("statusSnapshot.interval"),
+		MaxBulkDeletes:            maxBulkDeletes,
+		TracingEndpoint:           viper.GetString("tracing.endpoint"),
+		TracingInsecure:           viper.GetBool("tracing.insecure"),
+		PublishRetryAttempts:      viper.GetInt("publishRetryAttempts"),
+		PublishRetryBackoff:       publishRetryBackoff,
+		ArtifactCollision:         artifactCollision,
+		AllowedPackages:           viper.GetStringSlice("packageNames.allow"),
+		DeniedPackages:            viper.GetStringSlice("packageNames.deny"),
+		ReplaceStrategy:           replaceStrategy,
+		DefaultVendor:             viper.GetString("defaultVendor"),
+		SyncInterval:              syncInterval,
+		DeletionInterval:          deletionInterval,
+		SyncTimeout:               viper.GetDuration("waitForSync.timeout"),
+		CloudsmithUserAgent:       viper.GetString("cloudsmith.userAgent"),
+		CloudsmithHeaders:         cloudsmithHeaders,
+		CloudsmithRequestRate:     viper.GetFloat64("cloudsmith.requestRate"),
+		SelfTestRepository:        viper.GetString("selfTest.repository"),
+		ComposerCacheSize:         composerCacheSize,
+		RequiredFields:            newFieldRulesFromConfig(viper.Get("requiredFields")),
+		RequireRewrites:           newRequireRewritesFromConfig(viper.Get("requireRewrites")),
+		ProvenanceKey:             viper.GetString("provenance.extraKey"),
+		DownloadBaseUrl:           viper.GetString("downloadBaseUrl"),
+		VersionPathPattern:        viper.GetString("versionPaths.pattern"),
+		VersionPathReplacement:    viper.GetString("versionPaths.replacement"),
+	}, nil
+}
+
+func newRepositoryFromConfig(cfg map[interface{}]interface{}) Repository {
+	publishSource := PublishSourceNever
+
+	switch value := cfg["publishSource"].(type) {
+	case bool:
+		if value {
+			publishSource = PublishSourceAlways
+		}
+	case string:
+		publishSource = value
+	}
+
+	url := getString(cfg, "url")
+	name := getString(cfg, "name")
+
+	if url == "" && name != "" {
+		url = "git@github.com:" + name + ".git"
+	}
+
+	return Repository{
+		Url:                 url,
+		Name:                name,
+		PublishSource:       publishSource,
+		TargetRepository:    getString(cfg, "targetRepository"),
+		Tags:                getStringList(cfg, "tags"),
+		StrictVersioning:    getBool(cfg, "strictVersioning"),
+		BuildStep:           newBuildStepFromConfig(cfg["buildStep"]),
+		Packages:            newPackagesFromConfig(cfg["packages"]),
+		UnprefixedTags:      getString(cfg, "unprefixedTags"),
+		Compression:         getString(cfg, "compression"),
+		TargetConcurrency:   getInt(cfg, "targetConcurrency"),
+		ArchiveMaxFiles:     getInt(cfg, "archiveMaxFiles"),
+		ArchiveMaxFileSize:  int64(getInt(cfg, "archiveMaxFileSize")),
+		Transforms:          newTransformsFromConfig(cfg["transforms"]),
+		Replace:             getStringMap(cfg, "replace"),
+		DefaultBranchOnly:   getBool(cfg, "defaultBranchOnly"),
+		DefaultBranch:       getString(cfg, "defaultBranch"),
+		IncludeSubmodules:   getBool(cfg, "includeSubmodules"),
+		KeepVendor:          getBool(cfg, "keepVendor"),
+		TagRule:             newTagRuleFromConfig(cfg["tagRule"]),
+		Staging:             newStagingFromConfig(cfg["staging"]),
+		PublishTargets:      newPublishTargetsFromConfig(cfg["publishTargets"]),
+		VersionSource:       getString(cfg, "versionSource"),
+		StaticVersion:       newStaticVersionFromConfig(cfg["staticVersion"]),
+		PrereleaseStability: getString(cfg, "prereleaseStability"),
+		ImmutableTags:       getBool(cfg, "immutableTags"),
+		Channels:            newChannelsFromConfig(cfg["channels"]),
+		RequiredFields:      newFieldRulesFromConfig(cfg["requiredFields"]),
+		RequireRewrites:     newRequireRewritesFromConfig(cfg["requireRewrites"]),
+		StableAlias:         newStableAliasFromConfig(cfg["stableAlias"]),
+		Metadata:            newMetadataFromConfig(cfg["metadata"]),
+		RequiredChecks:      newRequiredChecksFromConfig(cfg["requiredChecks"]),
+		ReposDir:            getString(cfg, "reposDir"),
+		ArtifactsDir:        getString(cfg, "artifactsDir"),
+		DescriptionFile:     getString(cfg, "descriptionFile"),
+		Manifest:            getString(cfg, "manifest"),
+		PackageRoot:         getString(cfg, "packageRoot"),
+		Transactional:       getBool(cfg, "transactional"),
+		AuthorFilter:        newAuthorFilterFromConfig(cfg["authorFilter"]),
+	}
+}
+
+func newPublishTargetsFromConfig(value interface{}) []PublishTarget {
+	var targets []PublishTarget
+
+	list, _ := value.([]interface{})
+
+	for _, item := range list {
+		if cfg, ok := item.(map[interface{}]interface{}); ok {
+			targets = append(targets, PublishTarget{
+				Format:      getString(cfg, "format"),
+				Repository:  getString(cfg, "repository"),
+				Compression: getString(cfg, "compression"),
+			})
+		}
+	}
+
+	return targets
+}
+
+func newChannelsFromConfig(value interface{}) []ChannelRule {
+	var rules []ChannelRule
+
+	list, _ := value.([]interface{})
+
+	for _, item := range list {
+		if cfg, ok := item.(map[interface{}]interface{}); ok {
+			rules = append(rules, ChannelRule{
+				RefType: getString(cfg, "refType"),
+				Pattern: getString(cfg, "pattern"),
+				Tags:    getStringList(cfg, "tags"),
+			})
+		}
+	}
+
+	return rules
+}
+
+// newFieldRulesFromConfig reads required fields, which block by default
+func newFieldRulesFromConfig(value interface{}) []FieldRule {
+	var rules []FieldRule
+
+	list, _ := value.([]interface{})
+
+	for _, item := range list {
+		if cfg, ok := item.(map[interface{}]interface{}); ok {
+			severity := PolicyBlock
+
+			// An unquoted off is read as false by yaml
+			switch value := cfg["severity"].(type) {
+			case bool:
+				if !value {
+					severity = PolicyOff
+				}
+			case string:
+				severity = value
+			}
+
+			rules = append(rules, FieldRule{
+				Field:    getString(cfg, "field"),
+				Severity: severity,
+			})
+		}
+	}
+
+	return rules
+}
+
+func newRequireRewritesFromConfig(value interface{}) []composer.RequireRewrite {
+	var rewrites []composer.RequireRewrite
+
+	list, _ := value.([]interface{})
+
+	for _, item := range list {
+		if cfg, ok := item.(map[interface{}]interface{}); ok {
+			rewrites = append(rewrites, composer.RequireRewrite{
+				Package:    getString(cfg, "package"),
+				Name:       getString(cfg, "name"),
+				Constraint: getString(cfg, "constraint"),
+			})
+		}
+	}
+
+	return rewrites
+}
+
+func newStableAliasFromConfig(value interface{}) *StableAlias {
+	cfg, ok := value.(map[interface{}]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	return &StableAlias{
+		Tag:                getString(cfg, "tag"),
+		IncludePrereleases: getBool(cfg, "includePrereleases"),
+	}
+}
+
+func newMetadataFromConfig(value interface{}) *Metadata {
+	cfg, ok := value.(map[interface{}]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	return &Metadata{
+		Repository: getString(cfg, "repository"),
+		Version:    getString(cfg, "version"),
+		TagsOnly:   getBool(cfg, "tagsOnly"),
+	}
+}
+
+func newStaticVersionFromConfig(value interface{}) *StaticVersion {
+	cfg, ok := value.(map[interface{}]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	return &StaticVersion{
+		Branches: getString(cfg, "branches"),
+		Tags:     getString(cfg, "tags"),
+	}
+}
+
+func newAuthorFilterFromConfig(value interface{}) *AuthorFilter {
+	cfg, ok := value.(map[interface{}]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	return &AuthorFilter{
+		Allow: getStringList(cfg, "allow"),
+		Deny:  getStringList(cfg, "deny"),
+	}
+}
+
+func newRequiredChecksFromConfig(value interface{}) *RequiredChecks {
+	cfg, ok := value.(map[interface{}]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	timeout, _ := time.ParseDuration(getString(cfg, "timeout"))
+	interval, _ := time.ParseDuration(getString(cfg, "interval"))
+
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	return &RequiredChecks{
+		Checks:   getStringList(cfg, "checks"),
+		Timeout:  timeout,
+		Interval: interval,
+	}
+}
+
+func newStagingFromConfig(value interface{}) *Staging {
+	cfg, ok := value.(map[interface{}]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	return &Staging{
+		Repository: getString(cfg, "repository"),
+		Verify:     newBuildStepFromConfig(cfg["verify"]),
+	}
+}
+
+func newTagRuleFromConfig(value interface{}) composer.TagRule {
+	cfg, ok := value.(map[interface{}]interface{})
+
+	if !ok {
+		return composer.TagRule{}
+	}
+
+	return composer.TagRule{
+		Prefixes: getStringList(cfg, "prefixes"),
+		Suffixes: getStringList(cfg, "suffixes"),
+		Pattern:  getString(cfg, "pattern"),
+	}
+}
+
+func newTransformsFromConfig(value interface{}) []composer.Transform {
+	var transforms []composer.Transform
+
+	list, _ := value.([]interface{})
+
+	for _, item := range list {
+		if cfg, ok := item.(map[interface{}]interface{}); ok {
+			transforms = append(transforms, composer.Transform{
+				Action:  getString(cfg, "action"),
+				Path:    getString(cfg, "path"),
+				Package: getString(cfg, "package"),
+				Value:   toJsonValue(cfg["value"]),
+			})
+		}
+	}
+
+	return transforms
+}
+
+// toJsonValue converts the map[interface{}]interface{} maps yaml gives us
+// into map[string]interface{} so they can be written out as json.
+func toJsonValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+
+		for key, item := range typed {
+			converted[fmt.Sprintf("%v", key)] = toJsonValue(item)
+		}
+
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(typed))
+
+		for i, item := range typed {
+			converted[i] = toJsonValue(item)
+		}
+
+		return converted
+	}
+
+	return value
+}
+
+func newPackagesFromConfig(value interface{}) []Package {
+	var packages []Package
+
+	list, _ := value.([]interface{})
+
+	for _, item := range list {
+		if cfg, ok := item.(map[interface{}]interface{}); ok {
+			packages = append(packages, Package{
+				Path:      getString(cfg, "path"),
+				TagPrefix: getString(cfg, "tagPrefix"),
+			})
+		}
+	}
+
+	return packages
+}
+
+func newBuildStepFromConfig(value interface{}) *BuildStep {
+	cfg, ok := value.(map[interface{}]interface{})
+
+	if !ok {
+		return nil
+	}
+
+	timeout, _ := time.ParseDuration(getString(cfg, "timeout"))
+
+	return &BuildStep{
+		Command:    getString(cfg, "command"),
+		Timeout:    timeout,
+		Env:        getStringMap(cfg, "env"),
+		InheritEnv: getBool(cfg, "inheritEnv"),
+	}
+}
+
+func getString(cfg map[interface{}]interface{}, key string) string {
+	value, _ := cfg[key].(string)
+
+	return value
+}
+
+func getInt(cfg map[interface{}]interface{}, key string) int {
+	value, _ := cfg[key].(int)
+
+	return value
+}
+
+func getBool(cfg map[interface{}]interface{}, key string) bool {
+	value, _ := cfg[key].(bool)
+
+	return value
+}
+
+func getStringMap(cfg map[interface{}]interface{}, key string) map[string]string {
+	values := map[string]string{}
+
+	items, _ := cfg[key].(map[interface{}]interface{})
+
+	for name, value := range items {
+		values[fmt.Sprintf("%v", name)] = fmt.Sprintf("%v", value)
+	}
+
+	return values
+}
+
+func getStringList(cfg map[interface{}]interface{}, key string) []string {
+	var values []string
+
+	list, _ := cfg[key].([]interface{})
+
+	for _, item := range list {
+		if value, ok := item.(string); ok {
+			values = append(values, value)
+		}
+	}
+
+	return values
 }
@@ -0,0 +1,532 @@
+package config_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newValidConfig(repositories ...config.Repository) *config.Config {
+	for i := range repositories {
+		repositories[i].PublishSource = config.PublishSourceNever
+	}
+
+	return &config.Config{
+		TargetRepository:        "packages",
+		Repositories:            repositories,
+		WebhookAuthMode:         config.WebhookAuthHmac,
+		MaxPayloadSize:          1024,
+		PingStatusCode:          201,
+		OnPackageRename:         config.PackageRenameWarn,
+		ArtifactCollision:       config.ArtifactCollisionUnique,
+		ReplaceStrategy:         config.ReplaceDeleteThenUpload,
+		ArchiveSymlinks:         config.SymlinksFollow,
+		ArchiveFileModes:        config.FileModesNormalize,
+		ArchiveAutoloadCheck:    config.AutoloadCheckIgnore,
+		StateRetryAttempts:      3,
+		StateCompactionInterval: time.Hour,
+		TargetConcurrency:       1,
+	}
+}
+
+func TestValidateRefusesDuplicateRepositories(t *testing.T) {
+	duplicates := map[string][]config.Repository{
+		"ssh and https urls": {
+			{Url: "git@github.com:acme/widgets.git"},
+			{Url: "https://github.com/Acme/widgets"},
+		},
+		"names": {
+			{Url: "git@github.com:acme/widgets.git", Name: "acme/widgets"},
+			{Url: "git@github.com:acme/widgets-mirror.git", Name: "Acme/Widgets"},
+		},
+	}
+
+	for name, repositories := range duplicates {
+		if err := newValidConfig(repositories...).Validate(); err == nil {
+			t.Errorf("[!] Validate(%s) = nil; want duplicates to be refused", name)
+		}
+	}
+
+	distinct := newValidConfig(
+		config.Repository{Url: "git@github.com:acme/widgets.git", Name: "acme/widgets"},
+		config.Repository{Url: "git@github.com:acme/gadgets.git"},
+	)
+
+	if err := distinct.Validate(); err != nil {
+		t.Errorf("[!] Validate() = %v; want distinct repositories to be accepted", err)
+	}
+}
+
+func TestGetRepositoryPrefersNameThenFirstDeclared(t *testing.T) {
+	cfg := newValidConfig(
+		config.Repository{Url: "git@github.com:acme/widgets.git", TargetRepository: "first"},
+		config.Repository{Url: "https://github.com/acme/widgets", TargetRepository: "second"},
+		config.Repository{Url: "git@github.com:acme/mirror.git", Name: "acme/widgets", TargetRepository: "named"},
+	)
+
+	repo, err := cfg.GetRepository("acme/widgets", "git@github.com:acme/widgets.git")
+
+	if err != nil || repo.TargetRepository != "named" {
+		t.Errorf("[!] GetRepository(acme/widgets) = %s, %v; want the entry with that name", repo.TargetRepository, err)
+	}
+
+	repo, err = cfg.GetRepository("", "git@github.com:acme/widgets.git")
+
+	if err != nil || repo.TargetRepository != "first" {
+		t.Errorf("[!] GetRepository(url) = %s, %v; want the first declared entry", repo.TargetRepository, err)
+	}
+}
+
+func TestRepositoryDeriveVersion(t *testing.T) {
+	data := composer.ComposerFile{"name": "acme/widgets", "version": "2.3.0"}
+
+	// [][]interface{}{version source, ref, is branch, expected version}
+	tests := [][]interface{}{
+		{"", "master", true, "dev-master"},
+		{config.VersionSourceRef, "v1.0.0", false, "v1.0.0"},
+		{config.VersionSourceComposer, "master", true, "2.3.0"},
+		{config.VersionSourceComposer, "v1.0.0", false, "2.3.0"},
+		{config.VersionSourceRefThenComposer, "master", true, "2.3.0"},
+		{config.VersionSourceRefThenComposer, "v1.0.0", false, "v1.0.0"},
+	}
+
+	for _, test := range tests {
+		repo := config.Repository{VersionSource: test[0].(string)}
+		version, _, err := repo.DeriveVersion(test[1].(string), test[2].(bool), data)
+
+		if err != nil || version != test[3] {
+			t.Errorf("[!] DeriveVersion(%s, %s) = %s, %v; want %s", test[0], test[1], version, err, test[3])
+		}
+	}
+
+	static := config.Repository{VersionSource: config.VersionSourceComposer, StaticVersion: &config.StaticVersion{Branches: "1.0.x-dev"}}
+
+	if version, normalised, err := static.DeriveVersion("feature/anything", true, data); version != "1.0.x-dev" || normalised != "1.0.9999999.9999999-dev" || err != nil {
+		t.Errorf("[!] DeriveVersion(static) = %s, %s, %v; want 1.0.x-dev, 1.0.9999999.9999999-dev", version, normalised, err)
+	}
+
+	// Tags without a static version still come from versionSource
+	if version, _, err := static.DeriveVersion("v1.0.0", false, data); version != "2.3.0" || err != nil {
+		t.Errorf("[!] DeriveVersion(static, tag) = %s, %v; want 2.3.0", version, err)
+	}
+
+	stable := config.Repository{PrereleaseStability: config.PrereleaseStabilityStable}
+
+	// [][]interface{}{ref, is branch, expected version, expected normalised version}
+	stableTests := [][]interface{}{
+		{"v2.0.0-beta1", false, "v2.0.0-beta1", "2.0.0.0"},
+		{"v2.0.0-RC2", false, "v2.0.0-RC2", "2.0.0.0"},
+		{"v2.0.0-patch1", false, "v2.0.0-patch1", "2.0.0.0-patch1"},
+		{"v2.0.0", false, "v2.0.0", "2.0.0.0"},
+		{"2.x", true, "2.x-dev", "2.9999999.9999999.9999999-dev"},
+	}
+
+	for _, test := range stableTests {
+		version, normalised, err := stable.DeriveVersion(test[0].(string), test[1].(bool), data)
+
+		if err != nil || version != test[2] || normalised != test[3] {
+			t.Errorf("[!] DeriveVersion(stable, %s) = %s, %s, %v; want %s, %s", test[0], version, normalised, err, test[2], test[3])
+		}
+	}
+
+	if _, normalised, _ := (&config.Repository{}).DeriveVersion("v2.0.0-beta1", false, data); normalised != "2.0.0.0-beta1" {
+		t.Errorf("[!] DeriveVersion(v2.0.0-beta1) normalised = %s; want 2.0.0.0-beta1", normalised)
+	}
+
+	invalidStatic := newValidConfig(config.Repository{Url: "git@github.com:acme/widgets.git", StaticVersion: &config.StaticVersion{Tags: "not a version"}})
+
+	if err := invalidStatic.Validate(); err == nil {
+		t.Errorf("[!] Validate() with an invalid staticVersion = nil; want an error")
+	}
+
+	repo := config.Repository{VersionSource: config.VersionSourceComposer}
+
+	for _, invalid := range []composer.ComposerFile{{}, {"version": "not a version"}} {
+		if _, _, err := repo.DeriveVersion("master", true, invalid); err == nil {
+			t.Errorf("[!] DeriveVersion(composer-json) of %v = nil; want an error so it's skipped", invalid)
+		}
+	}
+}
+
+func TestRepositoryReadDescription(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("# Widgets\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data := composer.ComposerFile{"description": "Makes widgets"}
+
+	cases := []struct {
+		file     string
+		expected string
+	}{
+		{"README.md", "# Widgets\n"},
+		{"MISSING.md", "Makes widgets"},
+		{"", "Makes widgets"},
+	}
+
+	for _, c := range cases {
+		repo := config.Repository{DescriptionFile: c.file}
+		description, err := repo.ReadDescription(dir, data)
+
+		if err != nil || description != c.expected {
+			t.Errorf("[!] ReadDescription() with %q = %q, %v; want %q", c.file, description, err, c.expected)
+		}
+	}
+}
+
+func TestGetPackageTagsAddsFirstMatchingChannel(t *testing.T) {
+	repo := config.Repository{
+		Tags: []string{"ci:passed"},
+		Channels: []config.ChannelRule{
+			{RefType: config.ChannelRefTag, Tags: []string{"stable"}},
+			{RefType: config.ChannelRefBranch, Pattern: "release/*", Tags: []string{"beta"}},
+			{RefType: config.ChannelRefBranch, Pattern: "develop", Tags: []string{"nightly"}},
+			{Pattern: "*", Tags: []string{"unstable"}},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		isBranch bool
+		expected []string
+	}{
+		{"v1.0.0", false, []string{"ci:passed", "tag:v1.0.0", "stable"}},
+		{"release/1.1", true, []string{"ci:passed", "branch:release/1.1", "beta"}},
+		{"develop", true, []string{"ci:passed", "branch:develop", "nightly"}},
+		{"feature", true, []string{"ci:passed", "branch:feature", "unstable"}},
+		{"feature/widgets", true, []string{"ci:passed", "branch:feature/widgets"}},
+	}
+
+	for _, c := range cases {
+		if tags := repo.GetPackageTags(c.name, c.isBranch); !reflect.DeepEqual(tags, c.expected) {
+			t.Errorf("[!] GetPackageTags(%s, %v) = %v; want %v", c.name, c.isBranch, tags, c.expected)
+		}
+	}
+}
+
+func TestCheckRequiredFieldsAppliesRepositoryOverrides(t *testing.T) {
+	cfg := newValidConfig()
+	cfg.RequiredFields = []config.FieldRule{
+		{Field: "license", Severity: config.PolicyBlock},
+		{Field: "description", Severity: config.PolicyBlock},
+		{Field: "authors", Severity: config.PolicyBlock},
+	}
+
+	repo := config.Repository{
+		RequiredFields: []config.FieldRule{
+			{Field: "description", Severity: config.PolicyWarn},
+			{Field: "authors", Severity: config.PolicyOff},
+		},
+	}
+
+	data := composer.ComposerFile{"license": "  ", "description": "", "authors": []interface{}{}}
+	warnings, violations := cfg.CheckRequiredFields(&repo, data)
+
+	if !reflect.DeepEqual(warnings, []string{"description is missing"}) {
+		t.Errorf("[!] CheckRequiredFields() warnings = %v; want only description", warnings)
+	}
+
+	if !reflect.DeepEqual(violations, []string{"license is missing"}) {
+		t.Errorf("[!] CheckRequiredFields() violations = %v; want only license", violations)
+	}
+
+	complete := composer.ComposerFile{"license": "MIT", "description": "Makes widgets"}
+
+	if warnings, violations := cfg.CheckRequiredFields(&repo, complete); warnings != nil || violations != nil {
+		t.Errorf("[!] CheckRequiredFields() = %v, %v; want nothing missing", warnings, violations)
+	}
+}
+
+func TestRequiredFieldsReadAnUnquotedOffAsOff(t *testing.T) {
+	defer viper.Reset()
+
+	viper.SetConfigType("yaml")
+
+	yaml := `
+requiredFields:
+  - field: license
+    severity: off
+repositories:
+  - url: git@github.com:acme/widgets.git
+    requiredFields:
+      - field: authors
+        severity: off
+`
+
+	if err := viper.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.NewConfigFromViper("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []config.FieldRule{{Field: "license", Severity: config.PolicyOff}}; !reflect.DeepEqual(cfg.RequiredFields, want) {
+		t.Errorf("[!] RequiredFields = %v; want %v", cfg.RequiredFields, want)
+	}
+
+	if want := []config.FieldRule{{Field: "authors", Severity: config.PolicyOff}}; !reflect.DeepEqual(cfg.Repositories[0].RequiredFields, want) {
+		t.Errorf("[!] repository RequiredFields = %v; want %v", cfg.Repositories[0].RequiredFields, want)
+	}
+}
+
+func TestRepositoryStorageOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo := config.Repository{Url: "git@github.com:acme/huge.git", ReposDir: dir, ArtifactsDir: dir}
+	cfg := newValidConfig(repo)
+	cfg.DataDir = "/data"
+
+	if path := cfg.GetReposDir(&cfg.Repositories[0]); path != dir {
+		t.Errorf("[!] GetReposDir(huge) = %s; want %s", path, dir)
+	}
+
+	if path := cfg.GetRepositoryArtifactPath(&cfg.Repositories[0], "huge.zip"); path != dir+"/huge.zip" {
+		t.Errorf("[!] GetRepositoryArtifactPath(huge) = %s; want it in %s", path, dir)
+	}
+
+	if path := cfg.GetArtifactPath("other.zip"); path != "/data/artifacts/other.zip" {
+		t.Errorf("[!] GetArtifactPath() = %s; want the global artifacts directory", path)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("[!] Validate() = %v; want an existing directory to be accepted", err)
+	}
+
+	if err := cfg.CheckArtifactsDir(&cfg.Repositories[0]); err != nil {
+		t.Errorf("[!] CheckArtifactsDir(huge) = %v; want a writable directory to pass", err)
+	}
+
+	if err := cfg.CheckArtifactsDirs(); err == nil {
+		t.Errorf("[!] CheckArtifactsDirs() = nil; want the missing /data/artifacts to fail")
+	}
+
+	cfg.Repositories[0].ArtifactsDir = filepath.Join(dir, "gone")
+
+	if err := cfg.CheckArtifactsDir(&cfg.Repositories[0]); err == nil || !strings.Contains(err.Error(), "artifact directory not writable") {
+		t.Errorf("[!] CheckArtifactsDir(huge) = %v; want a missing directory to be not writable", err)
+	}
+
+	cfg.Repositories[0].ReposDir = filepath.Join(dir, "missing")
+
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("[!] Validate() = nil; want a missing reposDir to be refused")
+	}
+}
+
+func TestSanitizeVersion(t *testing.T) {
+	cfg := &config.Config{}
+
+	versions := map[string]string{
+		"1.2.0":                "1.2.0",
+		"v1.2.0-beta1+build.5": "v1.2.0-beta1+build.5",
+		"dev-feature/JIRA-123": "dev-feature-JIRA-123",
+		"dev-../../etc/passwd": "dev-..-..-etc-passwd",
+		`dev-windows\path`:     "dev-windows-path",
+		"dev-fix: a*b?":        "dev-fix--a-b-",
+		"..":                   "--",
+	}
+
+	for version, want := range versions {
+		if sanitized := cfg.SanitizeVersion(version); sanitized != want {
+			t.Errorf("[!] SanitizeVersion(%q) = %q; want %q", version, sanitized, want)
+		}
+	}
+
+	// A pattern that misses path separators still can't produce one
+	cfg.VersionPathPattern = `[*?]`
+	cfg.VersionPathReplacement = "_"
+
+	if sanitized := cfg.SanitizeVersion("dev-feature/a*b"); sanitized != "dev-feature_a_b" {
+		t.Errorf("[!] SanitizeVersion(dev-feature/a*b) = %q; want dev-feature_a_b", sanitized)
+	}
+}
+
+func TestRepositoryOwner(t *testing.T) {
+	urls := map[string]string{
+		"git@github.com:Acme/widgets.git":              "acme",
+		"https://github.com/acme/widgets":              "acme",
+		"ssh://git@github.acme.internal/tools/cli.git": "tools",
+		"not-a-url": "",
+	}
+
+	for url, want := range urls {
+		if owner := config.RepositoryOwner(url); owner != want {
+			t.Errorf("[!] RepositoryOwner(%s) = %q; want %q", url, owner, want)
+		}
+	}
+}
+
+func TestCheckBulkDelete(t *testing.T) {
+	cfg := &config.Config{MaxBulkDeletes: 20}
+
+	cases := [][]interface{}{
+		{5, 0, true},
+		{20, 0, true},
+		{21, 0, false},
+		{21, 20, false},
+		{21, 21, true},
+	}
+
+	for _, c := range cases {
+		count, confirmed, allowed := c[0].(int), c[1].(int), c[2].(bool)
+
+		if err := cfg.CheckBulkDelete(count, confirmed); (err == nil) != allowed {
+			t.Errorf("[!] CheckBulkDelete(%d, %d) = %v; want allowed %v", count, confirmed, err, allowed)
+		}
+	}
+
+	cfg.MaxBulkDeletes = 0
+
+	if err := cfg.CheckBulkDelete(1000, 0); err != nil {
+		t.Errorf("[!] CheckBulkDelete(1000, 0) = %v; want no limit", err)
+	}
+}
+
+func TestGetMetadataVersion(t *testing.T) {
+	cfg := &config.Config{}
+
+	versions := map[string]string{
+		"":                 "latest",
+		"latest-{ref}":     "latest-feature-login",
+		"{ref}-pointer":    "feature-login-pointer",
+		"releases/{ref}":   "releases-feature-login",
+		"../../{ref}-meta": "..-..-feature-login-meta",
+	}
+
+	for version, want := range versions {
+		repo := &config.Repository{Metadata: &config.Metadata{Version: version}}
+
+		if got := cfg.GetMetadataVersion(repo, "feature/login"); got != want {
+			t.Errorf("[!] GetMetadataVersion(feature/login) with %q = %q; want %q", version, got, want)
+		}
+	}
+
+	var off *config.Metadata
+
+	if off.Publishes(false) || (&config.Metadata{TagsOnly: true}).Publishes(true) {
+		t.Errorf("[!] Publishes() = true; want no metadata without it, or for branches when it's tags only")
+	}
+}
+
+func TestRepositoryFullName(t *testing.T) {
+	urls := map[string]string{
+		"git@github.com:Acme/widgets.git":              "acme/widgets",
+		"https://github.com/acme/widgets":              "acme/widgets",
+		"ssh://git@github.acme.internal/tools/cli.git": "tools/cli",
+		"not-a-url": "",
+	}
+
+	for url, want := range urls {
+		if name := config.RepositoryFullName(url); name != want {
+			t.Errorf("[!] RepositoryFullName(%s) = %q; want %q", url, name, want)
+		}
+	}
+}
+
+func TestAuthorFilterAllows(t *testing.T) {
+	deny := &config.AuthorFilter{Deny: []string{"dependabot*", "*@bots.example.com"}}
+	allow := &config.AuthorFilter{Allow: []string{"release-please*"}, Deny: []string{"*@bots.example.com"}}
+
+	cases := []struct {
+		filter     *config.AuthorFilter
+		identities []string
+		expected   bool
+	}{
+		{nil, []string{"octocat"}, true},
+		{deny, []string{"octocat", "octocat@example.com"}, true},
+		{deny, []string{"Dependabot[bot]", ""}, false},
+		{deny, []string{"octocat", "ci@bots.example.com"}, false},
+		{allow, []string{"release-please[bot]", "octocat@example.com"}, true},
+		{allow, []string{"octocat", "octocat@example.com"}, false},
+		{allow, []string{"release-please[bot]", "release@bots.example.com"}, false},
+		{allow, []string{"", ""}, false},
+	}
+
+	for _, c := range cases {
+		if allowed := c.filter.Allows(c.identities); allowed != c.expected {
+			t.Errorf("[!] Allows(%q) with %+v = %v; want %v", c.identities, c.filter, allowed, c.expected)
+		}
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	cfg := newValidConfig()
+
+	if cfg.ProviderRoute(config.ProviderGithub) != "/webhooks/github" || cfg.AdminRoute("/sync") != "/sync" {
+		t.Errorf("[!] default routes = %s, %s; want /webhooks/github, /sync", cfg.ProviderRoute(config.ProviderGithub), cfg.AdminRoute("/sync"))
+	}
+
+	cfg.RoutePrefix = "/cloudsmith-sync"
+	cfg.AdminRoutePrefix = "/admin"
+	cfg.ProviderRoutes = map[string]string{config.ProviderGithub: "/hooks/github"}
+
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("[!] Validate() = %v; want prefixed routes to be accepted", err)
+	}
+
+	if cfg.ProviderRoute(config.ProviderGithub) != "/cloudsmith-sync/hooks/github" || cfg.AdminRoute("/sync") != "/cloudsmith-sync/admin/sync" {
+		t.Errorf("[!] prefixed routes = %s, %s; want them under /cloudsmith-sync", cfg.ProviderRoute(config.ProviderGithub), cfg.AdminRoute("/sync"))
+	}
+
+	invalid := map[string]func(cfg *config.Config){
+		"prefix without a slash":   func(cfg *config.Config) { cfg.RoutePrefix = "hooks" },
+		"prefix with a slash":      func(cfg *config.Config) { cfg.RoutePrefix = "/hooks/" },
+		"unknown provider":         func(cfg *config.Config) { cfg.ProviderRoutes = map[string]string{"gitlab": "/hooks/gitlab"} },
+		"empty provider path":      func(cfg *config.Config) { cfg.ProviderRoutes = map[string]string{config.ProviderGithub: ""} },
+		"provider on an admin one": func(cfg *config.Config) { cfg.ProviderRoutes = map[string]string{config.ProviderGithub: "/sync"} },
+		"provider on the metrics":  func(cfg *config.Config) { cfg.ProviderRoutes = map[string]string{config.ProviderGithub: "/metrics"} },
+	}
+
+	for name, configure := range invalid {
+		cfg := newValidConfig()
+		configure(cfg)
+
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("[!] Validate(%s) = nil; want an error", name)
+		}
+	}
+}
+
+func TestGetPackagesForRefUsesPackageRoot(t *testing.T) {
+	repo := config.Repository{Url: "git@github.com:acme/widgets.git", PackageRoot: "src"}
+	packages, versionRef, err := repo.GetPackagesForRef("v1.0.0", false)
+
+	if err != nil || !reflect.DeepEqual(packages, []config.Package{{Path: "src"}}) || versionRef != "v1.0.0" {
+		t.Errorf("[!] GetPackagesForRef(v1.0.0) = %v, %s, %v; want the package in src", packages, versionRef, err)
+	}
+
+	invalid := map[string]config.Repository{
+		"outside the repository": {Url: "git@github.com:acme/widgets.git", PackageRoot: "../src"},
+		"with packages":          {Url: "git@github.com:acme/widgets.git", PackageRoot: "src", Packages: []config.Package{{Path: "lib"}}},
+	}
+
+	for name, repo := range invalid {
+		if err := newValidConfig(repo).Validate(); err == nil {
+			t.Errorf("[!] Validate(packageRoot %s) = nil; want an error", name)
+		}
+	}
+}
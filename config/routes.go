@@ -0,0 +1,116 @@
+package config
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	// ProviderGithub serves GitHub's webhooks, and its diff endpoint under
+	// the same path
+	ProviderGithub = "github"
+)
+
+// DefaultProviderRoutes are the paths webhook providers are served at when
+// routes.providers doesn't move them
+var DefaultProviderRoutes = map[string]string{
+	ProviderGithub: "/webhooks/github",
+}
+
+// AdminRoutes are served under routes.admin, they change what's published so
+// can be routed separately to the webhooks
+var AdminRoutes = []string{"/sync", "/plan", "/maintenance", "/reconcile", "/snapshot"}
+
+// Route is the path an endpoint is served at, under routes.prefix
+func (config *Config) Route(path string) string {
+	return config.RoutePrefix + path
+}
+
+// ProviderRoute is the path a Provider*'s webhooks are served at
+func (config *Config) ProviderRoute(provider string) string {
+	if path, ok := config.ProviderRoutes[provider]; ok {
+		return config.Route(path)
+	}
+
+	return config.Route(DefaultProviderRoutes[provider])
+}
+
+// AdminRoute is the path one of the AdminRoutes is served at
+func (config *Config) AdminRoute(path string) string {
+	return config.Route(config.AdminRoutePrefix + path)
+}
+
+// validateRoutes checks the prefixes and provider paths are paths, and that
+// no two endpoints end up served at the same one
+func validateRoutes(config *Config) error {
+	if !isRoutePath(config.RoutePrefix, true) {
+		return errors.New("routes.prefix must start with / and not end with one")
+	}
+
+	if !isRoutePath(config.AdminRoutePrefix, true) {
+		return errors.New("routes.admin must start with / and not end with one")
+	}
+
+	for name, path := range config.ProviderRoutes {
+		if _, ok := DefaultProviderRoutes[name]; !ok {
+			return errors.New("routes.providers has an unknown provider " + name)
+		}
+
+		if !isRoutePath(path, false) {
+			return errors.New("routes.providers." + name + " must start with / and not end with one")
+		}
+	}
+
+	var providers []string
+
+	for provider := range DefaultProviderRoutes {
+		providers = append(providers, provider)
+	}
+
+	sort.Strings(providers)
+
+	routes := map[string]string{}
+
+	use := func(path, name string) error {
+		if other, ok := routes[path]; ok {
+			return errors.New("routes: " + path + " is used by both " + other + " and " + name)
+		}
+
+		routes[path] = name
+
+		return nil
+	}
+
+	for _, path := range []string{"/metrics", "/ready", "/status"} {
+		if err := use(config.Route(path), strings.TrimPrefix(path, "/")); err != nil {
+			return err
+		}
+	}
+
+	for _, provider := range providers {
+		if err := use(config.ProviderRoute(provider), provider+" webhooks"); err != nil {
+			return err
+		}
+	}
+
+	if err := use(config.ProviderRoute(ProviderGithub)+"/diff", ProviderGithub+" diff"); err != nil {
+		return err
+	}
+
+	for _, path := range AdminRoutes {
+		if err := use(config.AdminRoute(path), strings.TrimPrefix(path, "/")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isRoutePath(path string, optional bool) bool {
+	if path == "" {
+		return optional
+	}
+
+	return strings.HasPrefix(path, "/") && !strings.HasSuffix(path, "/") && !strings.ContainsAny(path, "{}")
+}
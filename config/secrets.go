@@ -0,0 +1,43 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ResolveSecret turns a secret from the config file into its value. Secrets
+// can be written literally, as file:/path/to/secret to read it from a file or
+// as env:NAME to read it from an environment variable.
+func ResolveSecret(value string) (string, error) {
+	if strings.HasPrefix(value, "file:") {
+		path := strings.TrimPrefix(value, "file:")
+		contents, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return "", errors.New("unable to read secret from " + path + ": " + err.Error())
+		}
+
+		secret := strings.TrimSpace(string(contents))
+
+		if secret == "" {
+			return "", errors.New("secret file " + path + " is empty")
+		}
+
+		return secret, nil
+	}
+
+	if strings.HasPrefix(value, "env:") {
+		name := strings.TrimPrefix(value, "env:")
+		secret := strings.TrimSpace(os.Getenv(name))
+
+		if secret == "" {
+			return "", errors.New("environment variable " + name + " is empty or not set")
+		}
+
+		return secret, nil
+	}
+
+	return value, nil
+}
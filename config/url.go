@@ -0,0 +1,64 @@
+package config
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var scpLikeUrl = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.+)$`)
+
+// RepositoryOwner is the owner, the GitHub user or organisation, from a git
+// url
+func RepositoryOwner(gitUrl string) string {
+	parts := strings.Split(CanonicalUrl(gitUrl), "/")
+
+	if len(parts) < 3 {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// RepositoryFullName is the owner/repo name, as GitHub's API knows it, from a
+// git url
+func RepositoryFullName(gitUrl string) string {
+	parts := strings.SplitN(CanonicalUrl(gitUrl), "/", 2)
+
+	if len(parts) < 2 || !strings.Contains(parts[1], "/") {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// CanonicalUrl reduces a git url to host/owner/repo so the same repository
+// matches no matter which protocol it was written with, or whichever host it
+// lives on (GitHub Enterprise pushes carry their own hostname).
+func CanonicalUrl(gitUrl string) string {
+	gitUrl = strings.TrimSpace(gitUrl)
+
+	var host, path string
+
+	if strings.Contains(gitUrl, "://") {
+		urlInfo, err := url.Parse(gitUrl)
+
+		if err != nil {
+			return strings.ToLower(gitUrl)
+		}
+
+		host = urlInfo.Hostname()
+		path = urlInfo.Path
+	} else if r := scpLikeUrl.FindStringSubmatch(gitUrl); len(r) > 0 {
+		// git@host:owner/repo.git
+		host = r[1]
+		path = r[2]
+	} else {
+		return strings.ToLower(gitUrl)
+	}
+
+	path = strings.Trim(path, "/")
+	path = strings.TrimSuffix(path, ".git")
+
+	return strings.ToLower(host + "/" + path)
+}
@@ -0,0 +1,61 @@
+package git
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// artifacts are the artifact paths currently being written or uploaded. Two
+// packages can share a commit ref (a fork and its upstream at the same SHA)
+// and so an artifact name, this stops one overwriting the other's file.
+var artifacts = struct {
+	mutex sync.Mutex
+	freed *sync.Cond
+	inUse map[string]bool
+}{inUse: map[string]bool{}}
+
+func init() {
+	artifacts.freed = sync.NewCond(&artifacts.mutex)
+}
+
+// ReserveArtifact returns where the artifact normally written to path should
+// go and the function to call once it has been uploaded. When path is already
+// in use it either waits for it or, by default, gives a path with the same
+// file name in a temporary directory of its own, depending on
+// Config.ArtifactCollision.
+func ReserveArtifact(path string) (string, func(), error) {
+	artifacts.mutex.Lock()
+	defer artifacts.mutex.Unlock()
+
+	if Config != nil && Config.ArtifactCollision == config.ArtifactCollisionWait {
+		for artifacts.inUse[path] {
+			artifacts.freed.Wait()
+		}
+	}
+
+	if !artifacts.inUse[path] {
+		artifacts.inUse[path] = true
+
+		return path, func() {
+			artifacts.mutex.Lock()
+			delete(artifacts.inUse, path)
+			artifacts.mutex.Unlock()
+
+			artifacts.freed.Broadcast()
+		}, nil
+	}
+
+	// The file name is what Cloudsmith shows for the package so it's kept
+	dir, err := ioutil.TempDir(filepath.Dir(path), "collision-")
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return filepath.Join(dir, filepath.Base(path)), func() {
+		_ = os.RemoveAll(dir)
+	}, nil
+}
@@ -0,0 +1,131 @@
+package git_test
+
+import (
+	"archive/zip"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReserveArtifactKeepsCollidingArtifactsApart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	git.Config = &config.Config{DataDir: dir, ArtifactCollision: config.ArtifactCollisionUnique}
+
+	// A fork and its upstream at the same SHA give the same artifact name
+	name := filepath.Join(dir, "acme-widgets-0123abc.zip")
+
+	upstream, releaseUpstream, err := git.ReserveArtifact(name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fork, releaseFork, err := git.ReserveArtifact(name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upstream == fork {
+		t.Fatalf("[!] ReserveArtifact() gave %s to both packages", fork)
+	}
+
+	if filepath.Base(fork) != filepath.Base(name) {
+		t.Errorf("[!] ReserveArtifact() = %s; want the file name kept", fork)
+	}
+
+	for artifact, contents := range map[string]string{upstream: "upstream", fork: "fork"} {
+		repo := filepath.Join(dir, contents)
+		os.MkdirAll(repo, 0755)
+
+		if err := ioutil.WriteFile(filepath.Join(repo, "composer.json"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := git.CreateArtifactFromRepository(repo, artifact, git.ArchiveOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for artifact, expected := range map[string]string{upstream: "upstream", fork: "fork"} {
+		archive, err := zip.OpenReader(artifact)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := archive.File[0].Open()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, _ := ioutil.ReadAll(file)
+		file.Close()
+		archive.Close()
+
+		if string(actual) != expected {
+			t.Errorf("[!] %s contains %q; want %q", artifact, actual, expected)
+		}
+	}
+
+	releaseFork()
+
+	if _, err := os.Stat(filepath.Dir(fork)); !os.IsNotExist(err) {
+		t.Errorf("[!] releasing %s left its directory behind", fork)
+	}
+
+	releaseUpstream()
+
+	if _, err := os.Stat(upstream); err != nil {
+		t.Errorf("[!] releasing %s removed the artifact: %v", upstream, err)
+	}
+}
+
+func TestReserveArtifactWaitsForArtifactInUse(t *testing.T) {
+	git.Config = &config.Config{ArtifactCollision: config.ArtifactCollisionWait}
+
+	name := filepath.Join(os.TempDir(), "acme-widgets-0123abc.zip")
+
+	_, release, err := git.ReserveArtifact(name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reserved := make(chan string)
+
+	go func() {
+		path, releaseSecond, _ := git.ReserveArtifact(name)
+		releaseSecond()
+		reserved <- path
+	}()
+
+	select {
+	case <-reserved:
+		t.Fatal("[!] ReserveArtifact() didn't wait for the artifact in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+
+	select {
+	case path := <-reserved:
+		if path != name {
+			t.Errorf("[!] ReserveArtifact() = %s after waiting; want %s", path, name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("[!] ReserveArtifact() still waiting after the artifact was released")
+	}
+}
@@ -1,44 +1,105 @@
 package git
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/limit"
 	"gopkg.in/src-d/go-git.v4"
 	config2 "gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+	"io"
 	"os"
+	"strings"
+	"sync"
 )
 
 var Config *config.Config
 
-func CloneOrOpenAndUpdate(url, path string) (*git.Repository, error) {
-	if _, err := os.Stat(path); err == nil {
-		return OpenAndFetch(path)
+var operationLimit *limit.Limit
+var operationLimitOnce sync.Once
+
+// operations limits how many clones and fetches run at once, it is created
+// the first time it is needed as Config isn't set until a command runs
+func operations() *limit.Limit {
+	operationLimitOnce.Do(func() {
+		if Config != nil {
+			operationLimit = limit.New(Config.GitConcurrency)
+		}
+	})
+
+	return operationLimit
+}
+
+// OperationsInUse is how many clones and fetches are currently running
+func OperationsInUse() int {
+	return operations().InUse()
+}
+
+// CloneOrOpenAndUpdate and the other functions that talk to a remote stop
+// as soon as ctx is done, including in the middle of a transfer or while
+// waiting to retry.
+func CloneOrOpenAndUpdate(ctx context.Context, url, path string) (*git.Repository, error) {
+	if _, err := os.Stat(path); err != nil {
+		return Clone(ctx, url, path)
+	}
+
+	repo, err := OpenAndFetch(ctx, path)
+
+	// Transient errors have already been retried and anything else, like a
+	// bad key or a missing remote, won't be fixed by cloning again. Only a
+	// broken clone is thrown away to start over. Clone doesn't come back
+	// through here so this can only ever happen once per call.
+	if err != nil && ctx.Err() == nil && IsCorruptClone(err) {
+		fmt.Printf("Unable to update %s (%v), re-cloning\n", path, err)
+
+		if err := os.RemoveAll(path); err != nil {
+			return nil, err
+		}
+
+		return Clone(ctx, url, path)
 	}
 
-	return Clone(url, path)
+	return repo, err
 }
 
 func GetAuth() (*ssh.PublicKeys, error) {
 	return ssh.NewPublicKeysFromFile("git", Config.SshKey, "")
 }
 
-func Clone(url, path string) (*git.Repository, error) {
+func Clone(ctx context.Context, url, path string) (*git.Repository, error) {
 	auth, err := GetAuth()
 
 	if err != nil {
 		return nil, err
 	}
 
-	git.PlainClone(path, false, &git.CloneOptions{
-		URL:  url,
-		Auth: auth,
+	err = withRetry(ctx, "Cloning "+url, func() error {
+		_, err := git.PlainCloneContext(ctx, path, false, &git.CloneOptions{
+			URL:  url,
+			Auth: auth,
+		})
+
+		// Don't leave a half cloned repository around for the next attempt
+		if err != nil {
+			os.RemoveAll(path)
+		}
+
+		return err
 	})
 
-	return OpenAndFetch(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenAndFetch(ctx, path)
 }
 
-func OpenAndFetch(path string) (*git.Repository, error) {
+func OpenAndFetch(ctx context.Context, path string) (*git.Repository, error) {
 	repo, err := git.PlainOpen(path)
 
 	if err != nil {
@@ -51,22 +112,76 @@ func OpenAndFetch(path string) (*git.Repository, error) {
 		return nil, err
 	}
 
-	err = repo.Fetch(&git.FetchOptions{
-		RefSpecs: []config2.RefSpec{
-			"refs/tags/*:refs/tags/*",
-			"refs/heads/*:refs/heads/*",
-		},
-		Auth: auth,
+	err = withRetry(ctx, "Fetching "+path, func() error {
+		err := repo.FetchContext(ctx, &git.FetchOptions{
+			// Forced, a force pushed branch or moved tag is otherwise left as it was
+			RefSpecs: []config2.RefSpec{
+				"+refs/tags/*:refs/tags/*",
+				"+refs/heads/*:refs/heads/*",
+			},
+			Auth: auth,
+		})
+
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+
+		return err
 	})
 
-	if err != nil && err != git.NoErrAlreadyUpToDate {
+	if err != nil {
 		return nil, err
 	}
 
 	return repo, nil
 }
 
-func CheckoutBranch(repo *git.Repository, worktree *git.Worktree, ref *plumbing.Reference) (string, error) {
+// ListRemote lists the refs on a remote without needing a local clone, which
+// makes it a cheap way to prove a url is reachable with the configured key.
+// go-git can't cancel a listing once it has started, so ctx is only checked
+// between attempts.
+func ListRemote(ctx context.Context, url string) ([]*plumbing.Reference, error) {
+	auth, err := GetAuth()
+
+	if err != nil {
+		return nil, err
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &config2.RemoteConfig{
+		Name: "origin",
+		URLs: []string{url},
+	})
+
+	var refs []*plumbing.Reference
+
+	err = withRetry(ctx, "Listing "+url, func() error {
+		refs, err = remote.List(&git.ListOptions{Auth: auth})
+		return err
+	})
+
+	return refs, err
+}
+
+// GetDefaultBranch finds the branch the remote's HEAD points at in a list of
+// refs from ListRemote or Remote.List
+func GetDefaultBranch(refs []*plumbing.Reference) string {
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			return ref.Target().Short()
+		}
+	}
+
+	return ""
+}
+
+// CheckoutBranch and CheckoutTag only touch the disk and go-git can't
+// interrupt them, they refuse to start once ctx is done. Both return the
+// commit checked out.
+func CheckoutBranch(ctx context.Context, repo *git.Repository, worktree *git.Worktree, ref *plumbing.Reference) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	err := worktree.Checkout(&git.CheckoutOptions{
 		Branch: ref.Target(),
 	})
@@ -84,7 +199,88 @@ func CheckoutBranch(repo *git.Repository, worktree *git.Worktree, ref *plumbing.
 	return head.Hash().String(), nil
 }
 
-func CheckoutTag(repo *git.Repository, worktree *git.Worktree, ref *plumbing.Reference) (string, error) {
+// UpdateSubmodules checks out every submodule, and their submodules, at the
+// commit the current checkout points them at using the same ssh key as the
+// parent repository.
+func UpdateSubmodules(ctx context.Context, worktree *git.Worktree) error {
+	submodules, err := worktree.Submodules()
+
+	if err != nil {
+		return errors.New("unable to read submodules: " + err.Error())
+	}
+
+	if len(submodules) == 0 {
+		return nil
+	}
+
+	auth, err := GetAuth()
+
+	if err != nil {
+		return err
+	}
+
+	err = withRetry(ctx, "Updating submodules", func() error {
+		return submodules.UpdateContext(ctx, &git.SubmoduleUpdateOptions{
+			Init:              true,
+			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+			Auth:              auth,
+		})
+	})
+
+	if err != nil {
+		if IsPermanentRemoteError(err) {
+			return errors.New("unable to fetch submodules, check the ssh key has access to them: " + err.Error())
+		}
+
+		return errors.New("unable to update submodules: " + err.Error())
+	}
+
+	return nil
+}
+
+// GetTagMessage returns the message of an annotated tag, lightweight tags
+// don't have one so an empty string is returned for them.
+func GetTagMessage(repo *git.Repository, ref *plumbing.Reference) string {
+	tagObject, err := repo.TagObject(ref.Hash())
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(tagObject.Message)
+}
+
+// ReadFile reads a file as it is in the commit a branch or tag points at,
+// without touching the worktree.
+func ReadFile(repo *git.Repository, ref *plumbing.Reference, path string) ([]byte, error) {
+	hash := ref.Hash()
+
+	if tagObject, err := repo.TagObject(hash); err == nil {
+		hash = tagObject.Target
+	}
+
+	commit, err := repo.CommitObject(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := commit.File(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := file.Contents()
+
+	return []byte(contents), err
+}
+
+func CheckoutTag(ctx context.Context, repo *git.Repository, worktree *git.Worktree, ref *plumbing.Reference) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	hash := ref.Hash()
 
 	// test for annotated ref
@@ -102,5 +298,150 @@ func CheckoutTag(repo *git.Repository, worktree *git.Worktree, ref *plumbing.Ref
 		return "", err
 	}
 
-	return ref.Hash().String(), nil
+	// The commit an annotated tag points at, not the tag object
+	return hash.String(), nil
+}
+
+// IsEmptyRepository is whether err, from cloning or fetching, means the
+// remote doesn't have any commits yet. GitHub sends webhooks for repositories
+// that have only just been created.
+func IsEmptyRepository(err error) bool {
+	return err == transport.ErrEmptyRemoteRepository
+}
+
+// HasCommits is whether a clone has any commits at all, a ref that can't be
+// found in one without is a ref with no commits rather than a missing one
+func HasCommits(repo *git.Repository) bool {
+	commits, err := repo.CommitObjects()
+
+	if err != nil {
+		return true
+	}
+
+	defer commits.Close()
+
+	_, err = commits.Next()
+
+	return err != io.EOF
+}
+
+// ErrCommitNotFound is returned by CheckoutCommit for a commit that isn't on
+// any branch, tag or pull request of the remote
+var ErrCommitNotFound = errors.New("commit not found")
+
+// CheckoutCommit checks out a commit by its full hash. A fetch already has
+// every commit on a branch or tag, commits that aren't are looked for in
+// GitHub's pull request refs before giving up.
+func CheckoutCommit(ctx context.Context, repo *git.Repository, worktree *git.Worktree, hash plumbing.Hash) error {
+	if _, err := repo.CommitObject(hash); err != nil {
+		if err := fetchPullRequests(ctx, repo); err != nil {
+			return err
+		}
+
+		if _, err := repo.CommitObject(hash); err != nil {
+			return ErrCommitNotFound
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := worktree.Checkout(&git.CheckoutOptions{
+		Hash: hash,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func fetchPullRequests(ctx context.Context, repo *git.Repository) error {
+	auth, err := GetAuth()
+
+	if err != nil {
+		return err
+	}
+
+	return withRetry(ctx, "Fetching pull requests", func() error {
+		err := repo.FetchContext(ctx, &git.FetchOptions{
+			RefSpecs: []config2.RefSpec{
+				"+refs/pull/*/head:refs/pull/*/head",
+			},
+			Auth: auth,
+		})
+
+		if err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+
+		return err
+	})
+}
+
+// ResetWorktree throws away everything done to a checkout while processing
+// it, including files a build step created, ready for the next ref.
+func ResetWorktree(worktree *git.Worktree) error {
+	err := worktree.Reset(&git.ResetOptions{
+		Mode: git.HardReset,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return worktree.Clean(&git.CleanOptions{Dir: true})
+}
+
+// ErrNoHeadRef is returned by HeadRef when HEAD is detached from any branch
+// and isn't tagged either
+var ErrNoHeadRef = errors.New("HEAD isn't a branch or tag")
+
+// HeadRef works out the branch or tag a local checkout is on. A tag pointing
+// at the commit checked out wins over the branch, it's what a release would
+// be published from.
+func HeadRef(repo *git.Repository) (*plumbing.Reference, error) {
+	head, err := repo.Head()
+
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := repo.Tags()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var tag *plumbing.Reference
+
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		hash := ref.Hash()
+
+		if tagObject, err := repo.TagObject(hash); err == nil {
+			hash = tagObject.Target
+		}
+
+		if hash == head.Hash() && tag == nil {
+			tag = ref
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tag != nil {
+		return tag, nil
+	}
+
+	if !head.Name().IsBranch() {
+		return nil, ErrNoHeadRef
+	}
+
+	return head, nil
 }
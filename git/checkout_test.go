@@ -0,0 +1,381 @@
+package git_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	git2 "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	ioutil2 "gopkg.in/src-d/go-git.v4/utils/ioutil"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestConfig writes a throwaway ssh key so the git functions get as far
+// as talking to the remote
+func newTestConfig(t *testing.T, dir string) *config.Config {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "id_rsa")
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	if err := ioutil.WriteFile(keyPath, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// go-git won't connect without somewhere to check host keys against
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+
+	if err := ioutil.WriteFile(knownHostsPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("SSH_KNOWN_HOSTS", knownHostsPath)
+
+	return &config.Config{
+		SshKey:           keyPath,
+		GitRetryAttempts: 5,
+		GitRetryBackoff:  time.Minute,
+	}
+}
+
+// closedPort returns a local port nothing is listening on, connecting to it
+// fails straight away with a (retryable) connection refused
+func closedPort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr().String()
+	listener.Close()
+
+	return addr
+}
+
+func TestCloneStopsWhenContextIsCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	git.Config = newTestConfig(t, dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = git.Clone(ctx, "ssh://git@"+closedPort(t)+"/org/repo.git", filepath.Join(dir, "repo"))
+	elapsed := time.Since(start)
+
+	if err != context.DeadlineExceeded {
+		t.Errorf("[!] Clone() = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	// Without the context this would be waiting out a minute long backoff
+	if elapsed > 5*time.Second {
+		t.Errorf("[!] Clone() took %v to return after its context was cancelled", elapsed)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "repo")); !os.IsNotExist(err) {
+		t.Errorf("[!] Clone() left a partial clone behind")
+	}
+}
+
+// stallingServer serves repositories from disk like server.DefaultServer, but
+// stops part way through sending a packfile. stalled is closed once it has,
+// nothing more is sent until release is closed
+type stallingServer struct {
+	transport.Transport
+	stalled, release chan struct{}
+}
+
+func (s *stallingServer) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	session, err := s.Transport.NewUploadPackSession(ep, auth)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &stallingSession{UploadPackSession: session, server: s}, nil
+}
+
+type stallingSession struct {
+	transport.UploadPackSession
+	server *stallingServer
+}
+
+// UploadPack wraps the packfile in a context reader like the ssh transport
+// does, so cancelling interrupts the stalled read
+func (s *stallingSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	response, err := s.UploadPackSession.UploadPack(ctx, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &stallingReader{ReadCloser: response, server: s.server}
+
+	return packp.NewUploadPackResponseWithPackfile(req, ioutil2.NewContextReadCloser(ctx, reader)), nil
+}
+
+type stallingReader struct {
+	io.ReadCloser
+	server *stallingServer
+	read   bool
+}
+
+// Read sends the packfile's header and then waits
+func (r *stallingReader) Read(p []byte) (int, error) {
+	if r.read {
+		close(r.server.stalled)
+		<-r.server.release
+
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	r.read = true
+
+	if len(p) > 12 {
+		p = p[:12]
+	}
+
+	return r.ReadCloser.Read(p)
+}
+
+var stalledTransfers = []struct {
+	name string
+	// Leaves dir/clone needing a packfile from dir/upstream
+	prepare  func(t *testing.T, dir string)
+	transfer func(ctx context.Context, dir string) error
+}{
+	{
+		name:    "clone",
+		prepare: func(t *testing.T, dir string) {},
+		transfer: func(ctx context.Context, dir string) error {
+			_, err := git.Clone(ctx, filepath.Join(dir, "upstream", ".git"), filepath.Join(dir, "clone"))
+			return err
+		},
+	},
+	{
+		name: "fetch",
+		prepare: func(t *testing.T, dir string) {
+			if _, err := git.Clone(context.Background(), filepath.Join(dir, "upstream", ".git"), filepath.Join(dir, "clone")); err != nil {
+				t.Fatal(err)
+			}
+
+			commitTestFile(t, filepath.Join(dir, "upstream"), "README.md")
+		},
+		transfer: func(ctx context.Context, dir string) error {
+			_, err := git.OpenAndFetch(ctx, filepath.Join(dir, "clone"))
+			return err
+		},
+	},
+}
+
+func TestTransferStopsWhenContextIsCancelled(t *testing.T) {
+	for _, test := range stalledTransfers {
+		dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer os.RemoveAll(dir)
+
+		git.Config = newTestConfig(t, dir)
+		client.InstallProtocol("file", server.DefaultServer)
+
+		newTestUpstream(t, filepath.Join(dir, "upstream"))
+		test.prepare(t, dir)
+
+		stalling := &stallingServer{Transport: server.DefaultServer, stalled: make(chan struct{}), release: make(chan struct{})}
+		client.InstallProtocol("file", stalling)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelled := make(chan time.Time, 1)
+		done := make(chan struct{})
+
+		go func() {
+			select {
+			case <-stalling.stalled:
+			case <-time.After(10 * time.Second):
+			}
+
+			cancelled <- time.Now()
+			cancel()
+
+			// Lets a transfer that ignores the cancel fail rather than hang
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+			}
+
+			close(stalling.release)
+		}()
+
+		err = test.transfer(ctx, dir)
+		elapsed := time.Since(<-cancelled)
+		close(done)
+
+		select {
+		case <-stalling.stalled:
+		default:
+			t.Errorf("[!] %s finished without stalling, it wasn't cancelled mid-transfer", test.name)
+		}
+
+		if err != context.Canceled {
+			t.Errorf("[!] %s = %v; want %v", test.name, err, context.Canceled)
+		}
+
+		// Without the context this would wait for the upstream forever
+		if elapsed > 5*time.Second {
+			t.Errorf("[!] %s took %v to return after its context was cancelled", test.name, elapsed)
+		}
+	}
+
+	client.InstallProtocol("file", server.DefaultServer)
+}
+
+func TestEmptyRepositoryHasNoCommits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	git.Config = newTestConfig(t, dir)
+	// Served as a client, like GitHub over ssh, so a repository without refs
+	// is reported as empty rather than failing to find its HEAD
+	client.InstallProtocol("file", server.NewClient(server.DefaultLoader))
+
+	upstreamPath := filepath.Join(dir, "upstream")
+	upstream, err := git2.PlainInit(upstreamPath, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PlainInit doesn't write a config file, without one the file transport
+	// says there's no repository rather than an empty one
+	cfg, err := upstream.Config()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := upstream.Storer.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if git.HasCommits(upstream) {
+		t.Errorf("[!] HasCommits() = true; want false for a new repository")
+	}
+
+	_, err = git.Clone(context.Background(), filepath.Join(upstreamPath, ".git"), filepath.Join(dir, "clone"))
+
+	if !git.IsEmptyRepository(err) {
+		t.Errorf("[!] IsEmptyRepository(%v) = false; want cloning a new repository to be empty", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(upstreamPath, "composer.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := upstream.Worktree()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := worktree.Add("composer.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	signature := &object.Signature{Name: "Octo Cat", Email: "octocat@example.com", When: time.Now()}
+
+	if _, err := worktree.Commit("First commit", &git2.CommitOptions{Author: signature}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !git.HasCommits(upstream) {
+		t.Errorf("[!] HasCommits() = false; want true once something is committed")
+	}
+}
+
+func TestHeadRefPrefersTagOverBranch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo, err := git2.PlainInit(dir, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "composer.json"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := repo.Worktree()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := worktree.Add("composer.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	signature := &object.Signature{Name: "Octo Cat", Email: "octocat@example.com", When: time.Now()}
+	hash, err := worktree.Commit("First commit", &git2.CommitOptions{Author: signature})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := git.HeadRef(repo)
+
+	if err != nil || ref.Name().String() != "refs/heads/master" {
+		t.Errorf("[!] HeadRef() = %v, %v; want refs/heads/master", ref, err)
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/tags/v1.0.0", hash)); err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err = git.HeadRef(repo)
+
+	if err != nil || ref.Name().String() != "refs/tags/v1.0.0" {
+		t.Errorf("[!] HeadRef() = %v, %v; want refs/tags/v1.0.0", ref, err)
+	}
+}
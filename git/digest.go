@@ -0,0 +1,49 @@
+package git
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DigestRepository is a sha256 of what an artifact of the checkout at
+// repoPath would hold, every file's path, mode and contents, without writing
+// the artifact. Checkouts with the same digest archive the same whatever
+// commit they're at.
+func DigestRepository(repoPath string, options ArchiveOptions) (string, error) {
+	hash := sha256.New()
+
+	err := walkRepository(repoPath+"/.", options, func(archivePath, filePath string, fileInfo os.FileInfo) error {
+		fmt.Fprintf(hash, "%s\x00%o\x00", archivePath, archiveMode(fileInfo, options))
+
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(hash, "%d\x00%s", len(target), target)
+			return nil
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+
+		fmt.Fprintf(hash, "%d\x00", fileInfo.Size())
+		_, err = io.Copy(hash, file)
+		return err
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,62 @@
+package git_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDigestRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	write := func(repo, file, contents string, mode os.FileMode) {
+		path := filepath.Join(dir, repo, file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err := ioutil.WriteFile(path, []byte(contents), mode); err != nil {
+			t.Fatal(err)
+		}
+
+		os.Chmod(path, mode)
+	}
+
+	digest := func(repo string) string {
+		digest, err := git.DigestRepository(filepath.Join(dir, repo), git.ArchiveOptions{})
+
+		if err != nil {
+			t.Fatalf("[!] DigestRepository(%s) = %v", repo, err)
+		}
+
+		return digest
+	}
+
+	for _, repo := range []string{"a", "b", "c", "d"} {
+		write(repo, "composer.json", `{"name": "acme/widgets"}`, 0644)
+		write(repo, "src/Widget.php", "<?php", 0644)
+	}
+
+	// Only the git metadata differs
+	write("b", ".git/HEAD", "ref: refs/heads/master", 0644)
+	write("c", "src/Widget.php", "<?php\n", 0644)
+	write("d", "src/Widget.php", "<?php", 0755)
+
+	if digest("a") != digest("b") {
+		t.Errorf("[!] DigestRepository() differs for checkouts with the same files")
+	}
+
+	if digest("a") == digest("c") {
+		t.Errorf("[!] DigestRepository() is the same with a file changed")
+	}
+
+	if digest("a") == digest("d") {
+		t.Errorf("[!] DigestRepository() is the same with a file made executable")
+	}
+}
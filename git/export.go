@@ -0,0 +1,104 @@
+package git
+
+import (
+	"context"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// go-git's object storage isn't safe to read from more than one goroutine at
+// once, so exports take turns reading out of their clone
+var exportMutex sync.Mutex
+
+// ExportRef writes the files of the commit a branch or tag points at to dir,
+// the way a checkout of it would have them, and returns the commit. The
+// clone's worktree and HEAD are left alone, so refs of the same clone can be
+// exported to directories of their own and published side by side.
+// Submodules aren't exported.
+func ExportRef(ctx context.Context, repo *git.Repository, ref *plumbing.Reference, dir string) (string, error) {
+	exportMutex.Lock()
+	defer exportMutex.Unlock()
+
+	hash := ref.Hash()
+
+	if tagObject, err := repo.TagObject(hash); err == nil {
+		hash = tagObject.Target
+	}
+
+	commit, err := repo.CommitObject(hash)
+
+	if err != nil {
+		return "", err
+	}
+
+	tree, err := commit.Tree()
+
+	if err != nil {
+		return "", err
+	}
+
+	err = tree.Files().ForEach(func(file *object.File) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return exportFile(file, filepath.Join(dir, filepath.FromSlash(file.Name)))
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return hash.String(), nil
+}
+
+// exportFile writes a file from a commit to path, with the mode a checkout
+// would give it
+func exportFile(file *object.File, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	if file.Mode == filemode.Symlink {
+		target, err := file.Contents()
+
+		if err != nil {
+			return err
+		}
+
+		return os.Symlink(target, path)
+	}
+
+	mode := os.FileMode(0644)
+
+	if file.Mode == filemode.Executable {
+		mode = 0755
+	}
+
+	reader, err := file.Reader()
+
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,106 @@
+package git_test
+
+import (
+	"context"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	git2 "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExportRefLeavesTheCheckoutAlone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	repoPath := filepath.Join(dir, "repo")
+	repo, err := git2.PlainInit(repoPath, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := repo.Worktree()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature := &object.Signature{Name: "Octo Cat", Email: "octocat@example.com", When: time.Now()}
+
+	commit := func(file, contents string, mode os.FileMode) plumbing.Hash {
+		os.MkdirAll(filepath.Dir(filepath.Join(repoPath, file)), 0755)
+
+		if err := ioutil.WriteFile(filepath.Join(repoPath, file), []byte(contents), mode); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := worktree.Add(file); err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := worktree.Commit("Add "+file, &git2.CommitOptions{Author: signature})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hash
+	}
+
+	commit("composer.json", `{"name": "acme/widgets"}`, 0644)
+
+	if err := os.Symlink("composer.json", filepath.Join(repoPath, "manifest.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := worktree.Add("manifest.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	tagged := commit("bin/widgets", "#!/bin/sh\n", 0755)
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/tags/v1.0.0", tagged)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The checkout moves on past the tag
+	commit("src/Widget.php", "<?php\n", 0644)
+
+	exportPath := filepath.Join(dir, "export")
+	ref, _ := repo.Reference("refs/tags/v1.0.0", false)
+	hash, err := git.ExportRef(context.Background(), repo, ref, exportPath)
+
+	if err != nil || hash != tagged.String() {
+		t.Fatalf("[!] ExportRef(v1.0.0) = %s, %v; want %s", hash, err, tagged)
+	}
+
+	if contents, err := ioutil.ReadFile(filepath.Join(exportPath, "composer.json")); string(contents) != `{"name": "acme/widgets"}` {
+		t.Errorf("[!] exported composer.json = %s, %v", contents, err)
+	}
+
+	if info, err := os.Stat(filepath.Join(exportPath, "bin", "widgets")); err != nil || info.Mode()&0111 == 0 {
+		t.Errorf("[!] exported bin/widgets = %v, %v; want it executable", info, err)
+	}
+
+	if target, err := os.Readlink(filepath.Join(exportPath, "manifest.json")); target != "composer.json" {
+		t.Errorf("[!] exported manifest.json links to %s, %v; want composer.json", target, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(exportPath, "src", "Widget.php")); !os.IsNotExist(err) {
+		t.Errorf("[!] ExportRef(v1.0.0) exported a file from after the tag")
+	}
+
+	if _, err := os.Stat(filepath.Join(repoPath, "src", "Widget.php")); err != nil {
+		t.Errorf("[!] ExportRef() changed the checkout: %v", err)
+	}
+}
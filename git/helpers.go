@@ -1,9 +1,15 @@
 package git
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"gopkg.in/src-d/go-git.v4"
 	url2 "net/url"
+	"os"
+	"regexp"
 	"strings"
 )
 
@@ -24,3 +30,91 @@ func GitUrlToDirectory(url string) (string, error) {
 
 	return strings.ToLower(fmt.Sprintf("%s_%s", host, path)), nil
 }
+
+func GitUrlToUniqueDirectory(url string) (string, error) {
+	urlInfo, err := url2.Parse("ssh://" + url)
+
+	if err != nil {
+		return "", errors.New("Unable to parse url " + url)
+	}
+
+	exp := regexp.MustCompile(`[^a-z0-9.-]+`)
+
+	name := strings.ToLower(urlInfo.Host + urlInfo.Path)
+	name = strings.TrimSuffix(name, ".git")
+	name = strings.Trim(exp.ReplaceAllString(name, "_"), "_")
+
+	hash := sha1.Sum([]byte(url))
+
+	return name + "-" + hex.EncodeToString(hash[:])[0:8], nil
+}
+
+// GetRepoPath works out where the clone for url lives using the configured
+// layout, under the repository's own reposDir when it has one. Clones made
+// under the flat layout are moved to their new home the first time they're
+// used, as long as they really are a clone of url, so an upgrade doesn't mean
+// cloning everything again.
+func GetRepoPath(url string) (string, error) {
+	flatDir, err := GitUrlToDirectory(url)
+
+	if err != nil {
+		return "", err
+	}
+
+	// Repositories can be cloned somewhere of their own
+	reposDir := Config.GetReposDir(nil)
+
+	if repoCfg, err := Config.GetRepository("", url); err == nil {
+		reposDir = Config.GetReposDir(&repoCfg)
+	}
+
+	flatPath := reposDir + "/" + flatDir
+
+	if Config.RepoLayout == config.RepoLayoutFlat {
+		return flatPath, nil
+	}
+
+	uniqueDir, err := GitUrlToUniqueDirectory(url)
+
+	if err != nil {
+		return "", err
+	}
+
+	uniquePath := reposDir + "/" + uniqueDir
+
+	if _, err := os.Stat(uniquePath); err == nil {
+		return uniquePath, nil
+	}
+
+	if isCloneOf(flatPath, url) {
+		fmt.Printf("Moving %s to %s\n", flatPath, uniquePath)
+
+		if err := os.Rename(flatPath, uniquePath); err != nil {
+			return "", err
+		}
+	}
+
+	return uniquePath, nil
+}
+
+func isCloneOf(path, url string) bool {
+	repo, err := git.PlainOpen(path)
+
+	if err != nil {
+		return false
+	}
+
+	remote, err := repo.Remote("origin")
+
+	if err != nil {
+		return false
+	}
+
+	for _, remoteUrl := range remote.Config().URLs {
+		if remoteUrl == url {
+			return true
+		}
+	}
+
+	return false
+}
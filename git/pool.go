@@ -0,0 +1,152 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clonePool keeps track of who is using each clone and when it was last
+// used, so clones can be evicted to keep the number on disk down without
+// pulling one out from under a sync.
+type clonePool struct {
+	mutex     sync.Mutex
+	locks     map[string]*sync.Mutex
+	inUse     map[string]int
+	lastUsed  map[string]time.Time
+	evictions int
+}
+
+var pool = &clonePool{
+	locks:    map[string]*sync.Mutex{},
+	inUse:    map[string]int{},
+	lastUsed: map[string]time.Time{},
+}
+
+// PoolStats is a snapshot of the clone pool for metrics
+type PoolStats struct {
+	InUse     int
+	Evictions int
+}
+
+// LockClone waits until nothing else is using the clone at path and returns
+// the function that gives it back, which must be called once finished with
+// it. Giving a clone back evicts the least recently used clones if there are
+// more on disk than Config.MaxClones allows.
+func LockClone(path string) func() {
+	pool.mutex.Lock()
+
+	lock, ok := pool.locks[path]
+
+	if !ok {
+		lock = &sync.Mutex{}
+		pool.locks[path] = lock
+	}
+
+	// Counted before waiting on the lock so eviction leaves it alone
+	pool.inUse[path]++
+	pool.mutex.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		pool.mutex.Lock()
+		pool.inUse[path]--
+		pool.lastUsed[path] = time.Now()
+		pool.mutex.Unlock()
+
+		lock.Unlock()
+
+		evictClones()
+	}
+}
+
+func GetPoolStats() PoolStats {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	stats := PoolStats{Evictions: pool.evictions}
+
+	for _, count := range pool.inUse {
+		if count > 0 {
+			stats.InUse++
+		}
+	}
+
+	return stats
+}
+
+type cloneOnDisk struct {
+	path     string
+	lastUsed time.Time
+}
+
+func evictClones() {
+	if Config == nil || Config.MaxClones <= 0 {
+		return
+	}
+
+	var clones []cloneOnDisk
+
+	for _, repo := range Config.Repositories {
+		path, err := GetRepoPath(repo.Url)
+
+		if err != nil {
+			continue
+		}
+
+		info, err := os.Stat(path)
+
+		if err != nil {
+			continue
+		}
+
+		clones = append(clones, cloneOnDisk{path: path, lastUsed: info.ModTime()})
+	}
+
+	if len(clones) <= Config.MaxClones {
+		return
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	// Clones used since we started know exactly when, the rest go by when
+	// their directory last changed
+	for i, clone := range clones {
+		if lastUsed, ok := pool.lastUsed[clone.path]; ok {
+			clones[i].lastUsed = lastUsed
+		}
+	}
+
+	sort.Slice(clones, func(i, j int) bool {
+		return clones[i].lastUsed.Before(clones[j].lastUsed)
+	})
+
+	excess := len(clones) - Config.MaxClones
+
+	for _, clone := range clones {
+		if excess == 0 {
+			break
+		}
+
+		// Holding the pool's mutex stops anyone locking an unused clone
+		// while it is being removed
+		if pool.inUse[clone.path] > 0 {
+			continue
+		}
+
+		fmt.Printf("Evicting %s, it is the least recently used of %d clones\n", clone.path, len(clones))
+
+		if err := os.RemoveAll(clone.path); err != nil {
+			fmt.Printf("Unable to evict %s: %v\n", clone.path, err)
+			continue
+		}
+
+		delete(pool.lastUsed, clone.path)
+		pool.evictions++
+		excess--
+	}
+}
@@ -0,0 +1,60 @@
+package git_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLockCloneNeverEvictsACloneInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	git.Config = &config.Config{
+		DataDir:    dir,
+		RepoLayout: config.RepoLayoutFlat,
+		MaxClones:  1,
+		Repositories: []config.Repository{
+			{Url: "ssh://git@github.com/acme/widgets.git"},
+			{Url: "ssh://git@github.com/acme/gadgets.git"},
+		},
+	}
+
+	var paths []string
+
+	for _, repo := range git.Config.Repositories {
+		path, err := git.GetRepoPath(repo.Url)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.MkdirAll(path, 0755)
+		paths = append(paths, path)
+	}
+
+	// gadgets is the least recently used but it's busy, so widgets goes
+	unlockGadgets := git.LockClone(paths[1])
+	git.LockClone(paths[0])()
+
+	if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+		t.Errorf("[!] %s wasn't evicted", paths[0])
+	}
+
+	if _, err := os.Stat(paths[1]); err != nil {
+		t.Errorf("[!] %s was evicted while it was in use", paths[1])
+	}
+
+	unlockGadgets()
+
+	if _, err := os.Stat(paths[1]); err != nil {
+		t.Errorf("[!] %s was evicted with only one clone on disk", paths[1])
+	}
+}
@@ -0,0 +1,170 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/idxfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/objfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem/dotgit"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Errors that mean the remote has answered and said no, retrying won't change
+// its mind so these are never retried.
+var permanentRemoteErrors = []error{
+	transport.ErrRepositoryNotFound,
+	transport.ErrEmptyRemoteRepository,
+	transport.ErrAuthenticationRequired,
+	transport.ErrAuthorizationFailed,
+	transport.ErrInvalidAuthMethod,
+}
+
+// Errors that mean the local clone is unusable, fetching into it again
+// fails the same way so it has to be cloned again.
+var corruptCloneErrors = []error{
+	git.ErrRepositoryNotExists,
+	git.ErrRemoteNotFound,
+	plumbing.ErrObjectNotFound,
+	dotgit.ErrConfigNotFound,
+	dotgit.ErrIdxNotFound,
+	dotgit.ErrPackfileNotFound,
+	dotgit.ErrPackedRefsBadFormat,
+	idxfile.ErrMalformedIdxFile,
+	index.ErrMalformedSignature,
+	index.ErrInvalidChecksum,
+	objfile.ErrHeader,
+	objfile.ErrNegativeSize,
+}
+
+// Fragments of error messages that come back from the ssh/http transports
+// when the network (or GitHub) had a brief wobble.
+var transientErrorMessages = []string{
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"i/o timeout",
+	"tls handshake",
+	"unexpected eof",
+	"internal server error",
+	"bad gateway",
+	"service unavailable",
+	"gateway timeout",
+}
+
+func IsPermanentRemoteError(err error) bool {
+	for _, permanent := range permanentRemoteErrors {
+		if err == permanent {
+			return true
+		}
+	}
+
+	// ssh reports rejected keys as a handshake failure rather than one of
+	// the transport errors above
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// IsCorruptClone is whether err, from opening or fetching into a clone, means
+// the clone is broken rather than the remote or the network
+func IsCorruptClone(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	for _, corrupt := range corruptCloneErrors {
+		if err == corrupt {
+			return true
+		}
+	}
+
+	// Packfile errors come with details added, so are never the same error
+	_, ok := err.(*packfile.Error)
+
+	return ok
+}
+
+func IsTransientError(err error) bool {
+	// A broken clone is broken every time, it's cloned again instead
+	if err == nil || IsPermanentRemoteError(err) || IsCorruptClone(err) {
+		return false
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	for _, fragment := range transientErrorMessages {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withRetry runs operation until it succeeds, returns an error that isn't
+// transient, the configured number of attempts is used up or ctx is done.
+// The wait between attempts doubles each time starting at the configured
+// backoff.
+func withRetry(ctx context.Context, description string, operation func() error) error {
+	attempts := 1
+	backoff := time.Second
+
+	if Config != nil {
+		if Config.GitRetryAttempts > 0 {
+			attempts = Config.GitRetryAttempts
+		}
+
+		if Config.GitRetryBackoff > 0 {
+			backoff = Config.GitRetryBackoff
+		}
+	}
+
+	var err error
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		// Only hold on to a slot while actually talking to the remote
+		if err := operations().AcquireContext(ctx); err != nil {
+			return err
+		}
+
+		err = operation()
+		operations().Release()
+
+		// Whatever went wrong, the caller has stopped waiting for it
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !IsTransientError(err) {
+			return err
+		}
+
+		if attempt < attempts {
+			fmt.Printf("%s failed (attempt %d of %d), retrying in %v - %v\n", description, attempt, attempts, backoff, err)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+		}
+	}
+
+	return err
+}
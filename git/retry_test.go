@@ -0,0 +1,195 @@
+package git_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	git2 "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// [][]interface{}{error, transient, corrupt clone}
+var gitErrors = [][]interface{}{
+	{nil, false, false},
+	{io.EOF, true, false},
+	{io.ErrUnexpectedEOF, true, false},
+	{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true, false},
+	{errors.New("ssh: handshake failed: read tcp: connection reset by peer"), true, false},
+	{errors.New("unexpected client error: unexpected requesting status code: 502 Bad Gateway"), true, false},
+	{transport.ErrRepositoryNotFound, false, false},
+	{transport.ErrEmptyRemoteRepository, false, false},
+	{transport.ErrAuthenticationRequired, false, false},
+	{errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey]"), false, false},
+	{errors.New("open /keys/id_rsa: no such file or directory"), false, false},
+	{git2.ErrRepositoryNotExists, false, true},
+	{plumbing.ErrObjectNotFound, false, true},
+	{packfile.ErrZLib.AddDetails("unexpected EOF"), false, true},
+}
+
+func TestClassifyGitErrors(t *testing.T) {
+	for _, test := range gitErrors {
+		err, _ := test[0].(error)
+
+		if transient := git.IsTransientError(err); transient != test[1] {
+			t.Errorf("[!] IsTransientError(%v) = %v; want %v", err, transient, test[1])
+		}
+
+		if corrupt := git.IsCorruptClone(err); corrupt != test[2] {
+			t.Errorf("[!] IsCorruptClone(%v) = %v; want %v", err, corrupt, test[2])
+		}
+	}
+}
+
+// newTestUpstream commits a composer.json to a new repository at path, which
+// can be cloned from path/.git
+func newTestUpstream(t *testing.T, path string) {
+	upstream, err := git2.PlainInit(path, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PlainInit doesn't write a config file, without one the file transport
+	// says there's no repository
+	cfg, err := upstream.Config()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := upstream.Storer.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	commitTestFile(t, path, "composer.json")
+}
+
+// commitTestFile commits a file called name to the repository at path
+func commitTestFile(t *testing.T, path, name string) {
+	repo, err := git2.PlainOpen(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(path, name), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := repo.Worktree()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := worktree.Add(name); err != nil {
+		t.Fatal(err)
+	}
+
+	signature := &object.Signature{Name: "Octo Cat", Email: "octocat@example.com", When: time.Now()}
+
+	if _, err := worktree.Commit("Add "+name, &git2.CommitOptions{Author: signature}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var brokenClones = []struct {
+	name string
+	// Breaks the clone, upstream or config after the first clone
+	breakIt func(t *testing.T, dir string)
+	// Whether updating should still work, and whether the clone should
+	// have been thrown away
+	updates, recloned bool
+}{
+	{
+		name: "clone without its .git",
+		breakIt: func(t *testing.T, dir string) {
+			os.RemoveAll(filepath.Join(dir, "clone", ".git"))
+		},
+		updates:  true,
+		recloned: true,
+	},
+	{
+		name: "missing ssh key",
+		breakIt: func(t *testing.T, dir string) {
+			git.Config.SshKey = filepath.Join(dir, "missing")
+		},
+	},
+	{
+		name: "upstream gone",
+		breakIt: func(t *testing.T, dir string) {
+			os.RemoveAll(filepath.Join(dir, "upstream"))
+		},
+	},
+	{
+		// Cloned again once, which fails, rather than over and over
+		name: "clone without its .git and upstream gone",
+		breakIt: func(t *testing.T, dir string) {
+			os.RemoveAll(filepath.Join(dir, "clone", ".git"))
+			os.RemoveAll(filepath.Join(dir, "upstream"))
+		},
+		recloned: true,
+	},
+}
+
+func TestCloneOrOpenAndUpdateOnlyReclonesBrokenClones(t *testing.T) {
+	for _, test := range brokenClones {
+		dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer os.RemoveAll(dir)
+
+		// A minute between retries, anything retried fails the timeout
+		git.Config = newTestConfig(t, dir)
+		client.InstallProtocol("file", server.DefaultServer)
+
+		newTestUpstream(t, filepath.Join(dir, "upstream"))
+
+		url := filepath.Join(dir, "upstream", ".git")
+		clonePath := filepath.Join(dir, "clone")
+
+		if _, err := git.Clone(context.Background(), url, clonePath); err != nil {
+			t.Fatal(err)
+		}
+
+		// Marks the first clone, it goes when the clone is thrown away
+		marker := filepath.Join(clonePath, "first-clone")
+
+		if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		test.breakIt(t, dir)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		repo, err := git.CloneOrOpenAndUpdate(ctx, url, clonePath)
+		cancel()
+
+		if err == nil {
+			_, err = repo.Head()
+		}
+
+		if updates := err == nil; updates != test.updates {
+			t.Errorf("[!] CloneOrOpenAndUpdate(%s) = %v; want it to update %v", test.name, err, test.updates)
+		}
+
+		if _, err := os.Stat(marker); os.IsNotExist(err) != test.recloned {
+			t.Errorf("[!] CloneOrOpenAndUpdate(%s) threw the clone away %v; want %v", test.name, !test.recloned, test.recloned)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package git
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CreateTarballFromRepository writes the checkout at repoPath into target as
+// a tar.gz, for raw packages, and returns the size of the resulting archive.
+func CreateTarballFromRepository(repoPath, target string, options ArchiveOptions) (int64, error) {
+	repoPath = repoPath + "/."
+
+	tarball, err := os.Create(target)
+	if err != nil {
+		return 0, err
+	}
+	defer tarball.Close()
+
+	level := gzip.DefaultCompression
+
+	switch options.Compression {
+	case config.CompressionStore:
+		level = gzip.NoCompression
+	case config.CompressionFast:
+		level = gzip.BestSpeed
+	case config.CompressionBest:
+		level = gzip.BestCompression
+	}
+
+	compressed, err := gzip.NewWriterLevel(tarball, level)
+	if err != nil {
+		return 0, err
+	}
+
+	archive := tar.NewWriter(compressed)
+
+	err = walkRepository(repoPath, options, func(archivePath, filePath string, fileInfo os.FileInfo) error {
+		link := ""
+
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+
+			link = filepath.ToSlash(target)
+		}
+
+		header, err := tar.FileInfoHeader(fileInfo, link)
+		if err != nil {
+			return err
+		}
+
+		header.Name = archivePath
+
+		if options.FileModes != config.FileModesPreserve {
+			header.Mode = int64(archiveMode(fileInfo, options).Perm())
+		}
+
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if link != "" {
+			return nil
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+
+		_, err = io.Copy(archive, file)
+		return err
+	})
+
+	if err != nil {
+		archive.Close()
+		compressed.Close()
+		return 0, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := compressed.Close(); err != nil {
+		return 0, err
+	}
+
+	info, err := tarball.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
@@ -0,0 +1,86 @@
+package git_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCreateTarballFromRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"composer.json", "bin/tool", "vendor/autoload.php", ".git/HEAD"} {
+		path := filepath.Join(dir, "repo", file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := filepath.Join(dir, "artifact.tar.gz")
+
+	if _, err := git.CreateTarballFromRepository(filepath.Join(dir, "repo"), target, git.ArchiveOptions{StripVendor: true}); err != nil {
+		t.Fatalf("[!] CreateTarballFromRepository() = %v", err)
+	}
+
+	file, err := os.Open(target)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	compressed, err := gzip.NewReader(file)
+
+	if err != nil {
+		t.Fatalf("[!] CreateTarballFromRepository() didn't write a gzip: %v", err)
+	}
+
+	archive := tar.NewReader(compressed)
+
+	var names []string
+
+	for {
+		header, err := archive.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents, _ := ioutil.ReadAll(archive)
+
+		if string(contents) != header.Name {
+			t.Errorf("[!] CreateTarballFromRepository() wrote %q for %s; want %q", contents, header.Name, header.Name)
+		}
+
+		names = append(names, header.Name)
+	}
+
+	sort.Strings(names)
+
+	actual := strings.Join(names, ",")
+	expected := "bin/tool,composer.json"
+
+	if actual != expected {
+		t.Errorf("[!] CreateTarballFromRepository() archived %s; want %s", actual, expected)
+	}
+}
@@ -2,6 +2,9 @@ package git
 
 import (
 	"archive/zip"
+	"compress/flate"
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/config"
 	"io"
 	"os"
 	"path"
@@ -9,41 +12,77 @@ import (
 	"strings"
 )
 
-func CreateArtifactFromRepository(repoPath, target string) error {
+// ArchiveOptions control what goes into an artifact and how it's written
+type ArchiveOptions struct {
+	// One of the config.Compression* levels
+	Compression string
+	// Leave out a top level vendor directory
+	StripVendor bool
+	// One of the config.Symlinks* modes, links are followed when empty
+	Symlinks string
+	// One of the config.FileModes* modes, modes are normalised when empty
+	FileModes string
+	// The most files an archive can have, and the largest any of them can be
+	// in bytes. Archiving fails past either, 0 is no limit
+	MaxFiles    int
+	MaxFileSize int64
+}
+
+// CreateArtifactFromRepository zips up the checkout at repoPath into target
+// and returns the size of the resulting archive.
+func CreateArtifactFromRepository(repoPath, target string, options ArchiveOptions) (int64, error) {
 	repoPath = repoPath + "/."
 
 	zipfile, err := os.Create(target)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer zipfile.Close()
 
 	archive := zip.NewWriter(zipfile)
-	defer archive.Close()
 
-	_, err = os.Stat(repoPath)
-	if err != nil {
-		return nil
-	}
+	method := zip.Deflate
 
-	basePath := filepath.Dir(repoPath)
+	switch options.Compression {
+	case config.CompressionStore:
+		method = zip.Store
+	case config.CompressionFast, config.CompressionBest:
+		level := flate.BestSpeed
 
-	filepath.Walk(repoPath, func(filePath string, fileInfo os.FileInfo, err error) error {
-		if err != nil || fileInfo.IsDir() {
-			return err
+		if options.Compression == config.CompressionBest {
+			level = flate.BestCompression
 		}
 
-		// Ensure the archive doesn't contain the git repository
-		if strings.Contains(filePath, ".git") {
-			return nil
+		archive.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+
+	err = walkRepository(repoPath, options, func(archivePath, filePath string, fileInfo os.FileInfo) error {
+		header, err := zip.FileInfoHeader(fileInfo)
+		if err != nil {
+			return err
 		}
 
-		relativeFilePath, err := filepath.Rel(basePath, filePath)
+		header.Name = archivePath
+		header.Method = method
+		header.SetMode(archiveMode(fileInfo, options))
+
+		zipFileWriter, err := archive.CreateHeader(header)
 		if err != nil {
 			return err
 		}
 
-		archivePath := path.Join(filepath.SplitList(relativeFilePath)...)
+		// Zip stores a link as an entry holding the path it points to
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.WriteString(zipFileWriter, filepath.ToSlash(target))
+			return err
+		}
 
 		file, err := os.Open(filePath)
 		if err != nil {
@@ -53,14 +92,187 @@ func CreateArtifactFromRepository(repoPath, target string) error {
 			_ = file.Close()
 		}()
 
-		zipFileWriter, err := archive.Create(archivePath)
-		if err != nil {
-			return err
-		}
-
 		_, err = io.Copy(zipFileWriter, file)
 		return err
 	})
 
-	return err
+	if err != nil {
+		archive.Close()
+		return 0, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return 0, err
+	}
+
+	info, err := zipfile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// walkRepository calls fn for every file that belongs in an artifact of the
+// checkout at repoPath, with the path it should have inside the archive.
+// Symlinks are handled as options.Symlinks says, fn is given kept links
+// themselves and followed links as the file they point at. It stops with an
+// error at the file that goes over options' MaxFiles or MaxFileSize.
+func walkRepository(repoPath string, options ArchiveOptions, fn func(archivePath, filePath string, fileInfo os.FileInfo) error) error {
+	_, err := os.Stat(repoPath)
+	if err != nil {
+		return err
+	}
+
+	archived := 0
+	archive := fn
+
+	// Committed dependencies are the usual cause, better caught here than
+	// published as a package that takes an age to install
+	fn = func(archivePath, filePath string, fileInfo os.FileInfo) error {
+		archived++
+
+		if options.MaxFiles > 0 && archived > options.MaxFiles {
+			return fmt.Errorf("more than %d files to archive, stopped at %s. Are dependencies committed?", options.MaxFiles, archivePath)
+		}
+
+		if options.MaxFileSize > 0 && fileInfo.Mode()&os.ModeSymlink == 0 && fileInfo.Size() > options.MaxFileSize {
+			return fmt.Errorf("%s is %d bytes, more than the %d bytes a file in an archive can be", archivePath, fileInfo.Size(), options.MaxFileSize)
+		}
+
+		return archive(archivePath, filePath, fileInfo)
+	}
+
+	basePath := filepath.Dir(repoPath)
+
+	// Links are resolved to real paths, so the checkout has to be too for
+	// them to be compared
+	realBasePath, err := filepath.EvalSymlinks(basePath)
+	if err != nil {
+		return err
+	}
+
+	// Directories already walked by following a link, so links that loop
+	// back on themselves aren't followed forever
+	visited := map[string]bool{}
+
+	var walk func(root, prefix string) error
+
+	walk = func(root, prefix string) error {
+		return filepath.Walk(root, func(filePath string, fileInfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if fileInfo.IsDir() {
+				// A committed vendor directory bloats the package and its
+				// autoloader fights with the one in the consuming project
+				if options.StripVendor && filepath.Clean(filePath) == filepath.Join(basePath, "vendor") {
+					fmt.Printf("WARNING: %s has a vendor directory committed, leaving it out of the archive\n", basePath)
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
+			// Ensure the archive doesn't contain the git repository
+			if strings.Contains(filePath, ".git") {
+				return nil
+			}
+
+			relativeFilePath, err := filepath.Rel(root, filePath)
+			if err != nil {
+				return err
+			}
+
+			archivePath := path.Join(prefix, filepath.ToSlash(relativeFilePath))
+
+			if fileInfo.Mode()&os.ModeSymlink == 0 {
+				return fn(archivePath, filePath, fileInfo)
+			}
+
+			if options.Symlinks == config.SymlinksSkip {
+				return nil
+			}
+
+			// Whatever a link points at has to be part of the checkout,
+			// otherwise files from elsewhere on this machine end up in the
+			// package, or a link to them does
+			resolved, err := filepath.EvalSymlinks(filePath)
+
+			if err != nil {
+				fmt.Printf("WARNING: leaving %s out of the archive, it's a broken symlink\n", archivePath)
+				return nil
+			}
+
+			if !isWithin(realBasePath, resolved) {
+				fmt.Printf("WARNING: leaving %s out of the archive, it links outside the repository\n", archivePath)
+				return nil
+			}
+
+			if options.Symlinks == config.SymlinksKeep {
+				target, err := os.Readlink(filePath)
+
+				if err != nil {
+					return err
+				}
+
+				// The package is installed somewhere else entirely
+				if filepath.IsAbs(target) {
+					fmt.Printf("WARNING: leaving %s out of the archive, it's an absolute symlink\n", archivePath)
+					return nil
+				}
+
+				return fn(archivePath, filePath, fileInfo)
+			}
+
+			targetInfo, err := os.Stat(resolved)
+
+			if err != nil {
+				return err
+			}
+
+			if !targetInfo.IsDir() {
+				return fn(archivePath, resolved, targetInfo)
+			}
+
+			if visited[resolved] {
+				return nil
+			}
+
+			visited[resolved] = true
+
+			return walk(resolved, archivePath)
+		})
+	}
+
+	return walk(repoPath, "")
+}
+
+// isWithin is whether target is dir or somewhere inside it
+func isWithin(dir, target string) bool {
+	relative, err := filepath.Rel(dir, target)
+
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// archiveMode is the mode a file is given in an archive. Normalised modes
+// only keep whether a file is executable, consumers can then rely on
+// packages unpacking the same way whatever the permissions in the checkout
+func archiveMode(fileInfo os.FileInfo, options ArchiveOptions) os.FileMode {
+	mode := fileInfo.Mode()
+
+	if options.FileModes == config.FileModesPreserve {
+		return mode
+	}
+
+	if mode&os.ModeSymlink != 0 {
+		return os.ModeSymlink | 0777
+	}
+
+	if mode&0111 != 0 {
+		return 0755
+	}
+
+	return 0644
 }
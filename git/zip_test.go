@@ -0,0 +1,188 @@
+package git_test
+
+import (
+	"archive/zip"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func archiveFiles(t *testing.T, options git.ArchiveOptions) []string {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	files := []string{"composer.json", "src/Widget.php", "vendor/autoload.php", "src/vendor/Thing.php"}
+
+	for _, file := range files {
+		path := filepath.Join(dir, "repo", file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+
+		if err := ioutil.WriteFile(path, []byte("<?php"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := filepath.Join(dir, "artifact.zip")
+
+	if _, err := git.CreateArtifactFromRepository(filepath.Join(dir, "repo"), target, options); err != nil {
+		t.Fatalf("[!] CreateArtifactFromRepository() = %v", err)
+	}
+
+	archive, err := zip.OpenReader(target)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer archive.Close()
+
+	var names []string
+
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func TestCreateArtifactStripsVendor(t *testing.T) {
+	actual := strings.Join(archiveFiles(t, git.ArchiveOptions{StripVendor: true}), ",")
+	expected := "composer.json,src/Widget.php,src/vendor/Thing.php"
+
+	if actual != expected {
+		t.Errorf("[!] CreateArtifactFromRepository(StripVendor) archived %s; want %s", actual, expected)
+	}
+
+	actual = strings.Join(archiveFiles(t, git.ArchiveOptions{}), ",")
+	expected = "composer.json,src/Widget.php,src/vendor/Thing.php,vendor/autoload.php"
+
+	if actual != expected {
+		t.Errorf("[!] CreateArtifactFromRepository() archived %s; want %s", actual, expected)
+	}
+}
+
+// [][]interface{}{symlinks mode, expected entries as name mode [contents]}
+var symlinkTests = [][]interface{}{
+	{"", "absolute -rw-r--r--,bin/run -rwxr-xr-x,composer.json -rw-r--r--,lib/Widget.php -rw-r--r--,src/Widget.php -rw-r--r--,widget.php -rw-r--r--"},
+	{config.SymlinksKeep, "bin/run -rwxr-xr-x,composer.json -rw-r--r--,lib Lrwxrwxrwx src,src/Widget.php -rw-r--r--,widget.php Lrwxrwxrwx src/Widget.php"},
+	{config.SymlinksSkip, "bin/run -rwxr-xr-x,composer.json -rw-r--r--,src/Widget.php -rw-r--r--"},
+}
+
+func TestCreateArtifactHandlesSymlinksAndModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	os.MkdirAll(filepath.Join(repo, "src"), 0755)
+	os.MkdirAll(filepath.Join(repo, "bin"), 0755)
+
+	files := map[string]os.FileMode{"composer.json": 0600, "src/Widget.php": 0664, "bin/run": 0775, "../secret": 0600}
+
+	for file, mode := range files {
+		if err := ioutil.WriteFile(filepath.Join(repo, file), []byte("<?php"), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{"widget.php": "src/Widget.php", "lib": "src", "secret": "../secret", "absolute": filepath.Join(repo, "composer.json")}
+
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(repo, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range symlinkTests {
+		target := filepath.Join(dir, "artifact.zip")
+
+		if _, err := git.CreateArtifactFromRepository(repo, target, git.ArchiveOptions{Symlinks: test[0].(string)}); err != nil {
+			t.Fatalf("[!] CreateArtifactFromRepository(%s) = %v", test[0], err)
+		}
+
+		archive, err := zip.OpenReader(target)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var entries []string
+
+		for _, file := range archive.File {
+			entry := file.Name + " " + file.Mode().String()
+
+			if file.Mode()&os.ModeSymlink != 0 {
+				reader, _ := file.Open()
+				contents, _ := ioutil.ReadAll(reader)
+				reader.Close()
+
+				entry += " " + string(contents)
+			}
+
+			entries = append(entries, entry)
+		}
+
+		archive.Close()
+		sort.Strings(entries)
+
+		if actual := strings.Join(entries, ","); actual != test[1] {
+			t.Errorf("[!] CreateArtifactFromRepository(%s) archived %s; want %s", test[0], actual, test[1])
+		}
+	}
+}
+
+func TestCreateArtifactLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	os.MkdirAll(filepath.Join(repo, "node_modules", "left-pad"), 0755)
+
+	files := map[string]string{
+		"composer.json":                  `{"name": "acme/widgets"}`,
+		"node_modules/left-pad/index.js": "module.exports = require('./pad')",
+	}
+
+	for file, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(repo, file), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// options, what the error has to mention or empty when it's archived
+	tests := [][]interface{}{
+		{git.ArchiveOptions{MaxFiles: 2, MaxFileSize: 33}, ""},
+		{git.ArchiveOptions{MaxFiles: 1}, "more than 1 files"},
+		{git.ArchiveOptions{MaxFileSize: 32}, "node_modules/left-pad/index.js is 33 bytes"},
+	}
+
+	for _, test := range tests {
+		options, want := test[0].(git.ArchiveOptions), test[1].(string)
+		_, err := git.CreateArtifactFromRepository(repo, filepath.Join(dir, "artifact.zip"), options)
+
+		if (want == "" && err != nil) || (want != "" && (err == nil || !strings.Contains(err.Error(), want))) {
+			t.Errorf("[!] CreateArtifactFromRepository(%+v) = %v; want %q", options, err, want)
+		}
+	}
+}
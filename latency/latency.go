@@ -0,0 +1,107 @@
+package latency
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Recorder keeps the most recent durations of each phase for each key, so
+// percentiles reflect how things are now rather than since startup.
+type Recorder struct {
+	mutex   sync.Mutex
+	size    int
+	samples map[string]map[string]*window
+}
+
+// Summary is the percentiles of a phase's recent durations in milliseconds
+type Summary struct {
+	Count int   `json:"count"`
+	P50   int64 `json:"p50Ms"`
+	P95   int64 `json:"p95Ms"`
+	P99   int64 `json:"p99Ms"`
+}
+
+type window struct {
+	durations []time.Duration
+	next      int
+}
+
+// New creates a Recorder keeping the last size durations of each phase
+func New(size int) *Recorder {
+	return &Recorder{size: size, samples: map[string]map[string]*window{}}
+}
+
+// Record adds how long phase took for key
+func (r *Recorder) Record(key, phase string, duration time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	phases, ok := r.samples[key]
+
+	if !ok {
+		phases = map[string]*window{}
+		r.samples[key] = phases
+	}
+
+	samples, ok := phases[phase]
+
+	if !ok {
+		samples = &window{}
+		phases[phase] = samples
+	}
+
+	if len(samples.durations) < r.size {
+		samples.durations = append(samples.durations, duration)
+		return
+	}
+
+	samples.durations[samples.next] = duration
+	samples.next = (samples.next + 1) % r.size
+}
+
+// Since records the time since start, for use with defer
+func (r *Recorder) Since(key, phase string, start time.Time) {
+	r.Record(key, phase, time.Since(start))
+}
+
+// Summaries returns the percentiles of every phase by key
+func (r *Recorder) Summaries() map[string]map[string]Summary {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	summaries := map[string]map[string]Summary{}
+
+	for key, phases := range r.samples {
+		summaries[key] = map[string]Summary{}
+
+		for phase, samples := range phases {
+			sorted := append([]time.Duration(nil), samples.durations...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+			summaries[key][phase] = Summary{
+				Count: len(sorted),
+				P50:   percentile(sorted, 50),
+				P95:   percentile(sorted, 95),
+				P99:   percentile(sorted, 99),
+			}
+		}
+	}
+
+	return summaries
+}
+
+// percentile uses the nearest rank of the already sorted durations
+func percentile(sorted []time.Duration, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := (p*len(sorted) + 99) / 100
+
+	if rank < 1 {
+		rank = 1
+	}
+
+	return int64(sorted[rank-1] / time.Millisecond)
+}
@@ -0,0 +1,50 @@
+package latency_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/latency"
+	"testing"
+	"time"
+)
+
+func TestRecorderSummaries(t *testing.T) {
+	recorder := latency.New(100)
+
+	for i := 1; i <= 100; i++ {
+		recorder.Record("acme/widgets", "upload", time.Duration(i)*time.Millisecond)
+	}
+
+	recorder.Record("acme/gadgets", "clone", 3*time.Second)
+
+	actual := recorder.Summaries()["acme/widgets"]["upload"]
+	expected := latency.Summary{Count: 100, P50: 50, P95: 95, P99: 99}
+
+	if actual != expected {
+		t.Errorf("[!] Summaries() = %+v; want %+v", actual, expected)
+	}
+
+	actual = recorder.Summaries()["acme/gadgets"]["clone"]
+	expected = latency.Summary{Count: 1, P50: 3000, P95: 3000, P99: 3000}
+
+	if actual != expected {
+		t.Errorf("[!] Summaries() = %+v; want %+v", actual, expected)
+	}
+}
+
+func TestRecorderKeepsRecentDurations(t *testing.T) {
+	recorder := latency.New(10)
+
+	for i := 0; i < 10; i++ {
+		recorder.Record("acme/widgets", "archive", time.Hour)
+	}
+
+	for i := 0; i < 10; i++ {
+		recorder.Record("acme/widgets", "archive", time.Second)
+	}
+
+	actual := recorder.Summaries()["acme/widgets"]["archive"]
+	expected := latency.Summary{Count: 10, P50: 1000, P95: 1000, P99: 1000}
+
+	if actual != expected {
+		t.Errorf("[!] Summaries() = %+v; want %+v", actual, expected)
+	}
+}
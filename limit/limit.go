@@ -0,0 +1,122 @@
+package limit
+
+import (
+	"context"
+	"sync"
+)
+
+// Limit caps how many of something can happen at once. A nil Limit, or one
+// created with a size of zero or less, never blocks.
+type Limit struct {
+	slots chan struct{}
+}
+
+func New(size int) *Limit {
+	if size <= 0 {
+		return &Limit{}
+	}
+
+	return &Limit{slots: make(chan struct{}, size)}
+}
+
+// Acquire blocks until there is a free slot, every Acquire must be paired
+// with a Release.
+func (l *Limit) Acquire() {
+	if l == nil || l.slots == nil {
+		return
+	}
+
+	l.slots <- struct{}{}
+}
+
+// AcquireContext is Acquire giving up with ctx's error once it is done.
+func (l *Limit) AcquireContext(ctx context.Context) error {
+	if l == nil || l.slots == nil {
+		return ctx.Err()
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *Limit) Release() {
+	if l == nil || l.slots == nil {
+		return
+	}
+
+	<-l.slots
+}
+
+// Each calls fn with every index from 0 to count-1, running at most size of
+// them at once, and returns once they have all returned. A size of zero or
+// less runs them all at once.
+func Each(count, size int, fn func(i int)) {
+	l := New(size)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < count; i++ {
+		l.Acquire()
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			defer l.Release()
+
+			fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// InUse is how many slots are currently taken, always zero when unlimited.
+func (l *Limit) InUse() int {
+	if l == nil {
+		return 0
+	}
+
+	return len(l.slots)
+}
+
+// Size is the number of slots, zero when unlimited.
+func (l *Limit) Size() int {
+	if l == nil {
+		return 0
+	}
+
+	return cap(l.slots)
+}
+
+// Keyed is a separate Limit of the same size for each key, like a GitHub
+// owner, so one key can't take every slot of a shared limit. A nil Keyed, or
+// one created with a size of zero or less, never blocks.
+type Keyed struct {
+	size   int
+	lock   sync.Mutex
+	limits map[string]*Limit
+}
+
+func NewKeyed(size int) *Keyed {
+	return &Keyed{size: size, limits: map[string]*Limit{}}
+}
+
+// For returns the key's Limit, created the first time the key is seen.
+func (k *Keyed) For(key string) *Limit {
+	if k == nil || k.size <= 0 {
+		return nil
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if _, ok := k.limits[key]; !ok {
+		k.limits[key] = New(k.size)
+	}
+
+	return k.limits[key]
+}
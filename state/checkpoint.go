@@ -0,0 +1,102 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Checkpoint records the package versions a long running sync has finished,
+// as json of package name to versions, so an interrupted sync can pick up
+// where it left off.
+type Checkpoint struct {
+	path  string
+	mutex sync.Mutex
+	done  map[string][]string
+}
+
+// NewCheckpoint starts an empty checkpoint at path, replacing whatever was
+// there once the first version is recorded.
+func NewCheckpoint(path string) *Checkpoint {
+	return &Checkpoint{path: path, done: map[string][]string{}}
+}
+
+// LoadCheckpoint reads the checkpoint saved at path, a missing file is the
+// same as an empty one.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	checkpoint := NewCheckpoint(path)
+
+	contents, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &checkpoint.done); err != nil {
+		return nil, err
+	}
+
+	return checkpoint, nil
+}
+
+// IsDone is whether the version of the package has been recorded
+func (c *Checkpoint) IsDone(name, version string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.isDone(name, version)
+}
+
+func (c *Checkpoint) isDone(name, version string) bool {
+	for _, done := range c.done[name] {
+		if done == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Record saves the version of the package as done
+func (c *Checkpoint) Record(name, version string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.isDone(name, version) {
+		return nil
+	}
+
+	c.done[name] = append(c.done[name], version)
+	sort.Strings(c.done[name])
+
+	return writeJson(c.path, c.done)
+}
+
+// Remove deletes the checkpoint file, for when the sync has finished
+func (c *Checkpoint) Remove() error {
+	if c == nil {
+		return nil
+	}
+
+	err := os.Remove(c.path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
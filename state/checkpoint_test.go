@@ -0,0 +1,53 @@
+package state_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/state"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "run-checkpoint.json")
+	checkpoint := state.NewCheckpoint(path)
+
+	for _, version := range []string{"1.1.0", "1.0.0", "1.1.0"} {
+		if err := checkpoint.Record("acme/widgets", version); err != nil {
+			t.Fatalf("[!] Record(acme/widgets, %s) = %v", version, err)
+		}
+	}
+
+	contents, _ := ioutil.ReadFile(path)
+	expected := "{\n  \"acme/widgets\": [\n    \"1.0.0\",\n    \"1.1.0\"\n  ]\n}"
+
+	if string(contents) != expected {
+		t.Errorf("[!] checkpoint saved %s; want %s", contents, expected)
+	}
+
+	resumed, err := state.LoadCheckpoint(path)
+
+	if err != nil {
+		t.Fatalf("[!] LoadCheckpoint() = %v", err)
+	}
+
+	if !resumed.IsDone("acme/widgets", "1.0.0") || resumed.IsDone("acme/widgets", "2.0.0") || resumed.IsDone("acme/gadgets", "1.0.0") {
+		t.Errorf("[!] LoadCheckpoint() didn't resume with acme/widgets 1.0.0 and 1.1.0 done")
+	}
+
+	if err := resumed.Remove(); err != nil {
+		t.Errorf("[!] Remove() = %v", err)
+	}
+
+	if fresh, _ := state.LoadCheckpoint(path); fresh.IsDone("acme/widgets", "1.0.0") {
+		t.Errorf("[!] LoadCheckpoint() after Remove() still has acme/widgets 1.0.0 done")
+	}
+}
@@ -0,0 +1,91 @@
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+// PublishedCommits remembers the commit each tag version was first published
+// from, so a tag that's been moved to another commit can be spotted. It is
+// kept in a json file so it survives restarts.
+type PublishedCommits struct {
+	path    string
+	mutex   sync.Mutex
+	commits map[string]entry
+}
+
+// LoadPublishedCommits reads the commits saved at path, a missing file is the
+// same as an empty one.
+func LoadPublishedCommits(path string) (*PublishedCommits, error) {
+	commits, err := loadEntries(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &PublishedCommits{path: path, commits: commits}, nil
+}
+
+// Get is the commit key was published from, empty when it hasn't been.
+func (c *PublishedCommits) Get(key string) string {
+	if c == nil {
+		return ""
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.commits[key].Value
+}
+
+// Record saves commit as what key was published from, unless it already has
+// one. Nothing changes when it can't be saved.
+func (c *PublishedCommits) Record(key, commit string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, known := c.commits[key]; known {
+		return nil
+	}
+
+	c.commits[key] = entry{Value: commit, RecordedAt: time.Now().UTC()}
+
+	if err := writeJson(c.path, c.commits); err != nil {
+		delete(c.commits, key)
+
+		return err
+	}
+
+	return nil
+}
+
+// Forget drops the commit for key, for when its tag has been deleted and can
+// be pushed again anywhere. Nothing changes when it can't be saved.
+func (c *PublishedCommits) Forget(key string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	previous, known := c.commits[key]
+
+	if !known {
+		return nil
+	}
+
+	delete(c.commits, key)
+
+	if err := writeJson(c.path, c.commits); err != nil {
+		restore(c.commits, key, previous, known)
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package state_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/state"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPublishedCommitsKeepsTheFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "published-commits.json")
+	commits, err := state.LoadPublishedCommits(path)
+
+	if err != nil {
+		t.Fatalf("[!] LoadPublishedCommits() = %v", err)
+	}
+
+	for _, commit := range []string{"abc123", "def456"} {
+		if err := commits.Record("packages:acme/widgets:v1.0.0", commit); err != nil {
+			t.Fatalf("[!] Record(%s) = %v", commit, err)
+		}
+	}
+
+	// Still the first after a restart
+	commits, err = state.LoadPublishedCommits(path)
+
+	if err != nil {
+		t.Fatalf("[!] LoadPublishedCommits() = %v", err)
+	}
+
+	if commit := commits.Get("packages:acme/widgets:v1.0.0"); commit != "abc123" {
+		t.Errorf("[!] Get() after reload = %v; want abc123", commit)
+	}
+
+	if err := commits.Forget("packages:acme/widgets:v1.0.0"); err != nil {
+		t.Fatalf("[!] Forget() = %v", err)
+	}
+
+	if err := commits.Record("packages:acme/widgets:v1.0.0", "def456"); err != nil {
+		t.Fatalf("[!] Record() after Forget() = %v", err)
+	}
+
+	if commit := commits.Get("packages:acme/widgets:v1.0.0"); commit != "def456" {
+		t.Errorf("[!] Get() after Forget() and Record() = %v; want def456", commit)
+	}
+}
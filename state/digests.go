@@ -0,0 +1,108 @@
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+// PublishedDigests remembers a digest of what each branch version was last
+// published with, so a push that doesn't change the package (docs or CI only)
+// can skip publishing it again. It is kept in a json file so it survives
+// restarts.
+type PublishedDigests struct {
+	path    string
+	mutex   sync.Mutex
+	digests map[string]entry
+}
+
+// LoadPublishedDigests reads the digests saved at path, a missing file is the
+// same as an empty one.
+func LoadPublishedDigests(path string) (*PublishedDigests, error) {
+	digests, err := loadEntries(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &PublishedDigests{path: path, digests: digests}, nil
+}
+
+// Get is the digest last recorded for key, empty when there isn't one.
+func (d *PublishedDigests) Get(key string) string {
+	if d == nil {
+		return ""
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.digests[key].Value
+}
+
+// Record saves digest as what key was last published with. Nothing changes
+// when it can't be saved.
+func (d *PublishedDigests) Record(key, digest string) error {
+	if d == nil {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	previous, known := d.digests[key]
+	d.digests[key] = entry{Value: digest, RecordedAt: time.Now().UTC()}
+
+	// Still in use, but not worth a write just to say so
+	if known && previous.Value == digest {
+		return nil
+	}
+
+	if err := writeJson(d.path, d.digests); err != nil {
+		restore(d.digests, key, previous, known)
+
+		return err
+	}
+
+	return nil
+}
+
+// Forget drops the digest for key, for when its version has been deleted.
+// Nothing changes when it can't be saved.
+func (d *PublishedDigests) Forget(key string) error {
+	if d == nil {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	previous, known := d.digests[key]
+
+	if !known {
+		return nil
+	}
+
+	delete(d.digests, key)
+
+	if err := writeJson(d.path, d.digests); err != nil {
+		restore(d.digests, key, previous, known)
+
+		return err
+	}
+
+	return nil
+}
+
+// Prune forgets the digests that haven't been recorded for longer than
+// maxAge, returning how many were. A pruned branch is published again on its
+// next push even if it hasn't changed.
+func (d *PublishedDigests) Prune(maxAge time.Duration) (int, error) {
+	if d == nil {
+		return 0, nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return pruneEntries(d.path, d.digests, maxAge)
+}
@@ -0,0 +1,149 @@
+package state_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/state"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPublishedDigests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "published-digests.json")
+	digests, err := state.LoadPublishedDigests(path)
+
+	if err != nil {
+		t.Fatalf("[!] LoadPublishedDigests() = %v", err)
+	}
+
+	if digest := digests.Get("packages:acme/widgets:dev-master"); digest != "" {
+		t.Errorf("[!] Get() before Record() = %v; want nothing", digest)
+	}
+
+	if err := digests.Record("packages:acme/widgets:dev-master", "abc123"); err != nil {
+		t.Fatalf("[!] Record() = %v", err)
+	}
+
+	if err := digests.Record("packages:acme/widgets:dev-feature", "def456"); err != nil {
+		t.Fatalf("[!] Record() = %v", err)
+	}
+
+	if err := digests.Forget("packages:acme/widgets:dev-feature"); err != nil {
+		t.Fatalf("[!] Forget() = %v", err)
+	}
+
+	// Still known after a restart
+	digests, err = state.LoadPublishedDigests(path)
+
+	if err != nil {
+		t.Fatalf("[!] LoadPublishedDigests() = %v", err)
+	}
+
+	if digest := digests.Get("packages:acme/widgets:dev-master"); digest != "abc123" {
+		t.Errorf("[!] Get(dev-master) after reload = %v; want abc123", digest)
+	}
+
+	if digest := digests.Get("packages:acme/widgets:dev-feature"); digest != "" {
+		t.Errorf("[!] Get(dev-feature) after Forget() = %v; want nothing", digest)
+	}
+}
+
+func TestPublishedDigestsUnchangedWhenUnsaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "published-digests.json")
+	digests, _ := state.LoadPublishedDigests(path)
+
+	if err := digests.Record("packages:acme/widgets:dev-master", "abc123"); err != nil {
+		t.Fatalf("[!] Record() = %v", err)
+	}
+
+	// Nowhere to write to any more
+	os.RemoveAll(dir)
+
+	if err := digests.Record("packages:acme/widgets:dev-master", "def456"); err == nil {
+		t.Fatalf("[!] Record() without its directory = nil; want an error")
+	}
+
+	if digest := digests.Get("packages:acme/widgets:dev-master"); digest != "abc123" {
+		t.Errorf("[!] Get() after an unsaved Record() = %v; want abc123", digest)
+	}
+
+	if err := digests.Forget("packages:acme/widgets:dev-master"); err == nil {
+		t.Fatalf("[!] Forget() without its directory = nil; want an error")
+	}
+
+	if digest := digests.Get("packages:acme/widgets:dev-master"); digest != "abc123" {
+		t.Errorf("[!] Get() after an unsaved Forget() = %v; want abc123", digest)
+	}
+}
+
+func TestPublishedDigestsPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Saved before digests were recorded with a time
+	path := filepath.Join(dir, "published-digests.json")
+
+	if err := ioutil.WriteFile(path, []byte(`{"packages:acme/widgets:dev-master": "abc123"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	digests, err := state.LoadPublishedDigests(path)
+
+	if err != nil {
+		t.Fatalf("[!] LoadPublishedDigests() = %v", err)
+	}
+
+	if digest := digests.Get("packages:acme/widgets:dev-master"); digest != "abc123" {
+		t.Errorf("[!] Get() from an old file = %v; want abc123", digest)
+	}
+
+	if pruned, err := digests.Prune(time.Hour); pruned != 0 || err != nil {
+		t.Errorf("[!] Prune(1h) = %d, %v; want nothing pruned", pruned, err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if err := digests.Record("packages:acme/widgets:dev-feature", "def456"); err != nil {
+		t.Fatalf("[!] Record() = %v", err)
+	}
+
+	if pruned, err := digests.Prune(100 * time.Millisecond); pruned != 1 || err != nil {
+		t.Errorf("[!] Prune(100ms) = %d, %v; want dev-master pruned", pruned, err)
+	}
+
+	digests, err = state.LoadPublishedDigests(path)
+
+	if err != nil {
+		t.Fatalf("[!] LoadPublishedDigests() = %v", err)
+	}
+
+	if digest := digests.Get("packages:acme/widgets:dev-master"); digest != "" {
+		t.Errorf("[!] Get(dev-master) after Prune() = %v; want nothing", digest)
+	}
+
+	if digest := digests.Get("packages:acme/widgets:dev-feature"); digest != "def456" {
+		t.Errorf("[!] Get(dev-feature) after Prune() = %v; want def456", digest)
+	}
+}
@@ -0,0 +1,80 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// entry is a value in a state file along with when it was last recorded, so
+// ones that haven't been for a while can be pruned
+type entry struct {
+	Value      string    `json:"value"`
+	RecordedAt time.Time `json:"recordedAt"`
+}
+
+// loadEntries reads the entries saved at path, a missing file is the same as
+// an empty one. Files from before entries had a time are plain key to value,
+// their entries are treated as just recorded.
+func loadEntries(path string) (map[string]entry, error) {
+	entries := map[string]entry{}
+
+	contents, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &entries); err == nil {
+		return entries, nil
+	}
+
+	var values map[string]string
+
+	if err := json.Unmarshal(contents, &values); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	entries = map[string]entry{}
+
+	for key, value := range values {
+		entries[key] = entry{Value: value, RecordedAt: now}
+	}
+
+	return entries, nil
+}
+
+// pruneEntries drops the entries last recorded more than maxAge ago and saves
+// what's left to path, returning how many were dropped. Nothing changes when
+// it can't be saved.
+func pruneEntries(path string, entries map[string]entry, maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+	pruned := map[string]entry{}
+
+	for key, recorded := range entries {
+		if recorded.RecordedAt.Before(cutoff) {
+			pruned[key] = recorded
+			delete(entries, key)
+		}
+	}
+
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+
+	if err := writeJson(path, entries); err != nil {
+		for key, recorded := range pruned {
+			entries[key] = recorded
+		}
+
+		return 0, err
+	}
+
+	return len(pruned), nil
+}
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// PackageNames remembers the composer name last published from each
+// repository (or monorepo package directory) so renames can be spotted. It is
+// kept in a json file so it survives restarts.
+type PackageNames struct {
+	path  string
+	mutex sync.Mutex
+	names map[string]entry
+}
+
+// LoadPackageNames reads the names saved at path, a missing file is the same
+// as an empty one.
+func LoadPackageNames(path string) (*PackageNames, error) {
+	names, err := loadEntries(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &PackageNames{path: path, names: names}, nil
+}
+
+// Record saves name as the latest for key and returns the name it replaced,
+// which is empty when there wasn't one or it hasn't changed. Nothing changes
+// when it can't be saved, so it can be recorded again.
+func (n *PackageNames) Record(key, name string) (string, error) {
+	if n == nil {
+		return "", nil
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	previous, known := n.names[key]
+
+	// Still in use, but not worth a write just to say so
+	if previous.Value == name {
+		if known {
+			n.names[key] = entry{Value: name, RecordedAt: time.Now().UTC()}
+		}
+
+		return "", nil
+	}
+
+	n.names[key] = entry{Value: name, RecordedAt: time.Now().UTC()}
+
+	if err := writeJson(n.path, n.names); err != nil {
+		restore(n.names, key, previous, known)
+
+		return "", err
+	}
+
+	return previous.Value, nil
+}
+
+// Prune forgets the names that haven't been recorded for longer than maxAge,
+// returning how many were. A rename of a pruned repository isn't spotted.
+func (n *PackageNames) Prune(maxAge time.Duration) (int, error) {
+	if n == nil {
+		return 0, nil
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return pruneEntries(n.path, n.names, maxAge)
+}
+
+// restore puts back the value a map had before a change that couldn't be
+// saved
+func restore(entries map[string]entry, key string, previous entry, known bool) {
+	if known {
+		entries[key] = previous
+	} else {
+		delete(entries, key)
+	}
+}
+
+// writeJson saves value to path as indented json, written to the side and
+// moved over so a crash can't leave half a file
+func writeJson(path string, value interface{}) error {
+	contents, err := json.MarshalIndent(value, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path+".tmp", contents, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
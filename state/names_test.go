@@ -0,0 +1,51 @@
+package state_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/state"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackageNamesRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "package-names.json")
+	names, err := state.LoadPackageNames(path)
+
+	if err != nil {
+		t.Fatalf("[!] LoadPackageNames() = %v", err)
+	}
+
+	records := [][]string{
+		{"acme/widgets", ""},
+		{"acme/widgets", ""},
+		{"acme/gadgets", "acme/widgets"},
+	}
+
+	for _, record := range records {
+		previous, err := names.Record("git@github.com:acme/widgets.git", record[0])
+
+		if err != nil || previous != record[1] {
+			t.Errorf("[!] Record(%s) = %v, %v; want %v", record[0], previous, err, record[1])
+		}
+	}
+
+	// The latest name is still known after a restart
+	names, err = state.LoadPackageNames(path)
+
+	if err != nil {
+		t.Fatalf("[!] LoadPackageNames() = %v", err)
+	}
+
+	if previous, _ := names.Record("git@github.com:acme/widgets.git", "acme/widgets"); previous != "acme/gadgets" {
+		t.Errorf("[!] Record(acme/widgets) after reload = %v; want acme/gadgets", previous)
+	}
+}
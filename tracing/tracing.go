@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+const tracerName = "github.com/Lavoaster/cloudsmith-sync"
+
+// Tracing is opt in. Until Setup is given an endpoint OpenTelemetry's global
+// provider is its no-op one, so the spans started below cost next to nothing.
+
+// Setup exports spans over OTLP/HTTP to endpoint, a host:port like
+// otel-collector:4318, and continues traces from W3C traceparent headers. The
+// returned function flushes spans that haven't been exported yet, nothing is
+// set up when endpoint is empty.
+func Setup(ctx context.Context, endpoint string, insecure bool, version string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+
+	if insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName("cloudsmith-sync"),
+			semconv.ServiceVersion(version),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider.Shutdown, nil
+}
+
+// FromRequest continues the trace an incoming request is part of, if any,
+// on ctx. Webhooks are deliberately processed on a context that isn't tied
+// to the request so only the trace is carried over.
+func FromRequest(ctx context.Context, r *http.Request) context.Context {
+	remote := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+
+	return trace.ContextWithRemoteSpanContext(ctx, trace.SpanContextFromContext(remote))
+}
+
+// Start starts a span, a child of the one in ctx if there is one
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End ends a span, marking it as failed when err isn't nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+func Repository(url string) attribute.KeyValue {
+	return attribute.String("cloudsmith_sync.repository", url)
+}
+
+func Ref(ref string) attribute.KeyValue {
+	return attribute.String("cloudsmith_sync.ref", ref)
+}
+
+func Package(name string) attribute.KeyValue {
+	return attribute.String("cloudsmith_sync.package", name)
+}
+
+func Version(version string) attribute.KeyValue {
+	return attribute.String("cloudsmith_sync.version", version)
+}
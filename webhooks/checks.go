@@ -0,0 +1,54 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/checks"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	"strings"
+)
+
+// Reads the GitHub checks of repositories with requiredChecks
+var Checks *checks.Client
+
+// awaitRequiredChecks waits for a push's required checks, returning false
+// with the response to give when they haven't passed. Checks still pending
+// once the wait is over defer the push, publishing it is then up to a
+// redelivery or POST /sync.
+func awaitRequiredChecks(ctx context.Context, repoCfg *config.Repository, push github.PushPayload) (int, response, bool) {
+	fullName := push.Repository.FullName
+
+	// Create events don't fill in the repository
+	if fullName == "" {
+		fullName = config.RepositoryFullName(repoCfg.Url)
+	}
+
+	// Or the commit, GitHub's api takes the tag's name instead
+	ref := push.HeadCommit.ID
+
+	if ref == "" {
+		ref = strings.TrimPrefix(push.Ref, "refs/")
+	}
+
+	required := repoCfg.RequiredChecks
+	result, err := Checks.Wait(ctx, fullName, ref, required.Checks, required.Interval, required.Timeout)
+
+	if err != nil {
+		return 500, response{Status: statusError, Reason: "unable to read the required checks: " + err.Error()}, false
+	}
+
+	switch result.State {
+	case checks.StateFailed:
+		fmt.Printf("Refusing to publish %s for %s, required checks failed: %s\n", push.Ref, repoCfg.Url, strings.Join(result.Failed, ", "))
+
+		return 422, response{Status: statusRejected, Reason: "required checks failed: " + strings.Join(result.Failed, ", ")}, false
+
+	case checks.StatePending:
+		fmt.Printf("Deferring %s for %s, awaiting CI: %s\n", push.Ref, repoCfg.Url, strings.Join(result.Pending, ", "))
+
+		return 202, response{Status: statusDeferred, Reason: "deferred, awaiting CI: " + strings.Join(result.Pending, ", ")}, false
+	}
+
+	return 0, response{}, true
+}
@@ -0,0 +1,22 @@
+package webhooks
+
+import (
+	"context"
+	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
+	"github.com/Lavoaster/cloudsmith-sync/limit"
+	"github.com/cloudsmith-io/cloudsmith-api/bindings/go/src"
+	"time"
+)
+
+// CloudsmithClient is what the handlers need from Cloudsmith. It's satisfied
+// by *cloudsmith.Client, tests stand in a fake so webhooks can be replayed
+// without talking to Cloudsmith.
+type CloudsmithClient interface {
+	UploadPackage(owner, repo, format, artifactPath string, options cloudsmith.UploadOptions) (*cloudsmith_api.ModelPackage, error)
+	DeletePackageIfExists(owner, repo, format, name, version, reason, actor string) error
+	WaitForPackageDeletion(ctx context.Context, owner, repo, name, version string, timeout time.Duration) error
+	PromotePackage(ctx context.Context, owner, staging, target, name, version, actor string, timeout time.Duration) error
+	ListPackageVersions(owner, repo string) ([]cloudsmith.Package, error)
+	TagPackage(owner, repo, name, version, action string, tags []string) error
+	UploadLimit() *limit.Limit
+}
@@ -0,0 +1,120 @@
+package webhooks
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How long a ref event is remembered for, GitHub sends the push and the
+// create or delete event for the same change within seconds of each other
+const refEventWindow = 5 * time.Minute
+
+const (
+	refEventPublish = "publish"
+	refEventDelete  = "delete"
+)
+
+// refEvents remembers the tags published and refs deleted recently, so a
+// repository whose webhook gets both push and create/delete events only acts
+// on the first of them.
+type refEvents struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time
+}
+
+var recentRefEvents = &refEvents{seen: map[string]time.Time{}}
+
+// Record notes the action on the ref, returning false when it was already
+// done within the window. Doing the opposite action forgets the earlier one
+// so a tag deleted and pushed again is still published.
+func (e *refEvents) Record(repoUrl, ref, action string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	now := time.Now()
+
+	for key, at := range e.seen {
+		if now.Sub(at) > refEventWindow {
+			delete(e.seen, key)
+		}
+	}
+
+	opposite := refEventDelete
+
+	if action == refEventDelete {
+		opposite = refEventPublish
+	}
+
+	delete(e.seen, repoUrl+" "+ref+" "+opposite)
+
+	key := repoUrl + " " + ref + " " + action
+
+	if _, ok := e.seen[key]; ok {
+		return false
+	}
+
+	e.seen[key] = now
+
+	return true
+}
+
+// Forget drops the action on the ref, for when acting on it failed and a
+// later event should try again.
+func (e *refEvents) Forget(repoUrl, ref, action string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	delete(e.seen, repoUrl+" "+ref+" "+action)
+}
+
+// pushFlights collapses identical pushes, the same commit pushed to the same
+// ref, that arrive while the first is still being published. The per
+// repository lock would only run them one after the other, doing the delete
+// and upload twice.
+type pushFlights struct {
+	mutex   sync.Mutex
+	flights map[string]*pushFlight
+}
+
+type pushFlight struct {
+	done chan struct{}
+	code int
+	res  response
+}
+
+var inFlightPushes = &pushFlights{flights: map[string]*pushFlight{}}
+
+// Do publishes with publish unless the same key is already being published,
+// in which case it waits for and returns that result instead. The returned
+// bool is whether the result was shared.
+func (f *pushFlights) Do(ctx context.Context, key string, publish func() (int, response)) (int, response, bool) {
+	f.mutex.Lock()
+
+	if flight, ok := f.flights[key]; ok {
+		f.mutex.Unlock()
+
+		select {
+		case <-flight.done:
+			return flight.code, flight.res, true
+		case <-ctx.Done():
+			return 500, response{Status: statusError, Reason: "gave up waiting for the identical push being published"}, true
+		}
+	}
+
+	flight := &pushFlight{done: make(chan struct{})}
+	f.flights[key] = flight
+	f.mutex.Unlock()
+
+	defer func() {
+		f.mutex.Lock()
+		delete(f.flights, key)
+		f.mutex.Unlock()
+
+		close(flight.done)
+	}()
+
+	flight.code, flight.res = publish()
+
+	return flight.code, flight.res, false
+}
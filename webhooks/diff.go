@@ -0,0 +1,96 @@
+package webhooks
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// HandleGithubDiff takes a push webhook and responds with the changes that
+// publishing it would make to each package's composer.json, using the same
+// checkout and mutation as a real publish but without uploading anything.
+func HandleGithubDiff(w http.ResponseWriter, r *http.Request) {
+	payload, _, ok := readPayload(w, r, github.PushEvent)
+
+	if !ok {
+		return
+	}
+
+	ctx, cancel := newWebhookContext()
+	defer cancel()
+
+	push := payload.(github.PushPayload)
+	repoCfg, err := Config.GetRepository(push.Repository.FullName, push.Repository.SSHURL)
+
+	if err != nil {
+		writeResponse(w, 422, response{Status: statusRejected, Reason: "repository not configured"})
+		return
+	}
+
+	if push.Deleted {
+		writeResponse(w, 422, response{Status: statusRejected, Reason: "deleted refs have nothing to publish"})
+		return
+	}
+
+	checkout, code, err := checkoutPush(ctx, &repoCfg, push)
+
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	defer checkout.release()
+
+	packages, versionRef, err := repoCfg.GetPackagesForRef(checkout.ref.Name().Short(), checkout.isBranch)
+
+	if err != nil {
+		writeError(w, 422, err)
+		return
+	}
+
+	var diffs []string
+
+	for _, pkg := range packages {
+		diff, err := diffPackage(&repoCfg, filepath.Join(checkout.repoPath, pkg.Path), versionRef, checkout)
+
+		if err != nil {
+			writeError(w, 422, err)
+			return
+		}
+
+		diffs = append(diffs, diff)
+	}
+
+	w.Header().Set("Content-Type", "text/x-diff")
+	w.Write([]byte(strings.Join(diffs, "")))
+}
+
+func diffPackage(repoCfg *config.Repository, packagePath, versionRef string, checkout *checkedOutPush) (string, error) {
+	data, err := composer.LoadManifest(packagePath, repoCfg.Manifest)
+
+	if err != nil {
+		return "", err
+	}
+
+	version, normalisedVersion, err := repoCfg.DeriveVersion(versionRef, checkout.isBranch, data)
+
+	if err != nil {
+		return "", err
+	}
+
+	packageName, err := composer.ResolvePackageName(data, Config.DefaultVendor)
+
+	if err != nil {
+		return "", err
+	}
+
+	mutation := newMutation(repoCfg, checkout.isBranch, packageName, version, normalisedVersion, checkout.ref.Hash().String(), checkout.description, "")
+
+	diff, err := composer.DiffMutation(packagePath, mutation)
+
+	// Diff against the path within the repository rather than our clone
+	return strings.Replace(diff, checkout.repoPath+"/", "", -1), err
+}
@@ -0,0 +1,72 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+)
+
+type forceKey struct{}
+
+// withForce marks a publish as forced, publishing a branch even when nothing
+// has changed since it was last published
+func withForce(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceKey{}, true)
+}
+
+func isForced(ctx context.Context) bool {
+	forced, _ := ctx.Value(forceKey{}).(bool)
+
+	return forced
+}
+
+// branchDigest is what a branch publish is compared with the last one by, the
+// package's files before composer.json is mutated along with the mutation and
+// where it's published. The commit it's built from is left out, that changes
+// with every push whether the package does or not.
+func branchDigest(repoCfg *config.Repository, packagePath string, composerData composer.ComposerFile, mutation composer.Mutation) (string, error) {
+	files, err := git.DigestRepository(packagePath, git.ArchiveOptions{
+		StripVendor: repoCfg.ShouldStripVendor(composerData),
+		Symlinks:    Config.ArchiveSymlinks,
+		FileModes:   Config.ArchiveFileModes,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	mutation.Provenance = nil
+
+	if mutation.Source != nil {
+		source := *mutation.Source
+		source.Reference = ""
+		mutation.Source = &source
+	}
+
+	encoded, err := json.Marshal(struct {
+		Files    string
+		Mutation composer.Mutation
+		Targets  []config.PublishTarget
+		Tags     []string
+	}{files, mutation, Config.GetPublishTargets(repoCfg), repoCfg.Tags})
+
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(encoded)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// forgetDigest drops what a version was published with once it's deleted,
+// so the branch is published again when it comes back
+func forgetDigest(key string) {
+	saveState(StorePublishedDigests, "that "+key+" was deleted", func() error {
+		return PublishedDigests.Forget(key)
+	})
+}
@@ -1,173 +1,1176 @@
 package webhooks
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/build"
 	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
 	"github.com/Lavoaster/cloudsmith-sync/composer"
 	"github.com/Lavoaster/cloudsmith-sync/config"
 	"github.com/Lavoaster/cloudsmith-sync/git"
+	"github.com/Lavoaster/cloudsmith-sync/limit"
+	"github.com/Lavoaster/cloudsmith-sync/state"
+	"github.com/Lavoaster/cloudsmith-sync/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"gopkg.in/go-playground/webhooks.v5/github"
 	git2 "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var Hook *github.Webhook
-var Client *cloudsmith.Client
+
+// Verifies deliveries signed with the secondary secret while the webhook
+// secret is rotated, nil outside of a rotation
+var SecondaryHook *github.Webhook
+var Client CloudsmithClient
 var Config *config.Config
 
-func HandleGithubWebhook(w http.ResponseWriter, r *http.Request) {
-	payload, err := Hook.Parse(r, github.PushEvent, github.PingEvent)
-	if err != nil {
-		if err == github.ErrMissingGithubEventHeader || err == github.ErrMissingHubSignatureHeader {
-			w.WriteHeader(400)
-			w.Write([]byte(err.Error()))
-			return
-		}
+// Version of cloudsmith-sync recorded in the provenance of published packages
+var Version = "dev"
+
+// The name each repository's packages were last published under
+var PackageNames *state.PackageNames
+
+// What each branch version was last published with, nil unless unchanged
+// branches are skipped
+var PublishedDigests *state.PublishedDigests
+
+// The commit each tag version was first published from, nil unless a
+// repository has immutable tags
+var PublishedCommits *state.PublishedCommits
+
+// How many pushes from each GitHub owner are published at once, nil for no
+// limit
+var SourceLimits *limit.Keyed
+
+// Branch deletions waiting out the grace period
+var pendingDeletes = newScheduler()
+
+// How long to wait for Cloudsmith to finish deleting a package before
+// giving up on replacing it
+const deletionTimeout = 2 * time.Minute
+
+// batchedRefs is the part of a push we read ourselves when a mirror or
+// another integration batches several updated refs into one delivery,
+// GitHub's own pushes only ever have the one ref
+type batchedRefs struct {
+	Refs []struct {
+		Ref     string `json:"ref"`
+		Before  string `json:"before"`
+		After   string `json:"after"`
+		Created bool   `json:"created"`
+		Deleted bool   `json:"deleted"`
+		Forced  bool   `json:"forced"`
+	} `json:"refs"`
+}
+
+// pingRepository is the part of a ping we read ourselves, the payload the
+// webhook library gives back doesn't include the repository
+type pingRepository struct {
+	Repository struct {
+		FullName string `json:"full_name"`
+		SSHURL   string `json:"ssh_url"`
+	} `json:"repository"`
+}
+
+// readBody reads a request's body, refusing it with a 413 when it's larger
+// than the configured maximum. It writes the response itself and returns
+// false when the body can't be read.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	// Reading a byte past the maximum is enough to tell it's been exceeded
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, Config.MaxPayloadSize+1))
+
+	if err != nil {
+		writeError(w, 400, err)
+		return nil, false
+	}
+
+	if int64(len(body)) > Config.MaxPayloadSize {
+		writeResponse(w, 413, response{Status: statusRejected, Reason: "payload larger than " + strconv.FormatInt(Config.MaxPayloadSize, 10) + " bytes"})
+		return nil, false
+	}
+
+	return body, true
+}
+
+func HandleGithubWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, body, ok := readPayload(w, r, github.PushEvent, github.PingEvent, github.CreateEvent, github.DeleteEvent)
+
+	if !ok {
+		return
+	}
+
+	// Pings don't publish anything, so are still answered
+	if _, ping := payload.(github.PingPayload); inMaintenance() && !ping {
+		writeMaintenance(w)
+		return
+	}
+
+	ctx, cancel := newWebhookContext()
+	defer cancel()
+
+	deliveryID := r.Header.Get("X-GitHub-Delivery")
+
+	ctx, span := tracing.Start(tracing.FromRequest(ctx, r), "webhook",
+		attribute.String("github.delivery", deliveryID),
+		attribute.String("github.event", r.Header.Get("X-GitHub-Event")),
+	)
+	defer span.End()
+
+	switch payload.(type) {
+	case github.PingPayload:
+		push := payload.(github.PingPayload)
+		message := "pong (" + strconv.Itoa(push.HookID) + ")"
+
+		if Config.PingCheckRepository {
+			message += "\n" + describePingRepository(body)
+		}
+
+		writeResponse(w, Config.PingStatusCode, response{Status: statusOk, Reason: message})
+
+	case github.PushPayload:
+		push := payload.(github.PushPayload)
+		repository := push.Repository
+		pushes := splitPush(push, body)
+
+		if len(pushes) == 1 {
+			code, res := publishRefEvent(ctx, repository.FullName, repository.SSHURL, repository.DefaultBranch, push, deliveryID)
+			writeResponse(w, code, res)
+			return
+		}
+
+		code, res := publishRefEvents(ctx, repository.FullName, repository.SSHURL, repository.DefaultBranch, pushes, deliveryID)
+		writeResponse(w, code, res)
+
+	// Depending on what a webhook is subscribed to, tags and deletions can
+	// come as create and delete events instead of, or as well as, pushes.
+	// They're published as the equivalent push
+	case github.CreatePayload:
+		create := payload.(github.CreatePayload)
+		repository := create.Repository
+
+		if create.RefType != "tag" {
+			writeResponse(w, 200, response{Status: statusSkipped, Reason: "Skipping " + create.Ref + ", new branches are published by their push"})
+			return
+		}
+
+		push := github.PushPayload{Ref: "refs/tags/" + create.Ref, Created: true}
+		push.Sender.Login = create.Sender.Login
+
+		code, res := publishRefEvent(ctx, repository.FullName, repository.SSHURL, repository.DefaultBranch, push, deliveryID)
+		writeResponse(w, code, res)
+
+	case github.DeletePayload:
+		deletion := payload.(github.DeletePayload)
+		repository := deletion.Repository
+
+		push := github.PushPayload{Ref: "refs/heads/" + deletion.Ref, Deleted: true}
+		push.Sender.Login = deletion.Sender.Login
+
+		if deletion.RefType == "tag" {
+			push.Ref = "refs/tags/" + deletion.Ref
+		}
+
+		code, res := publishRefEvent(ctx, repository.FullName, repository.SSHURL, repository.DefaultBranch, push, deliveryID)
+		writeResponse(w, code, res)
+	}
+}
+
+// publishRefEvents publishes each ref of a delivery that updated several in
+// turn, a ref that fails doesn't stop the others. The response is the worst
+// outcome with every ref's result.
+func publishRefEvents(ctx context.Context, fullName, sshUrl, defaultBranch string, pushes []github.PushPayload, deliveryID string) (int, response) {
+	status := 204
+	var results []response
+
+	for _, push := range pushes {
+		code, res := publishRefEvent(ctx, fullName, sshUrl, defaultBranch, push, deliveryID)
+		res.Ref = push.Ref
+
+		status = worstStatus(status, code)
+		results = append(results, res)
+	}
+
+	return status, response{Status: worstResultStatus(results), Results: results}
+}
+
+// publishRefEvent publishes a push, or the push a create or delete event
+// stands for, to the repository it came from. Created tags and deleted refs
+// are only acted on once when both a push and a create or delete event are
+// sent for them.
+func publishRefEvent(ctx context.Context, fullName, sshUrl, defaultBranch string, push github.PushPayload, deliveryID string) (int, response) {
+	repoCfg, err := Config.GetRepository(fullName, sshUrl)
+
+	if err != nil {
+		return 422, response{Status: statusRejected, Reason: "repository not configured"}
+	}
+
+	if branch := strings.TrimPrefix(push.Ref, "refs/heads/"); branch != push.Ref && !repoCfg.ShouldPublishBranch(branch, defaultBranch) {
+		return 200, response{Status: statusSkipped, Reason: "Skipping " + branch + ", only the default branch is published"}
+	}
+
+	if !repoCfg.AuthorFilter.Allows(pushAuthors(push)) {
+		return 200, response{Status: statusSkipped, Reason: "Skipping " + push.Ref + ", skipped by author filter"}
+	}
+
+	action := ""
+
+	if push.Deleted {
+		action = refEventDelete
+	} else if push.Created && strings.HasPrefix(push.Ref, "refs/tags/") {
+		action = refEventPublish
+	}
+
+	if action != "" && !recentRefEvents.Record(repoCfg.Url, push.Ref, action) {
+		return 200, response{Status: statusSkipped, Reason: "Skipping " + push.Ref + ", it was already handled by another event"}
+	}
+
+	// A branch pushed again after it was deleted can be deleted again,
+	// branch pushes aren't recorded so this doesn't happen through Record
+	if action == "" && !push.Deleted {
+		recentRefEvents.Forget(repoCfg.Url, push.Ref, refEventDelete)
+	}
+
+	var code int
+	var res response
+
+	// A push of the same commit to the same ref joins one already being
+	// published, create and delete events have no commit to go by
+	if push.After != "" {
+		var shared bool
+
+		code, res, shared = inFlightPushes.Do(ctx, repoCfg.Url+" "+push.Ref+" "+push.After, func() (int, response) {
+			return publishPush(ctx, &repoCfg, push, deliveryID)
+		})
+
+		if shared {
+			fmt.Printf("Joined the publish of %s@%s already in flight for %s\n", push.Ref, push.After, repoCfg.Url)
+		}
+	} else {
+		code, res = publishPush(ctx, &repoCfg, push, deliveryID)
+	}
+
+	// Handled again when it's redelivered, or a deferred tag couldn't be
+	// published once its checks pass
+	if action != "" && (code >= 500 || res.Status == statusDeferred) {
+		recentRefEvents.Forget(repoCfg.Url, push.Ref, action)
+	}
+
+	repoStatuses.record(repoCfg.Url, push.Ref, code, res)
+
+	return code, res
+}
+
+// publishPush publishes every package for a push. Packages that fail with an
+// error are tried again from a fresh fetch and checkout, up to
+// Config.PublishRetryAttempts times in all, anything else (a skip, a rejected
+// ref, a publish) is final.
+func publishPush(ctx context.Context, repoCfg *config.Repository, push github.PushPayload, deliveryID string) (int, response) {
+	attempts := Config.PublishRetryAttempts
+	backoff := Config.PublishRetryBackoff
+
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	if push.Forced && strings.HasPrefix(push.Ref, "refs/heads/") {
+		fmt.Printf("Force push to %s on %s (%s -> %s)\n", push.Ref, repoCfg.Url, push.Before, push.After)
+	}
+
+	// Before anything is locked, waiting for CI can take a while
+	if repoCfg.RequiredChecks != nil && !push.Deleted {
+		if code, res, ok := awaitRequiredChecks(ctx, repoCfg, push); !ok {
+			return code, res
+		}
+	}
+
+	// Keyed by package path, kept between attempts so only the packages
+	// that failed are published again
+	results := map[string]packageResult{}
+
+	source := pushSource(push, repoCfg)
+
+	for attempt := 1; ; attempt++ {
+		// Only held while publishing, not while waiting to retry
+		sourceLimit := SourceLimits.For(source)
+
+		if err := sourceLimit.AcquireContext(ctx); err != nil {
+			return 500, response{Status: statusError, Reason: "gave up waiting for other pushes from " + source + ": " + err.Error()}
+		}
+
+		code, res, retryable := attemptPush(ctx, repoCfg, push, deliveryID, results)
+		sourceLimit.Release()
+
+		if !retryable || attempt >= attempts || ctx.Err() != nil {
+			return code, res
+		}
+
+		fmt.Printf("Publishing %s for %s failed (attempt %d of %d), retrying in %v - %s\n", push.Ref, repoCfg.Url, attempt, attempts, backoff, res.text())
+
+		select {
+		case <-ctx.Done():
+			return code, res
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
+
+// pushSource is the GitHub owner a push came from, create and delete events
+// don't fill in the push's repository so they fall back to the configured url
+func pushSource(push github.PushPayload, repoCfg *config.Repository) string {
+	if owner := strings.SplitN(push.Repository.FullName, "/", 2); len(owner) == 2 {
+		return strings.ToLower(owner[0])
+	}
+
+	return config.RepositoryOwner(repoCfg.Url)
+}
+
+// pushAuthors is who made a push, the logins and emails of its pusher, sender
+// and head commit author. Create and delete events only have a sender
+func pushAuthors(push github.PushPayload) []string {
+	return []string{
+		push.Pusher.Name,
+		push.Pusher.Email,
+		push.Sender.Login,
+		push.HeadCommit.Author.Username,
+		push.HeadCommit.Author.Email,
+	}
+}
+
+type packageResult struct {
+	status int
+	result response
+}
+
+// attemptPush is a single go at publishing a push, returning whether it
+// failed in a way that is worth trying again.
+func attemptPush(ctx context.Context, repoCfg *config.Repository, push github.PushPayload, deliveryID string, results map[string]packageResult) (int, response, bool) {
+	ctx, span := tracing.Start(ctx, "publish", tracing.Repository(repoCfg.Url), tracing.Ref(push.Ref))
+	defer span.End()
+
+	checkoutStarted := time.Now()
+	checkout, code, err := checkoutPush(ctx, repoCfg, push)
+	Latencies.Since(repoCfg.Url, phaseClone, checkoutStarted)
+
+	if err == errNoCommits {
+		return code, response{Status: statusSkipped, Reason: err.Error()}, false
+	}
+
+	if err != nil {
+		return code, response{Status: statusError, Reason: err.Error()}, !git.IsPermanentRemoteError(err)
+	}
+
+	defer checkout.release()
+
+	packages, versionRef, err := repoCfg.GetPackagesForRef(checkout.ref.Name().Short(), checkout.isBranch)
+
+	if err != nil {
+		return 422, response{Status: statusRejected, Reason: err.Error()}, false
+	}
+
+	pushedRef := pushedRef{
+		Name:         versionRef,
+		IsBranch:     checkout.isBranch,
+		Commit:       checkout.ref.Hash().String(),
+		TaggedCommit: checkout.taggedCommit,
+		Description:  checkout.description,
+		Deleted:      push.Deleted,
+		Forced:       push.Forced,
+		DeliveryID:   deliveryID,
+		Force:        isForced(ctx),
+	}
+
+	// A failed transaction has been rolled back, so it's tried again as a
+	// whole rather than only the packages that failed
+	if isTransaction(repoCfg, packages, pushedRef) {
+		code, res := publishTransaction(ctx, repoCfg, checkout.repoPath, packages, pushedRef)
+
+		return code, res, code == 500
+	}
+
+	status := 204
+	retryable := false
+	var pkgResults []response
+
+	// Monorepos publish several packages from one push, the response is
+	// the worst outcome of them all with every package's result
+	for _, pkg := range packages {
+		previous, ok := results[pkg.Path]
+
+		if !ok || previous.status == 500 {
+			pkgStatus, result := publishRef(ctx, repoCfg, checkout.repoPath, pkg, pushedRef)
+			previous = packageResult{pkgStatus, result}
+			results[pkg.Path] = previous
+		}
+
+		if previous.status == 500 {
+			retryable = true
+		}
+
+		status = worstStatus(status, previous.status)
+		pkgResults = append(pkgResults, previous.result)
+	}
+
+	if len(pkgResults) == 1 {
+		return status, pkgResults[0], retryable
+	}
+
+	return status, response{Status: worstResultStatus(pkgResults), Results: pkgResults}, retryable
+}
+
+// readPayload authenticates and parses a webhook, writing the response
+// itself and returning false when that fails. The raw body is returned too
+// for the parts of payloads the webhook library doesn't give back.
+func readPayload(w http.ResponseWriter, r *http.Request, events ...github.Event) (interface{}, []byte, bool) {
+	if Config.UsesWebhookAuthHeader() && !hasAuthHeaderToken(r) {
+		writeResponse(w, 403, response{Status: statusRejected, Reason: "missing or invalid " + Config.WebhookAuthHeader + " header"})
+		return nil, nil, false
+	}
+
+	// Read the body up front so oversized payloads can be refused before
+	// anything, including the signature check, has to process them. The
+	// parser then reads and verifies the buffered copy
+	body, ok := readBody(w, r)
+
+	if !ok {
+		return nil, nil, false
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	payload, err := Hook.Parse(r, events...)
+
+	if err == github.ErrHMACVerificationFailed && SecondaryHook != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		payload, err = SecondaryHook.Parse(r, events...)
+
+		if err == nil {
+			fmt.Printf("Delivery %s was signed with the secondary webhook secret\n", r.Header.Get("X-GitHub-Delivery"))
+		}
+	}
+
+	if err != nil {
+		if err == github.ErrMissingGithubEventHeader || err == github.ErrMissingHubSignatureHeader {
+			writeError(w, 400, err)
+			return nil, nil, false
+		}
+
+		if err == github.ErrHMACVerificationFailed {
+			writeError(w, 403, err)
+			return nil, nil, false
+		}
+
+		if err == github.ErrEventNotFound {
+			writeError(w, 422, err)
+			return nil, nil, false
+		}
+
+		writeError(w, 500, err)
+		return nil, nil, false
+	}
+
+	return payload, body, true
+}
+
+// newWebhookContext is deliberately not tied to the request, GitHub hangs up
+// long before a clone and upload finish and that shouldn't stop the publish
+func newWebhookContext() (context.Context, context.CancelFunc) {
+	if Config.WebhookTimeout > 0 {
+		return context.WithTimeout(context.Background(), Config.WebhookTimeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// errNoCommits is returned by checkoutPush, with a 200, for a repository
+// that doesn't have any commits yet
+var errNoCommits = errors.New("no commits to publish, skipping")
+
+// checkedOutPush is the ref from a push checked out in its clone
+type checkedOutPush struct {
+	repoPath    string
+	ref         *plumbing.Reference
+	isBranch    bool
+	description string
+	// The commit a tag points at, which isn't ref's hash for annotated tags
+	taggedCommit string
+	// Resets the worktree and gives the clone back, once finished with it
+	release func()
+}
+
+// checkoutPush fetches the repository and checks out the pushed ref, the
+// clone stays locked until release is called. On failure the status code to
+// respond with is returned alongside the error.
+func checkoutPush(ctx context.Context, repoCfg *config.Repository, push github.PushPayload) (*checkedOutPush, int, error) {
+	repoPath, err := git.GetRepoPath(repoCfg.Url)
+
+	if err != nil {
+		return nil, 500, err
+	}
+
+	// One push at a time per clone, they share a worktree
+	unlock := git.LockClone(repoPath)
+
+	fail := func(err error) (*checkedOutPush, int, error) {
+		unlock()
+		return nil, 500, err
+	}
+
+	fetchCtx, fetchSpan := tracing.Start(ctx, "fetch")
+	repo, err := git.CloneOrOpenAndUpdate(fetchCtx, repoCfg.Url, repoPath)
+	tracing.End(fetchSpan, err)
+
+	if git.IsEmptyRepository(err) {
+		unlock()
+		return nil, 200, errNoCommits
+	}
+
+	if err != nil {
+		return fail(err)
+	}
+
+	ref, err := repo.Reference(plumbing.ReferenceName(push.Ref), true)
+
+	if err == plumbing.ErrReferenceNotFound && !git.HasCommits(repo) {
+		unlock()
+		return nil, 200, errNoCommits
+	}
+
+	if err != nil {
+		return fail(err)
+	}
+
+	repo, ref, err = verifyPushedRef(ctx, repoCfg, repoPath, repo, ref, pushedCommit(push))
+
+	if err != nil {
+		return fail(err)
+	}
+
+	worktree, err := repo.Worktree()
+
+	if err != nil {
+		return fail(err)
+	}
+
+	tag := strings.TrimPrefix(push.Ref, "refs/tags/")
+	checkout := &checkedOutPush{
+		repoPath: repoPath,
+		ref:      ref,
+		isBranch: tag == push.Ref,
+		release: func() {
+			git.ResetWorktree(worktree)
+			unlock()
+		},
+	}
+
+	ctx, checkoutSpan := tracing.Start(ctx, "checkout")
+
+	var commit string
+
+	if checkout.isBranch {
+		commit, err = git.CheckoutBranch(ctx, repo, worktree, ref)
+	} else {
+		commit, err = git.CheckoutTag(ctx, repo, worktree, ref)
+		checkout.description = git.GetTagMessage(repo, ref)
+		checkout.taggedCommit = ref.Hash().String()
+
+		if tagObject, tagErr := repo.TagObject(ref.Hash()); tagErr == nil {
+			checkout.taggedCommit = tagObject.Target.String()
+		}
+	}
+
+	// Its manifests can be cached now it's exactly the commit
+	if err == nil {
+		composer.CheckedOut(worktree.Filesystem.Root(), commit)
+	}
+
+	if err == nil && repoCfg.IncludeSubmodules {
+		err = git.UpdateSubmodules(ctx, worktree)
+	}
+
+	tracing.End(checkoutSpan, err)
+
+	if err != nil {
+		checkout.release()
+		return nil, 500, err
+	}
+
+	return checkout, 0, nil
+}
+
+// pushedCommit is the commit a push says its ref was updated to, empty when
+// there isn't one to check the clone against, like for manual syncs
+func pushedCommit(push github.PushPayload) string {
+	if strings.Trim(push.After, "0") == "" {
+		return ""
+	}
+
+	return push.After
+}
+
+// verifyPushedRef makes sure a ref in the clone is at the commit that was
+// pushed, so a stale clone that failed to fetch can't publish older code.
+// When it isn't the remote is asked where the ref is now, if it has moved on
+// since the push the newer commit is published instead. Otherwise the clone is
+// thrown away and cloned again, and if that still doesn't match the push
+// fails rather than publishing the wrong commit.
+func verifyPushedRef(ctx context.Context, repoCfg *config.Repository, repoPath string, repo *git2.Repository, ref *plumbing.Reference, expected string) (*git2.Repository, *plumbing.Reference, error) {
+	if expected == "" || ref.Hash().String() == expected {
+		return repo, ref, nil
+	}
+
+	refs, err := git.ListRemote(ctx, repoCfg.Url)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remoteHash := ""
+
+	for _, remoteRef := range refs {
+		if remoteRef.Name() == ref.Name() {
+			remoteHash = remoteRef.Hash().String()
+		}
+	}
+
+	if remoteHash == ref.Hash().String() {
+		fmt.Printf("%s of %s has moved on to %s since %s was pushed, publishing it instead\n", ref.Name(), repoCfg.Url, remoteHash, expected)
+		return repo, ref, nil
+	}
+
+	fmt.Printf("%s of %s is at %s in %s but %s was pushed, re-cloning\n", ref.Name(), repoCfg.Url, ref.Hash(), repoPath, expected)
+
+	if err := os.RemoveAll(repoPath); err != nil {
+		return nil, nil, err
+	}
+
+	repo, err = git.Clone(ctx, repoCfg.Url, repoPath)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cloned, err := repo.Reference(ref.Name(), true)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if hash := cloned.Hash().String(); hash != expected && hash != remoteHash {
+		return nil, nil, fmt.Errorf("%s of %s is at %s after cloning it again, not %s as pushed, refusing to publish a stale commit", ref.Name(), repoCfg.Url, hash, expected)
+	}
+
+	return repo, cloned, nil
+}
+
+// splitPush returns a push for each ref a delivery updated, which is only
+// the push itself unless it has a list of refs.
+func splitPush(push github.PushPayload, body []byte) []github.PushPayload {
+	var batched batchedRefs
+
+	if err := json.Unmarshal(body, &batched); err != nil || len(batched.Refs) == 0 {
+		return []github.PushPayload{push}
+	}
+
+	var pushes []github.PushPayload
+
+	for _, ref := range batched.Refs {
+		refPush := push
+		refPush.Ref = ref.Ref
+		refPush.Before = ref.Before
+		refPush.After = ref.After
+		refPush.Created = ref.Created
+		refPush.Deleted = ref.Deleted
+		refPush.Forced = ref.Forced
+
+		pushes = append(pushes, refPush)
+	}
+
+	return pushes
+}
+
+func hasAuthHeaderToken(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get(Config.WebhookAuthHeader), "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(Config.WebhookAuthToken)) == 1
+}
+
+func describePingRepository(body []byte) string {
+	var ping pingRepository
+
+	if err := json.Unmarshal(body, &ping); err != nil || ping.Repository.SSHURL == "" {
+		return "warning: unable to tell which repository this webhook belongs to"
+	}
+
+	if _, err := Config.GetRepository(ping.Repository.FullName, ping.Repository.SSHURL); err != nil {
+		return "warning: repository " + ping.Repository.SSHURL + " isn't configured"
+	}
+
+	return "repository " + ping.Repository.SSHURL + " is configured"
+}
 
-		if err == github.ErrHMACVerificationFailed {
-			w.WriteHeader(403)
-			w.Write([]byte(err.Error()))
-			return
+// worstStatus picks the response code that matters most, a 204 only stands
+// if every package was published.
+func worstStatus(a, b int) int {
+	if a == 204 {
+		return b
+	}
+
+	if b == 204 || a > b {
+		return a
+	}
+
+	return b
+}
+
+// pushedRef is everything publishRef needs to know about the pushed ref
+type pushedRef struct {
+	// The branch or tag name versions are derived from
+	Name        string
+	IsBranch    bool
+	Commit      string
+	Description string
+	Deleted     bool
+	Forced      bool
+	// GitHub's delivery id, recorded against anything deleted
+	DeliveryID string
+	// Published as this version as it is, rather than deriving one from Name
+	Version string
+	// Published even when nothing has changed since it last was
+	Force bool
+	// The commit a tag points at, peeled from the tag object of an annotated
+	// one. Only looked at for tags
+	TaggedCommit string
+}
+
+// worstResultStatus is the status for a response made up of several results
+func worstResultStatus(results []response) string {
+	for _, status := range []string{statusError, statusRejected, statusDeferred, statusSkipped, statusScheduled} {
+		for _, result := range results {
+			if result.Status == status {
+				return status
+			}
 		}
+	}
 
-		if err == github.ErrEventNotFound {
-			w.WriteHeader(422)
-			w.Write([]byte(err.Error()))
-			return
+	return results[0].Status
+}
+
+// checkedPackage is a package of the checked out ref that can be published
+type checkedPackage struct {
+	pkg               config.Package
+	path              string
+	name              string
+	version           string
+	normalisedVersion string
+	composerData      composer.ComposerFile
+}
+
+// checkPackage reads the package in pkg and works out the version it's
+// published as, returning nil with the status code and result for the
+// webhook response when it can't be.
+func checkPackage(repoCfg *config.Repository, repoPath string, pkg config.Package, ref pushedRef) (*checkedPackage, int, response) {
+	packagePath := filepath.Join(repoPath, pkg.Path)
+	composerData, err := composer.LoadManifest(packagePath, repoCfg.Manifest)
+
+	// Fetching and checking out again won't make it appear
+	if composer.IsMissingManifest(err) {
+		reason := err.Error()
+
+		if pkg.Path != "" {
+			reason = pkg.Path + ": " + reason
 		}
 
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		return nil, 422, response{Status: statusRejected, Reason: reason}
 	}
 
-	switch payload.(type) {
-	case github.PingPayload:
-		push := payload.(github.PingPayload)
+	if err != nil {
+		return nil, 500, response{Status: statusError, Reason: err.Error()}
+	}
 
-		w.WriteHeader(201)
-		w.Write([]byte("pong (" + strconv.Itoa(push.HookID) + ")"))
+	packageName, err := composer.ResolvePackageName(composerData, Config.DefaultVendor)
 
-	case github.PushPayload:
-		push := payload.(github.PushPayload)
-		repoCfg, err := Config.GetRepository(push.Repository.SSHURL)
+	if err != nil {
+		return nil, 422, response{Status: statusRejected, Reason: err.Error()}
+	}
 
-		if err != nil {
-			w.WriteHeader(422)
-			w.Write([]byte("repository not configured"))
-			return
+	if !Config.IsPackageAllowed(packageName) {
+		fmt.Printf("Refusing to publish %s from %s, the package name isn't allowed\n", packageName, repoCfg.Url)
+
+		return nil, 403, response{
+			Status:  statusRejected,
+			Reason:  "package " + packageName + " is not allowed to be published",
+			Package: packageName,
 		}
+	}
 
-		repoDir, err := git.GitUrlToDirectory(repoCfg.Url)
-		repoPath := Config.GetRepoPath(repoDir)
+	warnings, violations := Config.CheckRequiredFields(repoCfg, composerData)
 
-		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
-			return
+	if len(warnings) > 0 {
+		fmt.Printf("%s from %s is below policy: %s\n", packageName, repoCfg.Url, strings.Join(warnings, ", "))
+	}
+
+	if len(violations) > 0 && !ref.Deleted {
+		return nil, 422, response{
+			Status:  statusRejected,
+			Reason:  "package " + packageName + " is below policy: " + strings.Join(violations, ", "),
+			Package: packageName,
 		}
+	}
 
-		repo, err := git.CloneOrOpenAndUpdate(repoCfg.Url, repoPath)
+	version, normalisedVersion, err := repoCfg.DeriveVersion(ref.Name, ref.IsBranch, composerData)
 
-		worktree, err := repo.Worktree()
+	// A version asked for is published as given, but still has to be one
+	// composer can read
+	if ref.Version != "" {
+		version = ref.Version
+		normalisedVersion, err = composer.NormaliseVersion(ref.Version, "")
 
 		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
-			return
+			return nil, 422, response{
+				Status:  statusRejected,
+				Reason:  fmt.Sprintf("%s isn't a valid version: %s", ref.Version, err),
+				Package: packageName,
+			}
+		}
+	}
+
+	if err != nil {
+		result := response{
+			Status:  statusSkipped,
+			Reason:  fmt.Sprintf("Skipping %s@%s due to %s...", packageName, ref.Name, err),
+			Package: packageName,
+		}
+
+		// For repos where every push should publish a skip means
+		// something is wrong, so make it visible to GitHub
+		if repoCfg.StrictVersioning {
+			result.Status = statusRejected
+			return nil, 422, result
 		}
 
-		ref, err := repo.Reference(plumbing.ReferenceName(push.Ref), true)
+		return nil, 200, result
+	}
 
-		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
-			return
+	if moved := movedTag(repoCfg, packageName, version, ref); moved != "" {
+		recordMovedTagRefusal()
+		fmt.Printf("WARNING: %s of %s has been moved from %s to %s, refusing to republish %s@%s as its tags are immutable\n", ref.Name, repoCfg.Url, moved, ref.TaggedCommit, packageName, version)
+
+		return nil, 409, response{
+			Status:  statusRejected,
+			Reason:  fmt.Sprintf("tag %s was published from %s and has been moved to %s, tags are immutable so %s@%s was left as it was", ref.Name, moved, ref.TaggedCommit, packageName, version),
+			Package: packageName,
+			Version: version,
 		}
+	}
+
+	return &checkedPackage{pkg, packagePath, packageName, version, normalisedVersion, composerData}, 0, response{}
+}
 
-		branchName := strings.TrimPrefix(push.Ref, "refs/heads/")
-		tag := strings.TrimPrefix(push.Ref, "refs/tags/")
-		isBranch := tag == push.Ref
+// movedTag is the commit a tag was first published from when it has since
+// been moved to another commit and the repository's tags are immutable, empty
+// otherwise
+func movedTag(repoCfg *config.Repository, packageName, version string, ref pushedRef) string {
+	if !repoCfg.ImmutableTags || ref.IsBranch || ref.Deleted || ref.TaggedCommit == "" {
+		return ""
+	}
 
-		if isBranch {
-			_, err := git.CheckoutBranch(repo, worktree, ref)
+	published := PublishedCommits.Get(tagCommitKey(repoCfg, packageName, version))
 
-			if err != nil {
-				w.WriteHeader(500)
-				w.Write([]byte(err.Error()))
-				return
-			}
-		} else {
-			_, err := git.CheckoutTag(repo, worktree, ref)
+	if published == "" || published == ref.TaggedCommit {
+		return ""
+	}
 
-			if err != nil {
-				w.WriteHeader(500)
-				w.Write([]byte(err.Error()))
+	return published
+}
+
+// tagCommitKey is what the commit a tag version was published from is kept
+// under
+func tagCommitKey(repoCfg *config.Repository, packageName, version string) string {
+	return Config.GetTargetRepository(repoCfg) + ":" + packageName + ":" + version
+}
+
+// recordTagCommit keeps the commit a tag version was published from, when
+// its repository's tags are immutable
+func recordTagCommit(repoCfg *config.Repository, packageName, version string, ref pushedRef) {
+	if !repoCfg.ImmutableTags || ref.IsBranch || ref.TaggedCommit == "" {
+		return
+	}
+
+	saveState(StorePublishedCommits, "the commit "+packageName+"@"+version+" was published from", func() error {
+		return PublishedCommits.Record(tagCommitKey(repoCfg, packageName, version), ref.TaggedCommit)
+	})
+}
+
+// publishRef publishes the package in pkg for the checked out ref, returning
+// the status code and result for the webhook response.
+func publishRef(ctx context.Context, repoCfg *config.Repository, repoPath string, pkg config.Package, ref pushedRef) (int, response) {
+	ctx, span := tracing.Start(ctx, "package", attribute.String("cloudsmith_sync.path", pkg.Path))
+	defer span.End()
+
+	checked, code, res := checkPackage(repoCfg, repoPath, pkg, ref)
+
+	if checked == nil {
+		return code, res
+	}
+
+	packagePath, packageName := checked.path, checked.name
+	version, normalisedVersion := checked.version, checked.normalisedVersion
+
+	span.SetAttributes(tracing.Package(packageName), tracing.Version(version))
+
+	result := response{Package: packageName, Version: version}
+	targetRepository := Config.GetTargetRepository(repoCfg)
+	deleteKey := targetRepository + ":" + packageName + ":" + version
+
+	// Branches that get deleted and pushed again (rebase workflows) keep
+	// their package if they come back within the grace period
+	if ref.Deleted && ref.IsBranch && Config.BranchDeleteGracePeriod > 0 {
+		pendingDeletes.Schedule(deleteKey, Config.BranchDeleteGracePeriod, func() {
+			if err := deletePublished(repoCfg, packageName, version, cloudsmith.DeleteReasonRefDeleted, ref.DeliveryID); err != nil {
+				fmt.Println(err)
 				return
 			}
+
+			forgetDigest(deleteKey)
+		})
+
+		result.Status = statusScheduled
+		result.Reason = fmt.Sprintf("%s@%s will be deleted in %v unless the branch is pushed again", packageName, version, Config.BranchDeleteGracePeriod)
+
+		return 202, result
+	}
+
+	if pendingDeletes.Cancel(deleteKey) {
+		fmt.Printf("Branch for %s@%s came back, cancelled its deletion\n", packageName, version)
+	}
+
+	if ref.Deleted {
+		// Reported rather than answered as deleted, GitHub then shows the
+		// delivery as failed and it can be redelivered
+		if err := deletePublished(repoCfg, packageName, version, cloudsmith.DeleteReasonRefDeleted, ref.DeliveryID); err != nil {
+			result.Status = statusError
+			result.Reason = err.Error()
+
+			return 500, result
 		}
 
-		composerData, err := composer.LoadFile(repoPath)
+		forgetDigest(deleteKey)
 
-		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
-			return
+		// A deleted tag can be pushed again to any commit
+		if !ref.IsBranch {
+			saveState(StorePublishedCommits, "that "+deleteKey+" was deleted", func() error {
+				return PublishedCommits.Forget(deleteKey)
+			})
 		}
 
-		packageName := composerData["name"].(string)
+		result.Status = statusDeleted
+		return 204, result
+	}
+
+	// Checked before anything is deleted, otherwise a full disk only shows up
+	// once the archive fails to be written with the old version already gone
+	if err := Config.CheckArtifactsDir(repoCfg); err != nil {
+		recordArtifactsDirFailure()
+		fmt.Printf("Unable to publish %s@%s: %v\n", packageName, version, err)
+
+		result.Status = statusError
+		result.Reason = err.Error()
+
+		return 500, result
+	}
+
+	defer Latencies.Since(repoCfg.Url, phaseTotal, time.Now())
 
-		version, normalisedVersion, err := composer.DeriveVersion(ref.Name().String(), isBranch)
+	// Built before the old version is deleted, a failed build step then
+	// leaves it published
+	if err := runBuildStep(repoCfg, packagePath, packageName, version); err != nil {
+		result.Status = statusError
+		result.Reason = err.Error()
+
+		return 500, result
+	}
+
+	mutation := newMutation(repoCfg, ref.IsBranch, packageName, version, normalisedVersion, ref.Commit, ref.Description, ref.DeliveryID)
+	var digest string
+
+	if ref.IsBranch && Config.SkipUnchangedBranches {
+		var err error
+		digest, err = branchDigest(repoCfg, packagePath, checked.composerData, mutation)
 
 		if err != nil {
-			w.WriteHeader(200)
-			w.Write([]byte(fmt.Sprintf("Skipping %s@%s due to %s...\n", packageName, branchName, err)))
-			return
+			fmt.Printf("Unable to tell if %s@%s changed, publishing it: %v\n", packageName, version, err)
+		} else if !ref.Force && digest == PublishedDigests.Get(deleteKey) {
+			result.Status = statusSkipped
+			result.Reason = fmt.Sprintf("Skipping %s@%s, nothing changed since it was last published", packageName, version)
+
+			return 200, result
 		}
+	}
 
-		Client.DeletePackageIfExists(Config.Owner, Config.TargetRepository, packageName, version)
+	if err := clearForUpload(ctx, repoCfg, packageName, version, ref); err != nil {
+		result.Status = statusError
+		result.Reason = err.Error()
 
-		if push.Deleted {
-			w.WriteHeader(204)
-			return
+		return 500, result
+	}
+
+	composerData, err := mutatePackage(ctx, packagePath, mutation)
+
+	if err == nil {
+		err = uploadPackage(ctx, Client, repoCfg, packagePath, ref.Name, ref.IsBranch, packageName, version, ref.Commit, composerData)
+	}
+
+	if err != nil {
+		result.Status = statusError
+		result.Reason = err.Error()
+
+		return 500, result
+	}
+
+	if repoCfg.Staging != nil {
+		if err := promotePackage(ctx, repoCfg, packagePath, packageName, version, ref.DeliveryID); err != nil {
+			result.Status = statusError
+			result.Reason = err.Error()
+
+			return 500, result
 		}
+	}
+
+	// Only once the new name is published, a failed publish otherwise
+	// leaves neither
+	checkForRename(repoCfg, pkg, packageName, version, targetRepository, ref.DeliveryID)
 
-		err = processPackage(
-			Client,
-			&repoCfg,
-			repoPath,
-			ref.Name().Short(),
-			packageName,
-			version,
-			normalisedVersion,
-			ref.Hash().String(),
-		)
+	if !ref.IsBranch && repoCfg.StableAlias != nil {
+		updateStableAlias(repoCfg, packageName, version)
+	}
+
+	publishMetadata(repoCfg, packageName, version, ref)
+	recordTagCommit(repoCfg, packageName, version, ref)
 
-		worktree.Reset(&git2.ResetOptions{
-			Mode: git2.HardReset,
+	if digest != "" {
+		saveState(StorePublishedDigests, "what "+packageName+"@"+version+" was published with", func() error {
+			return PublishedDigests.Record(deleteKey, digest)
 		})
+	}
 
-		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
+	result.Status = statusPublished
+
+	return 204, result
+}
+
+// clearForUpload deletes the version about to be uploaded, unless
+// republishing replaces it in the same request. With staging the target
+// keeps the old version until the new one has passed verification and is
+// promoted.
+func clearForUpload(ctx context.Context, repoCfg *config.Repository, packageName, version string, ref pushedRef) error {
+	if Config.RepublishesInPlace() {
+		return nil
+	}
+
+	uploadRepository := Config.GetUploadRepository(repoCfg)
+	// Uploading over a version that's still there fails, or worse leaves a
+	// duplicate, so there's no point trying
+	if err := Client.DeletePackageIfExists(Config.Owner, uploadRepository, cloudsmith.FormatComposer, packageName, version, cloudsmith.DeleteReasonReplace, ref.DeliveryID); err != nil {
+		return err
+	}
+
+	// Cloudsmith deletes in the background, after a force push the upload can
+	// beat the delete and leave the old commit published so make sure it has
+	// really gone first
+	if ref.Forced && ref.IsBranch {
+		return Client.WaitForPackageDeletion(ctx, Config.Owner, uploadRepository, packageName, version, deletionTimeout)
+	}
+
+	return nil
+}
+
+// updateStableAlias moves the repository's stable alias tag to a version that
+// has just been published from a tag when it's now the highest version of the
+// package. Failures are only logged, the version itself was published fine.
+func updateStableAlias(repoCfg *config.Repository, packageName, version string) {
+	alias := repoCfg.StableAlias
+
+	if !isStableAliasCandidate(alias, version) {
+		return
+	}
+
+	targetRepository := Config.GetTargetRepository(repoCfg)
+	packages, err := Client.ListPackageVersions(Config.Owner, targetRepository)
+
+	if err != nil {
+		fmt.Printf("Unable to update the %s tag of %s: %v\n", alias.Tag, packageName, err)
+		return
+	}
+
+	var previous string
+
+	for _, pkg := range packages {
+		if pkg.Name != packageName || pkg.Version == version || !isStableAliasCandidate(alias, pkg.Version) {
+			continue
+		}
+
+		if c, err := composer.CompareVersions(pkg.Version, previous); previous == "" || (err == nil && c > 0) {
+			previous = pkg.Version
+		}
+	}
+
+	if previous != "" {
+		if c, err := composer.CompareVersions(version, previous); err != nil || c <= 0 {
 			return
 		}
+	}
+
+	if previous != "" {
+		err := Client.TagPackage(Config.Owner, targetRepository, packageName, previous, cloudsmith.TagActionRemove, []string{alias.Tag})
+
+		if err != nil {
+			fmt.Printf("Unable to remove the %s tag from %s@%s: %v\n", alias.Tag, packageName, previous, err)
+		}
+	}
 
-		w.WriteHeader(204)
+	err = Client.TagPackage(Config.Owner, targetRepository, packageName, version, cloudsmith.TagActionAdd, []string{alias.Tag})
+
+	if err != nil {
+		fmt.Printf("Unable to add the %s tag to %s@%s: %v\n", alias.Tag, packageName, version, err)
+		return
 	}
+
+	fmt.Printf("Moved the %s tag to %s@%s\n", alias.Tag, packageName, version)
 }
 
-func processPackage(
-	client *cloudsmith.Client,
-	repoCfg *config.Repository,
-	repoPath, branchOrTagName, packageName, version, normalisedVersion, commitRef string,
-) error {
+// isStableAliasCandidate is whether a version can have the stable alias,
+// branch versions never can and prereleases only when included.
+func isStableAliasCandidate(alias *config.StableAlias, version string) bool {
+	normalised, err := composer.NormaliseVersion(version, "")
+
+	if err != nil || strings.HasPrefix(normalised, "dev-") || strings.HasSuffix(normalised, "-dev") {
+		return false
+	}
+
+	return alias.IncludePrereleases || composer.IsStable(version)
+}
+
+// newMutation works out what is changed in a ref's composer.json before it
+// is archived.
+func newMutation(repoCfg *config.Repository, isBranch bool, packageName, version, normalisedVersion, commitRef, description, deliveryID string) composer.Mutation {
 	var source *composer.Source
 
-	if repoCfg.PublishSource {
+	if repoCfg.ShouldPublishSource(isBranch) {
 		source = &composer.Source{
 			Url:       repoCfg.Url,
 			Type:      "git",
@@ -175,33 +1178,281 @@ func processPackage(
 		}
 	}
 
-	// Mutate composer.json file
-	err := composer.MutateComposerFile(repoPath, version, normalisedVersion, source)
+	return composer.Mutation{
+		Name:              packageName,
+		Version:           version,
+		NormalizedVersion: normalisedVersion,
+		Source:            source,
+		Description:       description,
+		Manifest:          repoCfg.Manifest,
+		Replace:           repoCfg.Replace,
+		RequireRewrites:   Config.GetRequireRewrites(repoCfg),
+		Provenance:        Config.NewProvenance(commitRef, Version, deliveryID),
+		Transforms:        repoCfg.Transforms,
+	}
+}
+
+// checkForRename compares the package name with the one last published from
+// the same place, a rename otherwise quietly leaves the old package behind.
+// Only this ref's version is cleaned up, releases under the old name are
+// still valid. Called once the package has been published under its new
+// name.
+func checkForRename(repoCfg *config.Repository, pkg config.Package, packageName, version, targetRepository, deliveryID string) {
+	var previous string
+
+	saveState(StorePackageNames, "the package name for "+repoCfg.Url, func() (err error) {
+		previous, err = PackageNames.Record(repoCfg.PackageKey(pkg), packageName)
+
+		return err
+	})
+
+	if previous == "" {
+		return
+	}
+
+	fmt.Println("**********************************************************************")
+	fmt.Printf("WARNING: %s was published as %s and is now %s\n", repoCfg.PackageKey(pkg), previous, packageName)
+	fmt.Println("**********************************************************************")
+
+	if Config.OnPackageRename != config.PackageRenameDeleteOld {
+		return
+	}
+
+	if err := Client.DeletePackageIfExists(Config.Owner, targetRepository, cloudsmith.FormatComposer, previous, version, cloudsmith.DeleteReasonRenamed, deliveryID); err != nil {
+		fmt.Printf("Unable to delete %s@%s: %v\n", previous, version, err)
+	}
+}
+
+// promotePackage verifies a package that has just been uploaded to staging
+// and moves it to the target repository, when verification fails it is left
+// in staging for someone to look at.
+func promotePackage(ctx context.Context, repoCfg *config.Repository, packagePath, packageName, version, deliveryID string) error {
+	stagingRepository := repoCfg.Staging.Repository
+
+	if repoCfg.Staging.Verify != nil {
+		output, err := build.RunVerification(repoCfg.Staging.Verify, packagePath, Config.Owner, stagingRepository, packageName, version)
+		fmt.Printf("Verifying %s@%s:\n%s\n", packageName, version, output)
+
+		if err != nil {
+			return fmt.Errorf("%s@%s left in %s: %v", packageName, version, stagingRepository, err)
+		}
+	}
+
+	return Client.PromotePackage(ctx, Config.Owner, stagingRepository, Config.GetTargetRepository(repoCfg), packageName, version, deliveryID, deletionTimeout)
+}
+
+// buildPackage runs the build step and mutates composer.json, returning the
+// composer.json that ends up in the archive.
+func buildPackage(
+	ctx context.Context,
+	repoCfg *config.Repository,
+	repoPath string,
+	isBranch bool,
+	packageName, version, normalisedVersion, commitRef, description, deliveryID string,
+) (composer.ComposerFile, error) {
+	if err := runBuildStep(repoCfg, repoPath, packageName, version); err != nil {
+		return nil, err
+	}
+
+	return mutatePackage(ctx, repoPath, newMutation(repoCfg, isBranch, packageName, version, normalisedVersion, commitRef, description, deliveryID))
+}
+
+func runBuildStep(repoCfg *config.Repository, repoPath, packageName, version string) error {
+	if repoCfg.BuildStep == nil {
+		return nil
+	}
+
+	output, err := build.RunStep(repoCfg.BuildStep, repoPath)
+	fmt.Printf("Build step for %s@%s:\n%s\n", packageName, version, output)
+
+	return err
+}
+
+// mutatePackage applies mutation to the package's composer.json, returning
+// the result.
+func mutatePackage(ctx context.Context, repoPath string, mutation composer.Mutation) (composer.ComposerFile, error) {
+	_, composerSpan := tracing.Start(ctx, "composer")
+
+	if err := composer.MutateComposerFile(repoPath, mutation); err != nil {
+		tracing.End(composerSpan, err)
+		return nil, err
+	}
+
+	composerData, err := composer.LoadFile(repoPath)
+	tracing.End(composerSpan, err)
+
+	return composerData, err
+}
+
+// uploadPackage archives a built package and uploads it to each of the
+// repository's publish targets, GetTargetConcurrency of them at once. The
+// checkout isn't changed while it's archived so they can share it.
+func uploadPackage(
+	ctx context.Context,
+	client CloudsmithClient,
+	repoCfg *config.Repository,
+	repoPath, branchOrTagName string,
+	isBranch bool,
+	packageName, version, commitRef string,
+	composerData composer.ComposerFile,
+) error {
+	tags := repoCfg.GetPackageTags(branchOrTagName, isBranch)
+	stripVendor := repoCfg.ShouldStripVendor(composerData)
+	packageDescription, err := repoCfg.ReadDescription(repoPath, composerData)
+
 	if err != nil {
 		return err
 	}
 
+	targets := Config.GetPublishTargets(repoCfg)
+	errs := make([]error, len(targets))
+
+	limit.Each(len(targets), Config.GetTargetConcurrency(repoCfg), func(i int) {
+		errs[i] = uploadToTarget(ctx, client, repoCfg, targets[i], repoPath, packageName, version, commitRef, cloudsmith.UploadOptions{
+			Tags: tags,
+			// Unless republishing, the main composer upload has already had
+			// its old version deleted, extra targets are always overwritten
+			// in place
+			Republish:   i > 0 || Config.RepublishesInPlace(),
+			Description: packageDescription,
+		}, stripVendor)
+	})
+
+	// A failed target doesn't stop the rest being published, they're all
+	// reported together in the order they're configured
+	var failures []string
+
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, targets[i].Format+" to "+targets[i].Repository+": "+err.Error())
+		}
+	}
+
+	if len(failures) == len(targets) {
+		return errors.New(fmt.Sprintf("Skipping %s@%s due to %s...\n", packageName, branchOrTagName, strings.Join(failures, ", ")))
+	}
+
+	if len(failures) > 0 {
+		return errors.New(fmt.Sprintf("Skipping %s@%s, published to %d of %d targets but not %s...\n", packageName, branchOrTagName, len(targets)-len(failures), len(targets), strings.Join(failures, ", ")))
+	}
+
+	return nil
+}
+
+// uploadToTarget builds the archive a publish target needs from the checkout
+// and uploads it.
+func uploadToTarget(
+	ctx context.Context,
+	client CloudsmithClient,
+	repoCfg *config.Repository,
+	target config.PublishTarget,
+	repoPath, packageName, version, commitRef string,
+	options cloudsmith.UploadOptions,
+	stripVendor bool,
+) error {
 	// Extract Info from the composer file
-	packageNameParts := strings.Split(packageName, "/")
-	namespace := packageNameParts[0]
-	name := packageNameParts[1]
+	namespace, name := composer.SplitPackageName(packageName)
+
+	maxFiles, maxFileSize := Config.GetArchiveLimits(repoCfg)
+
+	archiveOptions := git.ArchiveOptions{
+		Compression: Config.GetTargetCompression(repoCfg, target),
+		StripVendor: stripVendor,
+		Symlinks:    Config.ArchiveSymlinks,
+		FileModes:   Config.ArchiveFileModes,
+		MaxFiles:    maxFiles,
+		MaxFileSize: maxFileSize,
+	}
 
 	artifactName := fmt.Sprintf("%v-%v-%v.zip", namespace, name, commitRef)
-	artifactPath := Config.GetArtifactPath(artifactName)
 
-	// Create archive file
-	err = git.CreateArtifactFromRepository(repoPath, artifactPath)
+	if target.Format == config.PublishFormatRaw {
+		artifactName = fmt.Sprintf("%v-%v-%v.tar.gz", namespace, name, commitRef)
+
+		options.Name = targetPackageName(target, packageName)
+		options.Version = version
+	}
+
+	artifactPath, release, err := git.ReserveArtifact(Config.GetRepositoryArtifactPath(repoCfg, artifactName))
 
 	if err != nil {
 		return err
 	}
 
-	//Upload archive to cloudsmith
-	_, err = client.UploadComposerPackage(Config.Owner, Config.TargetRepository, artifactPath)
+	defer release()
+
+	targetAttributes := []attribute.KeyValue{
+		attribute.String("cloudsmith_sync.format", target.Format),
+		attribute.String("cloudsmith_sync.target", target.Repository),
+	}
+
+	var size int64
+	archiveStarted := time.Now()
+	_, archiveSpan := tracing.Start(ctx, "archive", targetAttributes...)
+
+	if target.Format == config.PublishFormatRaw {
+		size, err = git.CreateTarballFromRepository(repoPath, artifactPath, archiveOptions)
+	} else {
+		size, err = git.CreateArtifactFromRepository(repoPath, artifactPath, archiveOptions)
+	}
+
+	Latencies.Since(repoCfg.Url, phaseArchive, archiveStarted)
+	tracing.End(archiveSpan, err)
 
 	if err != nil {
-		return errors.New(fmt.Sprintf("Skipping %s@%s due to %s...\n", packageName, branchOrTagName, err))
+		return err
+	}
+
+	fmt.Printf("Created %s (%d bytes)\n", artifactName, size)
+
+	if target.Format == config.PublishFormatComposer {
+		if err := Config.CheckArchiveAutoload(artifactPath); err != nil {
+			return err
+		}
+	}
+
+	//Upload archive to cloudsmith
+	uploadStarted := time.Now()
+	_, uploadSpan := tracing.Start(ctx, "upload", targetAttributes...)
+	_, err = client.UploadPackage(Config.Owner, target.Repository, target.Format, artifactPath, options)
+	Latencies.Since(repoCfg.Url, phaseUpload, uploadStarted)
+	tracing.End(uploadSpan, err)
+
+	return err
+}
+
+// deletePublished deletes a version from every publish target, each looked
+// up in its own format. The target repository stands in for the upload
+// repository, a staged version has been promoted out of it.
+func deletePublished(repoCfg *config.Repository, packageName, version, reason, actor string) error {
+	targets := Config.GetPublishTargets(repoCfg)
+	targets[0].Repository = Config.GetTargetRepository(repoCfg)
+
+	var failures []string
+
+	for _, target := range targets {
+		err := Client.DeletePackageIfExists(Config.Owner, target.Repository, target.Format, targetPackageName(target, packageName), version, reason, actor)
+
+		if err != nil {
+			failures = append(failures, target.Repository+": "+err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.New("Unable to delete " + packageName + "@" + version + ", " + strings.Join(failures, ", "))
 	}
 
 	return nil
 }
+
+// targetPackageName is the name a package is uploaded to a publish target
+// as, raw packages can't have a slash in their name
+func targetPackageName(target config.PublishTarget, packageName string) string {
+	if target.Format != config.PublishFormatRaw {
+		return packageName
+	}
+
+	namespace, name := composer.SplitPackageName(packageName)
+
+	return namespace + "-" + name
+}
@@ -0,0 +1,31 @@
+package webhooks_test
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/webhooks"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOversizedPayloadsAreRefused(t *testing.T) {
+	hook, err := github.New(github.Options.Secret("secret"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks.Hook = hook
+	webhooks.Config = &config.Config{MaxPayloadSize: 16}
+
+	// A body at the maximum gets as far as the (missing) event header
+	for body, refused := range map[string]bool{strings.Repeat("x", 16): false, strings.Repeat("x", 17): true} {
+		recorder := httptest.NewRecorder()
+		webhooks.HandleGithubWebhook(recorder, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+
+		if (recorder.Code == 413) != refused {
+			t.Errorf("[!] %d byte payload with a maximum of 16 responded %d; want refused %v", len(body), recorder.Code, refused)
+		}
+	}
+}
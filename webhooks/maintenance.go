@@ -0,0 +1,68 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// How long GitHub, or whoever sent the delivery, is asked to wait before
+// trying again while in maintenance
+const maintenanceRetryAfter = 5 * time.Minute
+
+// Set while publishing is paused, 1 for in maintenance
+var maintenance int32
+
+// SetMaintenance pauses or resumes publishing. Publishes already running
+// when it's paused are left to finish
+func SetMaintenance(enabled bool) {
+	var value int32
+
+	if enabled {
+		value = 1
+	}
+
+	if atomic.SwapInt32(&maintenance, value) == value {
+		return
+	}
+
+	if enabled {
+		fmt.Println("Maintenance mode on, publishing is paused")
+	} else {
+		fmt.Println("Maintenance mode off, publishing again")
+	}
+}
+
+func inMaintenance() bool {
+	return atomic.LoadInt32(&maintenance) == 1
+}
+
+type maintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// HandleMaintenance turns maintenance mode on or off, authenticated the same
+// way as /plan. While it's on deliveries that would publish or delete
+// anything are refused with a 503 and a Retry-After, there's nowhere to keep
+// them until it's over.
+func HandleMaintenance(w http.ResponseWriter, r *http.Request) {
+	var request maintenanceRequest
+
+	if !readSignedRequest(w, r, &request) {
+		return
+	}
+
+	SetMaintenance(request.Enabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(request)
+}
+
+// writeMaintenance refuses a delivery while in maintenance
+func writeMaintenance(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+	writeResponse(w, 503, response{Status: statusDeferred, Reason: "in maintenance, publishing is paused. Try again later"})
+}
@@ -0,0 +1,48 @@
+package webhooks
+
+import (
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+)
+
+// publishMetadata uploads the metadata of a newly published version, when the
+// repository has it. It only points at the package, so a failure is logged
+// rather than failing a publish that has already happened.
+func publishMetadata(repoCfg *config.Repository, packageName, version string, ref pushedRef) {
+	if !repoCfg.Metadata.Publishes(ref.IsBranch) {
+		return
+	}
+
+	metadataVersion := Config.GetMetadataVersion(repoCfg, ref.Name)
+	namespace, name := composer.SplitPackageName(packageName)
+	artifactName := fmt.Sprintf("%v-%v-metadata-%v.json", namespace, name, metadataVersion)
+
+	artifactPath, release, err := git.ReserveArtifact(Config.GetRepositoryArtifactPath(repoCfg, artifactName))
+
+	if err != nil {
+		fmt.Printf("Unable to upload the metadata of %s@%s: %v\n", packageName, version, err)
+		return
+	}
+
+	defer release()
+
+	err = composer.WriteMetadata(artifactPath, Config.NewMetadata(repoCfg, packageName, version, ref.Name, ref.Commit, Version, ref.DeliveryID))
+
+	if err == nil {
+		_, err = Client.UploadPackage(Config.Owner, Config.GetMetadataRepository(repoCfg), config.PublishFormatRaw, artifactPath, cloudsmith.UploadOptions{
+			Name:      namespace + "-" + name + "-metadata",
+			Version:   metadataVersion,
+			Republish: true,
+		})
+	}
+
+	if err != nil {
+		fmt.Printf("Unable to upload the metadata of %s@%s: %v\n", packageName, version, err)
+		return
+	}
+
+	fmt.Printf("Uploaded the metadata of %s@%s as %s\n", packageName, version, metadataVersion)
+}
@@ -0,0 +1,88 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"github.com/Lavoaster/cloudsmith-sync/latency"
+	"net/http"
+	"sync/atomic"
+)
+
+// The phases of a publish that are timed, total is the whole of
+// publishRef from its build step on
+const (
+	phaseClone   = "clone"
+	phaseArchive = "archive"
+	phaseUpload  = "upload"
+	phaseTotal   = "total"
+)
+
+// How many publishes were refused because an artifacts directory wasn't
+// writable
+var artifactsDirFailures int64
+
+func recordArtifactsDirFailure() {
+	atomic.AddInt64(&artifactsDirFailures, 1)
+}
+
+// How many tag pushes were refused because the tag had been moved and the
+// repository's tags are immutable
+var movedTagRefusals int64
+
+func recordMovedTagRefusal() {
+	atomic.AddInt64(&movedTagRefusals, 1)
+}
+
+// Latencies are how long the recent publishes from each repository took
+var Latencies = latency.New(1000)
+
+type metrics struct {
+	GitOperationsInUse int `json:"gitOperationsInUse"`
+	GitOperationsLimit int `json:"gitOperationsLimit"`
+	UploadsInUse       int `json:"uploadsInUse"`
+	UploadsLimit       int `json:"uploadsLimit"`
+	ClonesInUse        int `json:"clonesInUse"`
+	CloneEvictions     int `json:"cloneEvictions"`
+	MaxClones          int `json:"maxClones"`
+	// Publishes refused because an artifacts directory wasn't writable
+	ArtifactsDirFailures int64 `json:"artifactsDirFailures"`
+	// Tag pushes refused because an immutable tag had been moved, worth
+	// alerting on as someone moved a release
+	MovedTagRefusals int64 `json:"movedTagRefusals"`
+	// State store to how many times it couldn't be loaded or saved, worth
+	// alerting on as the features that rely on it quietly stop working
+	StateStoreFailures map[string]int64 `json:"stateStoreFailures"`
+	// Repository url to phase to percentiles
+	PublishLatency map[string]map[string]latency.Summary `json:"publishLatency"`
+}
+
+// HandleMetrics reports what the server is currently busy with
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(currentMetrics())
+
+	if err != nil {
+		writeError(w, 500, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func currentMetrics() metrics {
+	poolStats := git.GetPoolStats()
+
+	return metrics{
+		GitOperationsInUse:   git.OperationsInUse(),
+		GitOperationsLimit:   Config.GitConcurrency,
+		UploadsInUse:         Client.UploadLimit().InUse(),
+		UploadsLimit:         Client.UploadLimit().Size(),
+		ClonesInUse:          poolStats.InUse,
+		CloneEvictions:       poolStats.Evictions,
+		MaxClones:            Config.MaxClones,
+		ArtifactsDirFailures: atomic.LoadInt64(&artifactsDirFailures),
+		MovedTagRefusals:     atomic.LoadInt64(&movedTagRefusals),
+		StateStoreFailures:   stateStores.Failures(),
+		PublishLatency:       Latencies.Summaries(),
+	}
+}
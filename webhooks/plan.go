@@ -0,0 +1,263 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// planRequest names the ref to plan, the repository is matched like a
+// webhook's, by owner/name or url
+type planRequest struct {
+	Repository string `json:"repository"`
+	Ref        string `json:"ref"`
+}
+
+// planTarget is the dist that would be built and where it would be uploaded
+type planTarget struct {
+	Format      string `json:"format"`
+	Repository  string `json:"repository"`
+	Artifact    string `json:"artifact"`
+	Compression string `json:"compression,omitempty"`
+}
+
+type plan struct {
+	Repository string        `json:"repository"`
+	Ref        string        `json:"ref"`
+	Commit     string        `json:"commit"`
+	Packages   []packagePlan `json:"packages"`
+}
+
+// packagePlan is everything publishing one package would do, Skipped is set
+// instead when it wouldn't be published at all
+type packagePlan struct {
+	Path              string                `json:"path"`
+	Name              string                `json:"name,omitempty"`
+	Skipped           string                `json:"skipped,omitempty"`
+	Version           string                `json:"version,omitempty"`
+	NormalizedVersion string                `json:"normalizedVersion,omitempty"`
+	Targets           []planTarget          `json:"targets,omitempty"`
+	PromoteTo         string                `json:"promoteTo,omitempty"`
+	Tags              []string              `json:"tags,omitempty"`
+	Source            *composer.Source      `json:"source,omitempty"`
+	Description       string                `json:"description,omitempty"`
+	Replace           map[string]string     `json:"replace,omitempty"`
+	Transforms        []composer.Transform  `json:"transforms,omitempty"`
+	StripVendor       bool                  `json:"stripVendor"`
+	BuildStep         string                `json:"buildStep,omitempty"`
+	Composer          composer.ComposerFile `json:"composer,omitempty"`
+}
+
+// HandlePlan takes a repository and ref and responds with what publishing it
+// would do, worked out from a real checkout but without running build steps,
+// uploading or deleting anything. Requests are authenticated the same way as
+// webhooks, signed with webhookSecret in X-Hub-Signature and/or with the
+// header token.
+func HandlePlan(w http.ResponseWriter, r *http.Request) {
+	var request planRequest
+
+	if !readSignedRequest(w, r, &request) {
+		return
+	}
+
+	if !strings.HasPrefix(request.Ref, "refs/heads/") && !strings.HasPrefix(request.Ref, "refs/tags/") {
+		writeError(w, 422, errors.New("ref must be a full refs/heads/ or refs/tags/ ref"))
+		return
+	}
+
+	repoCfg, err := Config.GetRepository(request.Repository, request.Repository)
+
+	if err != nil {
+		writeResponse(w, 422, response{Status: statusRejected, Reason: "repository not configured"})
+		return
+	}
+
+	ctx, cancel := newWebhookContext()
+	defer cancel()
+
+	checkout, code, err := checkoutPush(ctx, &repoCfg, github.PushPayload{Ref: request.Ref})
+
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+
+	defer checkout.release()
+
+	result := plan{
+		Repository: repoCfg.Url,
+		Ref:        request.Ref,
+		Commit:     checkout.ref.Hash().String(),
+		Packages:   []packagePlan{},
+	}
+
+	branch := checkout.ref.Name().Short()
+
+	// GitHub's default branch isn't known here, so only a configured
+	// defaultBranch can be checked
+	if checkout.isBranch && !repoCfg.ShouldPublishBranch(branch, repoCfg.DefaultBranch) {
+		result.Packages = append(result.Packages, packagePlan{Skipped: "only the default branch is published"})
+		writePlan(w, result)
+		return
+	}
+
+	packages, versionRef, err := repoCfg.GetPackagesForRef(branch, checkout.isBranch)
+
+	if err != nil {
+		writeError(w, 422, err)
+		return
+	}
+
+	for _, pkg := range packages {
+		packagePlan, err := planPackage(&repoCfg, pkg, versionRef, checkout)
+
+		if err != nil {
+			writeError(w, 500, err)
+			return
+		}
+
+		result.Packages = append(result.Packages, packagePlan)
+	}
+
+	writePlan(w, result)
+}
+
+func planPackage(repoCfg *config.Repository, pkg config.Package, versionRef string, checkout *checkedOutPush) (packagePlan, error) {
+	result := packagePlan{Path: pkg.Path}
+
+	data, err := composer.LoadManifest(filepath.Join(checkout.repoPath, pkg.Path), repoCfg.Manifest)
+
+	if err != nil {
+		return result, err
+	}
+
+	result.Name, err = composer.ResolvePackageName(data, Config.DefaultVendor)
+
+	if err != nil {
+		result.Skipped = err.Error()
+		return result, nil
+	}
+
+	if !Config.IsPackageAllowed(result.Name) {
+		result.Skipped = "package " + result.Name + " is not allowed to be published"
+		return result, nil
+	}
+
+	if _, violations := Config.CheckRequiredFields(repoCfg, data); len(violations) > 0 {
+		result.Skipped = "package " + result.Name + " is below policy: " + strings.Join(violations, ", ")
+		return result, nil
+	}
+
+	version, normalisedVersion, err := repoCfg.DeriveVersion(versionRef, checkout.isBranch, data)
+
+	if err != nil {
+		result.Skipped = err.Error()
+		return result, nil
+	}
+
+	commitRef := checkout.ref.Hash().String()
+	mutation := newMutation(repoCfg, checkout.isBranch, result.Name, version, normalisedVersion, commitRef, checkout.description, "")
+
+	if err := mutation.Apply(data); err != nil {
+		return result, err
+	}
+
+	result.Version = version
+	result.NormalizedVersion = normalisedVersion
+
+	artifactName := strings.Replace(result.Name, "/", "-", 1) + "-" + commitRef
+
+	for _, target := range Config.GetPublishTargets(repoCfg) {
+		artifact := artifactName + ".zip"
+
+		if target.Format == config.PublishFormatRaw {
+			artifact = artifactName + ".tar.gz"
+		}
+
+		result.Targets = append(result.Targets, planTarget{
+			Format:      target.Format,
+			Repository:  target.Repository,
+			Artifact:    artifact,
+			Compression: Config.GetTargetCompression(repoCfg, target),
+		})
+	}
+
+	result.Tags = repoCfg.GetPackageTags(versionRef, checkout.isBranch)
+	result.Source = mutation.Source
+	result.Description = mutation.Description
+	result.Replace = mutation.Replace
+	result.Transforms = mutation.Transforms
+	result.StripVendor = repoCfg.ShouldStripVendor(data)
+
+	if repoCfg.BuildStep != nil {
+		result.BuildStep = repoCfg.BuildStep.Command
+	}
+
+	result.Composer = data
+
+	if repoCfg.Staging != nil {
+		result.PromoteTo = Config.GetTargetRepository(repoCfg)
+	}
+
+	return result, nil
+}
+
+// readSignedRequest authenticates a request to one of our own endpoints the
+// same way as a webhook and reads its json body into v, writing the response
+// itself and returning false when either fails.
+func readSignedRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if Config.UsesWebhookAuthHeader() && !hasAuthHeaderToken(r) {
+		writeResponse(w, 403, response{Status: statusRejected, Reason: "missing or invalid " + Config.WebhookAuthHeader + " header"})
+		return false
+	}
+
+	body, ok := readBody(w, r)
+
+	if !ok {
+		return false
+	}
+
+	if Config.UsesWebhookSignature() && !hasValidSignature(r.Header.Get("X-Hub-Signature"), body) {
+		writeError(w, 403, github.ErrHMACVerificationFailed)
+		return false
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		writeError(w, 400, err)
+		return false
+	}
+
+	return true
+}
+
+func writePlan(w http.ResponseWriter, result plan) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// hasValidSignature checks a GitHub style sha1=<hmac> signature of body,
+// made with the webhook secret or the secondary one during a rotation
+func hasValidSignature(signature string, body []byte) bool {
+	if isSignedWith(Config.WebhookSecret, signature, body) {
+		return true
+	}
+
+	return Config.WebhookSecondarySecret != "" && isSignedWith(Config.WebhookSecondarySecret, signature, body)
+}
+
+func isSignedWith(secret, signature string, body []byte) bool {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body)
+
+	expected := "sha1=" + hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
@@ -0,0 +1,68 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	selfTestSkipped = "skipped"
+	selfTestPassed  = "passed"
+)
+
+type readiness struct {
+	Ready bool `json:"ready"`
+	// Whether the startup self-test passed or was skipped, the server
+	// doesn't start when it fails
+	SelfTest   string    `json:"selfTest"`
+	SelfTestAt time.Time `json:"selfTestAt,omitempty"`
+	// Why an artifacts directory can't be written to, publishes would fail
+	ArtifactsDir string `json:"artifactsDir,omitempty"`
+	// Publishing is paused, deliveries are refused until it's turned off.
+	// Still ready, so GitHub gets a 503 to retry on rather than no answer
+	Maintenance bool `json:"maintenance"`
+	// State stores that can't be loaded or saved, with why. Still ready as
+	// publishing doesn't need them, but degraded
+	Degraded    bool              `json:"degraded"`
+	StateStores map[string]string `json:"stateStores,omitempty"`
+}
+
+var selfTest = readiness{SelfTest: selfTestSkipped}
+
+// SelfTestPassed records that the startup self-test uploaded and deleted its
+// throwaway package
+func SelfTestPassed() {
+	selfTest.SelfTest = selfTestPassed
+	selfTest.SelfTestAt = time.Now().UTC()
+}
+
+// HandleReady reports whether the server is ready for webhooks, along with
+// how the startup self-test went. It isn't ready, with a 503, while an
+// artifacts directory can't be written to. A state store being unavailable
+// only makes it degraded
+func HandleReady(w http.ResponseWriter, r *http.Request) {
+	result := selfTest
+	result.Ready = true
+	result.Maintenance = inMaintenance()
+	result.StateStores = stateStores.Unavailable()
+	result.Degraded = result.StateStores != nil
+	code := 200
+
+	if err := Config.CheckArtifactsDirs(); err != nil {
+		result.Ready = false
+		result.ArtifactsDir = err.Error()
+		code = 503
+	}
+
+	body, err := json.Marshal(result)
+
+	if err != nil {
+		writeError(w, 500, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
@@ -0,0 +1,443 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"github.com/gorilla/mux"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	git2 "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ActorReconcile is recorded against anything deleted while reconciling
+const ActorReconcile = "reconcile"
+
+const (
+	reconcilePending   = "pending"
+	reconcileRunning   = "running"
+	reconcileFinished  = "finished"
+	reconcileFailed    = "failed"
+	reconcileCancelled = "cancelled"
+)
+
+// How many reconciliations are remembered, the oldest finished ones are
+// forgotten past this
+const keptReconciliations = 20
+
+var errReconcileRunning = errors.New("a reconciliation is already running")
+
+type reconcileRequest struct {
+	// Owner/name or urls of the repositories to reconcile, all of them when
+	// empty
+	Repositories []string `json:"repositories"`
+}
+
+// reconciliation publishes, in the background, every branch and tag of its
+// repositories that has a version missing from Cloudsmith
+type reconciliation struct {
+	ID           string                  `json:"id"`
+	Status       string                  `json:"status"`
+	Reason       string                  `json:"reason,omitempty"`
+	StartedAt    time.Time               `json:"startedAt"`
+	FinishedAt   *time.Time              `json:"finishedAt,omitempty"`
+	Repositories []*reconciledRepository `json:"repositories"`
+	cancel       context.CancelFunc
+}
+
+type reconciledRepository struct {
+	Url    string `json:"url"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	// Refs with a version missing from Cloudsmith, and how publishing each
+	// of them went
+	Missing []string   `json:"missing"`
+	Results []response `json:"results,omitempty"`
+}
+
+// reconciliations are the recent reconciliations, only one runs at a time so
+// a nightly one can't pile up behind another. Every change to them is made
+// holding the mutex
+type reconciliations struct {
+	mutex sync.Mutex
+	all   []*reconciliation
+}
+
+var recentReconciliations = &reconciliations{}
+
+// HandleReconcile starts a reconciliation of every configured repository, or
+// the ones asked for, authenticated the same way as /plan. It responds with a
+// 202 straight away, GET /reconcile/{id} shows how it's going and POST
+// /reconcile/{id}/cancel stops it.
+func HandleReconcile(w http.ResponseWriter, r *http.Request) {
+	var request reconcileRequest
+
+	if !readSignedRequest(w, r, &request) {
+		return
+	}
+
+	if inMaintenance() {
+		writeMaintenance(w)
+		return
+	}
+
+	repositories := Config.Repositories
+
+	if len(request.Repositories) > 0 {
+		repositories = nil
+
+		for _, name := range request.Repositories {
+			repoCfg, err := Config.GetRepository(name, name)
+
+			if err != nil {
+				writeResponse(w, 422, response{Status: statusRejected, Reason: name + " isn't configured"})
+				return
+			}
+
+			repositories = append(repositories, repoCfg)
+		}
+	}
+
+	job, err := recentReconciliations.start(repositories)
+
+	if err == errReconcileRunning {
+		recentReconciliations.write(w, 409, job)
+		return
+	}
+
+	if err != nil {
+		writeError(w, 500, err)
+		return
+	}
+
+	recentReconciliations.write(w, 202, job)
+}
+
+// HandleReconcileStatus reports how a reconciliation is going, or went
+func HandleReconcileStatus(w http.ResponseWriter, r *http.Request) {
+	job := recentReconciliations.get(mux.Vars(r)["id"])
+
+	if job == nil {
+		writeResponse(w, 404, response{Status: statusRejected, Reason: "no reconciliation " + mux.Vars(r)["id"]})
+		return
+	}
+
+	recentReconciliations.write(w, 200, job)
+}
+
+// HandleReconcileCancel stops a running reconciliation once the ref it's
+// publishing is done, authenticated the same way as /plan with a body of {}
+func HandleReconcileCancel(w http.ResponseWriter, r *http.Request) {
+	var request struct{}
+
+	if !readSignedRequest(w, r, &request) {
+		return
+	}
+
+	job := recentReconciliations.get(mux.Vars(r)["id"])
+
+	if job == nil {
+		writeResponse(w, 404, response{Status: statusRejected, Reason: "no reconciliation " + mux.Vars(r)["id"]})
+		return
+	}
+
+	job.cancel()
+
+	recentReconciliations.write(w, 200, job)
+}
+
+// start runs a reconciliation of repositories in the background, unless one
+// is already running, which is returned instead
+func (jobs *reconciliations) start(repositories []config.Repository) (*reconciliation, error) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	for _, job := range jobs.all {
+		if job.Status == reconcileRunning {
+			return job, errReconcileRunning
+		}
+	}
+
+	id := make([]byte, 8)
+
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	job := &reconciliation{
+		ID:        hex.EncodeToString(id),
+		Status:    reconcileRunning,
+		StartedAt: time.Now().UTC(),
+		cancel:    cancel,
+	}
+
+	for _, repoCfg := range repositories {
+		job.Repositories = append(job.Repositories, &reconciledRepository{Url: repoCfg.Url, Status: reconcilePending, Missing: []string{}})
+	}
+
+	jobs.all = append(jobs.all, job)
+
+	if len(jobs.all) > keptReconciliations {
+		jobs.all = jobs.all[len(jobs.all)-keptReconciliations:]
+	}
+
+	go jobs.run(ctx, job, repositories)
+
+	return job, nil
+}
+
+func (jobs *reconciliations) get(id string) *reconciliation {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	for _, job := range jobs.all {
+		if job.ID == id {
+			return job
+		}
+	}
+
+	return nil
+}
+
+// update changes a reconciliation while it's being run
+func (jobs *reconciliations) update(change func()) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	change()
+}
+
+func (jobs *reconciliations) write(w http.ResponseWriter, code int, job *reconciliation) {
+	jobs.mutex.Lock()
+	body, err := json.Marshal(job)
+	jobs.mutex.Unlock()
+
+	if err != nil {
+		writeError(w, 500, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// run reconciles one repository at a time and, within it, one ref at a time.
+// Publishes go through the same git, source and upload limits as webhooks
+func (jobs *reconciliations) run(ctx context.Context, job *reconciliation, repositories []config.Repository) {
+	defer job.cancel()
+
+	status, reason := reconcileFinished, ""
+
+	// Whether to stop before publishing anything else, the ref being
+	// published when it's cancelled or paused is finished first
+	stopped := func() bool {
+		if ctx.Err() != nil {
+			status = reconcileCancelled
+		} else if inMaintenance() {
+			status, reason = reconcileCancelled, "publishing was paused for maintenance"
+		}
+
+		return status != reconcileFinished
+	}
+
+	for i := range repositories {
+		repoCfg := &repositories[i]
+		result := job.Repositories[i]
+
+		if stopped() {
+			break
+		}
+
+		jobs.update(func() {
+			result.Status = reconcileRunning
+		})
+
+		missing, defaultBranch, err := missingRefs(ctx, repoCfg)
+
+		if err != nil {
+			jobs.update(func() {
+				result.Status = reconcileFailed
+				result.Reason = err.Error()
+			})
+
+			continue
+		}
+
+		jobs.update(func() {
+			for _, ref := range missing {
+				result.Missing = append(result.Missing, ref.Name().String())
+			}
+		})
+
+		for _, ref := range missing {
+			if stopped() {
+				break
+			}
+
+			refCtx, cancel := ctx, context.CancelFunc(func() {})
+
+			if Config.WebhookTimeout > 0 {
+				refCtx, cancel = context.WithTimeout(ctx, Config.WebhookTimeout)
+			}
+
+			_, res := publishRefEvent(refCtx, repoCfg.Name, repoCfg.Url, defaultBranch, github.PushPayload{Ref: ref.Name().String()}, ActorReconcile)
+			cancel()
+
+			res.Ref = ref.Name().String()
+
+			jobs.update(func() {
+				result.Results = append(result.Results, res)
+			})
+		}
+
+		jobs.update(func() {
+			result.Status = reconcileFinished
+
+			if len(result.Results) < len(result.Missing) {
+				result.Status = reconcileCancelled
+			}
+		})
+	}
+
+	jobs.update(func() {
+		finishedAt := time.Now().UTC()
+
+		job.Status = status
+		job.Reason = reason
+		job.FinishedAt = &finishedAt
+	})
+}
+
+// missingRefs lists the branches and tags of a repository with a package
+// version that isn't in its target repository on Cloudsmith, along with the
+// default branch. Manifests are read from the clone without checking anything
+// out.
+func missingRefs(ctx context.Context, repoCfg *config.Repository) ([]*plumbing.Reference, string, error) {
+	repoPath, err := git.GetRepoPath(repoCfg.Url)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	unlock := git.LockClone(repoPath)
+	defer unlock()
+
+	repo, err := git.CloneOrOpenAndUpdate(ctx, repoCfg.Url, repoPath)
+
+	if git.IsEmptyRepository(err) {
+		return nil, "", nil
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	refs, err := git.ListRemote(ctx, repoCfg.Url)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	published, err := Client.ListPackageVersions(Config.Owner, Config.GetTargetRepository(repoCfg))
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	publishedVersions := map[string]bool{}
+
+	for _, pkg := range published {
+		publishedVersions[pkg.Name+"@"+pkg.Version] = true
+	}
+
+	defaultBranch := git.GetDefaultBranch(refs)
+	var missing []*plumbing.Reference
+
+	for _, ref := range refs {
+		isBranch := strings.HasPrefix(ref.Name().String(), "refs/heads/")
+		isTag := strings.HasPrefix(ref.Name().String(), "refs/tags/")
+
+		if !isBranch && !isTag {
+			continue
+		}
+
+		if isBranch && !repoCfg.ShouldPublishBranch(ref.Name().Short(), defaultBranch) {
+			continue
+		}
+
+		for _, version := range refVersions(repo, repoCfg, ref, isBranch) {
+			if !publishedVersions[version] {
+				missing = append(missing, ref)
+				break
+			}
+		}
+	}
+
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].Name().String() < missing[j].Name().String()
+	})
+
+	return missing, defaultBranch, nil
+}
+
+// refVersions is the name@version of every package a ref publishes, packages
+// that wouldn't be published are left out
+func refVersions(repo *git2.Repository, repoCfg *config.Repository, ref *plumbing.Reference, isBranch bool) []string {
+	packages, versionRef, err := repoCfg.GetPackagesForRef(ref.Name().Short(), isBranch)
+
+	if err != nil {
+		return nil
+	}
+
+	manifest := repoCfg.Manifest
+
+	if manifest == "" {
+		manifest = composer.DefaultManifest
+	}
+
+	var versions []string
+
+	for _, pkg := range packages {
+		contents, err := git.ReadFile(repo, ref, path.Join(pkg.Path, manifest))
+
+		if err != nil {
+			continue
+		}
+
+		data, err := composer.ParseManifest(contents)
+
+		if err != nil {
+			continue
+		}
+
+		name, err := composer.ResolvePackageName(data, Config.DefaultVendor)
+
+		if err != nil {
+			continue
+		}
+
+		version, _, err := repoCfg.DeriveVersion(versionRef, isBranch, data)
+
+		if err != nil {
+			continue
+		}
+
+		versions = append(versions, name+"@"+version)
+	}
+
+	return versions
+}
@@ -0,0 +1,1381 @@
+package webhooks_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/checks"
+	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"github.com/Lavoaster/cloudsmith-sync/limit"
+	"github.com/Lavoaster/cloudsmith-sync/state"
+	"github.com/Lavoaster/cloudsmith-sync/webhooks"
+	"github.com/cloudsmith-io/cloudsmith-api/bindings/go/src"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	git2 "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const replaySecret = "replay-secret"
+
+// fixture is a webhook recorded from GitHub, headers and body as they were
+// delivered. Signatures are added when replaying as they depend on the secret
+type fixture struct {
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+// fakeClient records what would have been done on Cloudsmith, composer
+// uploads are recorded with the version in the uploaded composer.json
+type fakeClient struct {
+	// Uploads to several publish targets can be made at once
+	mutex sync.Mutex
+	calls []string
+	// Uploads of artifacts with this in their name fail
+	failUploads string
+	// Deletes of packages with this in their name fail
+	failDeletes string
+	// What ListPackageVersions reports is already on Cloudsmith
+	published []cloudsmith.Package
+}
+
+// record notes a call made to Cloudsmith
+func (c *fakeClient) record(format string, args ...interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.calls = append(c.calls, fmt.Sprintf(format, args...))
+}
+
+// recorded is a copy of the calls so far, for calls made in the background
+func (c *fakeClient) recorded() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]string(nil), c.calls...)
+}
+
+func (c *fakeClient) UploadPackage(owner, repo, format, artifactPath string, options cloudsmith.UploadOptions) (*cloudsmith_api.ModelPackage, error) {
+	if c.failUploads != "" && strings.Contains(filepath.Base(artifactPath), c.failUploads) {
+		return nil, fmt.Errorf("upload of %s failed", filepath.Base(artifactPath))
+	}
+
+	if strings.HasSuffix(artifactPath, ".json") {
+		return c.uploadMetadata(owner, repo, artifactPath, options)
+	}
+
+	// Raw packages are named and versioned by the upload rather than a
+	// composer.json
+	if format == cloudsmith.FormatRaw {
+		c.record("upload %s/%s %s %s@%s", owner, repo, format, options.Name, options.Version)
+
+		return &cloudsmith_api.ModelPackage{}, nil
+	}
+
+	version, err := archivedVersion(artifactPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.record("upload %s/%s %s %s %v", owner, repo, format, version, options.Tags)
+
+	return &cloudsmith_api.ModelPackage{}, nil
+}
+
+// uploadMetadata records the package version a metadata upload points at
+func (c *fakeClient) uploadMetadata(owner, repo, artifactPath string, options cloudsmith.UploadOptions) (*cloudsmith_api.ModelPackage, error) {
+	contents, err := ioutil.ReadFile(artifactPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata composer.Metadata
+
+	if err := json.Unmarshal(contents, &metadata); err != nil {
+		return nil, err
+	}
+
+	c.record("metadata %s/%s %s@%s for %s@%s in %s", owner, repo, options.Name, options.Version, metadata.Package, metadata.Version, metadata.Repository)
+
+	return &cloudsmith_api.ModelPackage{}, nil
+}
+
+func (c *fakeClient) DeletePackageIfExists(owner, repo, format, name, version, reason, actor string) error {
+	if c.failDeletes != "" && strings.Contains(name, c.failDeletes) {
+		return fmt.Errorf("delete of %s@%s failed", name, version)
+	}
+
+	c.record("delete %s/%s %s %s@%s %s by %s", owner, repo, format, name, version, reason, actor)
+
+	return nil
+}
+
+func (c *fakeClient) WaitForPackageDeletion(ctx context.Context, owner, repo, name, version string, timeout time.Duration) error {
+	c.record("wait %s/%s %s@%s", owner, repo, name, version)
+
+	return nil
+}
+
+func (c *fakeClient) PromotePackage(ctx context.Context, owner, staging, target, name, version, actor string, timeout time.Duration) error {
+	c.record("promote %s %s@%s to %s", staging, name, version, target)
+
+	return nil
+}
+
+func (c *fakeClient) ListPackageVersions(owner, repo string) ([]cloudsmith.Package, error) {
+	return c.published, nil
+}
+
+func (c *fakeClient) TagPackage(owner, repo, name, version, action string, tags []string) error {
+	c.record("tag %s/%s %s@%s %s %v", owner, repo, name, version, action, tags)
+
+	return nil
+}
+
+func (c *fakeClient) UploadLimit() *limit.Limit {
+	return nil
+}
+
+func archivedVersion(artifactPath string) (string, error) {
+	archive, err := zip.OpenReader(artifactPath)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		if file.Name != "composer.json" {
+			continue
+		}
+
+		reader, err := file.Open()
+
+		if err != nil {
+			return "", err
+		}
+
+		defer reader.Close()
+
+		var data struct {
+			Version string `json:"version"`
+		}
+
+		if err := json.NewDecoder(reader).Decode(&data); err != nil {
+			return "", err
+		}
+
+		return data.Version, nil
+	}
+
+	return "", fmt.Errorf("no composer.json in %s", artifactPath)
+}
+
+// newUpstream creates the repository the webhooks are about, master and a
+// feature branch with a v1.0.0 tag on master. go-git's in process server
+// stands in for GitHub so nothing leaves the machine
+func newUpstream(t *testing.T, dir string) (*git2.Repository, string) {
+	path := filepath.Join(dir, "upstream")
+	repo, err := git2.PlainInit(path, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PlainInit doesn't write a config file, without one the file transport
+	// says there's no repository to clone
+	cfg, err := repo.Config()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Storer.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	composerJson := []byte(`{"name": "acme/widgets", "type": "library", "require": {"php": "^7.1"}}`)
+
+	if err := ioutil.WriteFile(filepath.Join(path, "composer.json"), composerJson, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := repo.Worktree()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := worktree.Add("composer.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	signature := &object.Signature{Name: "Octo Cat", Email: "octocat@example.com", When: time.Now()}
+	hash, err := worktree.Commit("Add widget factory", &git2.CommitOptions{Author: signature})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.CreateTag("v1.0.0", hash, &git2.CreateTagOptions{Tagger: signature, Message: "First release"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/feature", hash)); err != nil {
+		t.Fatal(err)
+	}
+
+	client.InstallProtocol("file", server.DefaultServer)
+
+	return repo, filepath.Join(path, ".git")
+}
+
+// newReplayConfig sets up the handler's dependencies for a repository at url
+func newReplayConfig(t *testing.T, dir, url string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is never used, the local transport doesn't authenticate, but
+	// it has to load
+	keyPath := filepath.Join(dir, "id_rsa")
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	if err := ioutil.WriteFile(keyPath, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		DataDir:              filepath.Join(dir, "data"),
+		Owner:                "acme",
+		TargetRepository:     "packages",
+		SshKey:               keyPath,
+		WebhookSecret:        replaySecret,
+		WebhookAuthMode:      config.WebhookAuthHmac,
+		GitRetryAttempts:     1,
+		PublishRetryAttempts: 1,
+		RepoLayout:           config.RepoLayoutUnique,
+		PingStatusCode:       201,
+		PingCheckRepository:  true,
+		MaxPayloadSize:       1024 * 1024,
+		OnPackageRename:      config.PackageRenameWarn,
+		ArtifactCollision:    config.ArtifactCollisionUnique,
+		ReplaceStrategy:      config.ReplaceDeleteThenUpload,
+		Repositories: []config.Repository{{
+			Name:          "acme/widgets",
+			Url:           url,
+			PublishSource: config.PublishSourceNever,
+		}},
+	}
+
+	cfg.EnsureDirsExist()
+
+	hook, err := github.New(github.Options.Secret(replaySecret))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := state.LoadPackageNames(filepath.Join(dir, "package-names.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks.Config = cfg
+	webhooks.Hook = hook
+	webhooks.PackageNames = names
+	git.Config = cfg
+}
+
+// newReplay sets up a new directory with an upstream, the handler configured
+// for it and a fakeClient standing in for Cloudsmith. The caller removes dir
+func newReplay(t *testing.T) (string, *git2.Repository, *fakeClient) {
+	dir, err := ioutil.TempDir("", "cloudsmith-sync")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream, url := newUpstream(t, dir)
+	newReplayConfig(t, dir, url)
+
+	client := &fakeClient{}
+	webhooks.Client = client
+
+	return dir, upstream, client
+}
+
+// commitFile commits contents to name in upstream, creating its directory
+func commitFile(t *testing.T, upstream *git2.Repository, name, contents, message string) plumbing.Hash {
+	worktree, err := upstream.Worktree()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(worktree.Filesystem.Root(), name)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := worktree.Add(name); err != nil {
+		t.Fatal(err)
+	}
+
+	signature := &object.Signature{Name: "Octo Cat", Email: "octocat@example.com", When: time.Now()}
+	hash, err := worktree.Commit(message, &git2.CommitOptions{Author: signature})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+// signedRequest signs body with the webhook secret like /sync and /reconcile
+// expect
+func signedRequest(target, body string) *http.Request {
+	mac := hmac.New(sha1.New, []byte(replaySecret))
+	mac.Write([]byte(body))
+
+	request := httptest.NewRequest("POST", target, bytes.NewReader([]byte(body)))
+	request.Header.Set("X-Hub-Signature", "sha1="+hex.EncodeToString(mac.Sum(nil)))
+
+	return request
+}
+
+func replay(t *testing.T, name string) *httptest.ResponseRecorder {
+	return deliver(t, loadFixture(t, name))
+}
+
+func loadFixture(t *testing.T, name string) fixture {
+	contents, err := ioutil.ReadFile(filepath.Join("testdata", "github", name+".json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recorded fixture
+
+	if err := json.Unmarshal(contents, &recorded); err != nil {
+		t.Fatal(err)
+	}
+
+	return recorded
+}
+
+// deliver signs a webhook and hands it to the handler
+func deliver(t *testing.T, recorded fixture) *httptest.ResponseRecorder {
+	mac := hmac.New(sha1.New, []byte(replaySecret))
+	mac.Write(recorded.Body)
+
+	request := httptest.NewRequest("POST", "/webhooks/github", bytes.NewReader(recorded.Body))
+
+	for header, value := range recorded.Headers {
+		request.Header.Set(header, value)
+	}
+
+	request.Header.Set("X-Hub-Signature", "sha1="+hex.EncodeToString(mac.Sum(nil)))
+
+	recorder := httptest.NewRecorder()
+	webhooks.HandleGithubWebhook(recorder, request)
+
+	return recorder
+}
+
+func TestReplayRecordedGithubWebhooks(t *testing.T) {
+	dir, upstream, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	replays := []struct {
+		fixture string
+		// Run against upstream before replaying, deleted refs are gone from
+		// GitHub by the time it sends the webhook
+		before func() error
+		status int
+		calls  []string
+	}{
+		{
+			fixture: "ping",
+			status:  201,
+		},
+		{
+			fixture: "push-to-branch",
+			status:  204,
+			calls: []string{
+				"delete acme/packages composer acme/widgets@dev-master pre-upload-replace by f3e4d5c6-7740-11e9-9a1e-1c2a3b4c5d02",
+				"upload acme/packages composer dev-master [branch:master]",
+			},
+		},
+		{
+			fixture: "push-to-tag",
+			status:  204,
+			calls: []string{
+				"delete acme/packages composer acme/widgets@v1.0.0 pre-upload-replace by 0b1c2d3e-7741-11e9-8f2a-6e7f8a9b0c03",
+				"upload acme/packages composer v1.0.0 [tag:v1.0.0]",
+			},
+		},
+		{
+			// GitHub sends a create event alongside the push of a new tag
+			fixture: "tag-create",
+			status:  200,
+		},
+		{
+			// A mirror updating several refs at once, the missing branch
+			// fails without stopping the others
+			fixture: "push-multiple-refs",
+			status:  500,
+			calls: []string{
+				"delete acme/packages composer acme/widgets@dev-master pre-upload-replace by 5f6a7b8c-7741-11e9-8d6e-3a4b5c6d7e06",
+				"upload acme/packages composer dev-master [branch:master]",
+				"delete acme/packages composer acme/widgets@v1.0.0 pre-upload-replace by 5f6a7b8c-7741-11e9-8d6e-3a4b5c6d7e06",
+				"upload acme/packages composer v1.0.0 [tag:v1.0.0]",
+			},
+		},
+		{
+			fixture: "branch-delete",
+			before: func() error {
+				return upstream.Storer.RemoveReference("refs/heads/feature")
+			},
+			status: 204,
+			calls: []string{
+				"delete acme/packages composer acme/widgets@dev-feature ref-deletion by 2c3d4e5f-7741-11e9-8b4c-0d1e2f3a4b04",
+			},
+		},
+		{
+			fixture: "branch-delete-event",
+			status:  200,
+		},
+		{
+			fixture: "tag-delete",
+			before: func() error {
+				return upstream.DeleteTag("v1.0.0")
+			},
+			status: 204,
+			calls: []string{
+				"delete acme/packages composer acme/widgets@v1.0.0 ref-deletion by 4e5f6a7b-7741-11e9-9c5d-2f3a4b5c6d05",
+			},
+		},
+		{
+			fixture: "tag-delete-event",
+			status:  200,
+		},
+	}
+
+	for _, r := range replays {
+		if r.before != nil {
+			if err := r.before(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		client.calls = nil
+
+		response := replay(t, r.fixture)
+
+		if response.Code != r.status {
+			t.Errorf("[!] %s responded %d (%s); want %d", r.fixture, response.Code, response.Body.String(), r.status)
+		}
+
+		if !reflect.DeepEqual(client.calls, r.calls) {
+			t.Errorf("[!] %s called Cloudsmith with %q; want %q", r.fixture, client.calls, r.calls)
+		}
+	}
+}
+
+func TestReplaySignedWithSecondarySecret(t *testing.T) {
+	dir, _, _ := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	// Mid rotation, GitHub still signs with the old secret
+	hook, err := github.New(github.Options.Secret("new-secret"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks.Hook = hook
+
+	if response := replay(t, "ping"); response.Code != 403 {
+		t.Errorf("[!] ping signed with an unknown secret responded %d; want 403", response.Code)
+	}
+
+	secondary, err := github.New(github.Options.Secret(replaySecret))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks.SecondaryHook = secondary
+	defer func() { webhooks.SecondaryHook = nil }()
+
+	if response := replay(t, "ping"); response.Code != 201 {
+		t.Errorf("[!] ping signed with the secondary secret responded %d (%s); want 201", response.Code, response.Body.String())
+	}
+}
+
+func TestManualSyncOfCommit(t *testing.T) {
+	dir, upstream, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	head, err := upstream.Head()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := head.Hash().String()
+	short := commit[:7]
+
+	syncs := []struct {
+		body   string
+		status int
+		calls  []string
+	}{
+		{
+			body:   `{"repository": "acme/widgets", "commit": "` + commit + `"}`,
+			status: 204,
+			calls: []string{
+				"delete acme/packages composer acme/widgets@dev-" + short + " pre-upload-replace by manual-sync",
+				"upload acme/packages composer dev-" + short + " [branch:" + short + "]",
+			},
+		},
+		{
+			body:   `{"repository": "acme/widgets", "commit": "` + commit + `", "version": "1.0.1-RC1"}`,
+			status: 204,
+			calls: []string{
+				"delete acme/packages composer acme/widgets@1.0.1-RC1 pre-upload-replace by manual-sync",
+				"upload acme/packages composer 1.0.1-RC1 [tag:1.0.1-RC1]",
+			},
+		},
+		{
+			body:   `{"repository": "acme/widgets", "commit": "` + commit + `", "version": "v1.2"}`,
+			status: 204,
+			calls: []string{
+				"delete acme/packages composer acme/widgets@v1.2 pre-upload-replace by manual-sync",
+				"upload acme/packages composer v1.2 [tag:v1.2]",
+			},
+		},
+		{
+			body:   `{"repository": "acme/widgets", "commit": "` + commit + `", "version": "not a version"}`,
+			status: 422,
+		},
+		{
+			body:   `{"repository": "acme/widgets", "commit": "0123456789abcdef0123456789abcdef01234567"}`,
+			status: 422,
+		},
+		{
+			body:   `{"repository": "acme/widgets", "commit": "` + short + `"}`,
+			status: 422,
+		},
+	}
+
+	for _, s := range syncs {
+		client.calls = nil
+
+		response := httptest.NewRecorder()
+		webhooks.HandleSync(response, signedRequest("/sync", s.body))
+
+		if response.Code != s.status {
+			t.Errorf("[!] sync of %s responded %d (%s); want %d", s.body, response.Code, response.Body.String(), s.status)
+		}
+
+		if !reflect.DeepEqual(client.calls, s.calls) {
+			t.Errorf("[!] sync of %s called Cloudsmith with %q; want %q", s.body, client.calls, s.calls)
+		}
+	}
+}
+
+func TestTransactionalSyncRollsBack(t *testing.T) {
+	dir, upstream, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	// A second package living alongside the first
+	hash := commitFile(t, upstream, "tools/composer.json", `{"name": "acme/widget-tools", "type": "library"}`, "Add widget tools")
+
+	webhooks.Config.Repositories[0].Packages = []config.Package{{Path: "."}, {Path: "tools"}}
+	webhooks.Config.Repositories[0].Transactional = true
+
+	body := `{"repository": "acme/widgets", "commit": "` + hash.String() + `", "version": "1.1.0"}`
+
+	syncs := []struct {
+		failUploads string
+		status      int
+		calls       []string
+	}{
+		{
+			status: 204,
+			calls: []string{
+				"delete acme/packages composer acme/widgets@1.1.0 pre-upload-replace by manual-sync",
+				"upload acme/packages composer 1.1.0 [tag:1.1.0]",
+				"delete acme/packages composer acme/widget-tools@1.1.0 pre-upload-replace by manual-sync",
+				"upload acme/packages composer 1.1.0 [tag:1.1.0]",
+			},
+		},
+		{
+			// widgets was already uploaded when tools failed
+			failUploads: "widget-tools",
+			status:      500,
+			calls: []string{
+				"delete acme/packages composer acme/widgets@1.1.0 pre-upload-replace by manual-sync",
+				"upload acme/packages composer 1.1.0 [tag:1.1.0]",
+				"delete acme/packages composer acme/widget-tools@1.1.0 pre-upload-replace by manual-sync",
+				"delete acme/packages composer acme/widgets@1.1.0 transaction-rollback by manual-sync",
+				"delete acme/packages composer acme/widget-tools@1.1.0 transaction-rollback by manual-sync",
+			},
+		},
+	}
+
+	for _, s := range syncs {
+		client.calls = nil
+		client.failUploads = s.failUploads
+
+		response := httptest.NewRecorder()
+		webhooks.HandleSync(response, signedRequest("/sync", body))
+
+		if response.Code != s.status {
+			t.Errorf("[!] sync failing %q responded %d (%s); want %d", s.failUploads, response.Code, response.Body.String(), s.status)
+		}
+
+		if !reflect.DeepEqual(client.calls, s.calls) {
+			t.Errorf("[!] sync failing %q called Cloudsmith with %q; want %q", s.failUploads, client.calls, s.calls)
+		}
+	}
+}
+
+func TestTransactionalSyncRollsBackRawTargets(t *testing.T) {
+	dir, upstream, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	hash := commitFile(t, upstream, "tools/composer.json", `{"name": "acme/widget-tools", "type": "library"}`, "Add widget tools")
+
+	webhooks.Config.Repositories[0].Packages = []config.Package{{Path: "."}, {Path: "tools"}}
+	webhooks.Config.Repositories[0].Transactional = true
+	webhooks.Config.Repositories[0].PublishTargets = []config.PublishTarget{
+		{Format: config.PublishFormatRaw, Repository: "downloads"},
+	}
+
+	body := `{"repository": "acme/widgets", "commit": "` + hash.String() + `", "version": "1.1.0"}`
+
+	client.failUploads = "widget-tools"
+
+	response := httptest.NewRecorder()
+	webhooks.HandleSync(response, signedRequest("/sync", body))
+
+	var rollbacks []string
+
+	for _, call := range client.calls {
+		if strings.Contains(call, cloudsmith.DeleteReasonRollback) {
+			rollbacks = append(rollbacks, call)
+		}
+	}
+
+	sort.Strings(rollbacks)
+
+	// Raw packages are looked up by their own format and name
+	expected := []string{
+		"delete acme/downloads raw acme-widget-tools@1.1.0 transaction-rollback by manual-sync",
+		"delete acme/downloads raw acme-widgets@1.1.0 transaction-rollback by manual-sync",
+		"delete acme/packages composer acme/widget-tools@1.1.0 transaction-rollback by manual-sync",
+		"delete acme/packages composer acme/widgets@1.1.0 transaction-rollback by manual-sync",
+	}
+
+	if response.Code != 500 || !reflect.DeepEqual(rollbacks, expected) {
+		t.Errorf("[!] sync responded %d (%s) and rolled back %q; want a 500 rolling back %q", response.Code, response.Body.String(), rollbacks, expected)
+	}
+}
+
+func TestReplaySkipsUnchangedBranch(t *testing.T) {
+	dir, _, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	webhooks.Config.SkipUnchangedBranches = true
+	digests, err := state.LoadPublishedDigests(filepath.Join(dir, "published-digests.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks.PublishedDigests = digests
+
+	defer func() {
+		webhooks.PublishedDigests = nil
+	}()
+
+	published := []string{
+		"delete acme/packages composer acme/widgets@dev-master pre-upload-replace by f3e4d5c6-7740-11e9-9a1e-1c2a3b4c5d02",
+		"upload acme/packages composer dev-master [branch:master]",
+	}
+
+	// The second push has nothing new to publish
+	for i, calls := range [][]string{published, nil} {
+		client.calls = nil
+
+		response := replay(t, "push-to-branch")
+
+		if !reflect.DeepEqual(client.calls, calls) {
+			t.Errorf("[!] push %d called Cloudsmith with %q (%s); want %q", i+1, client.calls, response.Body.String(), calls)
+		}
+	}
+
+	client.calls = nil
+
+	response := httptest.NewRecorder()
+	webhooks.HandleSync(response, signedRequest("/sync", `{"repository": "acme/widgets", "ref": "refs/heads/master", "force": true}`))
+
+	if len(client.calls) != 2 {
+		t.Errorf("[!] forced sync called Cloudsmith with %q (%s); want it published again", client.calls, response.Body.String())
+	}
+}
+
+func TestReplayPublishesWithoutItsState(t *testing.T) {
+	dir, _, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	// Loads as empty, but there's no directory to save it to
+	webhooks.Config.SkipUnchangedBranches = true
+	digests, err := state.LoadPublishedDigests(filepath.Join(dir, "missing", "published-digests.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks.PublishedDigests = digests
+
+	defer func() {
+		webhooks.PublishedDigests = nil
+	}()
+
+	if response := replay(t, "push-to-branch"); response.Code != 204 || len(client.calls) != 2 {
+		t.Errorf("[!] push with unwritable state responded %d (%s) with %q; want it published", response.Code, response.Body.String(), client.calls)
+	}
+
+	recorder := httptest.NewRecorder()
+	webhooks.HandleReady(recorder, httptest.NewRequest("GET", "/ready", nil))
+
+	var ready struct {
+		Ready       bool
+		Degraded    bool
+		StateStores map[string]string
+	}
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &ready); err != nil {
+		t.Fatal(err)
+	}
+
+	if recorder.Code != 200 || !ready.Ready || !ready.Degraded || ready.StateStores[webhooks.StorePublishedDigests] == "" {
+		t.Errorf("[!] /ready with unwritable state = %d %s; want ready but degraded", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestReplayAwaitsRequiredChecks(t *testing.T) {
+	dir, _, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	var run string
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/status") {
+			w.Write([]byte(`{"statuses": []}`))
+			return
+		}
+
+		w.Write([]byte(`{"check_runs": [` + run + `]}`))
+	}))
+	defer api.Close()
+
+	webhooks.Config.Repositories[0].RequiredChecks = &config.RequiredChecks{Checks: []string{"tests"}, Interval: time.Millisecond}
+	webhooks.Checks = checks.NewClient(api.URL, "token")
+
+	replays := []struct {
+		fixture string
+		run     string
+		status  int
+		calls   []string
+	}{
+		{
+			fixture: "push-to-tag",
+			run:     `{"name": "tests", "status": "in_progress", "conclusion": null}`,
+			status:  202,
+		},
+		{
+			fixture: "push-to-branch",
+			run:     `{"name": "tests", "status": "completed", "conclusion": "failure"}`,
+			status:  422,
+		},
+		{
+			// A deferred tag is published when GitHub redelivers it
+			fixture: "push-to-tag",
+			run:     `{"name": "tests", "status": "completed", "conclusion": "success"}`,
+			status:  204,
+			calls: []string{
+				"delete acme/packages composer acme/widgets@v1.0.0 pre-upload-replace by 0b1c2d3e-7741-11e9-8f2a-6e7f8a9b0c03",
+				"upload acme/packages composer v1.0.0 [tag:v1.0.0]",
+			},
+		},
+	}
+
+	for _, r := range replays {
+		run = r.run
+		client.calls = nil
+
+		response := replay(t, r.fixture)
+
+		if response.Code != r.status {
+			t.Errorf("[!] %s with %s responded %d (%s); want %d", r.fixture, r.run, response.Code, response.Body.String(), r.status)
+		}
+
+		if !reflect.DeepEqual(client.calls, r.calls) {
+			t.Errorf("[!] %s with %s called Cloudsmith with %q; want %q", r.fixture, r.run, client.calls, r.calls)
+		}
+	}
+}
+
+func TestReplayDuringMaintenance(t *testing.T) {
+	dir, _, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	webhooks.SetMaintenance(true)
+	defer webhooks.SetMaintenance(false)
+
+	response := replay(t, "push-to-branch")
+
+	if response.Code != 503 || response.Header().Get("Retry-After") == "" {
+		t.Errorf("[!] push-to-branch in maintenance responded %d with Retry-After %q; want 503 and a Retry-After", response.Code, response.Header().Get("Retry-After"))
+	}
+
+	if len(client.calls) > 0 {
+		t.Errorf("[!] push-to-branch in maintenance called Cloudsmith with %q; want nothing", client.calls)
+	}
+
+	if response := replay(t, "ping"); response.Code != 201 {
+		t.Errorf("[!] ping in maintenance responded %d; want 201", response.Code)
+	}
+}
+
+func TestReconcilePublishesMissingRefs(t *testing.T) {
+	dir, _, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	webhooks.Config.ManualSync = true
+
+	client.published = []cloudsmith.Package{{Name: "acme/widgets", Version: "dev-master"}}
+
+	router := webhooks.NewRouter(webhooks.Config)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, signedRequest("/reconcile", `{}`))
+
+	var job struct {
+		ID           string
+		Status       string
+		Repositories []struct {
+			Missing []string
+		}
+	}
+
+	if err := json.Unmarshal(response.Body.Bytes(), &job); response.Code != 202 || err != nil {
+		t.Fatalf("[!] reconcile responded %d (%s); want 202", response.Code, response.Body.String())
+	}
+
+	for i := 0; job.Status == "running"; i++ {
+		if i == 100 {
+			t.Fatalf("[!] reconcile %s is still running", job.ID)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest("GET", "/reconcile/"+job.ID, nil))
+
+		if err := json.Unmarshal(response.Body.Bytes(), &job); response.Code != 200 || err != nil {
+			t.Fatalf("[!] reconcile %s responded %d (%s); want 200", job.ID, response.Code, response.Body.String())
+		}
+	}
+
+	if job.Status != "finished" {
+		t.Errorf("[!] reconcile finished as %s (%s); want finished", job.Status, response.Body.String())
+	}
+
+	missing := []string{"refs/heads/feature", "refs/tags/v1.0.0"}
+
+	if len(job.Repositories) != 1 || !reflect.DeepEqual(job.Repositories[0].Missing, missing) {
+		t.Errorf("[!] reconcile found %s missing; want %q", response.Body.String(), missing)
+	}
+
+	calls := []string{
+		"delete acme/packages composer acme/widgets@dev-feature pre-upload-replace by reconcile",
+		"upload acme/packages composer dev-feature [branch:feature]",
+		"delete acme/packages composer acme/widgets@v1.0.0 pre-upload-replace by reconcile",
+		"upload acme/packages composer v1.0.0 [tag:v1.0.0]",
+	}
+
+	if !reflect.DeepEqual(client.calls, calls) {
+		t.Errorf("[!] reconcile called Cloudsmith with %q; want %q", client.calls, calls)
+	}
+
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest("GET", "/reconcile/unknown", nil))
+
+	if response.Code != 404 {
+		t.Errorf("[!] unknown reconcile responded %d; want 404", response.Code)
+	}
+}
+
+func TestStatusSnapshot(t *testing.T) {
+	dir, _, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	url := webhooks.Config.Repositories[0].Url
+	replay(t, "push-to-branch")
+
+	client.failUploads = "widgets"
+	replay(t, "push-to-tag")
+
+	path := filepath.Join(dir, "status.json")
+
+	if err := webhooks.WriteStatusSnapshot(path); err != nil {
+		t.Fatalf("[!] WriteStatusSnapshot() = %v; want nil", err)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot struct {
+		Repositories map[string]struct {
+			LastRef      string
+			Counts       map[string]int64
+			RecentErrors []struct {
+				Ref string
+			}
+		}
+	}
+
+	if err := json.Unmarshal(contents, &snapshot); err != nil {
+		t.Fatalf("[!] status snapshot isn't json: %v", err)
+	}
+
+	repository := snapshot.Repositories[url]
+	total := int64(0)
+
+	for _, count := range repository.Counts {
+		total += count
+	}
+
+	if repository.LastRef != "refs/tags/v1.0.0" || total != 2 {
+		t.Errorf("[!] status snapshot has %s; want the 2 refs published for %s", contents, url)
+	}
+
+	if len(repository.RecentErrors) != 1 || repository.RecentErrors[0].Ref != "refs/tags/v1.0.0" {
+		t.Errorf("[!] status snapshot has errors %+v; want the failed upload of v1.0.0", repository.RecentErrors)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, ".status.json.*"))
+
+	if len(files) != 0 {
+		t.Errorf("[!] WriteStatusSnapshot() left %v behind", files)
+	}
+}
+
+func TestReplayUploadsToTargetsAtOnce(t *testing.T) {
+	dir, _, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	webhooks.Config.TargetConcurrency = 3
+	webhooks.Config.Repositories[0].PublishTargets = []config.PublishTarget{
+		{Format: config.PublishFormatComposer, Repository: "mirror"},
+		{Format: config.PublishFormatRaw, Repository: "downloads"},
+	}
+
+	// The raw tarball fails, the composer targets are still published
+	client.failUploads = ".tar.gz"
+
+	response := replay(t, "push-to-branch")
+
+	if response.Code != 500 || !strings.Contains(response.Body.String(), "published to 2 of 3 targets but not raw to downloads") {
+		t.Errorf("[!] push responded %d (%s); want a 500 reporting the raw target failed", response.Code, response.Body.String())
+	}
+
+	var uploads []string
+
+	for _, call := range client.calls {
+		if strings.HasPrefix(call, "upload ") {
+			uploads = append(uploads, call)
+		}
+	}
+
+	sort.Strings(uploads)
+
+	expected := []string{
+		"upload acme/mirror composer dev-master [branch:master]",
+		"upload acme/packages composer dev-master [branch:master]",
+	}
+
+	if !reflect.DeepEqual(uploads, expected) {
+		t.Errorf("[!] push uploaded %q; want %q", uploads, expected)
+	}
+}
+
+func TestReplayDeletesRefFromEveryTarget(t *testing.T) {
+	dir, upstream, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	webhooks.Config.Repositories[0].PublishTargets = []config.PublishTarget{
+		{Format: config.PublishFormatComposer, Repository: "mirror"},
+		{Format: config.PublishFormatRaw, Repository: "downloads"},
+	}
+
+	// The clone still has the tag once GitHub no longer does
+	if response := replay(t, "push-to-tag"); response.Code != 204 {
+		t.Fatalf("[!] tag push responded %d (%s)", response.Code, response.Body.String())
+	}
+
+	if err := upstream.DeleteTag("v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the raw package fails to delete, that's still a failed delivery
+	client.failDeletes = "acme-widgets"
+
+	if response := replay(t, "tag-delete"); response.Code != 500 || !strings.Contains(response.Body.String(), "downloads: delete of acme-widgets@v1.0.0 failed") {
+		t.Errorf("[!] failed tag deletion responded %d (%s); want a 500 reporting the raw target", response.Code, response.Body.String())
+	}
+
+	// Redelivered once the delete can succeed
+	client.calls = nil
+	client.failDeletes = ""
+
+	response := replay(t, "tag-delete")
+
+	expected := []string{
+		"delete acme/packages composer acme/widgets@v1.0.0 ref-deletion by 4e5f6a7b-7741-11e9-9c5d-2f3a4b5c6d05",
+		"delete acme/mirror composer acme/widgets@v1.0.0 ref-deletion by 4e5f6a7b-7741-11e9-9c5d-2f3a4b5c6d05",
+		"delete acme/downloads raw acme-widgets@v1.0.0 ref-deletion by 4e5f6a7b-7741-11e9-9c5d-2f3a4b5c6d05",
+	}
+
+	if response.Code != 204 || !reflect.DeepEqual(client.calls, expected) {
+		t.Errorf("[!] tag deletion responded %d (%s) and called Cloudsmith with %q; want %q", response.Code, response.Body.String(), client.calls, expected)
+	}
+}
+
+func TestReplayDoesNotUploadOverAVersionItCouldNotDelete(t *testing.T) {
+	dir, _, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	client.failDeletes = "acme/widgets"
+
+	response := replay(t, "push-to-branch")
+
+	if response.Code != 500 || len(client.calls) != 0 {
+		t.Errorf("[!] push responded %d (%s) and called Cloudsmith with %q; want a 500 without uploading", response.Code, response.Body.String(), client.calls)
+	}
+}
+
+func TestReplayRecoversFromAStaleClone(t *testing.T) {
+	dir, upstream, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	url := webhooks.Config.Repositories[0].Url
+
+	if response := replay(t, "push-to-branch"); response.Code != 204 {
+		t.Fatalf("[!] first push responded %d (%s)", response.Code, response.Body.String())
+	}
+
+	// The clone fetches from a mirror that stops getting updates, so fetching
+	// works but never sees the next push
+	mirror := filepath.Join(dir, "mirror")
+
+	if _, err := git2.PlainClone(mirror, true, &git2.CloneOptions{URL: url}); err != nil {
+		t.Fatal(err)
+	}
+
+	repoPath, err := git.GetRepoPath(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone, err := git2.PlainOpen(repoPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cloneCfg, err := clone.Config()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cloneCfg.Remotes["origin"].URLs = []string{mirror}
+
+	if err := clone.Storer.SetConfig(cloneCfg); err != nil {
+		t.Fatal(err)
+	}
+
+	pushed := commitFile(t, upstream, "README.md", "# Widgets\n", "Add readme")
+	client.calls = nil
+
+	recorded := loadFixture(t, "push-to-branch")
+	recorded.Body = bytes.Replace(recorded.Body, []byte("3b6f8d3c1e4a9f2b7c5d0e1f2a3b4c5d6e7f8a9b"), []byte(pushed.String()), -1)
+
+	response := deliver(t, recorded)
+
+	if response.Code != 204 || len(client.calls) != 2 {
+		t.Errorf("[!] push of %s responded %d (%s) and called Cloudsmith with %q; want it published", pushed, response.Code, response.Body.String(), client.calls)
+	}
+
+	clone, err = git2.PlainOpen(repoPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ref, err := clone.Reference("refs/heads/master", true); err != nil || ref.Hash() != pushed {
+		t.Errorf("[!] clone has master at %v, %v; want it cloned again at %s", ref, err, pushed)
+	}
+}
+
+func TestReplayDeletesTheOldNameOnlyOnceRenamedPackageIsPublished(t *testing.T) {
+	dir, upstream, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	webhooks.Config.OnPackageRename = config.PackageRenameDeleteOld
+
+	if response := replay(t, "push-to-branch"); response.Code != 204 {
+		t.Fatalf("[!] first push responded %d (%s)", response.Code, response.Body.String())
+	}
+
+	pushed := commitFile(t, upstream, "composer.json", `{"name": "acme/gadgets", "type": "library", "require": {"php": "^7.1"}}`, "Rename to gadgets")
+
+	recorded := loadFixture(t, "push-to-branch")
+	recorded.Body = bytes.Replace(recorded.Body, []byte("3b6f8d3c1e4a9f2b7c5d0e1f2a3b4c5d6e7f8a9b"), []byte(pushed.String()), -1)
+
+	renamed := "delete acme/packages composer acme/widgets@dev-master " + cloudsmith.DeleteReasonRenamed + " by f3e4d5c6-7740-11e9-9a1e-1c2a3b4c5d02"
+
+	for i, failUploads := range []string{"gadgets", ""} {
+		client.calls = nil
+		client.failUploads = failUploads
+
+		response := deliver(t, recorded)
+		deleted := false
+
+		for _, call := range client.calls {
+			deleted = deleted || call == renamed
+		}
+
+		if failed := failUploads != ""; deleted == failed {
+			t.Errorf("[!] push %d responded %d and called Cloudsmith with %q; want acme/widgets deleted %v", i+1, response.Code, client.calls, !failed)
+		}
+	}
+}
+
+func TestReplayUploadsMetadata(t *testing.T) {
+	dir, _, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	webhooks.Config.Repositories[0].Metadata = &config.Metadata{Repository: "pointers", Version: "latest-{ref}", TagsOnly: true}
+
+	expected := map[string][]string{
+		// Only tags update it
+		"push-to-branch": {
+			"delete acme/packages composer acme/widgets@dev-master pre-upload-replace by f3e4d5c6-7740-11e9-9a1e-1c2a3b4c5d02",
+			"upload acme/packages composer dev-master [branch:master]",
+		},
+		"push-to-tag": {
+			"delete acme/packages composer acme/widgets@v1.0.0 pre-upload-replace by 0b1c2d3e-7741-11e9-8f2a-6e7f8a9b0c03",
+			"upload acme/packages composer v1.0.0 [tag:v1.0.0]",
+			"metadata acme/pointers acme-widgets-metadata@latest-v1.0.0 for acme/widgets@v1.0.0 in acme/packages",
+		},
+	}
+
+	for name, calls := range expected {
+		client.calls = nil
+
+		response := replay(t, name)
+
+		if !reflect.DeepEqual(client.calls, calls) {
+			t.Errorf("[!] %s called Cloudsmith with %q (%s); want %q", name, client.calls, response.Body.String(), calls)
+		}
+	}
+}
+
+func TestReplayRefusesToRepublishAMovedImmutableTag(t *testing.T) {
+	dir, upstream, client := newReplay(t)
+	defer os.RemoveAll(dir)
+
+	webhooks.Config.Repositories[0].ImmutableTags = true
+	commits, err := state.LoadPublishedCommits(filepath.Join(dir, "published-commits.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks.PublishedCommits = commits
+
+	defer func() {
+		webhooks.PublishedCommits = nil
+	}()
+
+	if response := replay(t, "push-to-tag"); response.Code != 204 || len(client.calls) != 2 {
+		t.Fatalf("[!] first push of v1.0.0 responded %d (%s) and called Cloudsmith with %q; want it published", response.Code, response.Body.String(), client.calls)
+	}
+
+	// Force pushed to a new commit
+	if err := upstream.DeleteTag("v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	moved := commitFile(t, upstream, "README.md", "# Widgets\n", "Add readme")
+	signature := &object.Signature{Name: "Octo Cat", Email: "octocat@example.com", When: time.Now()}
+
+	if _, err := upstream.CreateTag("v1.0.0", moved, &git2.CreateTagOptions{Tagger: signature, Message: "First release, again"}); err != nil {
+		t.Fatal(err)
+	}
+
+	client.calls = nil
+
+	// Not a new tag this time, so it isn't taken for the create event's twin
+	recorded := loadFixture(t, "push-to-tag")
+	recorded.Body = bytes.Replace(recorded.Body, []byte(`"created": true`), []byte(`"created": false`), 1)
+
+	response := deliver(t, recorded)
+
+	if response.Code != 409 || !strings.Contains(response.Body.String(), moved.String()) || len(client.calls) != 0 {
+		t.Errorf("[!] push of the moved v1.0.0 responded %d (%s) and called Cloudsmith with %q; want a 409 leaving it alone", response.Code, response.Body.String(), client.calls)
+	}
+}
+
+// featureFixture is a recorded push changed to be to or delete the feature
+// branch, with its own delivery id
+func featureFixture(t *testing.T, deleted bool, deliveryID string) fixture {
+	name := "push-to-branch"
+
+	if deleted {
+		name = "branch-delete"
+	}
+
+	recorded := loadFixture(t, name)
+
+	var body map[string]interface{}
+
+	if err := json.Unmarshal(recorded.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+
+	body["ref"] = "refs/heads/feature"
+
+	contents, err := json.Marshal(body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded.Body = contents
+	recorded.Headers["X-GitHub-Delivery"] = deliveryID
+
+	return recorded
+}
+
+var gracePeriodDeliveries = []struct {
+	name string
+	// Whether each delivery deletes the feature branch or pushes it again
+	deletes []bool
+	// Calls once the grace period is over
+	calls []string
+}{
+	{
+		name:    "deleted",
+		deletes: []bool{true},
+		calls: []string{
+			"delete acme/packages composer acme/widgets@dev-feature ref-deletion by delivery-0",
+		},
+	},
+	{
+		name:    "pushed again",
+		deletes: []bool{true, false},
+		calls: []string{
+			"delete acme/packages composer acme/widgets@dev-feature pre-upload-replace by delivery-1",
+			"upload acme/packages composer dev-feature [branch:feature]",
+		},
+	},
+	{
+		// Only the second deletion is still scheduled
+		name:    "deleted again",
+		deletes: []bool{true, false, true},
+		calls: []string{
+			"delete acme/packages composer acme/widgets@dev-feature pre-upload-replace by delivery-1",
+			"upload acme/packages composer dev-feature [branch:feature]",
+			"delete acme/packages composer acme/widgets@dev-feature ref-deletion by delivery-2",
+		},
+	},
+}
+
+func TestReplayDeletesBranchAfterGracePeriod(t *testing.T) {
+	for _, test := range gracePeriodDeliveries {
+		dir, _, client := newReplay(t)
+		defer os.RemoveAll(dir)
+
+		// Long enough for the push to get as far as cancelling the delete
+		gracePeriod := time.Second
+		webhooks.Config.BranchDeleteGracePeriod = gracePeriod
+
+		for i, deleted := range test.deletes {
+			response := deliver(t, featureFixture(t, deleted, fmt.Sprintf("delivery-%d", i)))
+
+			if status := map[bool]int{true: 202, false: 204}[deleted]; response.Code != status {
+				t.Errorf("[!] %s: delivery %d responded %d (%s); want %d", test.name, i, response.Code, response.Body.String(), status)
+			}
+		}
+
+		for _, call := range client.recorded() {
+			if strings.Contains(call, "ref-deletion") {
+				t.Errorf("[!] %s: %s before the grace period was over", test.name, call)
+			}
+		}
+
+		time.Sleep(2 * gracePeriod)
+
+		if calls := client.recorded(); !reflect.DeepEqual(calls, test.calls) {
+			t.Errorf("[!] %s called Cloudsmith with %q; want %q", test.name, calls, test.calls)
+		}
+	}
+}
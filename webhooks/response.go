@@ -0,0 +1,89 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	statusOk        = "ok"
+	statusPublished = "published"
+	statusDeleted   = "deleted"
+	statusScheduled = "scheduled"
+	statusDeferred  = "deferred"
+	statusSkipped   = "skipped"
+	statusRejected  = "rejected"
+	statusError     = "error"
+)
+
+// response is the body of every webhook response. By default only the reason
+// is written as plain text, which reads best in GitHub's delivery log, but
+// jsonResponses switches to the whole thing as json for tooling.
+type response struct {
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Package string `json:"package,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Which ref a result is for when a delivery updated several
+	Ref string `json:"ref,omitempty"`
+	// One entry per package when a push publishes several, or per ref
+	Results []response `json:"results,omitempty"`
+}
+
+func (res response) text() string {
+	if len(res.Results) == 0 {
+		return res.Reason
+	}
+
+	var lines []string
+
+	for _, result := range res.Results {
+		text := result.text()
+
+		if text == "" {
+			continue
+		}
+
+		if result.Ref != "" {
+			text = result.Ref + ": " + strings.Replace(text, "\n", "\n"+result.Ref+": ", -1)
+		}
+
+		lines = append(lines, text)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func writeResponse(w http.ResponseWriter, code int, res response) {
+	if Config.JsonResponses {
+		// A 204 can't have a body
+		if code == 204 {
+			code = 200
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	text := res.text()
+
+	if text != "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	w.WriteHeader(code)
+	w.Write([]byte(text))
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	status := statusError
+
+	if code < 500 {
+		status = statusRejected
+	}
+
+	writeResponse(w, code, response{Status: status, Reason: err.Error()})
+}
@@ -0,0 +1,38 @@
+package webhooks
+
+import (
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/gorilla/mux"
+)
+
+// NewRouter serves each webhook provider and the admin endpoints at the
+// paths cfg routes them to, along with /metrics, /ready and /status. The
+// debug, manual sync and snapshot endpoints are only served when they're
+// turned on
+func NewRouter(cfg *config.Config) *mux.Router {
+	router := mux.NewRouter()
+
+	router.HandleFunc(cfg.ProviderRoute(config.ProviderGithub), HandleGithubWebhook).Methods("POST")
+	router.HandleFunc(cfg.Route("/metrics"), HandleMetrics).Methods("GET")
+	router.HandleFunc(cfg.Route("/ready"), HandleReady).Methods("GET")
+	router.HandleFunc(cfg.Route("/status"), HandleStatus).Methods("GET")
+	router.HandleFunc(cfg.AdminRoute("/maintenance"), HandleMaintenance).Methods("POST")
+
+	if cfg.StatusSnapshotPath != "" {
+		router.HandleFunc(cfg.AdminRoute("/snapshot"), HandleStatusSnapshot).Methods("POST")
+	}
+
+	if cfg.DebugEndpoints {
+		router.HandleFunc(cfg.ProviderRoute(config.ProviderGithub)+"/diff", HandleGithubDiff).Methods("POST")
+		router.HandleFunc(cfg.AdminRoute("/plan"), HandlePlan).Methods("POST")
+	}
+
+	if cfg.ManualSync {
+		router.HandleFunc(cfg.AdminRoute("/sync"), HandleSync).Methods("POST")
+		router.HandleFunc(cfg.AdminRoute("/reconcile"), HandleReconcile).Methods("POST")
+		router.HandleFunc(cfg.AdminRoute("/reconcile/{id}"), HandleReconcileStatus).Methods("GET")
+		router.HandleFunc(cfg.AdminRoute("/reconcile/{id}/cancel"), HandleReconcileCancel).Methods("POST")
+	}
+
+	return router
+}
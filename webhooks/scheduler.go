@@ -0,0 +1,61 @@
+package webhooks
+
+import (
+	"sync"
+	"time"
+)
+
+// scheduler runs functions after a delay unless they are cancelled first.
+// Pending functions only live in memory, so they are lost on restart.
+type scheduler struct {
+	mutex  sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{timers: map[string]*time.Timer{}}
+}
+
+// Schedule runs fn after delay, replacing anything already scheduled for key
+func (s *scheduler) Schedule(key string, delay time.Duration, fn func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if timer, exists := s.timers[key]; exists {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+
+	timer = time.AfterFunc(delay, func() {
+		s.mutex.Lock()
+
+		// Only forget about the key if it hasn't been rescheduled since
+		if s.timers[key] == timer {
+			delete(s.timers, key)
+		}
+
+		s.mutex.Unlock()
+
+		fn()
+	})
+
+	s.timers[key] = timer
+}
+
+// Cancel stops whatever is scheduled for key, returning whether there was
+// anything to stop
+func (s *scheduler) Cancel(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	timer, exists := s.timers[key]
+
+	if !exists {
+		return false
+	}
+
+	delete(s.timers, key)
+
+	return timer.Stop()
+}
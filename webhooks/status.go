@@ -0,0 +1,216 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How many of the latest errors are kept for each repository
+const keptRepositoryErrors = 10
+
+// repositoryStatus is how publishing a repository's refs has been going
+// since the server started
+type repositoryStatus struct {
+	LastRef    string     `json:"lastRef,omitempty"`
+	LastStatus string     `json:"lastStatus,omitempty"`
+	LastAt     *time.Time `json:"lastAt,omitempty"`
+	// Status to how many refs ended up with it
+	Counts       map[string]int64 `json:"counts"`
+	RecentErrors []recentError    `json:"recentErrors"`
+}
+
+type recentError struct {
+	Time  time.Time `json:"time"`
+	Ref   string    `json:"ref"`
+	Error string    `json:"error"`
+}
+
+// status is everything GET /status and the status snapshot report, the
+// metrics along with how each repository has been getting on
+type status struct {
+	GeneratedAt time.Time         `json:"generatedAt"`
+	Version     string            `json:"version"`
+	Maintenance bool              `json:"maintenance"`
+	StateStores map[string]string `json:"stateStores,omitempty"`
+	Metrics     metrics           `json:"metrics"`
+	// Repository url to its status, only repositories something has been
+	// published for are here
+	Repositories map[string]repositoryStatus `json:"repositories"`
+}
+
+// repositoryStatuses are the repositories' statuses, every change to them is
+// made holding the mutex
+type repositoryStatuses struct {
+	mutex        sync.Mutex
+	repositories map[string]*repositoryStatus
+}
+
+var repoStatuses = &repositoryStatuses{repositories: map[string]*repositoryStatus{}}
+
+// record counts how publishing a ref went, keeping its error when it failed
+func (s *repositoryStatuses) record(url, ref string, code int, res response) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	repoStatus, ok := s.repositories[url]
+
+	if !ok {
+		repoStatus = &repositoryStatus{Counts: map[string]int64{}, RecentErrors: []recentError{}}
+		s.repositories[url] = repoStatus
+	}
+
+	now := time.Now().UTC()
+	result := res.Status
+
+	if result == "" {
+		result = statusOk
+	}
+
+	repoStatus.LastRef = ref
+	repoStatus.LastStatus = result
+	repoStatus.LastAt = &now
+	repoStatus.Counts[result]++
+
+	if code >= 500 || result == statusError {
+		repoStatus.RecentErrors = append(repoStatus.RecentErrors, recentError{Time: now, Ref: ref, Error: res.text()})
+
+		if len(repoStatus.RecentErrors) > keptRepositoryErrors {
+			repoStatus.RecentErrors = repoStatus.RecentErrors[len(repoStatus.RecentErrors)-keptRepositoryErrors:]
+		}
+	}
+}
+
+// prune forgets the repositories nothing has been published for in longer
+// than maxAge, returning how many were
+func (s *repositoryStatuses) prune(maxAge time.Duration) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cutoff := time.Now().Add(-maxAge)
+	pruned := 0
+
+	for url, repoStatus := range s.repositories {
+		if repoStatus.LastAt != nil && repoStatus.LastAt.Before(cutoff) {
+			delete(s.repositories, url)
+			pruned++
+		}
+	}
+
+	return pruned
+}
+
+// snapshot copies the statuses so they can be encoded without the lock
+func (s *repositoryStatuses) snapshot() map[string]repositoryStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	repositories := map[string]repositoryStatus{}
+
+	for url, repoStatus := range s.repositories {
+		copied := *repoStatus
+		copied.Counts = map[string]int64{}
+		copied.RecentErrors = append([]recentError{}, repoStatus.RecentErrors...)
+
+		for result, count := range repoStatus.Counts {
+			copied.Counts[result] = count
+		}
+
+		repositories[url] = copied
+	}
+
+	return repositories
+}
+
+func currentStatus() status {
+	return status{
+		GeneratedAt:  time.Now().UTC(),
+		Version:      Version,
+		Maintenance:  inMaintenance(),
+		StateStores:  stateStores.Unavailable(),
+		Metrics:      currentMetrics(),
+		Repositories: repoStatuses.snapshot(),
+	}
+}
+
+// HandleStatus reports the metrics and how publishing each repository has
+// been going, the same as the status snapshot
+func HandleStatus(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(currentStatus())
+
+	if err != nil {
+		writeError(w, 500, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// HandleStatusSnapshot writes the status snapshot straight away, rather than
+// at the next interval, authenticated the same way as /plan with a body of {}
+func HandleStatusSnapshot(w http.ResponseWriter, r *http.Request) {
+	var request struct{}
+
+	if !readSignedRequest(w, r, &request) {
+		return
+	}
+
+	if err := WriteStatusSnapshot(Config.StatusSnapshotPath); err != nil {
+		writeError(w, 500, err)
+		return
+	}
+
+	writeResponse(w, 200, response{Status: statusOk, Reason: "Wrote the status snapshot to " + Config.StatusSnapshotPath})
+}
+
+// WriteStatusSnapshot writes what GET /status reports to path. It's written
+// to a temporary file next to it and renamed over it, so a reader never sees
+// half a snapshot
+func WriteStatusSnapshot(path string) error {
+	body, err := json.MarshalIndent(currentStatus(), "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(body); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	// Temporary files are only readable by us, the snapshot is for others
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// WriteStatusSnapshots writes the status snapshot every interval until the
+// server stops, a snapshot that can't be written is logged and tried again
+// at the next one
+func WriteStatusSnapshots(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := WriteStatusSnapshot(path); err != nil {
+			fmt.Printf("Unable to write the status snapshot to %s: %v\n", path, err)
+		}
+	}
+}
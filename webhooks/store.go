@@ -0,0 +1,172 @@
+package webhooks
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The state stores kept in the data directory, what their health is reported
+// under. None of them are needed to publish
+const (
+	StorePackageNames     = "packageNames"
+	StorePublishedDigests = "publishedDigests"
+	StorePublishedCommits = "publishedCommits"
+)
+
+// What the repositories' statuses are pruned under, they're only kept in
+// memory so it isn't a state store
+const prunedStatus = "status"
+
+// storeHealth is how the state stores are doing. A store whose last write
+// failed is unavailable until it next saves, one that couldn't be loaded is
+// unavailable until the server restarts
+type storeHealth struct {
+	mutex sync.Mutex
+	// Store to how many loads and writes have failed since starting
+	failures map[string]int64
+	// Store to the error it's unavailable with
+	unavailable map[string]string
+	unloaded    map[string]bool
+}
+
+var stateStores = &storeHealth{failures: map[string]int64{}, unavailable: map[string]string{}, unloaded: map[string]bool{}}
+
+// StateStoreUnavailable records that a store couldn't be loaded, serve runs
+// without it rather than not starting
+func StateStoreUnavailable(store string, err error) {
+	fmt.Printf("WARNING: running without the %s state, its features are turned off: %v\n", store, err)
+
+	stateStores.failed(store, err)
+
+	stateStores.mutex.Lock()
+	stateStores.unloaded[store] = true
+	stateStores.mutex.Unlock()
+}
+
+func (h *storeHealth) failed(store string, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.failures[store]++
+	h.unavailable[store] = err.Error()
+}
+
+func (h *storeHealth) saved(store string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.unloaded[store] {
+		delete(h.unavailable, store)
+	}
+}
+
+// Failures is how many times each store has failed, for alerting on
+func (h *storeHealth) Failures() map[string]int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	failures := map[string]int64{}
+
+	for store, count := range h.failures {
+		failures[store] = count
+	}
+
+	return failures
+}
+
+// Unavailable is the error each unavailable store has, nil when they're all
+// fine
+func (h *storeHealth) Unavailable() map[string]string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.unavailable) == 0 {
+		return nil
+	}
+
+	unavailable := map[string]string{}
+
+	for store, err := range h.unavailable {
+		unavailable[store] = err
+	}
+
+	return unavailable
+}
+
+// saveState writes to a state store, trying Config.StateRetryAttempts times
+// in all. A store that still can't be written is logged and counted, never
+// returned, the publish it's part of has already happened and shouldn't fail
+// because of it.
+func saveState(store, description string, save func() error) {
+	attempts := Config.StateRetryAttempts
+	backoff := Config.StateRetryBackoff
+
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = save(); err == nil {
+			stateStores.saved(store)
+
+			return
+		}
+
+		if attempt < attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	fmt.Printf("WARNING: unable to save %s to the %s state after %d attempts: %v\n", description, store, attempts, err)
+
+	stateStores.failed(store, err)
+}
+
+// CompactStates prunes the entries of each state store that are past their
+// retention every interval until the server stops
+func CompactStates(interval time.Duration) {
+	for range time.Tick(interval) {
+		compactStates()
+	}
+}
+
+// compactStates prunes each store with a retention and logs how many entries
+// went. A store that can't be saved keeps its entries until the next run
+func compactStates() {
+	pruned := map[string]int{}
+
+	compact := func(store string, retention time.Duration, prune func(time.Duration) (int, error)) {
+		if retention <= 0 {
+			return
+		}
+
+		count, err := prune(retention)
+
+		if err != nil {
+			fmt.Printf("WARNING: unable to prune the %s state: %v\n", store, err)
+			stateStores.failed(store, err)
+
+			return
+		}
+
+		if count > 0 {
+			stateStores.saved(store)
+		}
+
+		pruned[store] = count
+	}
+
+	compact(StorePackageNames, Config.PackageNamesRetention, PackageNames.Prune)
+	compact(StorePublishedDigests, Config.PublishedDigestsRetention, PublishedDigests.Prune)
+	compact(prunedStatus, Config.StatusRetention, func(retention time.Duration) (int, error) {
+		return repoStatuses.prune(retention), nil
+	})
+
+	if len(pruned) > 0 {
+		fmt.Printf("Pruned expired state entries: %v\n", pruned)
+	}
+}
@@ -0,0 +1,224 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/git"
+	"github.com/Lavoaster/cloudsmith-sync/tracing"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ActorManualSync is recorded against anything deleted by a manual sync
+const ActorManualSync = "manual-sync"
+
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// syncRequest names what to publish, either a full ref like a push or a
+// commit. The repository is matched like a webhook's, by owner/name or url
+type syncRequest struct {
+	Repository string `json:"repository"`
+	Ref        string `json:"ref"`
+	Commit     string `json:"commit"`
+	// The version to publish a commit as, used as given when composer can
+	// read it. Without one it is published as dev-<short hash>
+	Version string `json:"version"`
+	// Publish a branch even when nothing has changed since it last was
+	Force bool `json:"force"`
+}
+
+// HandleSync publishes a ref or a commit on request, authenticated the same
+// way as /plan. A ref is published exactly as its push would be, a commit
+// doesn't need to be at the tip of anything, which is handy for trying out a
+// fix before it is tagged.
+func HandleSync(w http.ResponseWriter, r *http.Request) {
+	var request syncRequest
+
+	if !readSignedRequest(w, r, &request) {
+		return
+	}
+
+	if inMaintenance() {
+		writeMaintenance(w)
+		return
+	}
+
+	if (request.Ref == "") == (request.Commit == "") {
+		writeError(w, 422, errors.New("one of ref or commit is needed"))
+		return
+	}
+
+	ctx, cancel := newWebhookContext()
+	defer cancel()
+
+	if request.Force {
+		ctx = withForce(ctx)
+	}
+
+	if request.Ref != "" {
+		if !strings.HasPrefix(request.Ref, "refs/heads/") && !strings.HasPrefix(request.Ref, "refs/tags/") {
+			writeError(w, 422, errors.New("ref must be a full refs/heads/ or refs/tags/ ref"))
+			return
+		}
+
+		code, res := publishRefEvent(ctx, request.Repository, request.Repository, "", github.PushPayload{Ref: request.Ref}, ActorManualSync)
+		writeResponse(w, code, res)
+		return
+	}
+
+	commit := strings.ToLower(request.Commit)
+
+	if !commitPattern.MatchString(commit) {
+		writeError(w, 422, errors.New("commit must be a full 40 character hash"))
+		return
+	}
+
+	repoCfg, err := Config.GetRepository(request.Repository, request.Repository)
+
+	if err != nil {
+		writeResponse(w, 422, response{Status: statusRejected, Reason: "repository not configured"})
+		return
+	}
+
+	code, res := publishCommit(ctx, &repoCfg, plumbing.NewHash(commit), request.Version)
+	writeResponse(w, code, res)
+}
+
+// publishCommit publishes every package at a commit, as version when given
+// and otherwise as a branch called after the commit's short hash.
+func publishCommit(ctx context.Context, repoCfg *config.Repository, hash plumbing.Hash, version string) (int, response) {
+	ctx, span := tracing.Start(ctx, "publish", tracing.Repository(repoCfg.Url), tracing.Ref(hash.String()))
+	defer span.End()
+
+	checkout, code, err := checkoutCommit(ctx, repoCfg, hash)
+
+	if err != nil && code < 500 {
+		return code, response{Status: statusRejected, Reason: err.Error()}
+	}
+
+	if err != nil {
+		return code, response{Status: statusError, Reason: err.Error()}
+	}
+
+	defer checkout.release()
+
+	ref := pushedRef{
+		Name:         version,
+		Commit:       hash.String(),
+		TaggedCommit: hash.String(),
+		DeliveryID:   ActorManualSync,
+		Version:      version,
+		Force:        isForced(ctx),
+	}
+
+	// Published like a branch named after the short hash, but a hash of only
+	// digits would be read as a numbered branch so the version is set as is
+	if version == "" {
+		ref.Name = hash.String()[:7]
+		ref.IsBranch = true
+		ref.Version = "dev-" + ref.Name
+	}
+
+	packages, versionRef, err := repoCfg.GetPackagesForRef(ref.Name, ref.IsBranch)
+
+	if err != nil {
+		return 422, response{Status: statusRejected, Reason: err.Error()}
+	}
+
+	ref.Name = versionRef
+
+	if isTransaction(repoCfg, packages, ref) {
+		return publishTransaction(ctx, repoCfg, checkout.repoPath, packages, ref)
+	}
+
+	status := 204
+	var results []response
+
+	for _, pkg := range packages {
+		pkgStatus, result := publishRef(ctx, repoCfg, checkout.repoPath, pkg, ref)
+
+		status = worstStatus(status, pkgStatus)
+		results = append(results, result)
+	}
+
+	if len(results) == 1 {
+		return status, results[0]
+	}
+
+	return status, response{Status: worstResultStatus(results), Results: results}
+}
+
+// checkoutCommit is checkoutPush for a commit, one that can't be found is
+// refused with a 422.
+func checkoutCommit(ctx context.Context, repoCfg *config.Repository, hash plumbing.Hash) (*checkedOutPush, int, error) {
+	repoPath, err := git.GetRepoPath(repoCfg.Url)
+
+	if err != nil {
+		return nil, 500, err
+	}
+
+	unlock := git.LockClone(repoPath)
+
+	fail := func(code int, err error) (*checkedOutPush, int, error) {
+		unlock()
+		return nil, code, err
+	}
+
+	fetchCtx, fetchSpan := tracing.Start(ctx, "fetch")
+	repo, err := git.CloneOrOpenAndUpdate(fetchCtx, repoCfg.Url, repoPath)
+	tracing.End(fetchSpan, err)
+
+	if git.IsEmptyRepository(err) {
+		return fail(422, errNoCommits)
+	}
+
+	if err != nil {
+		return fail(500, err)
+	}
+
+	worktree, err := repo.Worktree()
+
+	if err != nil {
+		return fail(500, err)
+	}
+
+	checkout := &checkedOutPush{
+		repoPath: repoPath,
+		ref:      plumbing.NewHashReference(plumbing.ReferenceName(hash.String()), hash),
+		isBranch: true,
+		release: func() {
+			git.ResetWorktree(worktree)
+			unlock()
+		},
+	}
+
+	ctx, checkoutSpan := tracing.Start(ctx, "checkout")
+	err = git.CheckoutCommit(ctx, repo, worktree, hash)
+	tracing.End(checkoutSpan, err)
+
+	if err != nil {
+		checkout.release()
+
+		if err == git.ErrCommitNotFound {
+			return nil, 422, errors.New("commit " + hash.String() + " isn't on any branch, tag or pull request of " + repoCfg.Url)
+		}
+
+		return nil, 500, err
+	}
+
+	composer.CheckedOut(worktree.Filesystem.Root(), hash.String())
+
+	if repoCfg.IncludeSubmodules {
+		if err := git.UpdateSubmodules(ctx, worktree); err != nil {
+			checkout.release()
+			return nil, 500, err
+		}
+	}
+
+	return checkout, 0, nil
+}
@@ -0,0 +1,167 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lavoaster/cloudsmith-sync/cloudsmith"
+	"github.com/Lavoaster/cloudsmith-sync/composer"
+	"github.com/Lavoaster/cloudsmith-sync/config"
+	"github.com/Lavoaster/cloudsmith-sync/tracing"
+	"strings"
+)
+
+// isTransaction is whether a ref's packages are published together, deleting
+// a ref has nothing to roll back so it never is
+func isTransaction(repoCfg *config.Repository, packages []config.Package, ref pushedRef) bool {
+	return repoCfg.Transactional && len(packages) > 1 && !ref.Deleted
+}
+
+// publishTransaction publishes every package of a monorepo ref or none of
+// them. Each package is checked, built and has its composer.json mutated
+// before anything is uploaded, and when an upload fails the packages already
+// uploaded for the ref are deleted again. A version that replaced one already
+// published can't be put back, rolling back leaves it missing rather than
+// mismatched with the others.
+func publishTransaction(ctx context.Context, repoCfg *config.Repository, repoPath string, packages []config.Package, ref pushedRef) (int, response) {
+	ctx, span := tracing.Start(ctx, "transaction")
+	defer span.End()
+
+	checked := make([]*checkedPackage, len(packages))
+
+	for i, pkg := range packages {
+		var code int
+		var res response
+
+		if checked[i], code, res = checkPackage(repoCfg, repoPath, pkg, ref); checked[i] == nil {
+			return failTransaction(packages, checked, i, code, res, nil)
+		}
+	}
+
+	if err := Config.CheckArtifactsDir(repoCfg); err != nil {
+		recordArtifactsDirFailure()
+		fmt.Printf("Unable to publish %s: %v\n", repoCfg.Url, err)
+
+		return 500, response{Status: statusError, Reason: err.Error()}
+	}
+
+	built := make([]composer.ComposerFile, len(checked))
+
+	for i, pkg := range checked {
+		composerData, err := buildPackage(ctx, repoCfg, pkg.path, ref.IsBranch, pkg.name, pkg.version, pkg.normalisedVersion, ref.Commit, ref.Description, ref.DeliveryID)
+
+		if err != nil {
+			return failTransaction(packages, checked, i, 500, pkg.result(statusError, err.Error()), nil)
+		}
+
+		built[i] = composerData
+	}
+
+	for i, pkg := range checked {
+		err := clearForUpload(ctx, repoCfg, pkg.name, pkg.version, ref)
+
+		if err == nil {
+			err = uploadPackage(ctx, Client, repoCfg, pkg.path, ref.Name, ref.IsBranch, pkg.name, pkg.version, ref.Commit, built[i])
+		}
+
+		if err != nil {
+			fmt.Printf("Rolling back %s for %s, %s@%s failed to upload\n", ref.Name, repoCfg.Url, pkg.name, pkg.version)
+
+			// Including the one that failed, it may have made it to some of
+			// its publish targets
+			rollbacks := make([]error, i+1)
+
+			for j := 0; j <= i; j++ {
+				rollbacks[j] = rollbackPackage(repoCfg, checked[j], ref)
+			}
+
+			return failTransaction(packages, checked, i, 500, pkg.result(statusError, err.Error()), rollbacks)
+		}
+	}
+
+	var results []response
+	targetRepository := Config.GetTargetRepository(repoCfg)
+
+	// Only once they're all published, renames delete the old package
+	for _, pkg := range checked {
+		checkForRename(repoCfg, pkg.pkg, pkg.name, pkg.version, targetRepository, ref.DeliveryID)
+
+		if !ref.IsBranch && repoCfg.StableAlias != nil {
+			updateStableAlias(repoCfg, pkg.name, pkg.version)
+		}
+
+		publishMetadata(repoCfg, pkg.name, pkg.version, ref)
+		recordTagCommit(repoCfg, pkg.name, pkg.version, ref)
+
+		results = append(results, pkg.result(statusPublished, ""))
+	}
+
+	return 204, response{Status: worstResultStatus(results), Results: results}
+}
+
+func (pkg *checkedPackage) result(status, reason string) response {
+	return response{Status: status, Reason: reason, Package: pkg.name, Version: pkg.version}
+}
+
+// failTransaction is the response for a transaction that stopped at the
+// package at index failed. The others are reported as skipped, or with how
+// their rollback went when they had been uploaded.
+func failTransaction(packages []config.Package, checked []*checkedPackage, failed, code int, res response, rollbacks []error) (int, response) {
+	name := packages[failed].Path
+
+	if checked[failed] != nil {
+		name = checked[failed].name
+	}
+
+	var results []response
+
+	for i, pkg := range packages {
+		if i == failed {
+			if i < len(rollbacks) && rollbacks[i] != nil {
+				res.Reason += "\n" + rollbacks[i].Error()
+			}
+
+			results = append(results, res)
+			continue
+		}
+
+		result := response{Status: statusSkipped, Reason: "Not published (" + pkg.Path + "), " + name + " couldn't be"}
+
+		if checked[i] != nil {
+			result = checked[i].result(statusSkipped, "Not published, "+name+" couldn't be")
+		}
+
+		if i < len(rollbacks) {
+			result.Reason = "Rolled back, " + name + " failed to upload"
+
+			if rollbacks[i] != nil {
+				result.Status = statusError
+				result.Reason = rollbacks[i].Error()
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return code, response{Status: worstResultStatus(results), Results: results}
+}
+
+// rollbackPackage deletes a package uploaded by a failed transaction from
+// every publish target
+func rollbackPackage(repoCfg *config.Repository, pkg *checkedPackage, ref pushedRef) error {
+	var failures []string
+
+	for _, target := range Config.GetPublishTargets(repoCfg) {
+		err := Client.DeletePackageIfExists(Config.Owner, target.Repository, target.Format, targetPackageName(target, pkg.name), pkg.version, cloudsmith.DeleteReasonRollback, ref.DeliveryID)
+
+		if err != nil {
+			failures = append(failures, target.Repository+": "+err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.New("Unable to roll back " + pkg.name + "@" + pkg.version + ", " + strings.Join(failures, ", "))
+	}
+
+	return nil
+}